@@ -0,0 +1,220 @@
+/*
+ktscerts writes a CA and certificates for running the Kafka Traffic System with
+mutual TLS on a test network. The keys are not protected, so it is meant for
+tests and local clusters only.
+
+Usage: ktscerts [-dir <dir>] [-hosts <host>[,...]] [-days <days>] [-role <role> -name <name>]
+
+Without -role it writes a certificate for every role: server.pem, node.pem,
+client.pem and admin.pem, each next to its <name>-key.pem. With -role it only
+writes <name>.pem. The CA is kept in ca.pem and ca-key.pem and reused if it
+exists.
+
+Servers and nodes are checked against the address they are dialed on, so
+-hosts must cover every IP and name they listen on.
+*/
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../../lib/mtls"
+)
+
+const (
+	CA_CERT = "ca.pem"
+	CA_KEY  = "ca-key.pem"
+)
+
+var roles = []string{mtls.RoleServer, mtls.RoleNode, mtls.RoleClient, mtls.RoleAdmin}
+
+func main() {
+	dir := flag.String("dir", "certs", "Directory to write the certificates to")
+	hosts := flag.String("hosts", "127.0.0.1,localhost", "Comma separated IPs and names the certificates are valid for")
+	days := flag.Int("days", 30, "Days the certificates are valid for")
+	role := flag.String("role", "", "Only issue a certificate with this role: "+strings.Join(roles, ", "))
+	name := flag.String("name", "", "Name of the certificate issued with -role (default: the role)")
+	flag.Parse()
+
+	validFor := time.Duration(*days) * 24 * time.Hour
+	if err := run(*dir, strings.Split(*hosts, ","), validFor, *role, *name); err != nil {
+		fmt.Fprintf(os.Stderr, "ktscerts: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, hosts []string, validFor time.Duration, role string, name string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ca, caKey, err := loadOrCreateCA(dir, validFor)
+	if err != nil {
+		return err
+	}
+
+	if role == "" {
+		for _, r := range roles {
+			if err := issue(dir, ca, caKey, r, r, hosts, validFor); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %s, expected one of %s", role, strings.Join(roles, ", "))
+	}
+
+	if name == "" {
+		name = role
+	}
+	return issue(dir, ca, caKey, role, name, hosts, validFor)
+}
+
+func loadOrCreateCA(dir string, validFor time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(dir, CA_CERT), filepath.Join(dir, CA_KEY)
+
+	certPEM, certErr := ioutil.ReadFile(certPath)
+	keyPEM, keyErr := ioutil.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		return parseCA(certPEM, keyPEM)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "kts test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+
+	der, err := sign(template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeCert(certPath, keyPath, der, key); err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Println("Wrote", certPath)
+	return ca, key, nil
+}
+
+func parseCA(certPEM []byte, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("%s or %s is not PEM", CA_CERT, CA_KEY)
+	}
+
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+// Writes <name>.pem and <name>-key.pem. The role goes in the subject's
+// OrganizationalUnit, where mtls reads it from
+func issue(dir string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, role string, name string, hosts []string, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	// Servers and nodes both dial and accept, so every certificate is good
+	// for both ends of a connection
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name, OrganizationalUnit: []string{role}},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(validFor),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := sign(template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(dir, name+".pem")
+	if err := writeCert(certPath, filepath.Join(dir, name+"-key.pem"), der, key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s, role %s, valid for %v\n", certPath, role, hosts)
+	return nil
+}
+
+func sign(template *x509.Certificate, parent *x509.Certificate, pub interface{}, parentKey *ecdsa.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	return x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+}
+
+func writeCert(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return ioutil.WriteFile(keyPath, keyPEM, 0600)
+}
+
+func validRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
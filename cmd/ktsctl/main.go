@@ -0,0 +1,783 @@
+/*
+ktsctl is the command-line admin tool for the Kafka Traffic System. It talks to
+the server replicas, and to nodes directly for dump.
+
+Usage: ktsctl [-s <serv-ip>:<serv-port>[,...]] [-ca <file> -cert <file> -key <file>] [-token <token>] <command> [args]
+
+The TLS files default to KTS_TLS_CA, KTS_TLS_CERT and KTS_TLS_KEY. The
+certificate's role must be admin. The token defaults to KTS_TOKEN and is
+only needed without an admin certificate.
+
+Commands:
+
+	create <topic>      create a topic, see ktsctl create -h for its settings
+	list                list topics
+	describe <topic>    show each partition's leader, followers and their versions
+	delete <topic>      delete a topic and recycle its nodes
+	nodes               list registered nodes
+	orphans             list nodes waiting for a topic
+	drain <node-addr>   replace a node in its cluster and take it out of service
+	acl <topic>         list who may produce to, consume from and administer a topic
+	grant <topic> <principal> <perms>
+	                    set a principal's permissions, e.g. produce,consume
+	revoke <topic> <principal>
+	                    remove a principal from a topic's ACL
+	token <name>        generate a client token and its config entry
+	quota <topic>       show or set a topic's write quotas, see ktsctl quota -h
+	region <topic>      show or set the area a geo-routed topic covers, see ktsctl region -h
+	regions             list the regions of every geo-routed topic
+	locate <x,y>        show the geo-routed topic that covers a location
+	tail <topic>        print new data written to a topic
+	produce <topic>     write each line of stdin to a topic
+	dump <node-addr>    print a node's VersionList, node-addr is its PeerRpc ip:port
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"../../lib/consumer"
+	"../../lib/logging"
+	"../../lib/mtls"
+	"../../lib/producer"
+	"../../lib/serverclient"
+	node "../../node/clusterlib"
+	"../../structs"
+)
+
+type command struct {
+	usage string
+	run   func(servers []string, args []string) error
+}
+
+var commands = map[string]command{
+	"create":   {"create [flags] <topic>", createTopic},
+	"list":     {"list", listTopics},
+	"describe": {"describe <topic>", describeTopic},
+	"delete":   {"delete <topic>", deleteTopic},
+	"nodes":    {"nodes", listNodes},
+	"orphans":  {"orphans", listOrphans},
+	"drain":    {"drain <node-addr>", drainNode},
+	"acl":      {"acl <topic>", showACL},
+	"grant":    {"grant <topic> <principal> <produce,consume,admin>", grantACL},
+	"revoke":   {"revoke <topic> <principal>", revokeACL},
+	"token":    {"token <name>", generateToken},
+	"quota":    {"quota [flags] <topic>", topicQuota},
+	"region":   {"region [flags] <topic>", topicRegion},
+	"regions":  {"regions", listRegions},
+	"locate":   {"locate <x,y>", locate},
+	"tail":     {"tail [flags] <topic>", tailTopic},
+	"produce":  {"produce [flags] <topic>", produce},
+	"dump":     {"dump <node-addr>", dumpNode},
+}
+
+// Client credentials sent with topic calls
+var token string
+
+func main() {
+	servers := flag.String("s", "127.0.0.1:12345", "Comma separated ip:port of every server replica")
+	env := mtls.FromEnv()
+	tlsConf := mtls.Config{}
+	flag.StringVar(&tlsConf.CAFile, "ca", env.CAFile, "CA certificate for TLS")
+	flag.StringVar(&tlsConf.CertFile, "cert", env.CertFile, "Admin certificate for TLS")
+	flag.StringVar(&tlsConf.KeyFile, "key", env.KeyFile, "Key of the admin certificate")
+	flag.StringVar(&token, "token", os.Getenv("KTS_TOKEN"), "Client token, if not using an admin certificate")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := mtls.Setup(tlsConf); err != nil {
+		fmt.Fprintf(os.Stderr, "ktsctl: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := logging.ConfigureFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "ktsctl: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Library logs share the terminal with the command's output
+	if os.Getenv(logging.ENV_FORMAT) == "" {
+		logging.SetFormat(logging.FormatText)
+	}
+
+	if err := cmd.run(strings.Split(*servers, ","), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ktsctl %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: ktsctl [-s <serv-ip>:<serv-port>[,...]] [-ca <file> -cert <file> -key <file>] [-token <token>] <command> [args]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range []string{"create", "list", "describe", "delete", "nodes", "orphans", "drain", "acl", "grant", "revoke", "token", "quota", "region", "regions", "locate", "tail", "produce", "dump"} {
+		fmt.Fprintf(os.Stderr, "  ktsctl %s\n", commands[name].usage)
+	}
+}
+
+// Parses a command's flags and checks that exactly one topic or address is left
+func parseOneArg(fs *flag.FlagSet, args []string) (string, error) {
+	parsed, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return "", err
+	}
+	return parsed[0], nil
+}
+
+// Parses a command's flags and checks that exactly n arguments are left
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() != n {
+		return nil, fmt.Errorf("expected %d argument(s), got %d", n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// Calls a single method on the primary server
+func callServer(servers []string, serviceMethod string, args interface{}, reply interface{}) error {
+	client, err := serverclient.Dial(servers)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Call(serviceMethod, args, reply)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Topic commands
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+func createTopic(servers []string, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	partitions := fs.Int("partitions", 1, "Number of partitions")
+	clusterSize := fs.Uint("cluster-size", 0, "Nodes per partition including the leader (default: server's)")
+	minReplicas := fs.Uint("min-replicas", 0, "Followers a write must be replicated on (default: server's)")
+	retention := fs.Duration("retention", 0, "How long writes stay readable (default: forever)")
+	heartbeat := fs.Duration("heartbeat", 0, "Interval between heartbeats of the cluster's nodes (default: node's)")
+
+	topicName, err := parseOneArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	msg := structs.CreateTopicMsg{
+		TopicName: topicName,
+		Token:     token,
+		Spec: structs.TopicSpec{
+			NumPartitions: *partitions,
+			ClusterSize:   uint8(*clusterSize),
+			MinReplicas:   uint8(*minReplicas),
+			Retention:     int64(*retention / time.Millisecond),
+			HeartBeat:     uint32(*heartbeat / time.Millisecond)}}
+
+	var topic structs.Topic
+	if err := callServer(servers, "TServer.CreateTopic", &msg, &topic); err != nil {
+		return err
+	}
+
+	printTopics([]structs.Topic{topic})
+	return nil
+}
+
+func listTopics(servers []string, args []string) error {
+	var topicList []structs.Topic
+	if err := callServer(servers, "TServer.ListTopics", "", &topicList); err != nil {
+		return err
+	}
+
+	printTopics(topicList)
+	return nil
+}
+
+func printTopics(topicList []structs.Topic) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tPARTITION\tCLUSTER-SIZE\tMIN-REPLICAS\tCLUSTER-RPC\tPEER-RPC")
+	for _, topic := range topicList {
+		for _, partition := range topic.Partitions {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", topic.TopicName, partition.Id,
+				topic.Spec.ClusterSize, topic.Spec.MinReplicas, partition.Leaders[0], partition.Leaders[1])
+		}
+	}
+	w.Flush()
+}
+
+func describeTopic(servers []string, args []string) error {
+	topicName, err := parseOneArg(flag.NewFlagSet("describe", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	var desc structs.TopicDescription
+	if err := callServer(servers, "TServer.DescribeTopic", &topicName, &desc); err != nil {
+		return err
+	}
+
+	fmt.Printf("Topic: %s  partitions: %d  cluster-size: %d  min-replicas: %d  retention: %dms\n\n",
+		desc.TopicName, desc.Spec.NumPartitions, desc.Spec.ClusterSize, desc.Spec.MinReplicas, desc.Spec.Retention)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tROLE\tADDRESS\tFOLLOWER-ID\tLATEST\tWRITES\tFIRST-MISMATCH\tIN-SYNC")
+	for _, partition := range desc.Partitions {
+		if partition.Error != "" {
+			fmt.Fprintf(w, "%d\tleader\t%s\t-\t-\t-\t-\tunreachable: %s\n", partition.Id, partition.Leaders[1], partition.Error)
+			continue
+		}
+
+		printReplica(w, partition.Id, "leader", partition.Leader)
+		for _, follower := range partition.Followers {
+			printReplica(w, partition.Id, "follower", follower)
+		}
+	}
+	w.Flush()
+
+	for _, partition := range desc.Partitions {
+		if partition.UnderReplicated {
+			fmt.Printf("\nPartition %d is UNDER-REPLICATED\n", partition.Id)
+		}
+	}
+	return nil
+}
+
+func printReplica(w *tabwriter.Writer, partition int, role string, replica structs.ReplicaDescription) {
+	if !replica.Reachable {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t-\t-\t-\tunreachable\n", partition, role, replica.Address, replica.FollowerId)
+		return
+	}
+
+	followerId := fmt.Sprint(replica.FollowerId)
+	if role == "leader" {
+		followerId = "-"
+	}
+
+	fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%t\n", partition, role, replica.Address, followerId,
+		replica.LatestVersion, replica.NumWrites, replica.FirstMismatch, replica.InSync)
+}
+
+func deleteTopic(servers []string, args []string) error {
+	topicName, err := parseOneArg(flag.NewFlagSet("delete", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	var ignored bool
+	if err := callServer(servers, "TServer.DeleteTopic", &topicName, &ignored); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted topic %s\n", topicName)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Access control commands
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+func showACL(servers []string, args []string) error {
+	topicName, err := parseOneArg(flag.NewFlagSet("acl", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	var topic structs.Topic
+	msg := structs.GetTopicMsg{TopicName: topicName, Token: token}
+	if err := callServer(servers, "TServer.GetTopic", msg, &topic); err != nil {
+		return err
+	}
+
+	printACL(topic)
+	return nil
+}
+
+func grantACL(servers []string, args []string) error {
+	parsed, err := parseArgs(flag.NewFlagSet("grant", flag.ExitOnError), args, 3)
+	if err != nil {
+		return err
+	}
+
+	perms, err := structs.ParsePermissions(parsed[2])
+	if err != nil {
+		return err
+	}
+
+	if len(perms) == 0 {
+		return fmt.Errorf("no permissions given, use revoke to remove %s", parsed[1])
+	}
+
+	return setACL(servers, parsed[0], parsed[1], perms)
+}
+
+func revokeACL(servers []string, args []string) error {
+	parsed, err := parseArgs(flag.NewFlagSet("revoke", flag.ExitOnError), args, 2)
+	if err != nil {
+		return err
+	}
+
+	return setACL(servers, parsed[0], parsed[1], nil)
+}
+
+func setACL(servers []string, topicName string, principal string, perms []structs.Permission) error {
+	msg := structs.SetACLMsg{
+		TopicName:   topicName,
+		Principal:   principal,
+		Permissions: perms,
+		Token:       token}
+
+	var topic structs.Topic
+	if err := callServer(servers, "TServer.SetTopicACL", msg, &topic); err != nil {
+		return err
+	}
+
+	printACL(topic)
+	return nil
+}
+
+func printACL(topic structs.Topic) {
+	if len(topic.ACL) == 0 {
+		fmt.Printf("Topic %s is open to everyone\n", topic.TopicName)
+		return
+	}
+
+	principals := make([]string, 0, len(topic.ACL))
+	for principal := range topic.ACL {
+		principals = append(principals, principal)
+	}
+	sort.Strings(principals)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PRINCIPAL\tPERMISSIONS")
+	for _, principal := range principals {
+		perms := make([]string, 0)
+		for _, perm := range topic.ACL[principal] {
+			perms = append(perms, string(perm))
+		}
+		fmt.Fprintf(w, "%s\t%s\n", principal, strings.Join(perms, ","))
+	}
+	w.Flush()
+}
+
+// Prints a new random token and the entry to add to the server's clients.
+// Only the token's hash is given to the server
+func generateToken(servers []string, args []string) error {
+	name, err := parseOneArg(flag.NewFlagSet("token", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	newToken := hex.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(newToken))
+
+	fmt.Printf("Token for %s: %s\n\n", name, newToken)
+	fmt.Println("Add to \"clients\" in the server config:")
+	fmt.Printf("{\"name\": %q, \"token-sha256\": %q}\n", name, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Quota commands
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Shows a topic's quotas, or sets one when a rate or -clear is given
+func topicQuota(servers []string, args []string) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	clientId := fs.String("client", "", "Client id to set the quota of, * for every client (default: the whole topic)")
+	messages := fs.Float64("messages", 0, "Messages per second, 0 for unlimited")
+	bytes := fs.Float64("bytes", 0, "Bytes per second, 0 for unlimited")
+	unset := fs.Bool("clear", false, "Remove the quota so the server's default applies")
+
+	topicName, err := parseOneArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	set := *unset
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "messages" || f.Name == "bytes" {
+			set = true
+		}
+	})
+
+	var topic structs.Topic
+	if !set {
+		msg := structs.GetTopicMsg{TopicName: topicName, Token: token}
+		if err := callServer(servers, "TServer.GetTopic", msg, &topic); err != nil {
+			return err
+		}
+
+		printQuotas(topic)
+		return nil
+	}
+
+	msg := structs.SetQuotaMsg{
+		TopicName: topicName,
+		ClientId:  *clientId,
+		Token:     token}
+	if !*unset {
+		msg.Quota = &structs.Quota{MessagesPerSec: *messages, BytesPerSec: *bytes}
+	}
+
+	if err := callServer(servers, "TServer.SetTopicQuota", msg, &topic); err != nil {
+		return err
+	}
+
+	printQuotas(topic)
+	return nil
+}
+
+func printQuotas(topic structs.Topic) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tQUOTA")
+
+	if topic.Quotas.Topic != nil {
+		fmt.Fprintf(w, "(topic)\t%s\n", *topic.Quotas.Topic)
+	} else {
+		fmt.Fprintf(w, "(topic)\tserver default\n")
+	}
+
+	clientIds := make([]string, 0, len(topic.Quotas.Clients))
+	for clientId := range topic.Quotas.Clients {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+
+	for _, clientId := range clientIds {
+		fmt.Fprintf(w, "%s\t%s\n", clientId, topic.Quotas.Clients[clientId])
+	}
+	w.Flush()
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Geo-routing commands
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+func topicRegion(servers []string, args []string) error {
+	fs := flag.NewFlagSet("region", flag.ExitOnError)
+	box := fs.String("box", "", "Bounding box as min-x,min-y,max-x,max-y")
+	polygon := fs.String("polygon", "", "Polygon as space separated x,y points, at least 3")
+	unset := fs.Bool("clear", false, "Take the topic out of geo-routing")
+
+	topicName, err := parseOneArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var topic structs.Topic
+	if *box == "" && *polygon == "" && !*unset {
+		msg := structs.GetTopicMsg{TopicName: topicName, Token: token}
+		if err := callServer(servers, "TServer.GetTopic", msg, &topic); err != nil {
+			return err
+		}
+
+		printRegion(topic)
+		return nil
+	}
+
+	msg := structs.SetRegionMsg{TopicName: topicName, Token: token}
+	if !*unset {
+		region, err := parseRegion(*box, *polygon)
+		if err != nil {
+			return err
+		}
+		msg.Region = &region
+	}
+
+	if err := callServer(servers, "TServer.SetTopicRegion", msg, &topic); err != nil {
+		return err
+	}
+
+	printRegion(topic)
+	return nil
+}
+
+// The server checks the region itself
+func parseRegion(box string, polygon string) (structs.GeoRegion, error) {
+	var region structs.GeoRegion
+	if box != "" {
+		corners := strings.Split(box, ",")
+		if len(corners) != 4 {
+			return region, fmt.Errorf("box must be min-x,min-y,max-x,max-y, got %s", box)
+		}
+
+		low, err := structs.ParseGPSCoordinates(corners[0] + "," + corners[1])
+		if err != nil {
+			return region, err
+		}
+		high, err := structs.ParseGPSCoordinates(corners[2] + "," + corners[3])
+		if err != nil {
+			return region, err
+		}
+		region.Box = &structs.BoundingBox{Min: low, Max: high}
+	}
+
+	for _, point := range strings.Fields(polygon) {
+		p, err := structs.ParseGPSCoordinates(point)
+		if err != nil {
+			return region, err
+		}
+		region.Polygon = append(region.Polygon, p)
+	}
+
+	return region, nil
+}
+
+func printRegion(topic structs.Topic) {
+	if topic.Region == nil {
+		fmt.Printf("%s is not geo-routed\n", topic.TopicName)
+		return
+	}
+	fmt.Printf("%s covers %s\n", topic.TopicName, topic.Region)
+}
+
+func listRegions(servers []string, args []string) error {
+	var index structs.GeoIndex
+	if err := callServer(servers, "TServer.GetGeoIndex", "", &index); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tREGION")
+	for _, tr := range index {
+		fmt.Fprintf(w, "%s\t%s\n", tr.Topic, tr.Region)
+	}
+	return w.Flush()
+}
+
+func locate(servers []string, args []string) error {
+	arg, err := parseOneArg(flag.NewFlagSet("locate", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	location, err := structs.ParseGPSCoordinates(arg)
+	if err != nil {
+		return err
+	}
+
+	var topic structs.Topic
+	msg := structs.LocateMsg{Location: location, Token: token}
+	if err := callServer(servers, "TServer.LocateTopic", msg, &topic); err != nil {
+		return err
+	}
+
+	printRegion(topic)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Node commands
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+func listNodes(servers []string, args []string) error {
+	var nodes []structs.NodeStatus
+	if err := callServer(servers, "TServer.ListNodes", "", &nodes); err != nil {
+		return err
+	}
+
+	printNodes(nodes)
+	return nil
+}
+
+func listOrphans(servers []string, args []string) error {
+	var orphans []structs.NodeStatus
+	if err := callServer(servers, "TServer.ListOrphans", "", &orphans); err != nil {
+		return err
+	}
+
+	printNodes(orphans)
+	return nil
+}
+
+func drainNode(servers []string, args []string) error {
+	addr, err := parseOneArg(flag.NewFlagSet("drain", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	var ignored bool
+	if err := callServer(servers, "TServer.DrainNode", &addr, &ignored); err != nil {
+		return err
+	}
+
+	fmt.Printf("Drained node %s\n", addr)
+	return nil
+}
+
+func printNodes(nodes []structs.NodeStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tZONE\tRACK\tHOST\tSTATE\tPARTITION\tSINCE\tLAST-HEARTBEAT")
+	for _, n := range nodes {
+		lastHb := "-"
+		if n.RecentHeartbeat > 0 {
+			lastHb = ago(n.RecentHeartbeat)
+		}
+
+		partition := "-"
+		if n.Topic != "" {
+			partition = fmt.Sprintf("%s/%d", n.Topic, n.Partition)
+		}
+
+		since := "-"
+		if len(n.Transitions) > 0 {
+			since = ago(n.Transitions[len(n.Transitions)-1].At)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", n.Address, n.Labels.Zone, n.Labels.Rack, n.Labels.Host,
+			n.State, partition, since, lastHb)
+	}
+	w.Flush()
+}
+
+func ago(unixNano int64) string {
+	return time.Since(time.Unix(0, unixNano)).Round(time.Millisecond).String() + " ago"
+}
+
+func dumpNode(servers []string, args []string) error {
+	addr, err := parseOneArg(flag.NewFlagSet("dump", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	conn, err := mtls.Dial(addr)
+	if err != nil {
+		return err
+	}
+
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var clusterData node.ClusterData
+	if err := client.Call("Peer.GetClusterData", "", &clusterData); err != nil {
+		return err
+	}
+
+	fmt.Printf("Topic: %s  partition: %d  writes: %d\n\n", clusterData.Topic, clusterData.Partition, len(clusterData.Dataset))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIMESTAMP\tDATA")
+	for _, fdata := range clusterData.Dataset {
+		timestamp := "-"
+		if fdata.Timestamp > 0 {
+			timestamp = time.Unix(0, fdata.Timestamp).Format(time.RFC3339Nano)
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%q\n", fdata.Version, timestamp, fdata.Data)
+	}
+	w.Flush()
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Data commands
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+func tailTopic(servers []string, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "How often to poll for new data")
+	partition := fs.Int("partition", -1, "Only tail this partition (default: all)")
+
+	topicName, err := parseOneArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	rSess, err := consumer.GetTopic(topicName, servers, "ktsctl tail", token)
+	if err != nil {
+		return err
+	}
+	defer rSess.Close()
+
+	partitions := make([]int, 0)
+	for p := 0; p < rSess.NumPartitions(); p++ {
+		if *partition < 0 || *partition == p {
+			partitions = append(partitions, p)
+		}
+	}
+
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no partition %d", topicName, *partition)
+	}
+
+	// Versions already printed per partition. Committed transactions add
+	// records below the highest version seen, so a count or the last version
+	// would miss them. Versions dropped by retention are forgotten
+	seen := make(map[int]map[int]bool)
+	for {
+		for _, p := range partitions {
+			records, err := rSess.ReadPartitionRecords(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "partition %d: %s\n", p, err)
+				continue
+			}
+
+			current := make(map[int]bool, len(records))
+			for _, record := range records {
+				if !seen[p][record.Version] {
+					fmt.Printf("[%d] %s\n", p, strings.TrimRight(record.Data, "\n"))
+				}
+				current[record.Version] = true
+			}
+			seen[p] = current
+		}
+
+		time.Sleep(*interval)
+	}
+}
+
+func produce(servers []string, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	key := fs.String("key", "ktsctl", "Key used to pick the partition of every line")
+	partitions := fs.Int("partitions", 1, "Number of partitions if the topic is created")
+
+	topicName, err := parseOneArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	wSess, err := producer.OpenTopic(topicName, structs.TopicSpec{NumPartitions: *partitions}, servers, "ktsctl produce", token)
+	if err != nil {
+		return err
+	}
+	defer wSess.Close()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	numWritten := 0
+	for scanner.Scan() {
+		if err := wSess.Write(*key, scanner.Text()+"\n"); err != nil {
+			return fmt.Errorf("write %d failed: %s", numWritten+1, err)
+		}
+		numWritten++
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %d lines to %s\n", numWritten, topicName)
+	return scanner.Err()
+}
@@ -6,15 +6,30 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"./lib/consumer"
+	"./lib/logging"
+	"./lib/mtls"
 )
 
 func main() {
 	fmt.Println("This program connects to the data service as well as to an internal port for")
 	fmt.Println("sending data to a webserver.")
-	fmt.Println("Usage: go run <file> <serv-ip>:<serv-port> <internal-ip:internal-port>")
+	fmt.Println("Usage: go run <file> <serv-ip>:<serv-port>[,<serv-ip>:<serv-port>...] <internal-ip:internal-port>")
+	fmt.Println("TLS is set up from KTS_TLS_CA, KTS_TLS_CERT and KTS_TLS_KEY")
+	fmt.Println("A client token is read from KTS_TOKEN")
+
+	if err := mtls.SetupFromEnv(); err != nil {
+		fmt.Println("Could not set up TLS:", err)
+		return
+	}
+
+	if err := logging.ConfigureFromEnv(); err != nil {
+		fmt.Println("Could not set up logging:", err)
+		return
+	}
 
 	internalConn, err := net.Dial("tcp", os.Args[2])
 	if err != nil {
@@ -22,7 +37,7 @@ func main() {
 	}
 
 	topicName := "ubc"
-	rSess, err := consumer.GetTopic(topicName, os.Args[1], fmt.Sprintf("Read Id: %d", 1))
+	rSess, err := consumer.GetTopic(topicName, strings.Split(os.Args[1], ","), fmt.Sprintf("Read Id: %d", 1), os.Getenv("KTS_TOKEN"))
 	if err != nil {
 		fmt.Printf("Could not get ReadSession for Topic: [%s]\n", topicName)
 		return
@@ -59,7 +59,7 @@ def go_run_server(ip, pw)
 	Net::SSH.start(ip, @USERNAME, password: pw) do |ssh|
 		puts "Running server"
 		ssh.exec!("source ~/.profile && cd proj2_g4w8_g6y9a_i6y8_o5z8;"\
-			      "go run server/server.go -c server/config.json") do
+			      "go run server/*.go -c server/config.json") do
 			|ch, stream, line|
 			puts line
 		end
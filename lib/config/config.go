@@ -0,0 +1,202 @@
+/*
+Package config loads a binary's settings in layers. A struct with the
+defaults is overlaid with JSON files, then environment variables, then
+key=value pairs from the command line, each layer overriding the last.
+
+Keys are the json tags of the struct, joined with dots for nested structs:
+
+	{"node-settings": {"heartbeat": 10000}}
+	KTS_SERVER_NODE_SETTINGS_HEARTBEAT=10000
+	-set node-settings.heartbeat=10000
+
+The environment variable is the Loader's prefix and the key in upper case,
+with dots and dashes turned into underscores. Strings are taken as they are,
+lists of strings may be comma separated, and any other value is JSON.
+*/
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Where a binary's settings come from, in the order they are applied
+type Loader struct {
+	Files     []string // JSON files. Unknown keys are an error, to catch typos
+	EnvPrefix string   // e.g. KTS_SERVER_
+	Sets      []string // key=value pairs, e.g. from -set flags
+}
+
+// Overlays dst, a pointer to a struct holding the defaults, with every layer
+func (l Loader) Load(dst interface{}) error {
+	for _, path := range l.Files {
+		if err := loadFile(path, dst); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range Keys(dst) {
+		name := l.EnvName(key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := Set(dst, key, value); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+
+	for _, pair := range l.Sets {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Setting [%s] must be key=value", pair)
+		}
+		if err := Set(dst, parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the environment variable of key
+func (l Loader) EnvName(key string) string {
+	return l.EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+func loadFile(path string, dst interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// Returns every key that may be set in dst, a pointer to a struct
+func Keys(dst interface{}) []string {
+	return keys(reflect.TypeOf(dst).Elem(), "")
+}
+
+func keys(t reflect.Type, prefix string) []string {
+	var all []string
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := fieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+
+		if ft := t.Field(i).Type; ft.Kind() == reflect.Struct {
+			all = append(all, keys(ft, prefix+name+".")...)
+		} else {
+			all = append(all, prefix+name)
+		}
+	}
+	return all
+}
+
+// Sets key in dst, a pointer to a struct, from its text form
+func Set(dst interface{}, key string, value string) error {
+	v := reflect.ValueOf(dst).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("Unknown setting [%s]", key)
+		}
+
+		field, ok := fieldByName(v, name)
+		if !ok {
+			return fmt.Errorf("Unknown setting [%s]", key)
+		}
+		v = field
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(value, "["):
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list).Convert(v.Type()))
+		return nil
+	}
+
+	// Unmarshal into a fresh value so a bad value leaves the setting as it was
+	fresh := reflect.New(v.Type())
+	if err := json.Unmarshal([]byte(value), fresh.Interface()); err != nil {
+		return fmt.Errorf("Invalid value [%s] for setting [%s]: %s", value, key, err)
+	}
+	v.Set(fresh.Elem())
+	return nil
+}
+
+// Returns the keys whose values differ between a and b, pointers to structs
+// of the same type, e.g. to tell which settings a reload changed
+func Changed(a interface{}, b interface{}) []string {
+	var changed []string
+	for _, key := range Keys(a) {
+		if !reflect.DeepEqual(get(a, key).Interface(), get(b, key).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// Key must be one of Keys(dst)
+func get(dst interface{}, key string) reflect.Value {
+	v := reflect.ValueOf(dst).Elem()
+	for _, name := range strings.Split(key, ".") {
+		v, _ = fieldByName(v, name)
+	}
+	return v
+}
+
+func fieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		if fname, ok := fieldName(v.Type().Field(i)); ok && fname == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Returns the json name of an exported field. Fields tagged "-" are skipped
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	}
+	return name, true
+}
+
+// Flag value that collects every use of a flag, for -c and -set
+type List []string
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -2,12 +2,14 @@ package consumer
 
 import (
 	"fmt"
-	"net"
-	"net/rpc"
 
 	"../../structs"
+	"../logging"
+	"../serverclient"
 )
 
+var logger = logging.New("consumer")
+
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 // <ERROR DEFINITIONS>
 
@@ -54,17 +56,13 @@ func (e ConnectionError) Error() string {
 // Object that should be used by a client for reading. This is returned by
 // OpenTopic.
 type ReadSession struct {
-	topicName  string
-	clientId   string
-	leaderConn *rpc.Client
+	topicName string
+	clientId  string
+	token     string                     // Client credentials, empty to use the TLS certificate
+	leaders   *serverclient.TopicLeaders // Follows leader changes
 }
 
 //type Consumer interface {
-// Returns the Topic associated with the given gpsCoordinates
-// Can return the following errors:
-// - TopicDoesNotExistError
-//GetCurrentLocationCluster(gpsCoordinates GPSCoordinates) (topic structs.Topic, err error)
-
 // Returns the Topic the client will connect to and read from
 // Can return the following errors:
 // - TopicDoesNotExistError
@@ -77,92 +75,174 @@ type ReadSession struct {
 //Read(topicName string) (gpsCoordinates structs.GPSCoordinates, err error)
 //}
 
-func GetTopic(topicName string, serverAddr string, myId string) (*ReadSession, error) {
-	fmt.Println("Attempting server dial")
-	conn, err := net.Dial("tcp", serverAddr)
+// Parameter serverAddrs should be the ip:port combination of every server
+// replica. Calls fail over to the other replicas if the primary is down.
+//
+// Parameter token is the client's credentials. It may be empty when the
+// client has a TLS certificate, or for topics open to everyone. Errors for
+// missing permissions satisfy structs.IsUnauthorizedError.
+func GetTopic(topicName string, serverAddrs []string, myId string, token string) (*ReadSession, error) {
+	log := logger.With("client", myId, "topic", topicName)
+	serverRpc, err := serverclient.Dial(serverAddrs)
 	if err != nil {
+		log.Error("Could not dial server", "servers", serverAddrs, "err", err)
 		return nil, DisconnectedServerError(err.Error())
 	}
 
-	fmt.Println("Successfully dialed server")
-
-	serverRpc := rpc.NewClient(conn)
-	defer serverRpc.Close()
-
 	var topicData structs.Topic
+	getMsg := structs.GetTopicMsg{TopicName: topicName, Token: token}
 
 	// First attempt to get topic
-	fmt.Println("Attempting get topic")
-	err = serverRpc.Call("TServer.GetTopic", &topicName, &topicData)
+	err = serverRpc.Call("TServer.GetTopic", getMsg, &topicData)
 	if err == nil {
-		return connectToLeader(topicData, myId)
+		return connectToLeaders(serverRpc, topicData, myId, token)
+	}
+
+	// Retrying does not help without the right credentials
+	if structs.IsUnauthorizedError(err) {
+		serverRpc.Close()
+		return nil, err
 	}
 
 	// Attempt to get topic again in case of race condition
-	fmt.Println("Could not create topic; attempting to get topic again:", err)
-	err = serverRpc.Call("TServer.GetTopic", &topicName, &topicData)
+	log.Info("Could not get topic, getting it again", "err", err)
+	err = serverRpc.Call("TServer.GetTopic", getMsg, &topicData)
 	if err == nil {
-		return connectToLeader(topicData, myId)
+		return connectToLeaders(serverRpc, topicData, myId, token)
 	}
 
-	fmt.Println("Final error, quitting:", err)
+	log.Error("Could not get topic", "err", err)
+	serverRpc.Close()
+	if structs.IsUnauthorizedError(err) {
+		return nil, err
+	}
 	return nil, fmt.Errorf("Could not get topic.\n")
 }
 
+// Returns the geo-routed Topic whose region holds gpsCoordinates, whose name
+// can be given to GetTopic. Where regions overlap the smallest wins.
+// Can return the following errors:
+// - structs.NoTopicAtLocationError, see structs.IsNoTopicAtLocationError
+// - DisconnectedServerError
+func GetCurrentLocationCluster(gpsCoordinates structs.GPSCoordinates, serverAddrs []string, token string) (structs.Topic, error) {
+	var topic structs.Topic
+	serverRpc, err := serverclient.Dial(serverAddrs)
+	if err != nil {
+		logger.Error("Could not dial server", "servers", serverAddrs, "err", err)
+		return topic, DisconnectedServerError(err.Error())
+	}
+	defer serverRpc.Close()
+
+	msg := structs.LocateMsg{Location: gpsCoordinates, Token: token}
+	err = serverRpc.Call("TServer.LocateTopic", msg, &topic)
+	return topic, err
+}
+
 // Function closes the topic. Returns an error if not currently connected or
 // if somehow close returns an error.
 func (s *ReadSession) Close() error {
-	if s.leaderConn == nil {
+	if s.leaders == nil {
 		return DisconnectedError("")
 	}
 
-	err := s.leaderConn.Close()
-	if err != nil {
-		return err
+	err := s.leaders.Close()
+	s.leaders = nil
+	return err
+}
+
+// Function reads from every partition of the topic. Data is ordered within a
+// partition, and partitions are concatenated in order of their Id. Returns an
+// error if not currently connected, or if there is a connection error.
+func (s *ReadSession) Read() ([]string, error) {
+	if s.leaders == nil {
+		return nil, DisconnectedError("")
+	}
+
+	data := make([]string, 0)
+	for partition := 0; partition < s.leaders.NumPartitions(); partition++ {
+		partitionData, err := s.ReadPartition(partition)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, partitionData...)
 	}
 
-	s.leaderConn = nil
-	return nil
+	return data, nil
 }
 
-// Function reads from topic. Returns an error if not currently connected, or if
-// there is a connection error.
-func (s *ReadSession) Read() ([]string, error) {
-	if s.leaderConn == nil {
+// Function reads from a single partition of the topic. Returns an error if not
+// currently connected, if the partition does not exist or if there is a
+// connection error.
+func (s *ReadSession) ReadPartition(partition int) ([]string, error) {
+	if s.leaders == nil {
 		return nil, DisconnectedError("")
 	}
 
-	req := s.topicName
+	if partition < 0 || partition >= s.leaders.NumPartitions() {
+		return nil, fmt.Errorf("Consumer: Topic [%s] has no partition %d", s.topicName, partition)
+	}
+
+	req := structs.ReadMsg{
+		Topic:     s.topicName,
+		Partition: partition,
+		Id:        s.clientId,
+		Token:     s.token}
 	var data []string
 
-	err := s.leaderConn.Call("Cluster.ReadFromCluster", req, &data)
+	err := s.leaders.Call(partition, "Cluster.ReadFromCluster", req, &data)
 
 	return data, err
 }
 
+// Function reads from a single partition of the topic like ReadPartition,
+// with the version of each record. A consumer polling a partition can tell
+// new records from the versions it has seen, even when a transaction's
+// records appear between ones it already read.
+func (s *ReadSession) ReadPartitionRecords(partition int) ([]structs.Record, error) {
+	if s.leaders == nil {
+		return nil, DisconnectedError("")
+	}
+
+	if partition < 0 || partition >= s.leaders.NumPartitions() {
+		return nil, fmt.Errorf("Consumer: Topic [%s] has no partition %d", s.topicName, partition)
+	}
+
+	req := structs.ReadMsg{
+		Topic:     s.topicName,
+		Partition: partition,
+		Id:        s.clientId,
+		Token:     s.token}
+	var records []structs.Record
+
+	err := s.leaders.Call(partition, "Cluster.ReadRecordsFromCluster", req, &records)
+
+	return records, err
+}
+
+// Returns the number of partitions of the topic
+func (s *ReadSession) NumPartitions() int {
+	return s.leaders.NumPartitions()
+}
+
 // </API>
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-// Attempt to connect to a topic leader for writing
-func connectToLeader(topicData structs.Topic, myId string) (*ReadSession, error) {
-	fmt.Println("Attempting to connect to leader")
-	// There should only be one leader in the current implementation, so
-	// only attempt the 0th index.
-	conn, err := net.Dial("tcp", topicData.Leaders[0])
+// Attempt to connect to the leader of every partition of a topic for reading.
+// The session keeps serverRpc to watch for leader changes
+func connectToLeaders(serverRpc *serverclient.Client, topicData structs.Topic, myId string, token string) (*ReadSession, error) {
+	log := logger.With("client", myId, "topic", topicData.TopicName)
+	leaders, err := serverclient.WatchLeaders(serverRpc, topicData, token)
 	if err != nil {
-		fmt.Printf("Could not connect to leader %s of topic %s\n",
-			topicData.TopicName, topicData.Leaders[0])
+		log.Error("Could not connect to the leaders", "err", err)
+		serverRpc.Close()
 		return nil, ConnectionError(err.Error())
 	}
 
-	leaderConn := rpc.NewClient(conn)
-	if leaderConn == nil {
-		return nil, ConnectionError("rpc.NewClient failed")
-	}
-
-	fmt.Println("Successfully connected to leader:", topicData.Leaders)
+	log.Info("Connected to the leaders", "partitions", topicData.Partitions)
 	return &ReadSession{
 		topicData.TopicName,
 		myId,
-		leaderConn}, nil
+		token,
+		leaders}, nil
 }
@@ -0,0 +1,268 @@
+/*
+Package logging writes leveled logs with key/value fields, one JSON object
+per line by default, so that the logs of every server, node and client of a
+cluster can be merged and filtered together:
+
+	{"time":"2018-04-08T20:01:02.5Z","level":"info","msg":"Became leader","component":"node","node":"10.0.0.5:4001","topic":"ubc","partition":0}
+
+Each package keeps a Logger for its component and adds fields with With.
+Fields that change over a process's life, such as a node's role, are given
+as a Valuer and read on every line.
+
+The level and format are process wide. KTS_LOG_LEVEL (debug, info, warn or
+error) and KTS_LOG_FORMAT (json or text) set them with ConfigureFromEnv.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level [%s], must be debug, info, warn or error", s)
+}
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatText Format = "text" // For reading on a terminal
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatText:
+		return FormatText, nil
+	}
+	return FormatJSON, fmt.Errorf("Unknown log format [%s], must be json or text", s)
+}
+
+// Environment variables read by ConfigureFromEnv
+const (
+	ENV_LEVEL  = "KTS_LOG_LEVEL"
+	ENV_FORMAT = "KTS_LOG_FORMAT"
+)
+
+// A field value that is read each time a line is logged
+type Valuer func() interface{}
+
+var (
+	lock     sync.Mutex
+	out      io.Writer = os.Stderr
+	minLevel           = LevelInfo
+	format             = FormatJSON
+)
+
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	out = w
+}
+
+func SetLevel(level Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	minLevel = level
+}
+
+func SetFormat(f Format) {
+	lock.Lock()
+	defer lock.Unlock()
+	format = f
+}
+
+// Sets the level and format from KTS_LOG_LEVEL and KTS_LOG_FORMAT. Unset
+// variables keep info and json
+func ConfigureFromEnv() error {
+	level, err := ParseLevel(os.Getenv(ENV_LEVEL))
+	if err != nil {
+		return err
+	}
+
+	f, err := ParseFormat(os.Getenv(ENV_FORMAT))
+	if err != nil {
+		return err
+	}
+
+	SetLevel(level)
+	SetFormat(f)
+	return nil
+}
+
+func enabled(level Level) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return level >= minLevel
+}
+
+type Logger struct {
+	fields []interface{} // Alternating keys and values
+}
+
+// Returns a logger that tags every line with component, e.g. server or node
+func New(component string) *Logger {
+	return &Logger{fields: []interface{}{"component", component}}
+}
+
+// Returns a logger that adds the key/value pairs kv to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// Logs at error level and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !enabled(level) {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 == 1 {
+		fields = append(fields, "(missing)")
+	}
+
+	// Valuers may take their package's locks, so they are read before ours
+	for i := 1; i < len(fields); i += 2 {
+		fields[i] = value(fields[i])
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var line []byte
+	if format == FormatText {
+		line = textLine(time.Now(), level, msg, fields)
+	} else {
+		line = jsonLine(time.Now(), level, msg, fields)
+	}
+	out.Write(line)
+}
+
+// Keeps the keys in the order they were given, which encoding/json does not
+func jsonLine(now time.Time, level Level, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	buf.Write(marshal(now.UTC().Format(time.RFC3339Nano)))
+	buf.WriteString(`,"level":`)
+	buf.Write(marshal(level.String()))
+	buf.WriteString(`,"msg":`)
+	buf.Write(marshal(msg))
+
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		buf.Write(marshal(fmt.Sprint(fields[i])))
+		buf.WriteByte(':')
+		buf.Write(marshal(fields[i+1]))
+	}
+
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func textLine(now time.Time, level Level, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %-5s %s", now.UTC().Format("2006-01-02T15:04:05.000000Z"), strings.ToUpper(level.String()), msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		v := fields[i+1]
+		if s, ok := v.(string); ok && !strings.ContainsAny(s, " \"=") && s != "" {
+			fmt.Fprintf(&buf, " %v=%s", fields[i], s)
+		} else {
+			fmt.Fprintf(&buf, " %v=%s", fields[i], marshal(v))
+		}
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Reads Valuers and turns errors into their message, which encoding/json
+// would write as {}
+func value(v interface{}) interface{} {
+	if valuer, ok := v.(Valuer); ok {
+		v = valuer()
+	}
+
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
+
+func marshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
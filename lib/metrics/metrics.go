@@ -0,0 +1,402 @@
+/*
+Package metrics keeps counters, gauges and histograms and serves them on
+/metrics in the Prometheus text format. It only needs the standard library.
+
+Metrics are registered once, usually in a package level var block, and are
+safe to update from any goroutine:
+
+	var writes = metrics.NewCounterVec("kts_node_writes_total", "Writes by result", "result")
+	writes.With("accepted").Inc()
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds, for latencies from a local disk write to a
+// replicated write across hosts
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]metric)
+)
+
+// Metrics are only registered from var blocks and init, so a clash is a bug
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[m.name()]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// Writes every metric in the Prometheus text format, sorted by name
+func WriteText(w io.Writer) {
+	registryLock.Lock()
+	all := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		all = append(all, m)
+	}
+	registryLock.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].name() < all[j].name() })
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+// Serves WriteText
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
+
+// Serves /metrics on addr until the listener fails
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Counters
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// A value that only goes up
+type Counter struct {
+	lock  sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Adds v, which must not be negative
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+
+	c.lock.Lock()
+	c.value += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) get() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value
+}
+
+type counterMetric struct {
+	vec
+	counters map[string]*Counter // label values joined by \xff ->
+}
+
+// Counters that share a name and differ by their label values
+type CounterVec struct {
+	m *counterMetric
+}
+
+func NewCounter(name string, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	m := &counterMetric{
+		vec:      vec{metricName: name, help: help, kind: "counter", labels: labels},
+		counters: make(map[string]*Counter)}
+	register(m)
+	return &CounterVec{m}
+}
+
+// Returns the counter for values, one per label of the vec
+func (v *CounterVec) With(values ...string) *Counter {
+	key := v.m.key(values)
+
+	v.m.lock.Lock()
+	defer v.m.lock.Unlock()
+
+	c, ok := v.m.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.m.counters[key] = c
+	}
+	return c
+}
+
+func (m *counterMetric) write(w io.Writer) {
+	m.lock.Lock()
+	values := make(map[string]float64, len(m.counters))
+	for key, c := range m.counters {
+		values[key] = c.get()
+	}
+	m.lock.Unlock()
+
+	m.writeSamples(w, values)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Gauges
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// A value that goes up and down
+type Gauge struct {
+	lock  sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.lock.Lock()
+	g.value = v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.lock.Lock()
+	g.value += v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) get() float64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.value
+}
+
+type gaugeMetric struct {
+	vec
+	gauges map[string]*Gauge
+}
+
+// Gauges that share a name and differ by their label values
+type GaugeVec struct {
+	m *gaugeMetric
+}
+
+func NewGauge(name string, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	m := &gaugeMetric{
+		vec:    vec{metricName: name, help: help, kind: "gauge", labels: labels},
+		gauges: make(map[string]*Gauge)}
+	register(m)
+	return &GaugeVec{m}
+}
+
+// Returns the gauge for values, one per label of the vec
+func (v *GaugeVec) With(values ...string) *Gauge {
+	key := v.m.key(values)
+
+	v.m.lock.Lock()
+	defer v.m.lock.Unlock()
+
+	g, ok := v.m.gauges[key]
+	if !ok {
+		g = &Gauge{}
+		v.m.gauges[key] = g
+	}
+	return g
+}
+
+func (m *gaugeMetric) write(w io.Writer) {
+	m.lock.Lock()
+	values := make(map[string]float64, len(m.gauges))
+	for key, g := range m.gauges {
+		values[key] = g.get()
+	}
+	m.lock.Unlock()
+
+	m.writeSamples(w, values)
+}
+
+type gaugeFunc struct {
+	vec
+	fn func() map[string]float64 // label value ->
+}
+
+// Registers a gauge whose value is read from fn on every scrape
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	register(&gaugeFunc{
+		vec: vec{metricName: name, help: help, kind: "gauge"},
+		fn:  func() map[string]float64 { return map[string]float64{"": fn()} }})
+}
+
+// Registers a gauge with one label whose values are read from fn on every
+// scrape, e.g. the number of nodes by state
+func NewGaugeVecFunc(name string, help string, label string, fn func() map[string]float64) {
+	register(&gaugeFunc{
+		vec: vec{metricName: name, help: help, kind: "gauge", labels: []string{label}},
+		fn:  fn})
+}
+
+func (m *gaugeFunc) write(w io.Writer) {
+	m.writeSamples(w, m.fn())
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Histograms
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Counts observations into buckets by their upper bound
+type Histogram struct {
+	vec
+	buckets []float64 // Sorted upper bounds, without +Inf
+	counts  []uint64  // Per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// Buckets are upper bounds. nil uses DefBuckets
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+
+	h := &Histogram{
+		vec:     vec{metricName: name, help: help, kind: "histogram"},
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// Observes the seconds since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Helpers
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Name, help and labels shared by every kind of metric
+type vec struct {
+	lock       sync.Mutex
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// Writes the header and one sample per key of values, sorted by key
+func (v *vec) writeSamples(w io.Writer, values map[string]float64) {
+	v.writeHeader(w)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labelPairs(key), formatFloat(values[key]))
+	}
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.metricName, strings.Replace(v.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.metricName, v.kind)
+}
+
+// Joins label values into a map key. Missing values are left empty
+func (v *vec) key(values []string) string {
+	padded := make([]string, len(v.labels))
+	copy(padded, values)
+	return strings.Join(padded, "\xff")
+}
+
+// Formats a key as {label="value",...}, empty without labels
+func (v *vec) labelPairs(key string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(v.labels))
+	for i, label := range v.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label, escape(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,298 @@
+/*
+Package mtls sets up mutual TLS for every RPC connection: client to server,
+server to server, server to node, node to node and client to cluster. Each
+process loads the CA, its certificate and its key once with Setup. Both ends
+of a connection present a certificate signed by the CA, and the dialer checks
+that the certificate is valid for the address it dialed.
+
+A certificate's CommonName names the process and its OrganizationalUnit is
+the process's role. Receivers decide what a caller may do from its role.
+
+Without Setup, or with an empty Config, connections are plain TCP and every
+caller is allowed everything.
+*/
+
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	RoleServer = "server"
+	RoleNode   = "node"
+	RoleClient = "client" // Producers and consumers
+	RoleAdmin  = "admin"  // ktsctl
+)
+
+// Environment variables read by FromEnv
+const (
+	ENV_CA   = "KTS_TLS_CA"
+	ENV_CERT = "KTS_TLS_CERT"
+	ENV_KEY  = "KTS_TLS_KEY"
+)
+
+// Time an accepted connection has to finish its handshake
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+type IncompleteConfigError string
+
+func (e IncompleteConfigError) Error() string {
+	return fmt.Sprintf("TLS: ca-file, cert-file and key-file must all be set, %s is missing", string(e))
+}
+
+type BadCertificateError string
+
+func (e BadCertificateError) Error() string {
+	return fmt.Sprintf("TLS: %s", string(e))
+}
+
+// Paths to PEM files
+type Config struct {
+	CAFile   string `json:"ca-file"`
+	CertFile string `json:"cert-file"`
+	KeyFile  string `json:"key-file"`
+}
+
+func (c Config) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// Reads the paths from KTS_TLS_CA, KTS_TLS_CERT and KTS_TLS_KEY
+func FromEnv() Config {
+	return Config{
+		CAFile:   os.Getenv(ENV_CA),
+		CertFile: os.Getenv(ENV_CERT),
+		KeyFile:  os.Getenv(ENV_KEY)}
+}
+
+// The other end of a connection, as named by its certificate. The zero
+// Identity stands for a plain TCP caller
+type Identity struct {
+	Name string
+	Role string
+	cert *x509.Certificate
+}
+
+func (id Identity) String() string {
+	if id.cert == nil {
+		return "anonymous"
+	}
+	return fmt.Sprintf("%s [%s]", id.Name, id.Role)
+}
+
+// Reports whether the caller has one of roles. Always true without TLS
+func (id Identity) Is(roles ...string) bool {
+	if id.cert == nil {
+		return true
+	}
+
+	for _, role := range roles {
+		if id.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the caller's certificate is valid for the host of addr,
+// i.e. whether the caller may speak for the process listening on addr.
+// Always true without TLS
+func (id Identity) Owns(addr string) bool {
+	if id.cert == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return id.cert.VerifyHostname(host) == nil
+}
+
+var (
+	lock      sync.RWMutex
+	tlsConfig *tls.Config // nil when TLS is off
+)
+
+// Loads the CA, certificate and key. An empty conf turns TLS off
+func Setup(conf Config) error {
+	if !conf.Enabled() {
+		lock.Lock()
+		tlsConfig = nil
+		lock.Unlock()
+		return nil
+	}
+
+	switch {
+	case conf.CAFile == "":
+		return IncompleteConfigError("ca-file")
+	case conf.CertFile == "":
+		return IncompleteConfigError("cert-file")
+	case conf.KeyFile == "":
+		return IncompleteConfigError("key-file")
+	}
+
+	caPEM, err := ioutil.ReadFile(conf.CAFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return BadCertificateError("no CA certificate in " + conf.CAFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12}
+	return nil
+}
+
+// Same as Setup(FromEnv())
+func SetupFromEnv() error {
+	return Setup(FromEnv())
+}
+
+func Enabled() bool {
+	return current() != nil
+}
+
+func Dial(addr string) (net.Conn, error) {
+	return DialTimeout(addr, 0)
+}
+
+// Dials addr and completes the handshake. A timeout of 0 waits as long as the
+// OS does
+func DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	conf := current()
+	if conf == nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf = conf.Clone()
+	conf.ServerName = host
+	return tls.DialWithDialer(dialer, "tcp", addr, conf)
+}
+
+func Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := current()
+	if conf == nil {
+		return ln, nil
+	}
+	return tls.NewListener(ln, conf), nil
+}
+
+// Accepts connections on ln until it is closed. Each connection is handed to
+// serve in its own goroutine once its handshake is done. Connections that
+// fail the handshake are dropped
+func Accept(ln net.Listener, serve func(conn net.Conn, caller Identity)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			caller, err := handshake(conn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "TLS: dropping connection from %s: %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			serve(conn, caller)
+		}()
+	}
+}
+
+// Serves server on connections from ln, like rpc.Server.Accept. Connections
+// from callers without one of roles are closed
+func AcceptRoles(ln net.Listener, server *rpc.Server, roles ...string) error {
+	return Accept(ln, func(conn net.Conn, caller Identity) {
+		if !caller.Is(roles...) {
+			fmt.Fprintf(os.Stderr, "TLS: dropping connection from %s: %s may not connect\n", conn.RemoteAddr(), caller)
+			conn.Close()
+			return
+		}
+
+		server.ServeConn(conn)
+	})
+}
+
+func handshake(conn net.Conn) (Identity, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return Identity{}, nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if err := tlsConn.Handshake(); err != nil {
+		return Identity{}, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return identityOf(tlsConn.ConnectionState().PeerCertificates)
+}
+
+// Returns the caller of an HTTP request served on a listener from Listen.
+// The zero Identity without TLS
+func RequestIdentity(r *http.Request) (Identity, error) {
+	if r.TLS == nil {
+		return Identity{}, nil
+	}
+	return identityOf(r.TLS.PeerCertificates)
+}
+
+func identityOf(certs []*x509.Certificate) (Identity, error) {
+	if len(certs) == 0 {
+		return Identity{}, BadCertificateError("no client certificate")
+	}
+
+	cert := certs[0]
+	if len(cert.Subject.OrganizationalUnit) == 0 {
+		return Identity{}, BadCertificateError(fmt.Sprintf("certificate of %s has no role", cert.Subject.CommonName))
+	}
+
+	return Identity{
+		Name: cert.Subject.CommonName,
+		Role: cert.Subject.OrganizationalUnit[0],
+		cert: cert}, nil
+}
+
+func current() *tls.Config {
+	lock.RLock()
+	defer lock.RUnlock()
+	return tlsConfig
+}
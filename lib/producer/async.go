@@ -0,0 +1,260 @@
+package producer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../../structs"
+)
+
+// Settings of an AsyncWriter. Zero values of MaxInFlight and BatchSize take
+// the defaults
+type AsyncConfig struct {
+	MaxInFlight int           // Records queued or being sent. Send blocks while this many are
+	BatchSize   int           // Most records of one partition sent in one call
+	Linger      time.Duration // Time a partition's batch waits to fill before it is sent
+}
+
+const (
+	DEFAULT_MAX_IN_FLIGHT = 1000
+	DEFAULT_BATCH_SIZE    = 100
+)
+
+func DefaultAsyncConfig() AsyncConfig {
+	return AsyncConfig{
+		MaxInFlight: DEFAULT_MAX_IN_FLIGHT,
+		BatchSize:   DEFAULT_BATCH_SIZE,
+		Linger:      10 * time.Millisecond,
+	}
+}
+
+// Result of one record sent with AsyncWriter.Send
+type Future struct {
+	done    chan struct{}
+	version int
+	err     error
+}
+
+// Closed once the record is written or has failed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Blocks until the record is written or has failed. Returns the version the
+// leader gave the record, or the error of its batch
+func (f *Future) Wait() (int, error) {
+	<-f.done
+	return f.version, f.err
+}
+
+// Called once the record is written or has failed, on the goroutine that
+// sends the record's partition. It should return quickly, since the
+// partition's next batch waits for it
+type Callback func(version int, err error)
+
+// Writes records in the background, so the caller does not wait for them to
+// be replicated. Records are queued per partition and sent in batches, as
+// with WriteBatch, one batch of a partition at a time so that records with
+// the same key stay in order. Partitions are sent in parallel. This is
+// returned by WriteSession.Async.
+type AsyncWriter struct {
+	session *WriteSession
+	config  AsyncConfig
+	queues  []chan pendingRecord // index = partition
+	flushes []chan struct{}      // Wakes a partition's sender while Flush waits
+	slots   chan struct{}        // One per record queued or being sent
+	workers sync.WaitGroup
+
+	flushing int32 // Calls of Flush waiting, accessed atomically
+
+	lock        sync.Mutex
+	idle        *sync.Cond // Signalled when outstanding drops to 0
+	outstanding int
+	closed      bool
+}
+
+type pendingRecord struct {
+	data     string
+	future   *Future
+	callback Callback
+}
+
+// Returns an AsyncWriter that sends records through the session. The session
+// must stay open until the writer is closed
+func (s *WriteSession) Async(config AsyncConfig) *AsyncWriter {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = DEFAULT_MAX_IN_FLIGHT
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	if config.BatchSize > structs.MAX_BATCH_RECORDS {
+		config.BatchSize = structs.MAX_BATCH_RECORDS
+	}
+
+	a := &AsyncWriter{
+		session: s,
+		config:  config,
+		queues:  make([]chan pendingRecord, s.NumPartitions()),
+		flushes: make([]chan struct{}, s.NumPartitions()),
+		slots:   make(chan struct{}, config.MaxInFlight)}
+	a.idle = sync.NewCond(&a.lock)
+
+	for partition := range a.queues {
+		// Big enough that Send never waits for a partition once it has a slot
+		a.queues[partition] = make(chan pendingRecord, config.MaxInFlight)
+		a.flushes[partition] = make(chan struct{}, 1)
+		a.workers.Add(1)
+		go a.sendPartition(partition)
+	}
+	return a
+}
+
+// Function queues datum to be written with the partition of key, as in
+// WriteSession.Write, and returns at once unless MaxInFlight records are
+// outstanding. callback may be nil. Records sent after Close fail with a
+// DisconnectedError.
+func (a *AsyncWriter) Send(key string, datum string, callback Callback) *Future {
+	future := &Future{done: make(chan struct{})}
+
+	a.slots <- struct{}{}
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		<-a.slots
+		complete(future, callback, 0, DisconnectedError(""))
+		return future
+	}
+	a.outstanding++
+	partition := structs.PartitionForKey(key, len(a.queues))
+	a.queues[partition] <- pendingRecord{data: datum, future: future, callback: callback}
+	a.lock.Unlock()
+
+	return future
+}
+
+// Function sends every queued record without waiting for Linger, and blocks
+// until all records sent before and during the call are written or have
+// failed.
+func (a *AsyncWriter) Flush() {
+	atomic.AddInt32(&a.flushing, 1)
+	defer atomic.AddInt32(&a.flushing, -1)
+
+	for _, flush := range a.flushes {
+		select {
+		case flush <- struct{}{}:
+		default: // Already woken
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for a.outstanding > 0 {
+		a.idle.Wait()
+	}
+}
+
+// Function flushes the writer and stops it. It does not close the session.
+// Returns an error if the writer is already closed.
+func (a *AsyncWriter) Close() error {
+	a.Flush()
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return DisconnectedError("")
+	}
+	a.closed = true
+	for _, queue := range a.queues {
+		close(queue)
+	}
+	a.lock.Unlock()
+
+	a.workers.Wait()
+	return nil
+}
+
+// Sends the records of one partition until its queue is closed
+func (a *AsyncWriter) sendPartition(partition int) {
+	defer a.workers.Done()
+
+	for {
+		first, ok := <-a.queues[partition]
+		if !ok {
+			return
+		}
+
+		batch, open := a.collect(partition, first)
+		a.sendBatch(partition, batch)
+		if !open {
+			return
+		}
+	}
+}
+
+// Adds records of a partition to a batch until it holds BatchSize, Linger
+// passes, or Flush is waiting and the queue is empty. Returns false if the
+// queue was closed
+func (a *AsyncWriter) collect(partition int, first pendingRecord) ([]pendingRecord, bool) {
+	queue := a.queues[partition]
+	batch := []pendingRecord{first}
+	linger := time.NewTimer(a.config.Linger)
+	defer linger.Stop()
+
+	for len(batch) < a.config.BatchSize {
+		if len(queue) == 0 && atomic.LoadInt32(&a.flushing) > 0 {
+			return batch, true
+		}
+
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, p)
+		case <-a.flushes[partition]:
+		case <-linger.C:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+func (a *AsyncWriter) sendBatch(partition int, batch []pendingRecord) {
+	data := make([]string, len(batch))
+	for i, p := range batch {
+		data[i] = p.data
+	}
+
+	var versions []int
+	var err error = DisconnectedError("")
+	if a.session.leaders != nil {
+		versions, err = a.session.writeChunk(partition, data, structs.TraceContext{})
+	}
+
+	for i, p := range batch {
+		if err != nil {
+			complete(p.future, p.callback, 0, err)
+		} else {
+			complete(p.future, p.callback, versions[i], nil)
+		}
+		<-a.slots
+	}
+
+	a.lock.Lock()
+	a.outstanding -= len(batch)
+	if a.outstanding == 0 {
+		a.idle.Broadcast()
+	}
+	a.lock.Unlock()
+}
+
+func complete(future *Future, callback Callback, version int, err error) {
+	future.version, future.err = version, err
+	close(future.done)
+	if callback != nil {
+		callback(version, err)
+	}
+}
@@ -0,0 +1,123 @@
+package producer
+
+import (
+	"fmt"
+	"sync"
+
+	"../../structs"
+	"../tracing"
+)
+
+// One record of a batch. The key is used as in WriteSession.Write
+type Record struct {
+	Key  string
+	Data string
+}
+
+// Returned by WriteBatch when some records were not written. Errors is
+// indexed like the batch, with nil for every record that was written
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d records not written, first error: %v", failed, len(e.Errors), first)
+}
+
+// Function writes many records with one call per partition instead of one
+// per record. The records of a partition are sent in chunks of up to
+// structs.MAX_BATCH_RECORDS, and each chunk is replicated and stored as one
+// unit: either all its records are written or none are. Records with the
+// same key are kept in order. Partitions are written in parallel, and
+// throttled chunks are sent again as in Write. Returns a *BatchError if any
+// record was not written, or an error if not currently connected.
+func (s *WriteSession) WriteBatch(records []Record) (err error) {
+	if s.leaders == nil {
+		return DisconnectedError("")
+	}
+
+	span := tracing.Start("producer.WriteBatch", structs.TraceContext{})
+	span.Set("client", s.clientId)
+	span.Set("topic", s.topicName)
+	span.Set("records", len(records))
+	defer func() { span.End(err) }()
+
+	// Indices into records of each partition's records, in order
+	byPartition := make(map[int][]int)
+	for i, record := range records {
+		partition := structs.PartitionForKey(record.Key, s.leaders.NumPartitions())
+		byPartition[partition] = append(byPartition[partition], i)
+	}
+
+	errs := make([]error, len(records))
+	var wg sync.WaitGroup
+	for partition, indices := range byPartition {
+		wg.Add(1)
+		go func(partition int, indices []int) {
+			defer wg.Done()
+
+			for start := 0; start < len(indices); start += structs.MAX_BATCH_RECORDS {
+				end := start + structs.MAX_BATCH_RECORDS
+				if end > len(indices) {
+					end = len(indices)
+				}
+
+				data := make([]string, end-start)
+				for n, i := range indices[start:end] {
+					data[n] = records[i].Data
+				}
+
+				if _, err := s.writeChunk(partition, data, span.Context()); err != nil {
+					// Later chunks would be out of order with this one
+					for _, i := range indices[start:] {
+						errs[i] = err
+					}
+					return
+				}
+			}
+		}(partition, indices)
+	}
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			return &BatchError{errs}
+		}
+	}
+	return nil
+}
+
+// Writes data to partition as one WriteBatchMsg. Returns the version of
+// each record
+func (s *WriteSession) writeChunk(partition int, data []string, parent structs.TraceContext) (versions []int, err error) {
+	span := tracing.Start("producer.WriteChunk", parent)
+	span.Set("partition", partition)
+	span.Set("records", len(data))
+	defer func() { span.End(err) }()
+
+	req := structs.WriteBatchMsg{
+		Topic:     s.topicName,
+		Partition: partition,
+		Id:        s.clientId,
+		Records:   data,
+		Token:     s.token,
+		Trace:     span.Context(),
+
+		ProducerId: s.producerId,
+		Sequence:   s.nextSequences(partition, len(data)),
+	}
+	span.Set("sequence", req.Sequence)
+
+	err = s.call(partition, "Cluster.WriteBatchToCluster", req, &versions, span)
+	return versions, err
+}
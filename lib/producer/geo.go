@@ -0,0 +1,237 @@
+package producer
+
+import (
+	"sync"
+	"time"
+
+	"../../structs"
+	"../serverclient"
+)
+
+// Seconds the geographic index is used before it is fetched again, so that
+// new and changed regions reach running producers
+const GEO_INDEX_TTL = 30
+
+// Object that should be used by a client for writing to geo-routed topics.
+// Each point is written to the topic whose region holds it, and a
+// WriteSession is opened for each topic the first time a point falls in it.
+// Points outside every region go to the fallback topic. A vehicle that moves
+// between regions has its writes kept in order within each topic. Points
+// sent with Send go through an AsyncWriter per topic. This is returned by
+// OpenGeoSession.
+type GeoSession struct {
+	fallback    string // Empty refuses points outside every region
+	spec        structs.TopicSpec
+	serverAddrs []string
+	clientId    string
+	token       string
+
+	lock        sync.Mutex
+	serverRpc   *serverclient.Client
+	index       structs.GeoIndex
+	indexExpiry time.Time
+	sessions    map[string]*WriteSession // topic ->
+	async       AsyncConfig
+	writers     map[string]*AsyncWriter // topic ->
+}
+
+// Connects to the server and fetches the geographic index. fallbackTopic is
+// opened, and created with spec if needed, the first time a point is outside
+// every region. Without one such points return a NoTopicAtLocationError.
+// The other parameters are as for OpenTopic.
+func OpenGeoSession(fallbackTopic string, spec structs.TopicSpec, serverAddrs []string, myId string, token string) (*GeoSession, error) {
+	serverRpc, err := serverclient.Dial(serverAddrs)
+	if err != nil {
+		logger.Error("Could not dial server", "client", myId, "servers", serverAddrs, "err", err)
+		return nil, ConnectionError(err.Error())
+	}
+
+	g := &GeoSession{
+		fallback:    fallbackTopic,
+		spec:        spec,
+		serverAddrs: serverAddrs,
+		clientId:    myId,
+		token:       token,
+		serverRpc:   serverRpc,
+		sessions:    make(map[string]*WriteSession),
+		async:       DefaultAsyncConfig(),
+		writers:     make(map[string]*AsyncWriter)}
+
+	if err := g.refreshIndex(); err != nil {
+		serverRpc.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// Function writes datum to the topic whose region holds location. The key is
+// used as in WriteSession.Write. Returns an error if not currently connected,
+// if no topic holds location and there is no fallback, or if the write fails.
+func (g *GeoSession) Write(key string, location structs.GPSCoordinates, datum string) error {
+	session, err := g.SessionAt(location)
+	if err != nil {
+		return err
+	}
+	return session.Write(key, datum)
+}
+
+// Function queues datum to be written to the topic whose region holds
+// location, as AsyncWriter.Send does. The returned future fails at once if
+// no topic holds location and there is no fallback.
+func (g *GeoSession) Send(key string, location structs.GPSCoordinates, datum string, callback Callback) *Future {
+	writer, err := g.writerAt(location)
+	if err != nil {
+		future := &Future{done: make(chan struct{})}
+		complete(future, callback, 0, err)
+		return future
+	}
+	return writer.Send(key, datum, callback)
+}
+
+// Sets the AsyncConfig of topics that Send has not written to yet
+func (g *GeoSession) SetAsyncConfig(config AsyncConfig) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.async = config
+}
+
+// Blocks until every point queued with Send is written or has failed
+func (g *GeoSession) Flush() {
+	g.lock.Lock()
+	writers := make([]*AsyncWriter, 0, len(g.writers))
+	for _, writer := range g.writers {
+		writers = append(writers, writer)
+	}
+	g.lock.Unlock()
+
+	for _, writer := range writers {
+		writer.Flush()
+	}
+}
+
+// Returns the topic a point at location would be written to
+func (g *GeoSession) TopicAt(location structs.GPSCoordinates) (string, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.topicAt(location)
+}
+
+// Function closes every topic of the session. Returns the first error of
+// closing them, or an error if not currently connected.
+func (g *GeoSession) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.serverRpc == nil {
+		return DisconnectedError("")
+	}
+
+	// Points queued with Send are written before their sessions close
+	for topic, writer := range g.writers {
+		writer.Close()
+		delete(g.writers, topic)
+	}
+
+	var firstErr error
+	for topic, session := range g.sessions {
+		if err := session.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(g.sessions, topic)
+	}
+
+	if err := g.serverRpc.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	g.serverRpc = nil
+	return firstErr
+}
+
+// Returns the WriteSession of the topic whose region holds location, e.g. to
+// write a batch of points that are all at location with WriteBatch
+func (g *GeoSession) SessionAt(location structs.GPSCoordinates) (*WriteSession, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	topic, err := g.topicAt(location)
+	if err != nil {
+		return nil, err
+	}
+	return g.session(topic)
+}
+
+func (g *GeoSession) writerAt(location structs.GPSCoordinates) (*AsyncWriter, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	topic, err := g.topicAt(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if writer, ok := g.writers[topic]; ok {
+		return writer, nil
+	}
+
+	session, err := g.session(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := session.Async(g.async)
+	g.writers[topic] = writer
+	return writer, nil
+}
+
+// Lock is manually set from caller
+func (g *GeoSession) session(topic string) (*WriteSession, error) {
+	if session, ok := g.sessions[topic]; ok {
+		return session, nil
+	}
+
+	session, err := OpenTopic(topic, g.spec, g.serverAddrs, g.clientId, g.token)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Routing points to topic", "client", g.clientId, "topic", topic)
+	g.sessions[topic] = session
+	return session, nil
+}
+
+// Lock is manually set from caller
+func (g *GeoSession) topicAt(location structs.GPSCoordinates) (string, error) {
+	if g.serverRpc == nil {
+		return "", DisconnectedError("")
+	}
+
+	if time.Now().After(g.indexExpiry) {
+		// A stale index routes better than none. It is tried again after
+		// another GEO_INDEX_TTL rather than on every write
+		if err := g.refreshIndex(); err != nil {
+			logger.Warn("Could not refresh the geographic index", "client", g.clientId, "err", err)
+			g.indexExpiry = time.Now().Add(GEO_INDEX_TTL * time.Second)
+		}
+	}
+
+	if topic, ok := g.index.Lookup(location); ok {
+		return topic, nil
+	}
+
+	if g.fallback != "" {
+		return g.fallback, nil
+	}
+	return "", structs.NoTopicAtLocationError(location.String())
+}
+
+// Lock is manually set from caller, or g is not shared yet
+func (g *GeoSession) refreshIndex() error {
+	var index structs.GeoIndex
+	if err := g.serverRpc.Call("TServer.GetGeoIndex", "", &index); err != nil {
+		return err
+	}
+
+	g.index = index
+	g.indexExpiry = time.Now().Add(GEO_INDEX_TTL * time.Second)
+	return nil
+}
@@ -5,13 +5,29 @@ This file contains functions that should be used by producer clients.
 package producer
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"net"
-	"net/rpc"
+	"sync"
+	"time"
 
 	"../../structs"
+	"../logging"
+	"../serverclient"
+	"../tracing"
 )
 
+var logger = logging.New("producer")
+
+// Times a throttled write is sent again before Write gives up
+const THROTTLE_RETRIES = 5
+
+// Times a write that the leader could not replicate is sent again. Safe,
+// since the leader drops records it already has
+const REPLICATION_RETRIES = 3
+
+const REPLICATION_RETRY_WAIT = 500 * time.Millisecond
+
 type DisconnectedError string
 
 func (e DisconnectedError) Error() string {
@@ -25,77 +41,114 @@ func (e ConnectionError) Error() string {
 }
 
 // Object that should be used by a client for writing. This is returned by
-// OpenTopic.
+// OpenTopic. Every record is sent with the session's producer id and a
+// sequence number, so a retry after a lost reply, a failed replication or a
+// leader election is stored once. Only the session's own retries are
+// deduplicated: calling Write again after it returned an error sends the
+// datum as a new record, which may be stored twice.
 type WriteSession struct {
-	topicName  string
-	clientId   string
-	leaderConn *rpc.Client
+	topicName string
+	clientId  string
+	token     string                     // Client credentials, empty to use the TLS certificate
+	leaders   *serverclient.TopicLeaders // Follows leader changes
+
+	producerId string
+	seqLock    sync.Mutex
+	sequences  []uint64 // index = partition, last sequence sent
 }
 
 // Function will first try to get topic data. If the topic does not
-// exist, then it will try to create it. If create fails, it will again
-// try to get topic. If all of these fails, returns an error.
+// exist, then it will try to create it with the given spec. Unset fields of
+// the spec take the server's settings. If create fails, it will again try to
+// get topic. If all of these fails, returns an error.
 //
-// Parameter serverAddr should be an ip:port combination.
-func OpenTopic(topicName string, serverAddr string, myId string) (*WriteSession, error) {
-	fmt.Println("Attempting server dial")
-	conn, err := net.Dial("tcp", serverAddr)
+// Parameter serverAddrs should be the ip:port combination of every server
+// replica. Calls fail over to the other replicas if the primary is down.
+//
+// Parameter token is the client's credentials. It may be empty when the
+// client has a TLS certificate, or for topics open to everyone. A topic
+// created with credentials can only be used by its creator until they grant
+// others access. Errors for missing permissions satisfy
+// structs.IsUnauthorizedError.
+func OpenTopic(topicName string, spec structs.TopicSpec, serverAddrs []string, myId string, token string) (*WriteSession, error) {
+	log := logger.With("client", myId, "topic", topicName)
+	serverRpc, err := serverclient.Dial(serverAddrs)
 	if err != nil {
+		log.Error("Could not dial server", "servers", serverAddrs, "err", err)
 		return nil, ConnectionError(err.Error())
 	}
 
-	fmt.Println("Successfully dialed server")
-
-	serverRpc := rpc.NewClient(conn)
-	defer serverRpc.Close()
-
 	var topicData structs.Topic
+	getMsg := structs.GetTopicMsg{TopicName: topicName, Token: token}
 
 	// First attempt to get topic
-	fmt.Println("Attempting get topic")
-	err = serverRpc.Call("TServer.GetTopic", &topicName, &topicData)
+	err = serverRpc.Call("TServer.GetTopic", getMsg, &topicData)
 	if err == nil {
-		return connectToLeader(topicData, myId)
+		return connectToLeaders(serverRpc, topicData, myId, token)
+	}
+
+	// Retrying does not help without the right credentials
+	if structs.IsUnauthorizedError(err) {
+		serverRpc.Close()
+		return nil, err
 	}
 
 	// Attempt to create topic
-	fmt.Println("Could not get topic; attempting to create topic:", err)
-	err = serverRpc.Call("TServer.CreateTopic", &topicName, &topicData)
+	log.Info("Could not get topic, creating it", "err", err)
+	createMsg := structs.CreateTopicMsg{TopicName: topicName, Spec: spec, Token: token}
+	err = serverRpc.Call("TServer.CreateTopic", &createMsg, &topicData)
 	if err == nil {
-		return connectToLeader(topicData, myId)
+		return connectToLeaders(serverRpc, topicData, myId, token)
 	}
 
 	// Attempt to get topic again in case of race condition
-	fmt.Println("Could not create topic; attempting to get topic again:", err)
-	err = serverRpc.Call("TServer.GetTopic", &topicName, &topicData)
+	log.Info("Could not create topic, getting it again", "err", err)
+	err = serverRpc.Call("TServer.GetTopic", getMsg, &topicData)
 	if err == nil {
-		return connectToLeader(topicData, myId)
+		return connectToLeaders(serverRpc, topicData, myId, token)
 	}
 
-	fmt.Println("Final error, quitting:", err)
+	log.Error("Could not get or create topic", "err", err)
+	serverRpc.Close()
+	if structs.IsUnauthorizedError(err) {
+		return nil, err
+	}
 	return nil, fmt.Errorf("Could not get or create topic.\n")
 }
 
 // Function closes the topic. Returns an error if not currently connected or
 // if somehow close returns an error.
 func (s *WriteSession) Close() error {
-	if s.leaderConn == nil {
+	if s.leaders == nil {
 		return DisconnectedError("")
 	}
 
-	err := s.leaderConn.Close()
-	if err != nil {
-		return err
+	err := s.leaders.Close()
+	s.leaders = nil
+	return err
+}
+
+// Function writes to topic. The key (e.g. a vehicle id) is hashed to pick the
+// partition, so all writes with the same key are kept in order. If the
+// partition's leader changed, the write is sent to the new one. If the
+// leader throttles the client, Write waits as long as the leader asks and
+// sends the write again, up to THROTTLE_RETRIES times. Returns an error if
+// not currently connected, if there is a connection error, or if the client
+// is still throttled. A write that returned an error may still have been
+// stored, and writing the datum again stores it under a new sequence. With
+// tracing on, the write's spans on the leader and its followers are children
+// of the client's.
+func (s *WriteSession) Write(key string, datum string) error {
+	if s.leaders == nil {
+		return DisconnectedError("")
 	}
 
-	s.leaderConn = nil
-	return nil
+	return s.write(structs.PartitionForKey(key, s.leaders.NumPartitions()), datum, "")
 }
 
-// Function writes to topic. Returns an error if not currently connected, or if
-// there is a connection error.
-func (s *WriteSession) Write(datum string) error {
-	if s.leaderConn == nil {
+// Writes datum to partition, in the transaction txnId if it is set
+func (s *WriteSession) write(partition int, datum string, txnId string) (err error) {
+	if s.leaders == nil {
 		return DisconnectedError("")
 	}
 
@@ -103,32 +156,105 @@ func (s *WriteSession) Write(datum string) error {
 	var ignore string
 
 	req.Topic = s.topicName
+	req.Partition = partition
 	req.Id = s.clientId
 	req.Data = datum
+	req.Token = s.token
+	req.ProducerId = s.producerId
+	req.Sequence = s.nextSequences(req.Partition, 1)
+	req.TxnId = txnId
+
+	span := tracing.Start("producer.Write", structs.TraceContext{})
+	span.Set("client", s.clientId)
+	span.Set("topic", s.topicName)
+	span.Set("partition", req.Partition)
+	span.Set("sequence", req.Sequence)
+	if txnId != "" {
+		span.Set("txn", txnId)
+	}
+	defer func() { span.End(err) }()
+	req.Trace = span.Context()
 
-	return s.leaderConn.Call("Cluster.WriteToCluster", req, &ignore)
+	err = s.call(req.Partition, "Cluster.WriteToCluster", req, &ignore, span)
+	return err
 }
 
-// Attempt to connect to a topic leader for writing
-func connectToLeader(topicData structs.Topic, myId string) (*WriteSession, error) {
-	fmt.Println("Attempting to connect to leader")
-	// There should only be one leader in the current implementation, so
-	// only attempt the 0th index.
-	conn, err := net.Dial("tcp", topicData.Leaders[0])
+// Calls the leader of partition, waiting and sending the call again while
+// the leader throttles the client, up to THROTTLE_RETRIES times, or could
+// not replicate the write, up to REPLICATION_RETRIES times
+func (s *WriteSession) call(partition int, method string, args interface{}, reply interface{}, span *tracing.Span) error {
+	throttles, failures := 0, 0
+	for attempt := 1; ; attempt++ {
+		err := s.leaders.Call(partition, method, args, reply)
+
+		if retryAfter, throttled := structs.RetryAfterFromError(err); throttled && throttles < THROTTLE_RETRIES {
+			throttles++
+			logger.Debug("Write throttled", "client", s.clientId, "topic", s.topicName,
+				"partition", partition, "retry-after", retryAfter)
+			time.Sleep(retryAfter)
+			continue
+		}
+
+		if structs.IsNotReplicatedError(err) && failures < REPLICATION_RETRIES {
+			failures++
+			logger.Debug("Write not replicated, sending it again", "client", s.clientId, "topic", s.topicName,
+				"partition", partition, "err", err)
+			time.Sleep(REPLICATION_RETRY_WAIT)
+			continue
+		}
+
+		span.Set("attempts", attempt)
+		return err
+	}
+}
+
+// Reserves n sequence numbers of partition. Returns the first
+func (s *WriteSession) nextSequences(partition int, n int) uint64 {
+	s.seqLock.Lock()
+	defer s.seqLock.Unlock()
+
+	first := s.sequences[partition] + 1
+	s.sequences[partition] += uint64(n)
+	return first
+}
+
+// Returns the number of partitions of the topic
+func (s *WriteSession) NumPartitions() int {
+	return s.leaders.NumPartitions()
+}
+
+// Attempt to connect to the leader of every partition of a topic for writing.
+// The session keeps serverRpc to watch for leader changes
+func connectToLeaders(serverRpc *serverclient.Client, topicData structs.Topic, myId string, token string) (*WriteSession, error) {
+	log := logger.With("client", myId, "topic", topicData.TopicName)
+	leaders, err := serverclient.WatchLeaders(serverRpc, topicData, token)
 	if err != nil {
-		fmt.Printf("Could not connect to leader %s of topic %s\n",
-			topicData.TopicName, topicData.Leaders[0])
+		log.Error("Could not connect to the leaders", "err", err)
+		serverRpc.Close()
 		return nil, ConnectionError(err.Error())
 	}
 
-	leaderConn := rpc.NewClient(conn)
-	if leaderConn == nil {
-		return nil, ConnectionError("rpc.NewClient failed")
+	producerId, err := newProducerId()
+	if err != nil {
+		leaders.Close()
+		return nil, err
 	}
 
-	fmt.Println("Successfully connected to leader:", topicData.Leaders)
+	log.Info("Connected to the leaders", "partitions", topicData.Partitions, "producer", producerId)
 	return &WriteSession{
-		topicData.TopicName,
-		myId,
-		leaderConn}, nil
+		topicName:  topicData.TopicName,
+		clientId:   myId,
+		token:      token,
+		leaders:    leaders,
+		producerId: producerId,
+		sequences:  make([]uint64, leaders.NumPartitions())}, nil
+}
+
+// Producer ids are random, so that every session is its own producer
+func newProducerId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
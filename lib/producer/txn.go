@@ -0,0 +1,272 @@
+package producer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"../../structs"
+	"../serverclient"
+)
+
+// Object that should be used by a client for writing to several topics in
+// transactions. A committed transaction's records become visible to
+// consumers once every partition it wrote to has its commit marker, and an
+// aborted one's never do. The topics' sessions are kept across transactions.
+// This is returned by OpenTxnProducer.
+type TxnProducer struct {
+	spec        structs.TopicSpec
+	serverAddrs []string
+	clientId    string
+	token       string
+
+	lock      sync.Mutex
+	serverRpc *serverclient.Client
+	sessions  map[string]*WriteSession // topic ->
+	current   *Transaction
+}
+
+// One transaction of a TxnProducer. This is returned by TxnProducer.Begin.
+type Transaction struct {
+	producer *TxnProducer
+	id       string
+
+	lock       sync.Mutex
+	partitions map[structs.TopicPartition]bool // Added to the transaction on the server
+	failed     error                           // First failed write, which makes Commit abort
+	ended      bool
+}
+
+type TxnFailedError string
+
+func (e TxnFailedError) Error() string {
+	return fmt.Sprintf("Transaction aborted because a write failed: %s", string(e))
+}
+
+// Connects to the server. Topics are opened, and created with spec if needed,
+// the first time a transaction writes to them. The parameters are as for
+// OpenTopic.
+func OpenTxnProducer(spec structs.TopicSpec, serverAddrs []string, myId string, token string) (*TxnProducer, error) {
+	serverRpc, err := serverclient.Dial(serverAddrs)
+	if err != nil {
+		logger.Error("Could not dial server", "client", myId, "servers", serverAddrs, "err", err)
+		return nil, ConnectionError(err.Error())
+	}
+
+	return &TxnProducer{
+		spec:        spec,
+		serverAddrs: serverAddrs,
+		clientId:    myId,
+		token:       token,
+		serverRpc:   serverRpc,
+		sessions:    make(map[string]*WriteSession)}, nil
+}
+
+// Function begins a transaction. One transaction of a producer may be open at
+// a time. The server aborts it if it is not committed within timeout; 0 uses
+// the server's default. Returns an error if not currently connected, or if
+// another transaction is open.
+func (p *TxnProducer) Begin(timeout time.Duration) (*Transaction, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.serverRpc == nil {
+		return nil, DisconnectedError("")
+	}
+
+	if p.current != nil && !p.current.isEnded() {
+		return nil, fmt.Errorf("Transaction %s is still open", p.current.id)
+	}
+
+	var txn structs.Transaction
+	msg := structs.BeginTxnMsg{Timeout: uint32(timeout / time.Millisecond), Token: p.token}
+	if err := p.serverRpc.Call("TServer.BeginTransaction", msg, &txn); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("Began transaction", "client", p.clientId, "txn", txn.Id)
+	p.current = &Transaction{
+		producer:   p,
+		id:         txn.Id,
+		partitions: make(map[structs.TopicPartition]bool)}
+	return p.current, nil
+}
+
+// Function closes every topic of the producer. An open transaction is
+// aborted first. Returns the first error of closing them, or an error if not
+// currently connected.
+func (p *TxnProducer) Close() error {
+	p.lock.Lock()
+	current := p.current
+	p.lock.Unlock()
+
+	if current != nil && !current.isEnded() {
+		current.Abort()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.serverRpc == nil {
+		return DisconnectedError("")
+	}
+
+	var firstErr error
+	for topic, session := range p.sessions {
+		if err := session.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.sessions, topic)
+	}
+
+	if err := p.serverRpc.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	p.serverRpc = nil
+	return firstErr
+}
+
+func (p *TxnProducer) session(topic string) (*WriteSession, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.serverRpc == nil {
+		return nil, DisconnectedError("")
+	}
+
+	if session, ok := p.sessions[topic]; ok {
+		return session, nil
+	}
+
+	session, err := OpenTopic(topic, p.spec, p.serverAddrs, p.clientId, p.token)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sessions[topic] = session
+	return session, nil
+}
+
+func (t *Transaction) Id() string {
+	return t.id
+}
+
+// Function writes datum to topic in the transaction. The key picks the
+// partition as in WriteSession.Write. The record is stored when Write
+// returns but hidden from consumers until the transaction commits. Returns
+// an error if the transaction has ended or the write fails; after a failed
+// write the transaction can only abort.
+func (t *Transaction) Write(topic string, key string, datum string) error {
+	if t.isEnded() {
+		return structs.TxnNotOpenError(t.id)
+	}
+
+	session, err := t.producer.session(topic)
+	if err != nil {
+		return t.fail(err)
+	}
+
+	tp := structs.TopicPartition{Topic: topic, Partition: structs.PartitionForKey(key, session.NumPartitions())}
+	if err := t.addPartition(tp); err != nil {
+		return t.fail(err)
+	}
+
+	return t.fail(session.write(tp.Partition, datum, t.id))
+}
+
+// Function commits the transaction, which makes all of its records visible
+// at once. If a write of the transaction failed, it is aborted instead and
+// a TxnFailedError returned. Returns a TxnNotOpenError if the server
+// already aborted it, e.g. because its timeout passed.
+func (t *Transaction) Commit() error {
+	t.lock.Lock()
+	failed := t.failed
+	t.lock.Unlock()
+
+	if failed != nil {
+		if err := t.end(false); err != nil {
+			return err
+		}
+		return TxnFailedError(failed.Error())
+	}
+
+	return t.end(true)
+}
+
+// Function aborts the transaction. Its records are never shown to consumers.
+func (t *Transaction) Abort() error {
+	return t.end(false)
+}
+
+// Tells the server about tp before the first write to it, so that the
+// transaction's outcome is written there
+func (t *Transaction) addPartition(tp structs.TopicPartition) error {
+	t.lock.Lock()
+	added := t.partitions[tp]
+	t.lock.Unlock()
+	if added {
+		return nil
+	}
+
+	var txn structs.Transaction
+	msg := structs.AddTxnPartitionsMsg{
+		TxnId:      t.id,
+		Partitions: []structs.TopicPartition{tp},
+		Token:      t.producer.token}
+	if err := t.producer.serverRpc.Call("TServer.AddTxnPartitions", msg, &txn); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	t.partitions[tp] = true
+	t.lock.Unlock()
+	return nil
+}
+
+// Ending a transaction again the same way succeeds, so a call whose reply
+// was lost is simply retried by the server client
+func (t *Transaction) end(commit bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.ended {
+		return structs.TxnNotOpenError(t.id)
+	}
+
+	var txn structs.Transaction
+	msg := structs.EndTxnMsg{TxnId: t.id, Commit: commit, Token: t.producer.token}
+	err := t.producer.serverRpc.Call("TServer.EndTransaction", msg, &txn)
+
+	// A transaction the server no longer has open is over either way
+	if err == nil || structs.IsTxnNotOpenError(err) {
+		t.ended = true
+	}
+
+	if err != nil {
+		logger.Warn("Could not end transaction", "client", t.producer.clientId, "txn", t.id, "commit", commit, "err", err)
+		return err
+	}
+
+	logger.Debug("Ended transaction", "client", t.producer.clientId, "txn", t.id, "state", txn.State)
+	return nil
+}
+
+// Records the first failed write. Returns err
+func (t *Transaction) fail(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.failed == nil {
+		t.failed = err
+	}
+	return err
+}
+
+func (t *Transaction) isEnded() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.ended
+}
@@ -0,0 +1,292 @@
+package serverclient
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../../structs"
+	"../mtls"
+)
+
+// Time a call to a partition whose leader is gone waits for the server to
+// report a new one. Elections take a few heartbeats
+const LEADER_WAIT = 30 * time.Second
+
+// Time to connect to a leader. Partitions are dialed with the leaders locked
+const DIAL_TIMEOUT = 5 * time.Second
+
+type NoLeaderError string
+
+func (e NoLeaderError) Error() string {
+	return fmt.Sprintf("No leader for partition %s", string(e))
+}
+
+type LeadersClosedError string
+
+func (e LeadersClosedError) Error() string {
+	return fmt.Sprintf("Connections to the leaders of [%s] are closed", string(e))
+}
+
+// Connections to the leader of every partition of a topic. The server is
+// watched for leader changes, and a partition whose leader changed is
+// reconnected to the new one.
+type TopicLeaders struct {
+	sync.RWMutex
+	server  *Client
+	topic   structs.Topic
+	token   string        // Client credentials for WatchTopic
+	conns   []*rpc.Client // index = partition Id. nil when the leader could not be dialed
+	changed chan bool     // Closed when the leaders are updated
+	closed  bool
+}
+
+// Connects to the leader of every partition of topic, then watches the topic
+// in the background with the client's token. The leaders own server from
+// here on and close it in Close.
+func WatchLeaders(server *Client, topic structs.Topic, token string) (*TopicLeaders, error) {
+	if len(topic.Partitions) == 0 {
+		return nil, NoLeaderError(topic.TopicName + "/0")
+	}
+
+	conns := make([]*rpc.Client, len(topic.Partitions))
+	for _, partition := range topic.Partitions {
+		// There should only be one leader per partition in the current
+		// implementation, so only attempt the 0th index.
+		conn, err := dialLeader(partition)
+		if err != nil {
+			for _, c := range conns {
+				if c != nil {
+					c.Close()
+				}
+			}
+			return nil, err
+		}
+
+		conns[partition.Id] = conn
+	}
+
+	// The partitions are updated in place on leader changes
+	partitions := make([]structs.Partition, len(topic.Partitions))
+	copy(partitions, topic.Partitions)
+	topic.Partitions = partitions
+
+	t := &TopicLeaders{
+		server:  server,
+		topic:   topic,
+		token:   token,
+		conns:   conns,
+		changed: make(chan bool)}
+
+	go t.watch()
+	return t, nil
+}
+
+// Returns the number of partitions of the topic
+func (t *TopicLeaders) NumPartitions() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.conns)
+}
+
+// Call the named function on the leader of partition. A broken connection
+// is redialed right away, since the leader may still be up. If the leader is
+// gone or has stepped down, waits up to LEADER_WAIT for the server to name a
+// new one and tries once more. A write that reached the old leader before it
+// died is sent again, which the new leader drops if the write has a producer
+// id and sequence.
+func (t *TopicLeaders) Call(partition int, serviceMethod string, args interface{}, reply interface{}) error {
+	conn, changed, err := t.connect(partition)
+	if err != nil {
+		return err
+	}
+
+	if conn != nil {
+		err = conn.Call(serviceMethod, args, reply)
+		if served(err) {
+			return err
+		}
+
+		if _, ok := err.(rpc.ServerError); !ok {
+			t.drop(partition, conn)
+
+			conn, changed, err = t.connect(partition)
+			if err != nil {
+				return err
+			}
+
+			if conn != nil {
+				err = conn.Call(serviceMethod, args, reply)
+				if served(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(LEADER_WAIT):
+		return NoLeaderError(fmt.Sprintf("%s/%d", t.topic.TopicName, partition))
+	}
+
+	conn, _, err = t.connect(partition)
+	if err != nil {
+		return err
+	}
+
+	if conn == nil {
+		return NoLeaderError(fmt.Sprintf("%s/%d", t.topic.TopicName, partition))
+	}
+
+	return conn.Call(serviceMethod, args, reply)
+}
+
+// Returns true if the call reached the leader. Errors from the leader's
+// handlers are passed back, unless the node is no longer the leader
+func served(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return err == nil || (ok && !structs.IsNotLeaderError(err))
+}
+
+// Closes the leader connections and the server connection, which stops the
+// watch
+func (t *TopicLeaders) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return LeadersClosedError(t.topic.TopicName)
+	}
+
+	t.closed = true
+	var closeErr error
+	for _, conn := range t.conns {
+		if conn == nil {
+			continue
+		}
+
+		if err := conn.Close(); err != nil {
+			closeErr = err
+		}
+	}
+
+	t.server.Close()
+	return closeErr
+}
+
+// Returns the connection to the leader of partition and a channel that is
+// closed on the next update. A partition without a connection is redialed to
+// its last known leader; the connection is nil if that fails
+func (t *TopicLeaders) connect(partition int) (*rpc.Client, chan bool, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return nil, nil, LeadersClosedError(t.topic.TopicName)
+	}
+
+	if partition < 0 || partition >= len(t.conns) {
+		return nil, nil, NoLeaderError(fmt.Sprintf("%s/%d", t.topic.TopicName, partition))
+	}
+
+	if t.conns[partition] == nil {
+		if conn, err := dialLeader(t.topic.Partitions[partition]); err == nil {
+			t.conns[partition] = conn
+		}
+	}
+
+	return t.conns[partition], t.changed, nil
+}
+
+// Closes conn after a call on it failed with rpc.ErrShutdown or an I/O
+// error, so that the partition is redialed. Does nothing if conn was already
+// replaced
+func (t *TopicLeaders) drop(partition int, conn *rpc.Client) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed || t.conns[partition] != conn {
+		return
+	}
+
+	conn.Close()
+	t.conns[partition] = nil
+}
+
+// Long-polls the server for leader changes until the leaders are closed
+func (t *TopicLeaders) watch() {
+	for {
+		t.RLock()
+		closed, msg := t.closed, structs.WatchTopicMsg{TopicName: t.topic.TopicName, KnownEpoch: t.topic.Epoch, Token: t.token}
+		t.RUnlock()
+
+		if closed {
+			return
+		}
+
+		var topic structs.Topic
+		if err := t.server.Call("TServer.WatchTopic", msg, &topic); err != nil {
+			time.Sleep(RETRY_WAIT)
+			continue
+		}
+
+		if topic.Epoch > msg.KnownEpoch && !t.update(topic) {
+			time.Sleep(RETRY_WAIT)
+		}
+	}
+}
+
+// Reconnects every partition whose leader changed. Returns false if a new
+// leader could not be dialed; the old epoch is kept so that the next watch
+// returns right away and the dial is retried
+func (t *TopicLeaders) update(topic structs.Topic) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return true
+	}
+
+	dialed := true
+	for _, partition := range topic.Partitions {
+		if partition.Id >= len(t.conns) {
+			continue
+		}
+
+		old := t.topic.Partitions[partition.Id]
+		if t.conns[partition.Id] != nil && old.Leaders[0] == partition.Leaders[0] {
+			continue
+		}
+
+		conn, err := dialLeader(partition)
+		if err != nil {
+			dialed = false
+			continue
+		}
+
+		if t.conns[partition.Id] != nil {
+			t.conns[partition.Id].Close()
+		}
+		t.conns[partition.Id] = conn
+		t.topic.Partitions[partition.Id] = partition
+	}
+
+	if dialed {
+		t.topic.Epoch = topic.Epoch
+	}
+
+	close(t.changed)
+	t.changed = make(chan bool)
+	return dialed
+}
+
+func dialLeader(partition structs.Partition) (*rpc.Client, error) {
+	conn, err := mtls.DialTimeout(partition.Leaders[0], DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
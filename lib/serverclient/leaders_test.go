@@ -0,0 +1,171 @@
+package serverclient
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"../../structs"
+)
+
+// Stands in for the leader of a partition
+type fakeLeader struct {
+	addr string
+
+	sync.Mutex
+	notLeader bool
+	conns     []net.Conn
+}
+
+// Replies with the leader's address, so tests can tell which leader served a call
+func (l *fakeLeader) Whoami(arg string, reply *string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.notLeader {
+		return structs.NotLeaderError(arg)
+	}
+	*reply = l.addr
+	return nil
+}
+
+// Closes every connection to the leader, as a restart would
+func (l *fakeLeader) disconnect() {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func (l *fakeLeader) accepted() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.conns)
+}
+
+func serveLeader(t *testing.T) *fakeLeader {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	l := &fakeLeader{addr: listener.Addr().String()}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Fake", l); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			l.Lock()
+			l.conns = append(l.conns, conn)
+			l.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	return l
+}
+
+// Connects to the leader of every partition without watching the server,
+// so that tests drive the updates
+func connectLeaders(t *testing.T, leaders ...*fakeLeader) *TopicLeaders {
+	topic := structs.Topic{TopicName: "t", Epoch: 1}
+	conns := make([]*rpc.Client, len(leaders))
+	for i, l := range leaders {
+		partition := structs.Partition{Id: i, Leaders: []string{l.addr, l.addr}}
+		conn, err := dialLeader(partition)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		topic.Partitions = append(topic.Partitions, partition)
+		conns[i] = conn
+	}
+
+	return &TopicLeaders{topic: topic, conns: conns, changed: make(chan bool)}
+}
+
+func whoami(t *testing.T, leaders *TopicLeaders, partition int) string {
+	var addr string
+	if err := leaders.Call(partition, "Fake.Whoami", "t", &addr); err != nil {
+		t.Fatalf("Call(%d): %s", partition, err)
+	}
+	return addr
+}
+
+func TestCallRoutesToPartitionLeader(t *testing.T) {
+	first, second := serveLeader(t), serveLeader(t)
+	leaders := connectLeaders(t, first, second)
+
+	if got := whoami(t, leaders, 0); got != first.addr {
+		t.Errorf("partition 0 was served by %s, want %s", got, first.addr)
+	}
+	if got := whoami(t, leaders, 1); got != second.addr {
+		t.Errorf("partition 1 was served by %s, want %s", got, second.addr)
+	}
+
+	var addr string
+	if err := leaders.Call(2, "Fake.Whoami", "t", &addr); err == nil {
+		t.Errorf("Call to a partition the topic does not have succeeded")
+	} else if _, ok := err.(NoLeaderError); !ok {
+		t.Errorf("Call(2) = %v, want a NoLeaderError", err)
+	}
+}
+
+func TestCallRedialsBrokenConnection(t *testing.T) {
+	l := serveLeader(t)
+	leaders := connectLeaders(t, l)
+	whoami(t, leaders, 0)
+
+	// The leader is unchanged, so the server reports nothing and the call
+	// must not wait for it
+	l.disconnect()
+	start := time.Now()
+	if got := whoami(t, leaders, 0); got != l.addr {
+		t.Errorf("call was served by %s, want %s", got, l.addr)
+	}
+	if elapsed := time.Since(start); elapsed >= LEADER_WAIT {
+		t.Errorf("call waited %s for a leader change", elapsed)
+	}
+	if l.accepted() != 1 {
+		t.Errorf("leader accepted %d connections after the break, want 1", l.accepted())
+	}
+}
+
+func TestCallFollowsNewLeader(t *testing.T) {
+	old, next := serveLeader(t), serveLeader(t)
+	leaders := connectLeaders(t, old)
+
+	old.Lock()
+	old.notLeader = true
+	old.Unlock()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		topic := structs.Topic{
+			TopicName:  "t",
+			Epoch:      2,
+			Partitions: []structs.Partition{{Id: 0, Leaders: []string{next.addr, next.addr}}}}
+		if !leaders.update(topic) {
+			t.Errorf("update could not dial the new leader")
+		}
+	}()
+
+	if got := whoami(t, leaders, 0); got != next.addr {
+		t.Errorf("call was served by %s, want the new leader %s", got, next.addr)
+	}
+	if leaders.topic.Epoch != 2 {
+		t.Errorf("epoch = %d, want 2", leaders.topic.Epoch)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Package serverclient is used by nodes, producers and consumers to talk to the
+replicated coordination server. Calls are sent to the current primary, and
+fail over to the other replicas when the primary dies or steps down.
+*/
+
+package serverclient
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../../structs"
+	"../mtls"
+)
+
+// Time to wait before retrying all replicas again, e.g. while they are
+// electing a new primary
+const RETRY_WAIT = 2 * time.Second
+
+// Number of rounds over every replica before a call gives up
+const MAX_ROUNDS = 3
+
+type NoServerError string
+
+func (e NoServerError) Error() string {
+	return fmt.Sprintf("Could not reach a primary server in %s", string(e))
+}
+
+type ClientClosedError string
+
+func (e ClientClosedError) Error() string {
+	return fmt.Sprintf("Server client for %s is closed", string(e))
+}
+
+type Client struct {
+	sync.Mutex
+	addrs   []string
+	current int         // index into addrs of the replica we are connected to
+	client  *rpc.Client // nil when not connected
+	closed  bool        // Set by Close. Calls fail instead of dialing again
+}
+
+// Connects to the first reachable replica in addrs. Calls made through the
+// returned client find the primary on their own.
+func Dial(addrs []string) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, NoServerError("[]")
+	}
+
+	c := &Client{addrs: addrs}
+	for i := range addrs {
+		c.current = i
+		if err := c.connect(); err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, NoServerError(fmt.Sprintf("%v", addrs))
+}
+
+// Call the named function on the primary server. Connection errors and
+// replicas that are not the primary cause the call to be retried on the
+// other replicas. Errors returned by the primary itself are passed back.
+func (c *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	for attempt := 0; attempt < MAX_ROUNDS*len(c.addrs); attempt++ {
+		if attempt > 0 && attempt%len(c.addrs) == 0 {
+			time.Sleep(RETRY_WAIT)
+		}
+
+		client, err := c.getClient()
+		if _, ok := err.(ClientClosedError); ok {
+			return err
+		} else if err != nil {
+			continue
+		}
+
+		err = client.Call(serviceMethod, args, reply)
+		if err == nil {
+			return nil
+		}
+
+		if primary, ok := structs.PrimaryFromError(err); ok {
+			c.failover(client, primary)
+			continue
+		}
+
+		// Errors from the server's handlers are ServerErrors; anything else
+		// is a broken connection
+		if _, ok := err.(rpc.ServerError); ok {
+			return err
+		}
+
+		c.failover(client, "")
+	}
+
+	return NoServerError(fmt.Sprintf("%v", c.addrs))
+}
+
+func (c *Client) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closed = true
+	if c.client == nil {
+		return nil
+	}
+
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// Returns the connection to the current replica, dialing it if needed. On a
+// failed dial, moves on to the next replica
+func (c *Client) getClient() (*rpc.Client, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return nil, ClientClosedError(fmt.Sprintf("%v", c.addrs))
+	}
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	if err := c.connect(); err != nil {
+		c.current = (c.current + 1) % len(c.addrs)
+		return nil, err
+	}
+
+	return c.client, nil
+}
+
+// Drops the connection that failed and switches to the primary hint if it is
+// one of our replicas, otherwise to the next replica. Lock is taken here
+func (c *Client) failover(failed *rpc.Client, primary string) {
+	c.Lock()
+	defer c.Unlock()
+
+	// Another call already failed over
+	if c.client != failed {
+		return
+	}
+
+	c.client.Close()
+	c.client = nil
+
+	for i, addr := range c.addrs {
+		if primary != "" && addr == primary {
+			c.current = i
+			return
+		}
+	}
+
+	c.current = (c.current + 1) % len(c.addrs)
+}
+
+// Lock is manually set from caller
+func (c *Client) connect() error {
+	conn, err := mtls.Dial(c.addrs[c.current])
+	if err != nil {
+		return err
+	}
+
+	c.client = rpc.NewClient(conn)
+	return nil
+}
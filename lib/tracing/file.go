@@ -0,0 +1,38 @@
+package tracing
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Appends spans to a file, one JSON object per line, so the files of every
+// process of a cluster can be concatenated and grouped by trace-id
+type JSONFileExporter struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Opens path for appending, creating it if needed
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONFileExporter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Spans that fail to encode or write are dropped, tracing must never fail a write
+func (e *JSONFileExporter) Export(span SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.enc.Encode(span)
+}
+
+func (e *JSONFileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.file.Close()
+}
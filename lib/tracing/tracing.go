@@ -0,0 +1,185 @@
+/*
+Package tracing records spans of the write path, from the producer's call
+through the leader and its followers down to their disk writes, so that a
+slow or failed write shows which step held it up.
+
+A span's TraceContext is sent along with the RPC that continues the trace,
+e.g. in structs.WriteMsg, and the receiver starts its spans as children of
+it. Finished spans are handed to the process's Exporter. Without one, no
+spans are recorded and no context is sent, so tracing costs nothing when it
+is off. A process that exports spans traces every write it sees, even from
+clients that do not.
+
+KTS_TRACE_FILE sets up a JSONFileExporter with ConfigureFromEnv.
+*/
+
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"../../structs"
+)
+
+// Environment variable read by ConfigureFromEnv
+const ENV_TRACE_FILE = "KTS_TRACE_FILE"
+
+// A finished span as given to an Exporter
+type SpanData struct {
+	TraceId    string                 `json:"trace-id"`
+	SpanId     string                 `json:"span-id"`
+	ParentId   string                 `json:"parent-id,omitempty"`
+	Name       string                 `json:"name"`
+	Process    string                 `json:"process"` // e.g. node 10.0.0.5:4001
+	Start      time.Time              `json:"start"`
+	Duration   time.Duration          `json:"duration-ns"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Receives finished spans. Export is called from the goroutine that ended
+// the span, so it should not block for long
+type Exporter interface {
+	Export(span SpanData)
+	Close() error
+}
+
+var (
+	lock     sync.RWMutex
+	exporter Exporter
+	process  string
+)
+
+// Sets the exporter of this process. nil turns tracing off
+func SetExporter(e Exporter) {
+	lock.Lock()
+	defer lock.Unlock()
+	exporter = e
+}
+
+// Names this process in its spans
+func SetProcess(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	process = name
+}
+
+// Exports spans to the file named by KTS_TRACE_FILE. Unset leaves tracing off
+func ConfigureFromEnv() error {
+	path := os.Getenv(ENV_TRACE_FILE)
+	if path == "" {
+		return nil
+	}
+
+	e, err := NewJSONFileExporter(path)
+	if err != nil {
+		return err
+	}
+
+	SetExporter(e)
+	return nil
+}
+
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return exporter != nil
+}
+
+// One timed step of a trace. The zero Span, returned while tracing is off,
+// records nothing
+type Span struct {
+	data     SpanData
+	lock     sync.Mutex
+	recorded bool
+}
+
+// Starts a span as a child of parent, or as the root of a new trace if
+// parent is empty
+func Start(name string, parent structs.TraceContext) *Span {
+	lock.RLock()
+	on, proc := exporter != nil, process
+	lock.RUnlock()
+
+	if !on {
+		return &Span{}
+	}
+
+	traceId := parent.TraceId
+	if traceId == "" {
+		traceId = newId(16)
+	}
+
+	return &Span{
+		recorded: true,
+		data: SpanData{
+			TraceId:  traceId,
+			SpanId:   newId(8),
+			ParentId: parent.SpanId,
+			Name:     name,
+			Process:  proc,
+			Start:    time.Now()}}
+}
+
+// Returns the context to send to the next process, or to start child spans
+// with. Empty when the span is not recorded
+func (s *Span) Context() structs.TraceContext {
+	return structs.TraceContext{TraceId: s.data.TraceId, SpanId: s.data.SpanId}
+}
+
+// Sets an attribute, e.g. the topic or the version of a write
+func (s *Span) Set(key string, value interface{}) {
+	if !s.recorded {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// Ends the span and exports it. err, if any, is recorded as its error. Only
+// the first call has an effect
+func (s *Span) End(err error) {
+	if !s.recorded {
+		return
+	}
+
+	s.lock.Lock()
+	if s.data.Duration != 0 || s.data.Start.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+
+	s.data.Duration = time.Since(s.data.Start)
+	if s.data.Duration == 0 {
+		s.data.Duration = 1
+	}
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	s.lock.Unlock()
+
+	lock.RLock()
+	e := exporter
+	lock.RUnlock()
+
+	if e != nil {
+		e.Export(data)
+	}
+}
+
+func newId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
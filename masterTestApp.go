@@ -18,8 +18,12 @@ import (
 	"sync"
 	"time"
 
+	"./lib/logging"
+	"./lib/mtls"
 	"./lib/producer"
+	"./lib/tracing"
 	"./movement"
+	"./structs"
 )
 
 var collectedPoints []movement.Point
@@ -28,7 +32,26 @@ var collectedPointsLock sync.Mutex
 func main() {
 	fmt.Println("This program connects to the data service as well as to an internal port for")
 	fmt.Println("sending data to a webserver.")
-	fmt.Println("Usage: go run <file> <serv-ip>:<serv-port> <internal-ip:internal-port>")
+	fmt.Println("Usage: go run <file> <serv-ip>:<serv-port>[,<serv-ip>:<serv-port>...] <internal-ip:internal-port>")
+	fmt.Println("TLS is set up from KTS_TLS_CA, KTS_TLS_CERT and KTS_TLS_KEY")
+	fmt.Println("A client token is read from KTS_TOKEN")
+	fmt.Println("Spans of each write are appended to KTS_TRACE_FILE, if set")
+
+	if err := mtls.SetupFromEnv(); err != nil {
+		fmt.Println("Could not set up TLS:", err)
+		return
+	}
+
+	if err := logging.ConfigureFromEnv(); err != nil {
+		fmt.Println("Could not set up logging:", err)
+		return
+	}
+
+	if err := tracing.ConfigureFromEnv(); err != nil {
+		fmt.Println("Could not set up tracing:", err)
+		return
+	}
+	tracing.SetProcess("masterTestApp")
 	var files []string
 
 	root := "./testGraphs"
@@ -55,7 +78,12 @@ func main() {
 		fmt.Println("Could not connect to internal:", err)
 	}
 
+	serverAddrs := strings.Split(os.Args[1], ",")
+
 	topicName := "ubc"
+	// Each partition needs its own cluster of nodes. The rest of the settings
+	// are taken from the server's config
+	topicSpec := structs.TopicSpec{NumPartitions: 2}
 	for producerNodeId, files := range appMap {
 		for _, file := range files {
 			fmt.Println("Starting client node with graph file", file)
@@ -68,21 +96,17 @@ func main() {
 
 			myId := producerNodeId
 
-			// IDs 0,1,2 write to left side of WestMall
-			// IDs 3,4 write to right side of WestMall
-
-			// TODO UNCOMMENT IF WANT MULTIPLE TOPICS FOR DEMO
-			// if i, _ := strconv.ParseInt(filepath.Base(file), 10, 64); i < int64(2) {
-			// 	topicName = "westmall_left"
-			// } else {
-			// 	topicName = "westmall_right"
-			// }
-
-			wSess, err := producer.OpenTopic(topicName, os.Args[1], fmt.Sprintf("Writer %d", myId))
+			// Points inside a geo-routed topic's region are written to it, e.g.
+			// westmall_left and westmall_right set up with ktsctl region. The
+			// rest are written to topicName
+			geoSess, err := producer.OpenGeoSession(topicName, topicSpec, serverAddrs, fmt.Sprintf("Writer %s", myId), os.Getenv("KTS_TOKEN"))
 			if err != nil {
 				continue
 			}
 
+			// Each graph file is one vehicle, so its points stay in order on one partition
+			vehicleId := file
+
 			fn := func(p movement.Point) {
 				parseF := func(float1 float64) string {
 					return strconv.FormatFloat(float1, 'f', -1, 64)
@@ -94,7 +118,9 @@ func main() {
 				datum := fmt.Sprintf("%s %s\n", parseF(p.X), parseF(p.Y))
 
 				internalConn.Write([]byte(datum))
-				wSess.Write(datum)
+
+				// Sent in the background so a slow write does not hold up the next tick
+				geoSess.Send(vehicleId, structs.GPSCoordinates{X: p.X, Y: p.Y}, datum, nil)
 			}
 
 			// Hardcoding speed for demo
@@ -115,10 +141,10 @@ func main() {
 	// New Write session for terminal inputs
 	// Listening on any terminal inputs so we can add writes on demand for the demo
 
-	var wSess *producer.WriteSession
+	var geoSess *producer.GeoSession
 
 	for {
-		wSess, err = producer.OpenTopic(topicName, os.Args[1], fmt.Sprintf("Writer %d", 10))
+		geoSess, err = producer.OpenGeoSession(topicName, topicSpec, serverAddrs, fmt.Sprintf("Writer %d", 10), os.Getenv("KTS_TOKEN"))
 		if err != nil {
 			fmt.Println("Couldn't Open Write Session")
 			time.Sleep(10 * time.Second)
@@ -137,17 +163,26 @@ func main() {
 		text, _ := reader.ReadString('\n')
 		tokens := strings.Split(text, ",")
 
-		if len(tokens) == 2 {
+		location, err := structs.ParseGPSCoordinates(strings.TrimSpace(text))
+		if len(tokens) == 2 && err == nil {
 			x, y := tokens[0], tokens[1]
 
 			datum := fmt.Sprintf("%s %s\n", x, y)
 
-			// Write it 15 times because we can't see anything on the map otherwise
-			for i := 0; i < 10; i++ {
-				err := wSess.Write(datum)
-				if err != nil {
-					fmt.Println("ERROR IN WRITE.")
-				}
+			// Write it 10 times because we can't see anything on the map otherwise
+			records := make([]producer.Record, 10)
+			for i := range records {
+				records[i] = producer.Record{Key: "terminal", Data: datum}
+			}
+
+			session, err := geoSess.SessionAt(location)
+			if err == nil {
+				err = session.WriteBatch(records)
+			}
+			if err != nil {
+				fmt.Println("ERROR IN WRITE.")
+			}
+			for range records {
 				internalConn.Write([]byte(datum))
 			}
 		} else {
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"../../lib/mtls"
+	"../../lib/serverclient"
+	"../../structs"
+)
+
+// Seconds a client's permission is trusted before the server is asked again.
+// Bounds how long a revoked client can keep writing
+const AUTH_CACHE_TTL = 10
+
+// Seconds the last known permissions are used without asking again after the
+// server could not be reached
+const AUTH_RETRY_SECONDS = 2
+
+// Expired grants are swept once the cache holds this many
+const AUTH_CACHE_SWEEP = 1024
+
+type authKey struct {
+	Topic      string
+	Permission structs.Permission
+	Token      string
+	CertName   string
+	CertRole   string
+}
+
+var (
+	authCacheLock sync.Mutex
+	authCache     = make(map[authKey]time.Time) // -> expiry of the grant
+	openTopics    = make(map[string]time.Time)  // topic -> expiry of the server's word that it is open
+)
+
+// Checks with the server that the client may use perm on topic. Grants are
+// cached for AUTH_CACHE_TTL seconds, and so is the server's word that a topic
+// is open to callers without a token. Denials are not cached, so that a client
+// that was just granted access does not wait. While the server cannot be
+// reached the last known grants are kept, like quotas
+func Authorize(topic string, perm structs.Permission, token string, caller mtls.Identity) error {
+	key := authKey{
+		Topic:      topic,
+		Permission: perm,
+		Token:      token,
+		CertName:   caller.Name,
+		CertRole:   caller.Role}
+
+	authCacheLock.Lock()
+	expiry, granted := authCache[key]
+	openExpiry, open := openTopics[topic]
+	authCacheLock.Unlock()
+
+	open = open && token == ""
+	now := time.Now()
+	if (granted && now.Before(expiry)) || (open && now.Before(openExpiry)) {
+		return nil
+	}
+
+	msg := structs.AuthorizeMsg{
+		Topic:      topic,
+		Permission: perm,
+		Token:      token,
+		CertName:   caller.Name,
+		CertRole:   caller.Role}
+
+	var reply structs.AuthorizeReply
+	err := ServerClient.Call("TServer.Authorize", msg, &reply)
+	if _, unreachable := err.(serverclient.NoServerError); unreachable && (granted || open) {
+		checkError(err, "Authorize")
+
+		// Not every request waits for the server while it is down
+		cacheGrant(key, open, AUTH_RETRY_SECONDS*time.Second)
+		return nil
+	}
+
+	if err != nil {
+		if structs.IsUnauthorizedError(err) {
+			forgetGrant(key)
+		} else {
+			checkError(err, "Authorize")
+		}
+		return err
+	}
+
+	cacheGrant(key, reply.Open, AUTH_CACHE_TTL*time.Second)
+	return nil
+}
+
+// Trusts the grant for key, and the topic being open if it is, for ttl
+func cacheGrant(key authKey, open bool, ttl time.Duration) {
+	authCacheLock.Lock()
+	defer authCacheLock.Unlock()
+
+	now := time.Now()
+	if len(authCache) >= AUTH_CACHE_SWEEP {
+		for k, expiry := range authCache {
+			if now.After(expiry) {
+				delete(authCache, k)
+			}
+		}
+	}
+
+	authCache[key] = now.Add(ttl)
+	if open {
+		openTopics[key.Topic] = now.Add(ttl)
+	} else if key.Token == "" {
+		delete(openTopics, key.Topic)
+	}
+}
+
+// Drops the grant for key after the server refused it, so that it is not
+// served while the server is down. A refused caller without a token also
+// means the topic is no longer open
+func forgetGrant(key authKey) {
+	authCacheLock.Lock()
+	defer authCacheLock.Unlock()
+
+	delete(authCache, key)
+	if key.Token == "" {
+		delete(openTopics, key.Topic)
+	}
+}
@@ -0,0 +1,194 @@
+package node
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"../../lib/mtls"
+	"../../lib/serverclient"
+	"../../structs"
+)
+
+// Answers Authorize like the server would for a topic whose ACL lists allowed
+type fakeAuthServer struct {
+	sync.Mutex
+	open    bool
+	allowed map[string]bool // Token or certificate name ->
+	calls   int
+}
+
+func (s *fakeAuthServer) Authorize(msg structs.AuthorizeMsg, reply *structs.AuthorizeReply) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.calls++
+	if !s.open && !s.allowed[msg.Token] && !s.allowed[msg.CertName] {
+		return structs.UnauthorizedError("not on the ACL")
+	}
+
+	*reply = structs.AuthorizeReply{Open: s.open}
+	return nil
+}
+
+func (s *fakeAuthServer) numCalls() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls
+}
+
+// Serves s as the server and connects ServerClient to it. Returns a function
+// that takes the server down
+func serveAuth(t *testing.T, s *fakeAuthServer) func() {
+	server := rpc.NewServer()
+	if err := server.RegisterName("TServer", s); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var connsLock sync.Mutex
+	conns := make([]net.Conn, 0)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			connsLock.Lock()
+			conns = append(conns, conn)
+			connsLock.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+
+	stop := func() {
+		listener.Close()
+		connsLock.Lock()
+		defer connsLock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	t.Cleanup(stop)
+
+	client, err := serverclient.Dial([]string{listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ServerClient = client
+	t.Cleanup(func() { client.Close() })
+
+	authCacheLock.Lock()
+	defer authCacheLock.Unlock()
+	authCache = make(map[authKey]time.Time)
+	openTopics = make(map[string]time.Time)
+	return stop
+}
+
+func TestAuthorizeCachesGrants(t *testing.T) {
+	s := &fakeAuthServer{allowed: map[string]bool{"fleet-token": true}}
+	serveAuth(t, s)
+
+	for i := 0; i < 3; i++ {
+		if err := Authorize("t", structs.PermProduce, "fleet-token", mtls.Identity{}); err != nil {
+			t.Fatalf("Authorize: %s", err)
+		}
+	}
+	if s.numCalls() != 1 {
+		t.Errorf("server was asked %d times for a cached grant, want 1", s.numCalls())
+	}
+
+	// Denials are asked again every time
+	for i := 0; i < 2; i++ {
+		err := Authorize("t", structs.PermProduce, "", mtls.Identity{Name: "stranger", Role: mtls.RoleClient})
+		if !structs.IsUnauthorizedError(err) {
+			t.Fatalf("Authorize of a caller off the ACL = %v, want an UnauthorizedError", err)
+		}
+	}
+	if s.numCalls() != 3 {
+		t.Errorf("server was asked %d times, want 3", s.numCalls())
+	}
+}
+
+func TestAuthorizeOpenTopic(t *testing.T) {
+	s := &fakeAuthServer{open: true}
+	serveAuth(t, s)
+
+	callers := []mtls.Identity{{}, {Name: "a", Role: mtls.RoleClient}, {Name: "b", Role: mtls.RoleClient}}
+	for _, caller := range callers {
+		if err := Authorize("t", structs.PermConsume, "", caller); err != nil {
+			t.Fatalf("Authorize(%+v): %s", caller, err)
+		}
+	}
+	if s.numCalls() != 1 {
+		t.Errorf("server was asked %d times about an open topic, want 1", s.numCalls())
+	}
+
+	// A token still has to be checked
+	if err := Authorize("t", structs.PermConsume, "some-token", mtls.Identity{}); err != nil {
+		t.Fatalf("Authorize with a token: %s", err)
+	}
+	if s.numCalls() != 2 {
+		t.Errorf("server was asked %d times, want 2 after a caller with a token", s.numCalls())
+	}
+
+	// The topic gets an ACL and the server's word expires
+	s.Lock()
+	s.open = false
+	s.Unlock()
+
+	authCacheLock.Lock()
+	openTopics["t"] = time.Now().Add(-time.Second)
+	authCacheLock.Unlock()
+
+	for _, name := range []string{"c", "d"} {
+		if err := Authorize("t", structs.PermConsume, "", mtls.Identity{Name: name, Role: mtls.RoleClient}); err == nil {
+			t.Fatalf("Authorize of %s succeeded on a topic that is no longer open", name)
+		}
+	}
+	if s.numCalls() != 4 {
+		t.Errorf("server was asked %d times, want 4", s.numCalls())
+	}
+}
+
+func TestAuthorizeServerDown(t *testing.T) {
+	s := &fakeAuthServer{allowed: map[string]bool{"a": true}}
+	stop := serveAuth(t, s)
+
+	known := mtls.Identity{Name: "a", Role: mtls.RoleClient}
+	if err := Authorize("t", structs.PermProduce, "", known); err != nil {
+		t.Fatalf("Authorize: %s", err)
+	}
+
+	// The grant expires while the server is down
+	authCacheLock.Lock()
+	for key := range authCache {
+		authCache[key] = time.Now().Add(-time.Second)
+	}
+	authCacheLock.Unlock()
+	stop()
+
+	if err := Authorize("t", structs.PermProduce, "", known); err != nil {
+		t.Fatalf("Authorize of a known client while the server is down: %s", err)
+	}
+
+	start := time.Now()
+	if err := Authorize("t", structs.PermProduce, "", known); err != nil {
+		t.Fatalf("Authorize of a known client while the server is down: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed >= serverclient.RETRY_WAIT {
+		t.Errorf("second request waited %s for the server", elapsed)
+	}
+
+	stranger := mtls.Identity{Name: "b", Role: mtls.RoleClient}
+	if err := Authorize("t", structs.PermProduce, "", stranger); err == nil {
+		t.Error("Authorize of an unknown client succeeded while the server is down")
+	}
+}
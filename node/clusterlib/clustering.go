@@ -7,6 +7,9 @@ import (
 	"net/rpc"
 	"sync"
 	"time"
+
+	"../../lib/mtls"
+	"../../structs"
 )
 
 type Mode int
@@ -42,6 +45,18 @@ func (pm *PeerCMap) Delete(k string) {
 	delete(pm.Map, k)
 }
 
+// Deletes the peer only if conn is still its connection. Returns false if the
+// peer was replaced or already deleted
+func (pm *PeerCMap) DeleteIf(k string, conn *rpc.Client) bool {
+	pm.MapLock.Lock()
+	defer pm.MapLock.Unlock()
+	if v, exists := pm.Map[k]; !exists || v.PeerConn != conn {
+		return false
+	}
+	delete(pm.Map, k)
+	return true
+}
+
 func (pm *PeerCMap) GetCount() int {
 	pm.MapLock.Lock()
 	defer pm.MapLock.Unlock()
@@ -70,6 +85,9 @@ var FollowerListLock sync.RWMutex
 
 var LeaderConn *rpc.Client
 
+// Closed to stop the leader's WatchFollowerCount goroutine
+var followerWatchStopCh chan bool
+
 const CONSENSUS_FAILED_WAIT = 10 // Number of seconds to wait until retrying consensus protocol
 
 // Args:
@@ -89,17 +107,7 @@ func BecomeLeader(ips []string, LeaderAddr string) (latestVersions []int, err er
 			continue
 		}
 
-		LocalAddr, err := net.ResolveTCPAddr("tcp", ":0")
-		if err != nil {
-			continue
-		}
-
-		PeerAddr, err := net.ResolveTCPAddr("tcp", ip)
-		if err != nil {
-			continue
-		}
-
-		conn, err := net.DialTCP("tcp", LocalAddr, PeerAddr)
+		conn, err := mtls.Dial(ip)
 		if err != nil {
 			continue
 		}
@@ -114,13 +122,25 @@ func BecomeLeader(ips []string, LeaderAddr string) (latestVersions []int, err er
 		////////////////////////////
 
 		// It's ok if it fails, gaps in follower ID sequence will not mean anything
-		msg := FollowMeMsg{LeaderIp: LeaderAddr, FollowerIps: DirectFollowersList, YourId: FollowerId}
-		fmt.Printf("Telling node with ip %s to follow me\n", ip)
+		msg := FollowMeMsg{
+			Topic:       TopicName,
+			Partition:   Partition,
+			Spec:        TopicSettings,
+			LeaderIp:    LeaderAddr,
+			FollowerIps: DirectFollowersList,
+			YourId:      FollowerId}
+		Logger.Info("Telling node to follow me", "peer", ip, "follower-id", FollowerId)
 
 		var latestVersion int
 		err = client.Call("Peer.FollowMe", msg, &latestVersion)
 		startPeerHb(ip)
 		if err != nil {
+			FollowerListLock.Unlock()
+			Logger.Warn("Peer refused to follow", "peer", ip, "err", err)
+
+			// Its heartbeats fail once the connection is closed, and its death
+			// handler removes it from every follower list
+			client.Close()
 			continue
 		}
 
@@ -132,61 +152,61 @@ func BecomeLeader(ips []string, LeaderAddr string) (latestVersions []int, err er
 		successCount++
 	}
 
-	// Num followers required is ClusterSize - 1, since leader is counted
-	go WatchFollowerCount(int(ClusterSize)-1, LeaderAddr)
+	startFollowerWatch()
 	if successCount > 0 {
 		return latestVersions, nil
 	} else {
-		fmt.Println("BecomeLeader: Could not connect to any followers!")
+		Logger.Error("Could not connect to any followers")
 		return latestVersions, fmt.Errorf("Could not connect to any followers")
 	}
 }
 
 func FollowLeader(msg FollowMeMsg, addr string) (err error) {
-	fmt.Printf("FollowLeader: told to follow %s\n", msg.LeaderIp)
+	Logger.Info("Told to follow leader", "leader", msg.LeaderIp, "follower-id", msg.YourId)
 	FollowerListLock.Lock()
 	DirectFollowersList = msg.FollowerIps
 	FollowerListLock.Unlock()
 	FollowerId = msg.YourId
 	MyAddr = addr
+	TopicName = msg.Topic
+	Partition = msg.Partition
+	TopicSettings = msg.Spec
 
 	// Leader has given complete dataset
 	if len(msg.Data) != 0 {
 		VersionListLock.Lock()
 		VersionList = msg.Data
+		rebuildSequences()
+		rebuildMarkers()
 		VersionListLock.Unlock()
 	}
 
-	LocalAddr, err := net.ResolveTCPAddr("tcp", ":0")
+	conn, err := mtls.Dial(msg.LeaderIp)
 	if err != nil {
 		return err
 	}
 
-	PeerAddr, err := net.ResolveTCPAddr("tcp", msg.LeaderIp)
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.DialTCP("tcp", LocalAddr, PeerAddr)
-	if err != nil {
-		return err
-	}
-
-	// check if there is already a leader connection; if so, kill it.
+	// check if there is already a leader connection; if so, kill it. The new
+	// leader is set first so that its death does not start an election
 	oldLeader, ok := PeerMap.Get(LEADER_ID)
+	LEADER_ID = msg.LeaderIp
 	if ok {
 		oldLeader.HbChan <- "die"
 	}
 
 	LeaderConn = rpc.NewClient(conn)
+
+	// Only an election in progress reads from it
 	if receiveFollowerChannel != nil {
-		receiveFollowerChannel <- msg.LeaderIp
+		select {
+		case receiveFollowerChannel <- msg.LeaderIp:
+		default:
+		}
 	}
 
-	LEADER_ID = msg.LeaderIp
 	addPeer(LEADER_ID, LeaderConn, NodeDeathHandler, 0)
 	startPeerHb(LEADER_ID)
-	fmt.Println("FollowLeader: follower list is", msg.FollowerIps)
+	Logger.Info("Following leader", "leader", msg.LeaderIp, "followers", msg.FollowerIps)
 
 	return err
 }
@@ -200,7 +220,7 @@ func ModifyFollowerList(follower ModFollowerListMsg, add bool) (err error) {
 		if exists {
 			err = errors.New("Clustering: Follower is already known")
 		} else {
-			fmt.Printf("Adding %s to follower list\n", follower.FollowerIp)
+			Logger.Info("Adding follower", "peer", follower.FollowerIp, "follower-id", follower.FollowerId)
 			DirectFollowersList[follower.FollowerIp] = follower.FollowerId
 		}
 	} else {
@@ -208,9 +228,9 @@ func ModifyFollowerList(follower ModFollowerListMsg, add bool) (err error) {
 		if !exists {
 			err = fmt.Errorf("Clustering: %s not known. Cannot remove follower",
 				follower.FollowerIp)
-			fmt.Println(err.Error())
+			Logger.Warn("Cannot remove unknown follower", "peer", follower.FollowerIp)
 		} else {
-			fmt.Printf("Removing %s from follower list\n", follower.FollowerIp)
+			Logger.Info("Removing follower", "peer", follower.FollowerIp, "follower-id", follower.FollowerId)
 			delete(DirectFollowersList, follower.FollowerIp)
 		}
 	}
@@ -236,7 +256,7 @@ func GeneratePublicIP() string {
 
 func checkError(err error, parent string) bool {
 	if err != nil {
-		fmt.Println(parent, ":: found error! ", err)
+		Logger.Error("Found error", "in", parent, "err", err)
 		return true
 	}
 	return false
@@ -244,7 +264,7 @@ func checkError(err error, parent string) bool {
 
 // Adds a peer to the map
 func addPeer(ip string, peerConn *rpc.Client, deathFn func(string), id int) {
-	fmt.Printf("Adding %s to peer list\n", ip)
+	Logger.Debug("Adding peer", "peer", ip)
 	newPeer := Peer{make(chan string, 8), peerConn, deathFn}
 	PeerMap.Set(ip, newPeer)
 
@@ -255,7 +275,7 @@ func addPeer(ip string, peerConn *rpc.Client, deathFn func(string), id int) {
 
 // Starts heartbeat to a peer
 func startPeerHb(ip string) {
-	fmt.Printf("Starting hb goroutines for ip %s\n", ip)
+	Logger.Debug("Starting peer heartbeats", "peer", ip)
 	go peerHbSender(ip)
 	go peerHbHandler(ip)
 }
@@ -269,7 +289,7 @@ func AddToFollowerLists(ip string, id int) {
 	for ip, _ := range DirectFollowersList {
 		peer, ok := PeerMap.Get(ip)
 		if !ok {
-			fmt.Println("AddToFollowerLists :: ignoring this follower:", ip)
+			Logger.Warn("Follower is not a peer, not adding to its follower list", "peer", ip)
 			continue
 		}
 		peer.PeerConn.Call("Peer.AddFollower", msg, &_ignored)
@@ -285,7 +305,7 @@ func RemoveFromFollowerLists(ip string, id int) {
 	for ip, _ := range DirectFollowersList {
 		peer, ok := PeerMap.Get(ip)
 		if !ok {
-			fmt.Println("RemoveFromFollowerLists :: ignoring this follower:", ip)
+			Logger.Warn("Follower is not a peer, not removing from its follower list", "peer", ip)
 			continue
 		}
 		peer.PeerConn.Call("Peer.RemoveFollower", msg, &_ignored)
@@ -296,11 +316,16 @@ func NodeDeathHandler(ip string) {
 	// This is the death function in the case that this peer
 	// dies. There will be more functionality added to this
 	// later for sure. Maybe put into separate function.
-	fmt.Printf("Oh no, %s died!\n", ip)
+	Logger.Warn("Peer died", "peer", ip)
+
+	// The topic was dropped and its peers disconnected on purpose
+	if len(TopicName) == 0 {
+		return
+	}
 	switch NodeMode {
 	case Follower:
 		if ip == LEADER_ID {
-			fmt.Println("The leader has died, initiating consensus protocol")
+			Logger.Warn("Leader died, starting consensus protocol")
 
 			// Try the consensusProtocol indefinitely until there's a leader
 			// If the consensus protocol failed, that means there were too many node failures
@@ -317,7 +342,7 @@ func NodeDeathHandler(ip string) {
 		// N/A since Followers do not connect to other Followers
 
 	case Leader:
-		fmt.Println("A node has died, need to remove it from everyone's follower list")
+		Logger.Info("Removing dead follower from every follower list", "peer", ip)
 		FollowerListLock.Lock()
 		id := DirectFollowersList[ip]
 		delete(DirectFollowersList, ip)
@@ -326,61 +351,417 @@ func NodeDeathHandler(ip string) {
 
 	default:
 		// no default behavior
-		fmt.Println("serious error occured in NodeDeathHandler")
+		Logger.Error("Peer died while the node is neither leader nor follower", "peer", ip)
 	}
 }
 
 // Makes sure that there are always enough followers in the cluster. A leader
 // will never stop being leader of a topic under normal operation, so this
-// function has no exit conditions. Intended to be called as a goroutine.
-func WatchFollowerCount(requiredNumFollowers int, LeaderAddr string) {
-	fmt.Println("Watching follower count now")
+// function only exits when stopCh is closed because the topic was dropped or
+// leadership was handed off.
+// Intended to be called as a goroutine.
+func WatchFollowerCount(requiredNumFollowers int, stopCh chan bool) {
+	Logger.Debug("Watching follower count")
 	for {
-		time.Sleep(3 * time.Second)
+		select {
+		case <-stopCh:
+			Logger.Debug("Stopped watching follower count")
+			return
+		case <-time.After(3 * time.Second):
+		}
+
 		count := PeerMap.GetCount()
 		numToGet := requiredNumFollowers - count
-		if numToGet <= 1 {
+		if numToGet <= 0 {
 			continue
 		}
 
-		fmt.Printf("WatchFollowerCount: Need %d more followers!\n", numToGet)
+		Logger.Warn("Cluster needs more followers", "missing", numToGet)
 
 		var nodeAddr string
 		for i := 0; i < numToGet; i++ {
-			err := ServerClient.Call("TServer.TakeNode", "", &nodeAddr)
+			err := ServerClient.Call("TServer.TakeNode", clusterMembers(), &nodeAddr)
 			if err != nil {
 				// Sleep and try again later, no point requesting any more
 				break
 			}
 
-			conn, err := net.Dial("tcp", nodeAddr)
-			if err != nil {
-				continue
+			Logger.Info("Adding replacement follower", "peer", nodeAddr)
+			if err := AddSyncedFollower(nodeAddr); err != nil {
+				checkError(err, "WatchFollowerCount")
+
+				// Back to the orphans, so that the server does not count it
+				// as a follower
+				var ignored bool
+				if err := ServerClient.Call("TServer.ReturnNode", nodeAddr, &ignored); err != nil {
+					checkError(err, "WatchFollowerCount ReturnNode")
+				}
 			}
+		}
+	}
+}
 
-			client := rpc.NewClient(conn)
-			addPeer(nodeAddr, client, NodeDeathHandler, FollowerId)
+// Leader only. Makes nodeAddr a follower and gives it a full copy of the
+// data, so that it is in sync as soon as this returns
+func AddSyncedFollower(nodeAddr string) error {
+	conn, err := mtls.Dial(nodeAddr)
+	if err != nil {
+		return err
+	}
 
-			FollowerListLock.Lock()
-			DirectFollowersList[nodeAddr] = FollowerId
+	client := rpc.NewClient(conn)
 
-			var latestVersion int
+	VersionListLock.Lock()
+	sortVersionList()
+	data := make([]FileData, len(VersionList))
+	copy(data, VersionList)
+	VersionListLock.Unlock()
 
-			VersionListLock.Lock()
-			sortVersionList()
-			VersionListLock.Unlock()
+	FollowerListLock.Lock()
+	id := FollowerId
+	FollowerId++
+	DirectFollowersList[nodeAddr] = id
+	followerIps := make(map[string]int)
+	for ip, fId := range DirectFollowersList {
+		followerIps[ip] = fId
+	}
+	FollowerListLock.Unlock()
 
-			msg := FollowMeMsg{LeaderAddr, DirectFollowersList, FollowerId, VersionList}
-			fmt.Printf("Count Watcher: telling node with ip %s to follow me\n", nodeAddr)
-			err = client.Call("Peer.FollowMe", msg, &latestVersion)
-			startPeerHb(nodeAddr)
-			if err != nil {
-				continue
+	// Added before FollowMe so that its first heartbeats are answered
+	addPeer(nodeAddr, client, NodeDeathHandler, id)
+
+	msg := FollowMeMsg{
+		Topic:       TopicName,
+		Partition:   Partition,
+		Spec:        TopicSettings,
+		LeaderIp:    MyAddr,
+		FollowerIps: followerIps,
+		YourId:      id,
+		Data:        data}
+
+	var latestVersion int
+	if err := client.Call("Peer.FollowMe", msg, &latestVersion); err != nil {
+		PeerMap.Delete(nodeAddr)
+		client.Close()
+
+		FollowerListLock.Lock()
+		delete(DirectFollowersList, nodeAddr)
+		FollowerListLock.Unlock()
+		return err
+	}
+
+	startPeerHb(nodeAddr)
+	return nil
+}
+
+// Leader only. Adds newIp as a synced follower, then tells oldIp to drop the
+// topic. oldIp may already have left the cluster, e.g. when it was the leader
+// that handed off to this node
+func ReplaceFollower(oldIp, newIp string) error {
+	if NodeMode != Leader {
+		return errors.New("Node is not a leader. Cannot replace follower")
+	}
+
+	if err := AddSyncedFollower(newIp); err != nil {
+		return err
+	}
+
+	peer, ok := PeerMap.Get(oldIp)
+	if !ok {
+		return nil
+	}
+
+	var members []string
+	if err := peer.PeerConn.Call("Peer.DropTopic", TopicName, &members); err != nil {
+		checkError(err, "ReplaceFollower "+oldIp)
+	}
+
+	// Its death handler removes it from every follower list
+	select {
+	case peer.HbChan <- "die":
+	default:
+	}
+
+	Logger.Info("Replaced follower", "old", oldIp, "new", newIp)
+	return nil
+}
+
+// Leader only. Moves leadership of the partition to msg.Target, or to the
+// in-sync follower with the lowest follower id if no target is given, and
+// tells the server. With msg.Stay this node follows the new leader,
+// otherwise it drops the topic. Returns the partition with its new leader.
+// Writes must be blocked by the caller
+func HandOffLeadership(msg structs.HandOffMsg) (structs.Partition, error) {
+	if NodeMode != Leader {
+		return structs.Partition{}, errors.New("Node is not a leader. Cannot hand off leadership")
+	}
+
+	desc := DescribeCluster()
+
+	target, targetId := "", 0
+	for _, follower := range desc.Followers {
+		if !follower.InSync || (msg.Target != "" && follower.Address != msg.Target) {
+			continue
+		}
+
+		if target == "" || follower.FollowerId < targetId {
+			target, targetId = follower.Address, follower.FollowerId
+		}
+	}
+
+	if target == "" {
+		return structs.Partition{}, NoInSyncFollowerError(fmt.Sprintf("%s/%d", TopicName, Partition))
+	}
+
+	peer, ok := PeerMap.Get(target)
+	if !ok {
+		return structs.Partition{}, fmt.Errorf("Follower %s is not connected", target)
+	}
+
+	followerIps := make([]string, 0)
+	for _, follower := range desc.Followers {
+		if follower.Address != target {
+			followerIps = append(followerIps, follower.Address)
+		}
+	}
+
+	if msg.Stay {
+		followerIps = append(followerIps, MyAddr)
+	}
+
+	takeMsg := TakeLeadershipMsg{
+		Topic:         TopicName,
+		Partition:     Partition,
+		Spec:          TopicSettings,
+		FollowerIps:   followerIps,
+		LatestVersion: desc.Leader.LatestVersion}
+
+	// Step down first so that followers leaving for the new leader are not
+	// handled as deaths
+	oldLeaderId := LEADER_ID
+	stopFollowerWatch()
+	NodeMode = Follower
+	LEADER_ID = MyAddr
+
+	Logger.Info("Handing off leadership", "to", target)
+	var clusterAddr string
+	if err := peer.PeerConn.Call("Peer.TakeLeadership", takeMsg, &clusterAddr); err != nil {
+		NodeMode = Leader
+		LEADER_ID = oldLeaderId
+		startFollowerWatch()
+		return structs.Partition{}, err
+	}
+
+	partition := structs.Partition{
+		Id:      Partition,
+		Leaders: []string{clusterAddr, target}}
+
+	var ignore string
+	topic := structs.Topic{
+		TopicName:  TopicName,
+		Partitions: []structs.Partition{partition}}
+	if err := ServerClient.Call("TServer.UpdateTopicLeader", &topic, &ignore); err != nil {
+		checkError(err, "HandOffLeadership UpdateTopicLeader")
+	}
+
+	// The new leader has already told this node to follow it
+	if msg.Stay {
+		return partition, nil
+	}
+	return partition, ResetNode()
+}
+
+// Follower only. Becomes leader of the partition in place of the current
+// leader, which is handing off. The node must have every write up to
+// msg.LatestVersion
+func TakeLeadership(msg TakeLeadershipMsg) error {
+	if NodeMode != Follower || TopicName != msg.Topic || Partition != msg.Partition {
+		return fmt.Errorf("Node does not follow %s/%d", msg.Topic, msg.Partition)
+	}
+
+	if numWrites, hasAllData := countWrites(); !hasAllData || numWrites < msg.LatestVersion {
+		return fmt.Errorf("Node has %d of %d writes. Cannot take leadership", numWrites, msg.LatestVersion)
+	}
+
+	VersionListLock.Lock()
+	sortVersionList()
+	VersionListLock.Unlock()
+
+	// Closing the old leader's connection must not start an election. It is
+	// removed here so that its handler only closes the connection
+	oldLeader, ok := PeerMap.Get(LEADER_ID)
+	if ok {
+		PeerMap.DeleteIf(LEADER_ID, oldLeader.PeerConn)
+	}
+	LEADER_ID = MyAddr
+	if ok {
+		select {
+		case oldLeader.HbChan <- "die":
+		default:
+		}
+	}
+	LeaderConn = nil
+
+	Logger.Info("Taking over leadership", "version", msg.LatestVersion)
+	TopicSettings = msg.Spec
+	if _, err := BecomeLeader(msg.FollowerIps, MyAddr); err != nil {
+		// A new follower is added by the server or the follower watch
+		checkError(err, "TakeLeadership")
+	}
+
+	return nil
+}
+
+// Leader only. Returns the addresses of every node in the cluster
+func clusterMembers() []string {
+	PeerMap.MapLock.RLock()
+	defer PeerMap.MapLock.RUnlock()
+
+	members := []string{MyAddr}
+	for ip := range PeerMap.Map {
+		members = append(members, ip)
+	}
+	return members
+}
+
+func startFollowerWatch() {
+	// Num followers required is ClusterSize - 1, since leader is counted
+	stopFollowerWatch()
+	followerWatchStopCh = make(chan bool)
+	go WatchFollowerCount(int(TopicSettings.ClusterSize)-1, followerWatchStopCh)
+}
+
+func stopFollowerWatch() {
+	if followerWatchStopCh != nil {
+		close(followerWatchStopCh)
+		followerWatchStopCh = nil
+	}
+}
+
+// Leader only. Tells every follower to drop the topic and returns the
+// addresses of the followers that did
+func DropFollowers(topic string) []string {
+	// No more replacement followers while the cluster is torn down
+	stopFollowerWatch()
+
+	PeerMap.MapLock.RLock()
+	peers := make(map[string]Peer)
+	for ip, peer := range PeerMap.Map {
+		peers[ip] = peer
+	}
+	PeerMap.MapLock.RUnlock()
+
+	dropped := make([]string, 0)
+	for ip, peer := range peers {
+		var members []string
+		if err := peer.PeerConn.Call("Peer.DropTopic", topic, &members); err != nil {
+			checkError(err, "DropFollowers "+ip)
+			continue
+		}
+
+		dropped = append(dropped, members...)
+	}
+
+	return dropped
+}
+
+// Forgets this node's topic: peer connections are closed, follower and leader
+// state is reset and the data file is removed. Afterwards the node is an
+// orphan that can be given a new topic.
+func ResetNode() error {
+	// Cleared first so the death handlers of the closed peers do nothing
+	TopicName = ""
+	Partition = 0
+	TopicSettings = structs.TopicSpec{}.WithDefaults(ServerSettings())
+
+	stopFollowerWatch()
+	NodeMode = Follower
+
+	FollowerListLock.Lock()
+	DirectFollowersList = make(map[string]int)
+	FollowerId = 0
+	FollowerListLock.Unlock()
+
+	PeerMap.MapLock.RLock()
+	for _, peer := range PeerMap.Map {
+		select {
+		case peer.HbChan <- "die":
+		default:
+		}
+	}
+	PeerMap.MapLock.RUnlock()
+
+	LEADER_ID = "leader"
+	LeaderConn = nil
+
+	VersionListLock.Lock()
+	VersionList = make([]FileData, 0)
+	FirstMismatch = 0
+	rebuildSequences()
+	rebuildMarkers()
+	VersionListLock.Unlock()
+
+	return removeFromDisk(DataPath)
+}
+
+// Describes this node's copy of the partition
+func DescribeReplica() structs.ReplicaDescription {
+	numWrites, hasAllData := countWrites()
+	replica := structs.ReplicaDescription{
+		Address:       MyAddr,
+		LatestVersion: GetLatestVersion(),
+		NumWrites:     numWrites,
+		FirstMismatch: FirstMismatch,
+		HasAllData:    hasAllData,
+		Reachable:     true,
+	}
+
+	if NodeMode == Follower {
+		replica.FollowerId = FollowerId
+	}
+
+	return replica
+}
+
+// Leader only. Asks every follower for its replica's state and compares it
+// to the leader's own
+func DescribeCluster() structs.PartitionDescription {
+	desc := structs.PartitionDescription{
+		Id:        Partition,
+		Leaders:   []string{ClusterRpcAddr, MyAddr},
+		Leader:    DescribeReplica(),
+		Followers: make([]structs.ReplicaDescription, 0),
+	}
+	desc.Leader.InSync = desc.Leader.HasAllData
+
+	FollowerListLock.RLock()
+	followers := make(map[string]int)
+	for ip, id := range DirectFollowersList {
+		followers[ip] = id
+	}
+	FollowerListLock.RUnlock()
+
+	numInSync := 0
+	for ip, id := range followers {
+		replica := structs.ReplicaDescription{Address: ip}
+
+		if peer, ok := PeerMap.Get(ip); ok {
+			if err := peer.PeerConn.Call("Peer.DescribeReplica", "", &replica); err != nil {
+				checkError(err, "DescribeCluster "+ip)
+				replica = structs.ReplicaDescription{Address: ip}
 			}
+		}
 
-			FollowerId++
-			////////////////////////////
-			FollowerListLock.Unlock()
+		replica.FollowerId = id
+		replica.InSync = replica.Reachable && replica.HasAllData &&
+			replica.LatestVersion == desc.Leader.LatestVersion
+		if replica.InSync {
+			numInSync++
 		}
+
+		desc.Followers = append(desc.Followers, replica)
 	}
+
+	desc.UnderReplicated = numInSync < int(TopicSettings.ClusterSize)-1
+	return desc
 }
@@ -0,0 +1,175 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"../../structs"
+)
+
+// Answers the peer rpcs a leader makes to its followers
+type fakePeer struct {
+	refuse bool
+
+	sync.Mutex
+	followMe []FollowMeMsg
+}
+
+func (p *fakePeer) FollowMe(msg FollowMeMsg, latestVersion *int) error {
+	if p.refuse {
+		return errors.New("refused")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.followMe = append(p.followMe, msg)
+	*latestVersion = 7
+	return nil
+}
+
+func (p *fakePeer) Heartbeat(ip string, reply *string) error {
+	*reply = "ok"
+	return nil
+}
+
+func (p *fakePeer) AddFollower(msg ModFollowerListMsg, _ignored *string) error {
+	return nil
+}
+
+func (p *fakePeer) RemoveFollower(msg ModFollowerListMsg, _ignored *string) error {
+	return nil
+}
+
+// Serves p as Peer on a new local port. Returns its address
+func servePeer(t *testing.T, p *fakePeer) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Peer", p); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func resetClustering() {
+	stopFollowerWatch()
+	TopicName = "t"
+	Partition = 0
+	TopicSettings = structs.TopicSpec{}
+	NodeMode = Follower
+	LEADER_ID = "leader"
+	MyAddr = "127.0.0.1:1"
+	FollowerId = 0
+	VersionList = nil
+}
+
+func hasFollower(ip string) bool {
+	FollowerListLock.RLock()
+	defer FollowerListLock.RUnlock()
+	_, ok := DirectFollowersList[ip]
+	return ok
+}
+
+func TestBecomeLeaderSkipsRefusingFollower(t *testing.T) {
+	resetClustering()
+	defer stopFollowerWatch()
+
+	refusing := servePeer(t, &fakePeer{refuse: true})
+	following := &fakePeer{}
+	followingAddr := servePeer(t, following)
+
+	done := make(chan []int)
+	go func() {
+		versions, err := BecomeLeader([]string{refusing, followingAddr}, MyAddr)
+		if err != nil {
+			t.Errorf("BecomeLeader: %s", err)
+		}
+		done <- versions
+	}()
+
+	select {
+	case versions := <-done:
+		if len(versions) != 1 || versions[0] != 7 {
+			t.Errorf("latest versions = %v, want [7]", versions)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("BecomeLeader did not return after a follower refused")
+	}
+
+	if len(following.followMe) != 1 {
+		t.Fatalf("follower was told to follow %d times, want 1", len(following.followMe))
+	}
+	if !hasFollower(followingAddr) {
+		t.Errorf("follower %s is not in the follower list", followingAddr)
+	}
+
+	// The refusing peer's connection is closed, so it is dropped like a dead one
+	for deadline := time.Now().Add(5 * time.Second); hasFollower(refusing); {
+		if time.Now().After(deadline) {
+			t.Fatalf("refusing peer %s is still in the follower list", refusing)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTakeLeadership(t *testing.T) {
+	resetClustering()
+	defer stopFollowerWatch()
+
+	following := &fakePeer{}
+	followingAddr := servePeer(t, following)
+
+	VersionList = []FileData{{Version: 1}, {Version: 2}}
+	msg := TakeLeadershipMsg{
+		Topic:         "t",
+		Partition:     0,
+		Spec:          TopicSettings,
+		FollowerIps:   []string{followingAddr},
+		LatestVersion: 3}
+
+	// A follower missing writes of the leader handing off must refuse
+	if err := TakeLeadership(msg); err == nil {
+		t.Fatal("TakeLeadership with a missing write succeeded")
+	}
+	if NodeMode != Follower {
+		t.Fatal("node became leader while missing a write")
+	}
+
+	msg.Partition = 1
+	msg.LatestVersion = 2
+	if err := TakeLeadership(msg); err == nil {
+		t.Fatal("TakeLeadership of another partition succeeded")
+	}
+
+	msg.Partition = 0
+	if err := TakeLeadership(msg); err != nil {
+		t.Fatalf("TakeLeadership: %s", err)
+	}
+	if NodeMode != Leader || LEADER_ID != MyAddr {
+		t.Errorf("mode = %v, leader = %s, want leader %s", NodeMode, LEADER_ID, MyAddr)
+	}
+	if !hasFollower(followingAddr) {
+		t.Errorf("follower %s is not in the follower list", followingAddr)
+	}
+	if len(following.followMe) != 1 || following.followMe[0].LeaderIp != MyAddr {
+		t.Errorf("follower was told %+v, want to follow %s", following.followMe, MyAddr)
+	}
+}
@@ -0,0 +1,132 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	conf "../../lib/config"
+	"../../lib/logging"
+	"../../structs"
+)
+
+// Environment variables of settings start with this, e.g. KTS_NODE_DATA_PATH
+const ENV_CONFIG_PREFIX = "KTS_NODE_"
+
+// Settings of the node process, loaded in the same layers as the server's:
+// the -c JSON files, then KTS_NODE_* environment variables, then -set flags.
+// Timings of the cluster come from the server's NodeSettings instead, so that
+// every node of a cluster uses the same
+type Config struct {
+	Servers     []string           `json:"servers"`      // Address of every server replica
+	DataPath    string             `json:"data-path"`    // Directory of the node's data file
+	Labels      structs.NodeLabels `json:"labels"`       // host defaults to the machine's hostname
+	MetricsAddr string             `json:"metrics-addr"` // Serves Prometheus metrics. Empty serves none
+	LogLevel    string             `json:"log-level"`    // Empty uses KTS_LOG_LEVEL
+	LogFormat   string             `json:"log-format"`   // Empty uses KTS_LOG_FORMAT
+}
+
+// Top level settings that a reload applies
+var reloadable = map[string]bool{
+	"log-level":  true,
+	"log-format": true,
+}
+
+type InvalidConfigError string
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("Node: invalid config: %s", string(e))
+}
+
+// KTS_METRICS_ADDR is still read, as the default of metrics-addr
+func defaultConfig() Config {
+	return Config{MetricsAddr: os.Getenv(ENV_METRICS_ADDR)}
+}
+
+// Loads and validates every layer of the config
+func LoadConfig(loader conf.Loader) (Config, error) {
+	loaded := defaultConfig()
+	if err := loader.Load(&loaded); err != nil {
+		return loaded, err
+	}
+	return loaded, loaded.Validate()
+}
+
+func (cfg Config) Validate() error {
+	var problems []string
+	if len(cfg.Servers) == 0 {
+		problems = append(problems, "servers must be set")
+	}
+
+	if cfg.DataPath == "" {
+		problems = append(problems, "data-path must be set")
+	}
+
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if _, err := logging.ParseFormat(cfg.LogFormat); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return InvalidConfigError(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Sets the log level and format from the environment, then from the config
+func (cfg Config) ApplyLogging() error {
+	if err := logging.ConfigureFromEnv(); err != nil {
+		return err
+	}
+
+	if cfg.LogLevel != "" {
+		level, _ := logging.ParseLevel(cfg.LogLevel)
+		logging.SetLevel(level)
+	}
+
+	if cfg.LogFormat != "" {
+		format, _ := logging.ParseFormat(cfg.LogFormat)
+		logging.SetFormat(format)
+	}
+	return nil
+}
+
+// Loads the config again on every SIGHUP and applies the reloadable
+// settings. Changes to the others are logged and wait for a restart
+func ReloadOnHangup(loader conf.Loader, current Config) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		loaded, err := LoadConfig(loader)
+		if err == nil {
+			err = loaded.ApplyLogging()
+		}
+		if err != nil {
+			Logger.Error("Could not reload config, keeping the current one", "err", err)
+			continue
+		}
+
+		var applied, needRestart []string
+		for _, key := range conf.Changed(&current, &loaded) {
+			if reloadable[strings.Split(key, ".")[0]] {
+				applied = append(applied, key)
+			} else {
+				needRestart = append(needRestart, key)
+			}
+		}
+
+		Logger.Info("Reloaded config", "changed", applied)
+		if len(needRestart) > 0 {
+			Logger.Warn("Changed settings only apply after a restart", "settings", needRestart)
+		}
+
+		// Restart-only settings stay as the node started with them
+		current.LogLevel, current.LogFormat = loaded.LogLevel, loaded.LogFormat
+	}
+}
@@ -9,13 +9,12 @@ package node
 import (
 	"errors"
 	"fmt"
-	"log"
 	"math"
-	"net"
 	"net/rpc"
 	"sync"
 	"time"
 
+	"../../lib/mtls"
 	"../../structs"
 )
 
@@ -25,7 +24,8 @@ const ELECTION_ATTEMPT_FOLLOW_WAIT = 2
 // Number of seconds to wait until election is considered complete
 const ELECTION_COMPLETE_TIMEOUT = 8
 
-// Number of seconds to wait after election complete to let results come in
+// Number of seconds to wait after election complete to let results come in,
+// unless the server's NodeSettings set an election-wait
 const ELECTION_WAIT_FOR_RESULTS = 16
 
 var dataChannels sync.Map
@@ -50,7 +50,9 @@ var ClusterRpcAddr string
 // Called when the leader heartbeat stops
 // Returns error if too many nodes failed and we cannot rebuild the dataset
 func StartConsensusProtocol() error {
-	fmt.Println("ELECTION STARTED: my follower id is", FollowerId)
+	// Ties together the log lines of this node's part in the election
+	log := Logger.With("election", fmt.Sprintf("%s@%d", MyAddr, time.Now().UnixNano()))
+	log.Info("Election started", "follower-id", FollowerId)
 
 	// create Consensus job that returns an update channel and a channel for the func to receive followers on
 	var updateChannel chan bool
@@ -60,12 +62,12 @@ func StartConsensusProtocol() error {
 		lowestFollowerIp, lowestFollowerId := ScanFollowerList()
 		// case 1: we are the lowest follower and likely to become leader
 		if FollowerId == lowestFollowerId {
-			fmt.Printf("Expecting to become leader, follower id is %d, ip is %s\n\n",
-				FollowerId, lowestFollowerIp)
+			log.Info("Expecting to become leader", "follower-id", FollowerId)
 
 			electionLock.Lock()
 			electionInProgress = true
 			electionLock.Unlock()
+			ElectionsStarted.Inc()
 
 			updateChannel, receiveFollowerChannel = StartElection()
 			// block on update channel
@@ -78,13 +80,13 @@ func StartConsensusProtocol() error {
 			electionLock.Unlock()
 
 			if becameLeader {
-				fmt.Println("ELECTION COMPLETE: became the new Leader, my IP is", lowestFollowerIp)
+				ElectionsWon.Inc()
+				log.Info("Election complete, became leader")
 				latestVersions, _ := BecomeLeader(PotentialFollowerIps, lowestFollowerIp)
 
 				// Get entire dataset from Followers
 				// 1) Scan for highest VersionNumber
 
-				fmt.Printf(ERR_COL+"LatestVersions is: %+v\n"+ERR_END, latestVersions)
 				var max int
 				for _, v := range latestVersions {
 					if max < v {
@@ -92,24 +94,25 @@ func StartConsensusProtocol() error {
 					}
 				}
 
-				fmt.Println(fmt.Sprintf(ERR_COL+"MAX VERSION NUM IS: %d"+ERR_END, max))
+				log.Info("Latest versions of the followers", "versions", latestVersions, "version", max)
 				// Set the next WriteId to be after the highestLatestVersion and send back to node main
 				writeIdCh <- max + 1
 
 				// Aggregate any missing data
 				if err := GetMissingData(max); err != nil {
-					failErr = ERR_COL + "ELECTION PROTOCOL COULD NOT BE COMPLETE BECAUSE COULD NOT REBUILD DATA" + ERR_END
+					failErr = "Election could not complete because the data could not be rebuilt"
 					break
 				}
 
 				// Notify Server of new leader
-				fmt.Println(ERR_COL + "Notifying server of becoming leader" + ERR_END)
+				log.Info("Notifying server of becoming leader")
 
 				var ignore string
 				topic := structs.Topic{
-					TopicName:   TopicName,
-					MinReplicas: MinReplicas,
-					Leaders:     []string{ClusterRpcAddr, MyAddr},
+					TopicName: TopicName,
+					Partitions: []structs.Partition{{
+						Id:      Partition,
+						Leaders: []string{ClusterRpcAddr, MyAddr}}},
 				}
 				// If the server is down, we need to continuously attempt to notify it until
 				// the server is aware of the new leader
@@ -125,19 +128,19 @@ func StartConsensusProtocol() error {
 		} else {
 			// case 2: we should connect to the lowest follower
 			time.Sleep(ELECTION_ATTEMPT_FOLLOW_WAIT * time.Second)
-			fmt.Printf("Try to follow this leader: %s\n\n", lowestFollowerIp)
+			log.Info("Trying to follow new leader", "leader", lowestFollowerIp)
 			err := PeerFollowThatNode(lowestFollowerIp, MyAddr, false)
 			if err == nil {
-				fmt.Printf("ELECTION COMPLETE: following %s\n\n", lowestFollowerIp)
+				log.Info("Election complete, following new leader", "leader", lowestFollowerIp)
 				break
 			} else {
-				fmt.Printf("Could not follow node %s\n\n", lowestFollowerIp)
+				log.Warn("Could not follow new leader", "leader", lowestFollowerIp, "err", err)
 			}
 		}
 	}
 
 	if failErr != "" {
-		log.Print(failErr)
+		log.Error(failErr)
 		return IncompleteDataError(failErr)
 	}
 
@@ -150,7 +153,7 @@ func StartConsensusProtocol() error {
 func Nominate() (updateCh chan bool, receiveFollowerCh chan string) {
 	updateCh = make(chan bool, 32)
 	receiveFollowerCh = make(chan string, 32)
-	timeoutCh := createTimeout(ELECTION_COMPLETE_TIMEOUT)
+	timeoutCh := createTimeout(ELECTION_COMPLETE_TIMEOUT * time.Second)
 
 	go func() {
 		for {
@@ -188,29 +191,19 @@ func PeerAcceptThisNode(ip string) error {
 		return nil
 	} else if NodeMode == Leader {
 		numPeers := PeerMap.GetCount()
-		if numPeers == int(ClusterSize)-1 {
+		if numPeers == int(TopicSettings.ClusterSize)-1 {
 			return errors.New("Cluster is full. Cannot accept this Follower")
 		}
 
-		if numPeers > int(ClusterSize)-1 {
-			fmt.Println(ERR_COL + "NUMBER OF PEERS EXCEEDS CLUSTER SIZE" + ERR_END)
+		if numPeers > int(TopicSettings.ClusterSize)-1 {
+			Logger.Error("Number of peers exceeds cluster size", "peers", numPeers)
 			return errors.New("Cluster is full. Cannot accept this Follower")
 		}
 
 		// from clustering.go
 		// it's likely this cluster is trying to join after
 		// an election so just accept it
-		LocalAddr, err := net.ResolveTCPAddr("tcp", ":0")
-		if err != nil {
-			return err
-		}
-
-		PeerAddr, err := net.ResolveTCPAddr("tcp", ip)
-		if err != nil {
-			return err
-		}
-
-		conn, err := net.DialTCP("tcp", LocalAddr, PeerAddr)
+		conn, err := mtls.Dial(ip)
 		if err != nil {
 			return err
 		}
@@ -223,8 +216,14 @@ func PeerAcceptThisNode(ip string) error {
 		////////////////////////////
 		// It's ok if it fails, gaps in follower ID sequence will not mean anything
 		FollowerId += 1
-		msg := FollowMeMsg{LeaderIp: MyAddr, FollowerIps: DirectFollowersList, YourId: FollowerId}
-		fmt.Printf("Telling node with ip %s to follow me\n\n", ip)
+		msg := FollowMeMsg{
+			Topic:       TopicName,
+			Partition:   Partition,
+			Spec:        TopicSettings,
+			LeaderIp:    MyAddr,
+			FollowerIps: DirectFollowersList,
+			YourId:      FollowerId}
+		Logger.Info("Telling node to follow me", "peer", ip, "follower-id", FollowerId)
 		var latestVersion int
 		err = client.Call("Peer.FollowMe", msg, &latestVersion)
 		////////////////////////////
@@ -242,7 +241,7 @@ func PeerAcceptThisNode(ip string) error {
 		startPeerHb(ip)
 		return nil
 	} else {
-		fmt.Println("Peer tried to connect to me, but am not leader and no election in progress")
+		Logger.Warn("Peer tried to follow, but not leader and no election in progress", "peer", ip)
 		return fmt.Errorf(MyAddr, "is not a leader")
 	}
 
@@ -254,17 +253,7 @@ func PeerFollowThatNode(ip string, prpc string, isRejoin bool) error {
 	electionLock.Lock()
 	defer electionLock.Unlock()
 
-	LocalAddr, err := net.ResolveTCPAddr("tcp", ":0")
-	if err != nil {
-		return err
-	}
-
-	PeerAddr, err := net.ResolveTCPAddr("tcp", ip)
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.DialTCP("tcp", LocalAddr, PeerAddr)
+	conn, err := mtls.Dial(ip)
 	if err != nil {
 		return err
 	}
@@ -287,9 +276,11 @@ func PeerFollowThatNode(ip string, prpc string, isRejoin bool) error {
 		defer VersionListLock.Unlock()
 		VersionList = append(VersionList, fileData...)
 		sortVersionList()
+		rebuildSequences()
+		rebuildMarkers()
 	}
 
-	fmt.Println("Prev numWrites: %d, New numWrites after sync: %d", len(VersionList)-len(fileData), len(VersionList))
+	Logger.Info("Synced with leader", "leader", ip, "received", len(fileData), "writes", len(VersionList))
 	return nil
 
 }
@@ -301,7 +292,7 @@ func PeerFollowThatNode(ip string, prpc string, isRejoin bool) error {
 func StartElection() (updateCh chan bool, receiveFollowerCh chan string) {
 	updateCh = make(chan bool, 32)
 	receiveFollowerCh = make(chan string, 1)
-	timeoutCh := createTimeout(ELECTION_WAIT_FOR_RESULTS)
+	timeoutCh := createTimeout(electionWait())
 
 	go func() {
 		for {
@@ -312,8 +303,8 @@ func StartElection() (updateCh chan bool, receiveFollowerCh chan string) {
 			case follower := <-receiveFollowerCh:
 				electionLock.Lock()
 				PotentialFollowerIps = append(PotentialFollowerIps, follower)
-				fmt.Println("Added follower:", follower)
-				if len(PotentialFollowerIps) >= int(MinReplicas) {
+				Logger.Info("Added potential follower", "peer", follower)
+				if len(PotentialFollowerIps) >= int(TopicSettings.MinReplicas) {
 					updateCh <- true
 					electionLock.Unlock()
 					return
@@ -332,18 +323,26 @@ func StartElection() (updateCh chan bool, receiveFollowerCh chan string) {
 	return updateCh, receiveFollowerCh
 }
 
-// Starts a goroutine that will write to the returned channel in <secs> seconds.
-func createTimeout(secs time.Duration) chan bool {
+// Starts a goroutine that will write to the returned channel after <wait>.
+func createTimeout(wait time.Duration) chan bool {
 	timeout := make(chan bool, 1)
 
 	go func() {
-		time.Sleep(secs * time.Second)
+		time.Sleep(wait)
 		timeout <- true
 	}()
 
 	return timeout
 }
 
+// Time an election waits for enough followers
+func electionWait() time.Duration {
+	if ms := ServerSettings().ElectionWait; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return ELECTION_WAIT_FOR_RESULTS * time.Second
+}
+
 // Return the lowest follower's ID and the corresponding IP. Also removes
 // the returned ID and IP from the list.
 func ScanFollowerList() (lowestFollowerIp string, lowestFollowerId int) {
@@ -353,10 +352,6 @@ func ScanFollowerList() (lowestFollowerIp string, lowestFollowerId int) {
 	lowestFollowerId = math.MaxInt32
 	lowestFollowerIp = ":0"
 
-	for ip, id := range DirectFollowersList {
-		fmt.Printf("ScanFollowerList: %s %d\n", ip, id)
-	}
-
 	// Scan for lowest follower ID
 	for ip, id := range DirectFollowersList {
 		if id < lowestFollowerId {
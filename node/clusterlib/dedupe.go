@@ -0,0 +1,130 @@
+package node
+
+import (
+	"fmt"
+
+	"../../structs"
+)
+
+// Sequences of each producer that a node remembers. A retry of an older
+// write is refused with a StaleSequenceError
+const DEDUPE_WINDOW = 1000
+
+// Producers that a node remembers. When more write, the one whose last write
+// is oldest is forgotten, and a retry of its writes is stored again
+const MAX_DEDUPE_PRODUCERS = 1000
+
+// Recent writes of one producer
+type producerWindow struct {
+	versions    map[uint64]int // sequence -> version
+	highest     uint64
+	lastVersion int
+}
+
+// producer id -> recent writes. Like VersionList it is guarded by
+// VersionListLock, and it is rebuilt from VersionList whenever that is
+// replaced, so a new leader has the same window as the old one
+var sequences = make(map[string]*producerWindow)
+
+// Returns the versions of a producer's records if the leader already has
+// them, or nil if it has none of them. Either all records of a write are
+// stored or none are, so a retry has all or none
+func DuplicateWrites(producerId string, first uint64, n int) ([]int, error) {
+	VersionListLock.Lock()
+	defer VersionListLock.Unlock()
+
+	window, ok := sequences[producerId]
+	if !ok {
+		return nil, nil
+	}
+
+	if window.highest >= DEDUPE_WINDOW && first <= window.highest-DEDUPE_WINDOW {
+		return nil, structs.StaleSequenceError(producerId)
+	}
+
+	versions := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if version, ok := window.versions[first+uint64(i)]; ok {
+			versions = append(versions, version)
+		}
+	}
+
+	switch len(versions) {
+	case 0:
+		return nil, nil
+	case n:
+		return versions, nil
+	default:
+		return nil, fmt.Errorf("Sequences %d to %d of producer %s overlap an earlier write", first, first+uint64(n)-1, producerId)
+	}
+}
+
+// Returns whether the node already stored fdata under the same version
+// Lock is manually set from caller
+func hasSequence(fdata FileData) bool {
+	if fdata.ProducerId == "" {
+		return false
+	}
+
+	window, ok := sequences[fdata.ProducerId]
+	if !ok {
+		return false
+	}
+
+	version, ok := window.versions[fdata.Sequence]
+	return ok && version == fdata.Version
+}
+
+// Lock is manually set from caller
+func recordSequence(fdata FileData) {
+	if fdata.ProducerId == "" {
+		return
+	}
+
+	window, ok := sequences[fdata.ProducerId]
+	if !ok {
+		if len(sequences) >= MAX_DEDUPE_PRODUCERS {
+			forgetOldestProducer()
+		}
+		window = &producerWindow{versions: make(map[uint64]int)}
+		sequences[fdata.ProducerId] = window
+	}
+
+	window.versions[fdata.Sequence] = fdata.Version
+	if fdata.Sequence > window.highest {
+		window.highest = fdata.Sequence
+	}
+	if fdata.Version > window.lastVersion {
+		window.lastVersion = fdata.Version
+	}
+
+	// Sweep now and then rather than on every write
+	if len(window.versions) > 2*DEDUPE_WINDOW {
+		for sequence := range window.versions {
+			if sequence+DEDUPE_WINDOW <= window.highest {
+				delete(window.versions, sequence)
+			}
+		}
+	}
+}
+
+// Lock is manually set from caller
+func forgetOldestProducer() {
+	oldest, oldestVersion := "", 0
+	for producerId, window := range sequences {
+		if oldest == "" || window.lastVersion < oldestVersion {
+			oldest, oldestVersion = producerId, window.lastVersion
+		}
+	}
+	delete(sequences, oldest)
+	Logger.Warn("Forgot the oldest producer, its retries are no longer deduplicated",
+		"producer", oldest, "last-version", oldestVersion, "producers", MAX_DEDUPE_PRODUCERS)
+}
+
+// Lock is manually set from caller
+func rebuildSequences() {
+	sequences = make(map[string]*producerWindow)
+	for _, fdata := range VersionList {
+		recordSequence(fdata)
+	}
+}
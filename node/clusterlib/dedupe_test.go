@@ -0,0 +1,121 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"../../structs"
+)
+
+// Records n writes of producerId from sequence first, stored from version
+func recordWrites(producerId string, first uint64, n int, version int) {
+	for i := 0; i < n; i++ {
+		recordSequence(FileData{ProducerId: producerId, Sequence: first + uint64(i), Version: version + i})
+	}
+}
+
+func TestDuplicateWrites(t *testing.T) {
+	tests := []struct {
+		name       string
+		producerId string
+		first      uint64
+		n          int
+		want       []int
+		wantErr    bool
+	}{
+		{"retry of one write", "p1", 4, 1, []int{14}, false},
+		{"retry of a batch", "p1", 2, 3, []int{12, 13, 14}, false},
+		{"new write", "p1", 10, 2, nil, false},
+		{"batch overlapping an earlier write", "p1", 9, 3, nil, true},
+		{"other producer", "p2", 0, 1, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sequences = make(map[string]*producerWindow)
+			recordWrites("p1", 0, 10, 10)
+
+			got, err := DuplicateWrites(tt.producerId, tt.first, tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DuplicateWrites() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DuplicateWrites() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateWritesWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     uint64
+		want      []int
+		wantStale bool
+	}{
+		{"oldest sequence in the window", DEDUPE_WINDOW + 2, []int{DEDUPE_WINDOW + 3}, false},
+		{"newest sequence", 2*DEDUPE_WINDOW + 1, []int{2*DEDUPE_WINDOW + 2}, false},
+		{"just past the window", DEDUPE_WINDOW + 1, nil, true},
+		{"far past the window", 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Sequences 0 to 2*DEDUPE_WINDOW+1 at versions from 1
+			sequences = make(map[string]*producerWindow)
+			recordWrites("p1", 0, 2*DEDUPE_WINDOW+2, 1)
+
+			got, err := DuplicateWrites("p1", tt.first, 1)
+			if _, stale := err.(structs.StaleSequenceError); stale != tt.wantStale {
+				t.Fatalf("DuplicateWrites(%d) error = %v, want stale %v", tt.first, err, tt.wantStale)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DuplicateWrites(%d) = %v, want %v", tt.first, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasSequence(t *testing.T) {
+	tests := []struct {
+		name  string
+		fdata FileData
+		want  bool
+	}{
+		{"stored", FileData{ProducerId: "p1", Sequence: 3, Version: 13}, true},
+		{"same sequence at another version", FileData{ProducerId: "p1", Sequence: 3, Version: 20}, false},
+		{"new sequence", FileData{ProducerId: "p1", Sequence: 10, Version: 20}, false},
+		{"unknown producer", FileData{ProducerId: "p2", Sequence: 3, Version: 13}, false},
+		{"no producer", FileData{Version: 13}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sequences = make(map[string]*producerWindow)
+			recordWrites("p1", 0, 10, 10)
+
+			if got := hasSequence(tt.fdata); got != tt.want {
+				t.Errorf("hasSequence(%+v) = %v, want %v", tt.fdata, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForgetOldestProducer(t *testing.T) {
+	sequences = make(map[string]*producerWindow)
+	for i := 0; i < MAX_DEDUPE_PRODUCERS; i++ {
+		recordWrites(string(rune('A'+i%26))+string(rune('a'+i/26)), 0, 1, i+1)
+	}
+
+	// The producer whose last write is oldest makes room for the new one
+	recordWrites("new", 0, 1, MAX_DEDUPE_PRODUCERS+1)
+	if len(sequences) != MAX_DEDUPE_PRODUCERS {
+		t.Fatalf("producers = %d, want %d", len(sequences), MAX_DEDUPE_PRODUCERS)
+	}
+	if _, ok := sequences["Aa"]; ok {
+		t.Errorf("oldest producer was kept")
+	}
+	if _, ok := sequences["new"]; !ok {
+		t.Errorf("new producer was not recorded")
+	}
+}
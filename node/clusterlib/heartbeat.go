@@ -1,42 +1,52 @@
 package node
 
 import (
-	"errors"
 	"fmt"
-	"log"
-	"net"
-	"net/rpc"
+	"sync"
 	"time"
 
+	"../../lib/serverclient"
 	"../../structs"
 )
 
+// Defaults for the peer heartbeats, in seconds. A peer is dead after
+// HBTIMEOUT without a heartbeat, unless the server's NodeSettings set how
+// many heartbeats may be missed
 const HBTIMEOUT = 4
 const HBINTERVAL = 2
 const SERVER_RECONNECT_WAIT = 10
 
-var ServerClient *rpc.Client
+var ServerClient *serverclient.Client
 
 var (
-	MinReplicas uint8
-	ClusterSize uint8
-	HBInterval  uint32
+	// Settings of the topic this node is part of. Fields that the topic does
+	// not set are filled in from the server's NodeSettings
+	TopicSettings structs.TopicSpec
+
+	// Failure domains this node runs in, given to the server on Register
+	Labels structs.NodeLabels
 )
 
 var serverDeathCh chan bool
 
-func InitiateServerConnection(serverIp, peerAddr string) {
+// serverIps are the addresses of every server replica
+func InitiateServerConnection(serverIps []string, peerAddr string) {
 	serverDeathCh = make(chan bool)
 
-	serverConnProtocol := func() error {
+	serverConnProtocol := func(reconnect bool) error {
 		// Connect to the Server
-		fmt.Println("Connecting to server...")
-		if err := ConnectToServer(serverIp); err != nil {
+		Logger.Info("Connecting to server", "servers", serverIps)
+		if err := ConnectToServer(serverIps); err != nil {
 			return err
 		}
 
-		err := AttemptRejoin(peerAddr)
-		if err != nil {
+		// A node that is still part of a cluster when the server dies or fails
+		// over must not be put back in the orphan pool
+		if reconnect && len(TopicName) > 0 {
+			if err := ServerRejoin(peerAddr); err != nil {
+				return err
+			}
+		} else if err := AttemptRejoin(peerAddr); err != nil {
 			ServerRegister(peerAddr)
 		}
 		go ServerHeartBeat(peerAddr)
@@ -48,10 +58,10 @@ func InitiateServerConnection(serverIp, peerAddr string) {
 		for {
 			select {
 			case <-serverDeathCh:
-				log.Println(ERR_COL + "SERVER HAS DIED" + ERR_END)
+				Logger.Error("Lost connection to the server")
 				for {
 					time.Sleep(SERVER_RECONNECT_WAIT * time.Second)
-					if err := serverConnProtocol(); err == nil {
+					if err := serverConnProtocol(true); err == nil {
 						break
 					}
 				}
@@ -59,48 +69,105 @@ func InitiateServerConnection(serverIp, peerAddr string) {
 		}
 	}()
 
-	if err := serverConnProtocol(); err != nil {
-		log.Fatalf(err.Error())
+	if err := serverConnProtocol(false); err != nil {
+		Logger.Fatal("Could not connect to the server", "servers", serverIps, "err", err)
 	}
 }
 
-func ConnectToServer(ip string) error {
-	LocalAddr, _ := net.ResolveTCPAddr("tcp", ":0")
-	ServerAddr, _ := net.ResolveTCPAddr("tcp", ip)
-	conn, err := net.DialTCP("tcp", LocalAddr, ServerAddr)
+// Connects to the replicated server. Calls on ServerClient fail over between
+// the replicas on their own
+func ConnectToServer(ips []string) error {
+	if ServerClient != nil {
+		ServerClient.Close()
+	}
+
+	client, err := serverclient.Dial(ips)
 	if err != nil {
-		return errors.New("Could not connect to server")
-	} else {
-		log.Println("Connecting to server on:", conn.LocalAddr().String())
-		ServerClient = rpc.NewClient(conn)
-		return nil
+		return err
 	}
+
+	ServerClient = client
+	return nil
 }
 
 func ServerRegister(addr string) {
 	var resp structs.NodeSettings
-	err := ServerClient.Call("TServer.Register", addr, &resp)
+	msg := structs.RegisterMsg{Address: addr, Labels: Labels}
+	err := ServerClient.Call("TServer.Register", msg, &resp)
 	if err != nil {
-		fmt.Printf("Error in heartbeat::Register()\n%s\n", err)
+		Logger.Error("Could not register with the server", "err", err)
+	}
+	applyServerSettings(resp)
+}
+
+// Tells the server that this drained node is leaving, so that it is not
+// reported dead when its heartbeats stop
+func ServerDeregister(addr string) {
+	var _ignored bool
+	if err := ServerClient.Call("TServer.Deregister", addr, &_ignored); err != nil {
+		Logger.Error("Could not deregister from the server", "err", err)
+	}
+}
+
+// The server's NodeSettings. Changed by UpdateServerSettings while the node runs
+var (
+	settingsLock   sync.RWMutex
+	serverSettings structs.NodeSettings
+)
+
+func ServerSettings() structs.NodeSettings {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return serverSettings
+}
+
+func applyServerSettings(settings structs.NodeSettings) {
+	UpdateServerSettings(settings)
+	TopicSettings = TopicSettings.WithDefaults(settings)
+}
+
+// Takes the settings the server pushed after reloading its config. The
+// topic's settings are kept, they were fixed when the topic was created
+func UpdateServerSettings(settings structs.NodeSettings) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	serverSettings = settings
+}
+
+// Interval between heartbeats to peers. Topics may set their own
+func peerHbInterval() time.Duration {
+	if TopicSettings.HeartBeat > 0 {
+		return time.Duration(TopicSettings.HeartBeat) * time.Millisecond
+	}
+	return HBINTERVAL * time.Second
+}
+
+// Time without heartbeats until a peer is considered dead
+func peerHbTimeout() time.Duration {
+	if missed := ServerSettings().MissedHeartbeats; missed > 0 {
+		return peerHbInterval() * time.Duration(missed)
+	}
+	return peerHbInterval() * HBTIMEOUT / HBINTERVAL
+}
+
+// Interval between heartbeats to the server, half the server's timeout
+func serverHbInterval() time.Duration {
+	if hb := ServerSettings().HeartBeat; hb > 0 {
+		return time.Duration(hb/2) * time.Millisecond
 	}
-	MinReplicas = resp.MinReplicas
-	ClusterSize = resp.ClusterSize
-	HBInterval = resp.HeartBeat
+	return HBINTERVAL * time.Second
 }
 
 func ServerHeartBeat(addr string) {
 	var _ignored bool
-	fmt.Printf("starting server hb of: %d\n", HBInterval)
-	interval := time.Duration(HBInterval / 2)
-	heartbeat := time.Tick(interval * time.Millisecond)
+	Logger.Debug("Starting server heartbeats", "interval", serverHbInterval())
 	for {
-		select {
-		case <-heartbeat:
-			err := ServerClient.Call("TServer.HeartBeat", addr, &_ignored)
-			if err != nil {
-				serverDeathCh <- true
-				return
-			}
+		// Read every time, the server may push a new heartbeat
+		time.Sleep(serverHbInterval())
+		err := ServerClient.Call("TServer.HeartBeat", addr, &_ignored)
+		if err != nil {
+			serverDeathCh <- true
+			return
 		}
 	}
 }
@@ -112,10 +179,9 @@ func PeerHeartbeat(ip string, reply *string, id int) error {
 	// Check if peer is in map, then write to its heartbeat channel
 	peer, ok := PeerMap.Get(ip)
 	if !ok {
-		fmt.Println("PeerHeartbeat: could not find", ip)
+		Logger.Warn("Heartbeat from unknown peer", "peer", ip)
 		return fmt.Errorf("%s not in peer list", ip)
 	}
-	//fmt.Println(id,": was successful")
 	peer.HbChan <- "hb"
 
 	return nil
@@ -133,13 +199,12 @@ func peerHbSender(id string) {
 	// Note, could use a ticker, but not sure what behaviour would be if
 	// tick occurs while not receiving, eg. occurs in the call.Done branch
 	// before it starts waiting on timeout to complete
-	timeout := createPeerTimeout(HBINTERVAL)
+	timeout := createPeerTimeout(peerHbInterval())
 
 	for {
 		arg := MyAddr
 		var reply string
 
-		// fmt.Printf("Sending Peer.Heartbeat, arg is %s\n", arg)
 		call := peer.PeerConn.Go("Peer.Heartbeat", arg, &reply, nil)
 		if call == nil {
 			// connection is dead - error
@@ -154,7 +219,7 @@ func peerHbSender(id string) {
 			return
 		case <-call.Done:
 			if call.Error != nil {
-				fmt.Printf("Peer.Heartbeat error: %s\n", call.Error)
+				Logger.Warn("Peer heartbeat failed", "peer", id, "err", call.Error)
 				peer.HbChan <- "die"
 				return
 			}
@@ -162,7 +227,7 @@ func peerHbSender(id string) {
 			// Wait until timeout is done so that full interval has passed
 			// before sending again.
 			<-timeout
-			timeout = createTimeout(HBINTERVAL)
+			timeout = createPeerTimeout(peerHbInterval())
 		}
 	}
 }
@@ -183,16 +248,22 @@ func peerHbHandler(id string) {
 	// single point of deletion for a peer connection.
 	defer func() {
 		// Delete peer from the map - can't talk to this guy anymore.
-		PeerMap.Delete(id)
+		// A connection that was already replaced, e.g. when a follower became
+		// this node's leader, is only closed: the peer itself is alive
+		replaced := !PeerMap.DeleteIf(id, peer.PeerConn)
 		peer.PeerConn.Close()
+		if replaced {
+			Logger.Debug("Closed replaced peer connection", "peer", id)
+			return
+		}
 
-		fmt.Printf("Peer %s connection has died, calling DeathFn\n", id)
+		Logger.Warn("Peer connection died", "peer", id)
 		peer.DeathFn(id)
 	}()
 
 	// Heartbeat checking loop - does not exit until a peer disconnects
 	for {
-		timeout := createTimeout(HBTIMEOUT)
+		timeout := createPeerTimeout(peerHbTimeout())
 
 		select {
 		case <-timeout:
@@ -204,18 +275,17 @@ func peerHbHandler(id string) {
 				// Peer failure by another function, exit
 				return
 			case "hb":
-				// fmt.Printf("HbHandler: received hb from <%s>\n", id)
 				continue
 			}
 		}
 	}
 }
 
-// Starts a goroutine that will write to the returned channel in <secs> seconds.
-func createPeerTimeout(secs time.Duration) (timeout chan bool) {
+// Starts a goroutine that will write to the returned channel after d.
+func createPeerTimeout(d time.Duration) (timeout chan bool) {
 	timeout = make(chan bool, 1)
 	go func() {
-		time.Sleep(secs * time.Second)
+		time.Sleep(d)
 		timeout <- true
 	}()
 	return timeout
@@ -223,35 +293,49 @@ func createPeerTimeout(secs time.Duration) (timeout chan bool) {
 
 // Function to check if there was a previous topic and we should join it now
 func AttemptRejoin(pRpcAddr string) error {
-	var topic structs.Topic
-	var resp structs.NodeSettings
+	var partition structs.Partition
 	// A topic name exists but a followerId is not set
 	if len(TopicName) > 0 && FollowerId == 0 {
-		err := ServerClient.Call("TServer.GetTopic", TopicName, &topic)
+		msg := structs.GetPartitionMsg{TopicName: TopicName, Partition: Partition}
+		err := ServerClient.Call("TServer.GetPartition", msg, &partition)
 		if err != nil {
-			fmt.Printf("Error in heartbeat::Rejoin()::GetTopic\n%s\n", err)
+			Logger.Warn("Could not look up partition to rejoin", "err", err)
 			return err
 		}
 
-		// Attempt to follow the leader
+		// Attempt to follow the leader of our partition
 		rejoin := true
-		err = PeerFollowThatNode(topic.Leaders[1], pRpcAddr, rejoin)
+		err = PeerFollowThatNode(partition.Leaders[1], pRpcAddr, rejoin)
 		if err != nil {
-			fmt.Printf("Error in heartbeat::Rejoin()::FollowLeader\n%s\n", err)
+			Logger.Warn("Could not follow leader to rejoin", "leader", partition.Leaders[1], "err", err)
 			return err
 		}
 
 		// Call Rejoin instead of Register and do register things
-		err = ServerClient.Call("TServer.Rejoin", pRpcAddr, &resp)
-		if err != nil {
-			fmt.Printf("Error in heartbeat::Rejoin()::Rejoin\n%s\n", err)
-			return err
-		}
-		MinReplicas = resp.MinReplicas
-		ClusterSize = resp.ClusterSize
-		HBInterval = resp.HeartBeat
-
-		return nil
+		return ServerRejoin(pRpcAddr)
 	}
 	return fmt.Errorf("Nothing to rejoin")
 }
+
+// Tells the server that this node is back as a member of its topic
+func ServerRejoin(pRpcAddr string) error {
+	var resp structs.NodeSettings
+	msg := structs.RegisterMsg{
+		Address:   pRpcAddr,
+		Labels:    Labels,
+		State:     structs.NodeFollower,
+		Topic:     TopicName,
+		Partition: Partition}
+	if NodeMode == Leader {
+		msg.State = structs.NodeLeader
+	}
+
+	err := ServerClient.Call("TServer.Rejoin", msg, &resp)
+	if err != nil {
+		Logger.Error("Could not rejoin with the server", "err", err)
+		return err
+	}
+	applyServerSettings(resp)
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package node
+
+import (
+	"../../lib/logging"
+)
+
+// Logs with the node's address, role, topic and partition at the time of
+// each line. Shared with node main
+var Logger = logging.New("node").With(
+	"node", logging.Valuer(func() interface{} { return MyAddr }),
+	"role", logging.Valuer(func() interface{} { return Role() }),
+	"topic", logging.Valuer(func() interface{} { return TopicName }),
+	"partition", logging.Valuer(func() interface{} { return Partition }))
+
+// Returns leader, follower or orphan
+func Role() string {
+	switch {
+	case TopicName == "":
+		return "orphan"
+	case NodeMode == Leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
@@ -0,0 +1,53 @@
+package node
+
+import (
+	"../../lib/metrics"
+)
+
+// Environment variable with the ip:port to serve Prometheus metrics on.
+// Unset serves none
+const ENV_METRICS_ADDR = "KTS_METRICS_ADDR"
+
+// Reasons a leader refuses a write, as the reason label of WritesRejected
+const (
+	RejectUnauthorized  = "unauthorized"
+	RejectThrottled     = "throttled"
+	RejectNotLeader     = "not_leader"
+	RejectNotReplicated = "not_replicated"
+	RejectDisk          = "disk"
+	RejectDuplicate     = "duplicate" // Retried too late, or overlapping an earlier write
+	RejectTxnEnded      = "txn_ended" // Written in a transaction that already ended
+)
+
+var (
+	WritesAccepted = metrics.NewCounter("kts_node_writes_accepted_total",
+		"Writes this node stored as leader")
+	WritesDeduplicated = metrics.NewCounter("kts_node_writes_deduplicated_total",
+		"Retried writes this node already had as leader, which were not stored again")
+	WritesRejected = metrics.NewCounterVec("kts_node_writes_rejected_total",
+		"Writes this node refused as leader, by reason", "reason")
+	ConfirmWritesSeconds = metrics.NewHistogram("kts_node_confirm_writes_seconds",
+		"Time for a write to be confirmed or refused by the followers", nil)
+	ReplicationFailures = metrics.NewCounterVec("kts_node_replication_failures_total",
+		"Writes a follower did not confirm, by the follower's PeerRpc address", "follower")
+	ElectionsStarted = metrics.NewCounter("kts_node_elections_started_total",
+		"Elections this node ran as the lowest follower")
+	ElectionsWon = metrics.NewCounter("kts_node_elections_won_total",
+		"Elections that made this node the leader")
+	diskWriteSeconds = metrics.NewHistogram("kts_node_disk_write_seconds",
+		"Time to write the VersionList to disk", nil)
+)
+
+func init() {
+	metrics.NewGaugeVecFunc("kts_node_role", "1 for the node's current role", "role", func() map[string]float64 {
+		roles := map[string]float64{"leader": 0, "follower": 0, "orphan": 0}
+		roles[Role()] = 1
+		return roles
+	})
+
+	metrics.NewGaugeFunc("kts_node_version_list_length", "Writes in the node's VersionList", func() float64 {
+		VersionListLock.Lock()
+		defer VersionListLock.Unlock()
+		return float64(len(VersionList))
+	})
+}
@@ -1,8 +1,15 @@
 package node
 
+import (
+	"../../structs"
+)
+
 // Structs for node-based p2p messages
 
 type FollowMeMsg struct {
+	Topic       string
+	Partition   int
+	Spec        structs.TopicSpec
 	LeaderIp    string
 	FollowerIps map[string]int
 	YourId      int
@@ -14,14 +21,26 @@ type ModFollowerListMsg struct {
 	FollowerId int
 }
 
+// Writes of one WriteToCluster or WriteBatchToCluster, which the follower
+// stores together
 type PropagateWriteReq struct {
-	Topic      string
-	Data       string
-	VersionNum int
-	LeaderId   string
+	Topic     string
+	Partition int
+	Writes    []FileData // In version order
+	LeaderId  string
+	Trace     structs.TraceContext // Leader's span for this follower
 }
 
 type FollowMsg struct {
 	Ip             string       // Follower's ip address
 	ContainingData map[int]bool // Map of versionNum -> bool that the follower node contains
 }
+
+// Leader -> Follower message handing over leadership of a partition
+type TakeLeadershipMsg struct {
+	Topic         string
+	Partition     int
+	Spec          structs.TopicSpec
+	FollowerIps   []string // The other followers, without the old leader
+	LatestVersion int      // The new leader must have every write up to this one
+}
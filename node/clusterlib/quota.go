@@ -0,0 +1,205 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"../../structs"
+)
+
+// Seconds a client's quotas are used before the server is asked again.
+// Bounds how long a quota change takes to reach the leader
+const QUOTA_CACHE_TTL = 10
+
+// Seconds the last known quotas are used without asking again after the
+// server could not be reached
+const QUOTA_RETRY_SECONDS = 2
+
+// A client's bucket is dropped once it has been idle this long
+const QUOTA_IDLE_SECONDS = 60
+
+// Token bucket over one dimension of a quota. Holds at most one second of
+// the rate, so a client may burst up to its quota after being idle
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate float64, now time.Time) {
+	if b.rate != rate {
+		b.rate = rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// Time until n tokens may be taken. A write larger than the bucket only
+// needs a full bucket and leaves it in debt
+func (b *bucket) wait(n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	if n > b.rate {
+		n = b.rate
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// Buckets for messages and bytes
+type quotaBuckets struct {
+	messages bucket
+	bytes    bucket
+}
+
+func newQuotaBuckets(quota structs.Quota, now time.Time) *quotaBuckets {
+	return &quotaBuckets{
+		messages: bucket{rate: quota.MessagesPerSec, tokens: quota.MessagesPerSec, last: now},
+		bytes:    bucket{rate: quota.BytesPerSec, tokens: quota.BytesPerSec, last: now}}
+}
+
+func (q *quotaBuckets) wait(quota structs.Quota, messages float64, size float64, now time.Time) time.Duration {
+	q.messages.refill(quota.MessagesPerSec, now)
+	q.bytes.refill(quota.BytesPerSec, now)
+
+	waitMessages, waitBytes := q.messages.wait(messages), q.bytes.wait(size)
+	if waitMessages > waitBytes {
+		return waitMessages
+	}
+	return waitBytes
+}
+
+func (q *quotaBuckets) take(messages float64, size float64) {
+	q.messages.take(messages)
+	q.bytes.take(size)
+}
+
+type cachedQuota struct {
+	limits structs.QuotaLimits
+	expiry time.Time
+}
+
+var (
+	quotaLock    sync.Mutex
+	quotaCache   = make(map[string]cachedQuota)   // topic/clientId -> quotas from the server
+	clientQuotas = make(map[string]*quotaBuckets) // topic/clientId ->
+	topicQuotas  = make(map[string]*quotaBuckets) // topic ->
+)
+
+// Checks messages writes of size bytes in total by clientId against the
+// client's and the topic's quotas, and counts them if both allow them.
+// Returns a ThrottledError with the time until they would be allowed otherwise
+func ThrottleWrite(topic string, clientId string, messages int, size int) error {
+	limits := quotaLimits(topic, clientId)
+	if limits.Client.Unlimited() && limits.Topic.Unlimited() {
+		return nil
+	}
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	now := time.Now()
+	key := topic + "/" + clientId
+
+	client, ok := clientQuotas[key]
+	if !ok {
+		client = newQuotaBuckets(limits.Client, now)
+		clientQuotas[key] = client
+	}
+
+	all, ok := topicQuotas[topic]
+	if !ok {
+		all = newQuotaBuckets(limits.Topic, now)
+		topicQuotas[topic] = all
+	}
+
+	waitClient := client.wait(limits.Client, float64(messages), float64(size), now)
+	waitTopic := all.wait(limits.Topic, float64(messages), float64(size), now)
+
+	switch {
+	case waitClient >= waitTopic && waitClient > 0:
+		return structs.ThrottledError{
+			RetryAfter: waitClient,
+			Reason:     fmt.Sprintf("client %s is over its quota of %s on %s", clientId, limits.Client, topic)}
+	case waitTopic > 0:
+		return structs.ThrottledError{
+			RetryAfter: waitTopic,
+			Reason:     fmt.Sprintf("topic %s is over its quota of %s on this partition", topic, limits.Topic)}
+	}
+
+	client.take(float64(messages), float64(size))
+	all.take(float64(messages), float64(size))
+	return nil
+}
+
+// Returns the quotas of clientId on topic, from the cache or the server.
+// Quotas only protect the cluster, so writes are not refused while the server
+// cannot be reached: the last known quotas are kept, or none without them
+func quotaLimits(topic string, clientId string) structs.QuotaLimits {
+	key := topic + "/" + clientId
+
+	quotaLock.Lock()
+	cached, ok := quotaCache[key]
+	quotaLock.Unlock()
+
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.limits
+	}
+
+	var limits structs.QuotaLimits
+	ttl := QUOTA_CACHE_TTL * time.Second
+	msg := structs.QuotaMsg{Topic: topic, ClientId: clientId}
+	if err := ServerClient.Call("TServer.GetQuota", msg, &limits); err != nil {
+		checkError(err, "GetQuota")
+		limits = cached.limits
+
+		// Not every write waits for the server while it is down
+		ttl = QUOTA_RETRY_SECONDS * time.Second
+	}
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	now := time.Now()
+	if len(quotaCache) >= AUTH_CACHE_SWEEP {
+		sweepQuotas(now)
+	}
+
+	quotaCache[key] = cachedQuota{limits, now.Add(ttl)}
+	return limits
+}
+
+// Drops expired quotas and the buckets of idle clients
+// Lock is manually set from caller
+func sweepQuotas(now time.Time) {
+	for key, cached := range quotaCache {
+		if now.After(cached.expiry) {
+			delete(quotaCache, key)
+		}
+	}
+
+	idle := now.Add(-QUOTA_IDLE_SECONDS * time.Second)
+	for key, buckets := range clientQuotas {
+		if buckets.messages.last.Before(idle) {
+			delete(clientQuotas, key)
+		}
+	}
+}
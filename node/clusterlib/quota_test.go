@@ -0,0 +1,86 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"../../structs"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name    string
+		rate    float64
+		taken   float64       // Taken from a full bucket at start
+		elapsed time.Duration // Before asking for n
+		newRate float64       // Rate at the second ask, 0 keeps rate
+		n       float64
+		want    time.Duration
+	}{
+		{"unlimited", 0, 1000, 0, 0, 1000, 0},
+		{"full bucket", 10, 0, 0, 0, 10, 0},
+		{"empty bucket", 10, 10, 0, 0, 5, 500 * time.Millisecond},
+		{"refilled", 10, 10, time.Second, 0, 10, 0},
+		{"partly refilled", 10, 10, 200 * time.Millisecond, 0, 5, 300 * time.Millisecond},
+		{"refill caps at one second", 10, 0, time.Hour, 0, 11, 0},
+		{"larger than the bucket needs it full", 10, 0, 0, 0, 100, 0},
+		{"debt is paid off first", 10, 30, 0, 0, 1, 2100 * time.Millisecond},
+		{"lower rate caps the tokens", 10, 0, 0, 2, 2, 0},
+		{"lower rate applies to the wait", 10, 10, 0, 2, 1, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bucket{rate: tt.rate, tokens: tt.rate, last: start}
+			b.take(tt.taken)
+
+			rate := tt.rate
+			if tt.newRate != 0 {
+				rate = tt.newRate
+			}
+
+			b.refill(rate, start.Add(tt.elapsed))
+			if got := b.wait(tt.n); got != tt.want {
+				t.Errorf("wait(%v) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaBuckets(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name     string
+		quota    structs.Quota
+		messages float64
+		size     float64
+		want     time.Duration
+	}{
+		{"unlimited", structs.Quota{}, 1000, 1 << 20, 0},
+		{"within both", structs.Quota{MessagesPerSec: 10, BytesPerSec: 100}, 5, 50, 0},
+		{"over messages", structs.Quota{MessagesPerSec: 10, BytesPerSec: 1000}, 15, 50, 1500 * time.Millisecond},
+		{"over bytes", structs.Quota{MessagesPerSec: 100, BytesPerSec: 100}, 1, 150, 1500 * time.Millisecond},
+		{"longest wait wins", structs.Quota{MessagesPerSec: 10, BytesPerSec: 100}, 20, 125, 2 * time.Second},
+		{"only bytes limited", structs.Quota{BytesPerSec: 100}, 1000, 150, 1500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuotaBuckets(tt.quota, start)
+
+			// The first write fits a full bucket. The second waits for the debt
+			// to be paid off and then for its own tokens
+			if got := q.wait(tt.quota, tt.messages, tt.size, start); got != 0 {
+				t.Fatalf("first wait = %v, want 0", got)
+			}
+			q.take(tt.messages, tt.size)
+
+			if got := q.wait(tt.quota, tt.messages, tt.size, start); got != tt.want {
+				t.Errorf("second wait = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
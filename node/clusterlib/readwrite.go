@@ -5,25 +5,39 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
+
+	"../../lib/tracing"
+	"../../structs"
 )
 
-const GREEN_COL = "\x1b[32;1m"
-const ERR_COL = "\x1b[31;1m"
-const ERR_END = "\x1b[0m"
+// Seconds between passes that drop the data of expired writes
+const COMPACT_INTERVAL = 60
 
 type FileData struct {
-	Version int    `json:"version"`
-	Data    string `json:"data"`
+	Version   int    `json:"version"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"timestamp"` // Unix nanoseconds when the leader accepted the write
+
+	// Kept with the write so that every replica can rebuild the dedupe window
+	ProducerId string `json:"producer-id,omitempty"`
+	Sequence   uint64 `json:"sequence,omitempty"`
+
+	// Set on records written in a transaction, and on the marker the server
+	// has written once the transaction ended. Markers carry no data
+	TxnId  string           `json:"txn-id,omitempty"`
+	Marker structs.TxnState `json:"marker,omitempty"`
 }
 
 type ClusterData struct {
-	Topic   string     `json:"topic"`
-	Dataset []FileData `json: "dataset"`
+	Topic     string            `json:"topic"`
+	Partition int               `json:"partition"`
+	Spec      structs.TopicSpec `json:"spec"`
+	Dataset   []FileData        `json: "dataset"`
 }
 
 // DataPath where files are written to disk
@@ -31,6 +45,9 @@ var DataPath string
 
 var TopicName string
 
+// The partition of TopicName that this node's cluster holds
+var Partition int
+
 // For a Leader node, this list is guaranteed to be in order and continuous
 // since a Leader serializes the Writes but we cannot guarantee
 // the time arrival of those Writes to Follower nodes
@@ -53,13 +70,13 @@ var (
 type FileSystemError string
 
 func (e FileSystemError) Error() string {
-	return fmt.Sprintf(string(e))
+	return string(e)
 }
 
 type InsufficientConfirmedWritesError string
 
 func (e InsufficientConfirmedWritesError) Error() string {
-	return fmt.Sprintf("Could not replicate write enough times. %s", string(e))
+	return fmt.Sprintf("%s %s", structs.NotReplicatedPrefix, string(e))
 }
 
 type IncompleteDataError string
@@ -68,6 +85,12 @@ func (e IncompleteDataError) Error() string {
 	return fmt.Sprintf("There is an incomplete dataset. Cannot read.")
 }
 
+type NoInSyncFollowerError string
+
+func (e NoInSyncFollowerError) Error() string {
+	return fmt.Sprintf("No follower of %s is in sync to take leadership", string(e))
+}
+
 ////////////////////////////////////
 
 func MountFiles(path string, writeCh chan int) {
@@ -81,8 +104,7 @@ func MountFiles(path string, writeCh chan int) {
 	if _, err := os.Stat(fname); os.IsNotExist(err) {
 		f, err := os.Create(fname)
 		if err != nil {
-			checkError(err, "MountFiles CreateFiles")
-			log.Fatalf("Couldn't create file [%s]", fname)
+			Logger.Fatal("Could not create data file", "path", fname, "err", err)
 		}
 
 		f.Sync()
@@ -95,85 +117,171 @@ func MountFiles(path string, writeCh chan int) {
 	var clusterData ClusterData
 	err := readFromDisk(fname, &clusterData)
 	TopicName = clusterData.Topic
+	Partition = clusterData.Partition
+	TopicSettings = clusterData.Spec
 	VersionList = clusterData.Dataset
+	rebuildSequences()
+	rebuildMarkers()
 
 	if err != nil {
-		checkError(err, "MountFiles DiskRead")
-		log.Fatalf("Could not read from disk")
+		Logger.Fatal("Could not read data file", "path", fname, "err", err)
 	}
 }
 
-// Add the Write to the VersionList and commit Write to disk
-func WriteNode(topic, data string, version int) error {
+// Add the Writes to the VersionList and commit them to disk in one write
+// trace is the span of the leader's write or of its request to this follower
+func WriteNode(topic string, partition int, writes []FileData, trace structs.TraceContext) (err error) {
+	span := tracing.Start("node.WriteNode", trace)
+	span.Set("role", Role())
+	span.Set("writes", len(writes))
+	defer func() { span.End(err) }()
+
+	if len(writes) == 0 {
+		return nil
+	}
+	first, last := writes[0].Version, writes[len(writes)-1].Version
+	span.Set("version", first)
+
 	if TopicName != "" && topic != TopicName {
 		return errors.New("Writing to wrong topic")
 	}
 
+	if TopicName != "" && partition != Partition {
+		return errors.New("Writing to wrong partition")
+	}
+
 	TopicName = topic
+	Partition = partition
 	VersionListLock.Lock()
 
 	// Minor optimizations.
 	// We're assuming that writes often come in order and if its greater than the last
 	// item in the list, just append it.
-	versionLen := len(VersionList)
-	if versionLen == 0 {
-		FirstMismatch++
-	} else {
-		last := VersionList[versionLen-1]
-		if last.Version <= version {
+	for _, fdata := range writes {
+		// A retry of a write this node already stored, e.g. after the leader
+		// could not replicate it to enough followers
+		if hasSequence(fdata) {
+			continue
+		}
+
+		versionLen := len(VersionList)
+		if versionLen == 0 {
 			FirstMismatch++
+		} else {
+			last := VersionList[versionLen-1]
+			if last.Version <= fdata.Version {
+				FirstMismatch++
+			}
 		}
-	}
 
-	VersionList = append(VersionList, FileData{
-		Version: version,
-		Data:    data,
-	})
+		VersionList = append(VersionList, fdata)
+		recordSequence(fdata)
+		recordMarker(fdata)
+	}
 	VersionListLock.Unlock()
 
-	if err := writeToDisk(DataPath); err != nil {
-		log.Println("ERROR WRITING TO DISK IN WRITEFILE")
+	disk := tracing.Start("node.writeToDisk", span.Context())
+	err = writeToDisk(DataPath)
+	disk.End(err)
+	if err != nil {
+		Logger.Error("Could not write to disk", "first-version", first, "last-version", last, "err", err)
 		return err
 	}
 	return nil
 }
 
-// Returns confirmed writes the node contains
+// Returns confirmed writes the node contains. Writes older than the topic's
+// retention, and writes of transactions that have not committed, are left out
 // Errors:
 // IncompleteDataError - Not all writes have been received
 func ReadNode(topic string) ([]string, error) {
-	if data, hasCompleteData := HasAllData(); hasCompleteData {
-		return data, nil
+	records, err := ReadNodeRecords(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]string, len(records))
+	for i, record := range records {
+		data[i] = record.Data
+	}
+	return data, nil
+}
+
+// Same as ReadNode, with the version of each write
+func ReadNodeRecords(topic string) ([]structs.Record, error) {
+	resolvePendingTxns()
+
+	if records, hasCompleteData := readableRecords(); hasCompleteData {
+		return records, nil
 	}
 
 	return nil, IncompleteDataError("")
 }
 
+// Returns whether a write is past the topic's retention
+func isExpired(fdata FileData) bool {
+	if TopicSettings.Retention <= 0 || fdata.Timestamp == 0 {
+		return false
+	}
+
+	retention := time.Duration(TopicSettings.Retention) * time.Millisecond
+	return time.Since(time.Unix(0, fdata.Timestamp)) > retention
+}
+
+// Drops the data of writes past the topic's retention and rewrites the data
+// file if any was dropped. The writes themselves stay in VersionList with
+// their version, producer sequence and transaction, since reads, the dedupe
+// window and rejoining followers rely on versions without gaps
+func CompactExpired() (int, error) {
+	VersionListLock.Lock()
+	defer VersionListLock.Unlock()
+
+	compacted := 0
+	for i, fdata := range VersionList {
+		if fdata.Data != "" && isExpired(fdata) {
+			VersionList[i].Data = ""
+			compacted++
+		}
+	}
+
+	if compacted == 0 {
+		return 0, nil
+	}
+
+	if err := writeToDisk(DataPath); err != nil {
+		return compacted, err
+	}
+
+	Logger.Info("Dropped expired writes", "writes", compacted)
+	return compacted, nil
+}
+
+// Compacts the data file every COMPACT_INTERVAL. Topics without a retention
+// keep their writes forever
+func CompactLoop() {
+	for {
+		time.Sleep(COMPACT_INTERVAL * time.Second)
+		CompactExpired()
+	}
+}
+
 // writeStatusCh - Channel to wait on for peers to write to whether they have confirmed the write
 // numRequiredWrites - Needed number of confirmed writes to reach majority
 // maxFailures - Number of unconfirmed writes until we should return (otherwise could wait indefinitely for numRequiredWrites)
 // Returns a channel with whether the Write was replicated
 func CountConfirmedWrites(writeStatusCh chan bool, numRequiredWrites, maxFailures uint8) chan bool {
-	writeReplicatedCh := make(chan bool)
+	writeReplicatedCh := make(chan bool, 1)
 	go func() {
 		numWrites, numFailures := uint8(0), uint8(0)
-		for {
-			if numRequiredWrites >= numWrites {
-				writeReplicatedCh <- true
-			}
-
-			if numFailures > maxFailures {
-				writeReplicatedCh <- false
-			}
-			select {
-			case writeSucceeded := <-writeStatusCh:
-				if writeSucceeded {
-					numWrites++
-				} else {
-					numFailures++
-				}
+		for numWrites < numRequiredWrites && numFailures <= maxFailures {
+			if <-writeStatusCh {
+				numWrites++
+			} else {
+				numFailures++
 			}
 		}
+
+		writeReplicatedCh <- numWrites >= numRequiredWrites
 	}()
 
 	return writeReplicatedCh
@@ -190,7 +298,7 @@ func DiffMissingData(containingData map[int]bool) []FileData {
 	VersionListLock.Unlock()
 
 	if len(containingData) != versionLen {
-		fmt.Println(ERR_COL+"DiffsMissingData:: Follower node has %d numWrites, Leader node has %d numWrites"+ERR_END, len(containingData), versionLen)
+		Logger.Info("Follower is missing writes", "follower-writes", len(containingData), "writes", versionLen)
 		for i := 0; i < versionLen; i++ {
 			if !containingData[i+1] { // writeId's begin at 1, so we +1 compared to index i
 				missingData = append(missingData, VersionList[i])
@@ -210,14 +318,13 @@ func GetMissingData(latestVersion int) error {
 
 	// No data has been written
 	versionLen := len(VersionList)
-	fmt.Printf("Version len is: %d, latestVersion: %d\n", versionLen, latestVersion)
+	Logger.Info("Rebuilding data", "writes", versionLen, "version", latestVersion)
 	if latestVersion == 0 || latestVersion == versionLen {
 		return nil
 	}
 
 	// Find missing versions
 	var missingVersions map[int]bool = make(map[int]bool)
-	fmt.Printf("FirstMismatch: %d, Missing Versions: %+v", FirstMismatch, missingVersions)
 	// i is for index in the VersionList
 	// m the index we're looking for
 	for i, m := FirstMismatch, FirstMismatch; i < latestVersion; i, m = i+1, m+1 {
@@ -255,16 +362,16 @@ func GetMissingData(latestVersion int) error {
 
 		peer, ok := PeerMap.Get(ip)
 		if !ok {
-			fmt.Println("Peer died")
+			Logger.Warn("Follower died before sending missing writes", "peer", ip)
 			continue
 		}
 
 		var writeData []FileData
 
-		fmt.Println(ERR_COL+"Missing versions is:"+ERR_END+"%+v", missingVersions)
+		Logger.Info("Asking follower for missing writes", "peer", ip, "missing", len(missingVersions), "first-mismatch", FirstMismatch)
 		err := peer.PeerConn.Call("Peer.GetWrites", missingVersions, writeData)
 		if err != nil {
-			fmt.Println(ERR_COL+"Err to GetWrites for Peer [%s]"+ERR_END, ip)
+			Logger.Warn("Could not get missing writes from follower", "peer", ip, "err", err)
 			continue
 		}
 
@@ -274,7 +381,7 @@ func GetMissingData(latestVersion int) error {
 	}
 
 	if len(missingVersions) != 0 {
-		log.Println(ERR_COL + "Data is missing. Could not get data from followers" + ERR_END)
+		Logger.Error("Data is missing. Could not get it from the followers", "missing", len(missingVersions))
 		return IncompleteDataError("")
 	}
 
@@ -283,15 +390,29 @@ func GetMissingData(latestVersion int) error {
 
 ///////////////Writing to disk helpers /////////////////
 func writeToDisk(path string) error {
+	defer diskWriteSeconds.ObserveSince(time.Now())
+
 	fileData := ClusterData{
-		Topic:   TopicName,
-		Dataset: VersionList,
+		Topic:     TopicName,
+		Partition: Partition,
+		Spec:      TopicSettings,
+		Dataset:   VersionList,
 	}
 
 	fname := filepath.Join(path, "data.json")
 	contents, err := json.MarshalIndent(fileData, "", "  ")
 	if err = ioutil.WriteFile(fname, contents, 0644); err != nil {
-		log.Println(ERR_COL + "ERROR WRITING TO DISK" + ERR_END)
+		Logger.Error("Could not write data file", "path", fname, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+func removeFromDisk(path string) error {
+	fname := filepath.Join(path, "data.json")
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		Logger.Error("Could not remove data file", "path", fname, "err", err)
 		return err
 	}
 
@@ -306,7 +427,7 @@ func readFromDisk(fname string, clusterData *ClusterData) error {
 	}
 
 	if len(contents) == 0 {
-		log.Println("Reading from disk ... No ClusterData")
+		Logger.Info("Data file is empty", "path", fname)
 		return nil
 	}
 
@@ -330,31 +451,35 @@ func sortVersionList() {
 	for i, fdata := range VersionList {
 		if i+1 != fdata.Version {
 			FirstMismatch = i
-			fmt.Println(GREEN_COL+"After sorting ... First Mismatch: %d"+ERR_END, FirstMismatch)
+			Logger.Debug("Sorted VersionList", "first-mismatch", FirstMismatch)
 			return
 		}
 		j++
 	}
 
 	FirstMismatch = j
-	fmt.Println(GREEN_COL+"After sorting ... First Mismatch: %d"+ERR_END, FirstMismatch)
+	Logger.Debug("Sorted VersionList", "first-mismatch", FirstMismatch)
 }
 
-// Returns list of data (empty list if does not contain all data),
-func HasAllData() (data []string, hasAllData bool) {
+// Returns the readable writes (empty list if does not contain all data),
+func readableRecords() (records []structs.Record, hasAllData bool) {
 	VersionListLock.Lock()
 	defer VersionListLock.Unlock()
 
-	data = make([]string, 0)
+	records = make([]structs.Record, 0)
 	for i, fdata := range VersionList {
 		if i+1 != fdata.Version {
 			return nil, false
 		}
 
-		data = append(data, fdata.Data)
+		if isExpired(fdata) || !txnVisible(fdata) {
+			continue
+		}
+
+		records = append(records, structs.Record{Version: fdata.Version, Data: fdata.Data})
 	}
 
-	return data, true
+	return records, true
 }
 
 // Return the highest version number the node has. If node has no data, returns 0
@@ -379,14 +504,53 @@ func GetLatestVersion() int {
 	return max
 }
 
+// Returns the number of writes the node has and whether there are gaps in their
+// versions. Unlike readableRecords, VersionList is not required to be sorted
+func countWrites() (numWrites int, hasAllData bool) {
+	VersionListLock.Lock()
+	defer VersionListLock.Unlock()
+
+	versions := make([]int, 0, len(VersionList))
+	for _, fdata := range VersionList {
+		versions = append(versions, fdata.Version)
+	}
+	sort.Ints(versions)
+
+	for i, v := range versions {
+		if i+1 != v {
+			return len(versions), false
+		}
+	}
+
+	return len(versions), true
+}
+
+// Returns a copy of the node's topic and VersionList, sorted by version
+func GetClusterData() ClusterData {
+	VersionListLock.Lock()
+	defer VersionListLock.Unlock()
+
+	dataset := make([]FileData, len(VersionList))
+	copy(dataset, VersionList)
+	sort.Slice(dataset, func(i, j int) bool {
+		return dataset[i].Version < dataset[j].Version
+	})
+
+	return ClusterData{
+		Topic:     TopicName,
+		Partition: Partition,
+		Spec:      TopicSettings,
+		Dataset:   dataset,
+	}
+}
+
 /////////////// End VersionList Helpers ///////////////////
 
 func printVersionList() {
-	fmt.Println("Printing versionlist ...")
-
+	versions := make([]int, len(VersionList))
 	for i, v := range VersionList {
-		fmt.Printf("Index: %d, version: %+v\n", i, v)
+		versions[i] = v.Version
 	}
 
-	fmt.Println("Version length is ... : %d", len(VersionList))
+	Logger.Debug("VersionList", "versions", versions)
 }
@@ -0,0 +1,48 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountConfirmedWrites(t *testing.T) {
+	tests := []struct {
+		name        string
+		required    uint8
+		maxFailures uint8
+		statuses    []bool
+		want        bool
+		decided     bool // Whether the statuses are enough for a verdict
+	}{
+		{"no confirmations yet", 2, 1, nil, false, false},
+		{"one of two", 2, 1, []bool{true}, false, false},
+		{"two of two", 2, 1, []bool{true, true}, true, true},
+		{"failure within the allowed", 2, 1, []bool{false, true}, false, false},
+		{"enough despite a failure", 2, 1, []bool{false, true, true}, true, true},
+		{"too many failures", 2, 1, []bool{false, false}, false, true},
+		{"nothing required", 0, 1, nil, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusCh := make(chan bool, len(tt.statuses))
+			for _, status := range tt.statuses {
+				statusCh <- status
+			}
+
+			select {
+			case got := <-CountConfirmedWrites(statusCh, tt.required, tt.maxFailures):
+				if !tt.decided {
+					t.Fatalf("verdict %v before enough followers answered", got)
+				}
+				if got != tt.want {
+					t.Errorf("verdict = %v, want %v", got, tt.want)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.decided {
+					t.Errorf("no verdict, want %v", tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"../../lib/mtls"
+	"../../structs"
+)
+
+// Seconds a transaction the server does not know is taken as aborted before
+// the server is asked again
+const TXN_UNKNOWN_TTL = 60
+
+// Markers of a transaction in this node's partition
+type txnMarker struct {
+	State    structs.TxnState // Committed or aborted
+	Version  int              // Of the outcome's marker
+	Released bool             // Has the release marker of a visible transaction
+}
+
+// txn id -> marker. Like VersionList it is guarded by VersionListLock, and it
+// is rebuilt from VersionList whenever that is replaced
+var markers = make(map[string]txnMarker)
+
+// Outcome of a transaction that has no marker here yet, or no release marker
+type txnOutcome struct {
+	State  structs.TxnState // Committed, visible or aborted
+	Expiry time.Time        // Zero for outcomes the server gave, which are final
+}
+
+// A client whose writes in a transaction the server has allowed
+type txnWriter struct {
+	TxnId    string
+	Token    string
+	CertName string
+	CertRole string
+}
+
+var (
+	txnOutcomesLock sync.Mutex
+	txnOutcomes     = make(map[string]txnOutcome)
+	txnWriters      = make(map[txnWriter]time.Time) // -> expiry of the check
+)
+
+// Returns whether the node knows that a transaction has ended, so that late
+// writes to it are refused
+func TxnEnded(txnId string) bool {
+	VersionListLock.Lock()
+	_, marked := markers[txnId]
+	VersionListLock.Unlock()
+	if marked {
+		return true
+	}
+
+	txnOutcomesLock.Lock()
+	defer txnOutcomesLock.Unlock()
+	_, ended := knownOutcome(txnId, time.Now())
+	return ended
+}
+
+// Checks with the server on a client's first write in a transaction that the
+// transaction is open, that the client began it and that it includes this
+// partition. Allowed clients are remembered until the transaction's longest
+// timeout. Ended and unknown transactions are remembered as their outcome, so
+// that later writes to them are refused without asking again
+func CheckTxnWrite(txnId string, topic string, partition int, token string, caller mtls.Identity) error {
+	key := txnWriter{TxnId: txnId, Token: token, CertName: caller.Name, CertRole: caller.Role}
+	now := time.Now()
+
+	txnOutcomesLock.Lock()
+	expiry, allowed := txnWriters[key]
+	txnOutcomesLock.Unlock()
+
+	if allowed && now.Before(expiry) {
+		return nil
+	}
+
+	msg := structs.TxnWriteMsg{
+		TxnId:     txnId,
+		Topic:     topic,
+		Partition: partition,
+		Token:     token,
+		CertName:  caller.Name,
+		CertRole:  caller.Role}
+
+	var state structs.TxnState
+	if err := ServerClient.Call("TServer.CheckTxnWrite", msg, &state); err != nil {
+		if !structs.IsUnauthorizedError(err) {
+			checkError(err, "CheckTxnWrite")
+		}
+		return err
+	}
+
+	txnOutcomesLock.Lock()
+	defer txnOutcomesLock.Unlock()
+
+	if len(txnWriters) >= AUTH_CACHE_SWEEP || len(txnOutcomes) >= AUTH_CACHE_SWEEP {
+		sweepTxns(now)
+	}
+
+	if state == structs.TxnOpen {
+		txnWriters[key] = now.Add(structs.MAX_TXN_TIMEOUT * time.Millisecond)
+		return nil
+	}
+
+	setOutcome(txnId, state, now)
+	return structs.TxnNotOpenError(txnId)
+}
+
+// Returns whether the node already has the marker of state of a transaction:
+// the release marker for visible, otherwise the outcome's
+func HasTxnMarker(txnId string, state structs.TxnState) bool {
+	VersionListLock.Lock()
+	defer VersionListLock.Unlock()
+	marker, ok := markers[txnId]
+	if state == structs.TxnVisible {
+		return marker.Released
+	}
+	return ok && marker.State != ""
+}
+
+// Asks the server for the outcome of every transaction that has records here
+// that are neither aborted nor released. Without an answer their records stay
+// hidden
+func resolvePendingTxns() {
+	VersionListLock.Lock()
+	txnOutcomesLock.Lock()
+	pending := make(map[string]bool)
+	for _, fdata := range VersionList {
+		if fdata.TxnId == "" || fdata.Marker != "" {
+			continue
+		}
+		if marker := markers[fdata.TxnId]; marker.State == structs.TxnAborted || marker.Released {
+			continue
+		}
+		if state, known := knownOutcome(fdata.TxnId, time.Now()); !known || state == structs.TxnCommitted {
+			pending[fdata.TxnId] = true
+		}
+	}
+	txnOutcomesLock.Unlock()
+	VersionListLock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	txnIds := make([]string, 0, len(pending))
+	for txnId := range pending {
+		txnIds = append(txnIds, txnId)
+	}
+
+	var states map[string]structs.TxnState
+	if err := ServerClient.Call("TServer.TransactionStatus", txnIds, &states); err != nil {
+		checkError(err, "resolvePendingTxns")
+		return
+	}
+
+	txnOutcomesLock.Lock()
+	defer txnOutcomesLock.Unlock()
+	now := time.Now()
+	for txnId, state := range states {
+		setOutcome(txnId, state, now)
+	}
+}
+
+// Returns whether consumers may see fdata. Records of a transaction are
+// visible once the server made it visible, which it does when every
+// partition has the commit marker, except any written after the marker. A
+// commit marker alone does not show them, since other partitions may not
+// have theirs yet
+// Lock is manually set from caller
+func txnVisible(fdata FileData) bool {
+	if fdata.Marker != "" {
+		return false
+	}
+	if fdata.TxnId == "" {
+		return true
+	}
+
+	if marker, ok := markers[fdata.TxnId]; ok && marker.State != "" {
+		if marker.State != structs.TxnCommitted || fdata.Version >= marker.Version {
+			return false
+		}
+		if marker.Released {
+			return true
+		}
+	}
+
+	txnOutcomesLock.Lock()
+	defer txnOutcomesLock.Unlock()
+	state, _ := knownOutcome(fdata.TxnId, time.Now())
+	return state == structs.TxnVisible
+}
+
+// Remembers what the server said of a transaction. Open transactions are not
+// remembered. Ones it does not know were never begun, or were forgotten after
+// every partition got their marker, so without a marker here they are taken
+// as aborted, for TXN_UNKNOWN_TTL in case the server was behind
+// Lock is manually set from caller
+func setOutcome(txnId string, state structs.TxnState, now time.Time) {
+	switch state {
+	case structs.TxnCommitted, structs.TxnVisible, structs.TxnAborted:
+		txnOutcomes[txnId] = txnOutcome{State: state}
+	case structs.TxnUnknown:
+		txnOutcomes[txnId] = txnOutcome{State: structs.TxnAborted, Expiry: now.Add(TXN_UNKNOWN_TTL * time.Second)}
+	}
+}
+
+// Returns the outcome of a transaction if it is known and has not expired
+// Lock is manually set from caller
+func knownOutcome(txnId string, now time.Time) (structs.TxnState, bool) {
+	outcome, ok := txnOutcomes[txnId]
+	if !ok || (!outcome.Expiry.IsZero() && now.After(outcome.Expiry)) {
+		return "", false
+	}
+	return outcome.State, true
+}
+
+// Lock is manually set from caller
+func sweepTxns(now time.Time) {
+	for key, expiry := range txnWriters {
+		if now.After(expiry) {
+			delete(txnWriters, key)
+		}
+	}
+
+	for txnId, outcome := range txnOutcomes {
+		if !outcome.Expiry.IsZero() && now.After(outcome.Expiry) {
+			delete(txnOutcomes, txnId)
+		}
+	}
+}
+
+// Lock is manually set from caller
+func recordMarker(fdata FileData) {
+	if fdata.Marker == "" {
+		return
+	}
+
+	marker := markers[fdata.TxnId]
+	if fdata.Marker == structs.TxnVisible {
+		marker.Released = true
+	} else {
+		marker.State = fdata.Marker
+		marker.Version = fdata.Version
+	}
+	markers[fdata.TxnId] = marker
+
+	// The markers are the record of the outcome from now on, unless the
+	// records still wait for their release
+	if marker.State == structs.TxnAborted || marker.Released {
+		txnOutcomesLock.Lock()
+		delete(txnOutcomes, fdata.TxnId)
+		txnOutcomesLock.Unlock()
+	}
+}
+
+// Lock is manually set from caller
+func rebuildMarkers() {
+	markers = make(map[string]txnMarker)
+	for _, fdata := range VersionList {
+		recordMarker(fdata)
+	}
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"../../structs"
+)
+
+func TestTxnVisible(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		fdata   FileData
+		marker  *txnMarker
+		outcome *txnOutcome
+		want    bool
+	}{
+		{"plain write", FileData{Version: 1}, nil, nil, true},
+		{"marker", FileData{Version: 5, TxnId: "t", Marker: structs.TxnCommitted}, nil, nil, false},
+		{"open transaction", FileData{Version: 1, TxnId: "t"}, nil, nil, false},
+		{"commit marker waits for the other partitions", FileData{Version: 1, TxnId: "t"},
+			&txnMarker{State: structs.TxnCommitted, Version: 5}, nil, false},
+		{"commit marker and still committed on the server", FileData{Version: 1, TxnId: "t"},
+			&txnMarker{State: structs.TxnCommitted, Version: 5}, &txnOutcome{State: structs.TxnCommitted}, false},
+		{"commit marker and visible on the server", FileData{Version: 1, TxnId: "t"},
+			&txnMarker{State: structs.TxnCommitted, Version: 5}, &txnOutcome{State: structs.TxnVisible}, true},
+		{"released", FileData{Version: 1, TxnId: "t"},
+			&txnMarker{State: structs.TxnCommitted, Version: 5, Released: true}, nil, true},
+		{"written after the commit marker", FileData{Version: 6, TxnId: "t"},
+			&txnMarker{State: structs.TxnCommitted, Version: 5, Released: true}, nil, false},
+		{"aborted marker", FileData{Version: 1, TxnId: "t"},
+			&txnMarker{State: structs.TxnAborted, Version: 5}, nil, false},
+		{"marker wins over the server's outcome", FileData{Version: 1, TxnId: "t"},
+			&txnMarker{State: structs.TxnAborted, Version: 5}, &txnOutcome{State: structs.TxnVisible}, false},
+		{"committed on the server", FileData{Version: 1, TxnId: "t"},
+			nil, &txnOutcome{State: structs.TxnCommitted}, false},
+		{"visible on the server", FileData{Version: 1, TxnId: "t"},
+			nil, &txnOutcome{State: structs.TxnVisible}, true},
+		{"aborted on the server", FileData{Version: 1, TxnId: "t"},
+			nil, &txnOutcome{State: structs.TxnAborted}, false},
+		{"unknown to the server", FileData{Version: 1, TxnId: "t"},
+			nil, &txnOutcome{State: structs.TxnAborted, Expiry: now.Add(time.Minute)}, false},
+		{"expired outcome", FileData{Version: 1, TxnId: "t"},
+			nil, &txnOutcome{State: structs.TxnVisible, Expiry: now.Add(-time.Minute)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			markers = make(map[string]txnMarker)
+			txnOutcomes = make(map[string]txnOutcome)
+			if tt.marker != nil {
+				markers["t"] = *tt.marker
+			}
+			if tt.outcome != nil {
+				txnOutcomes["t"] = *tt.outcome
+			}
+
+			if got := txnVisible(tt.fdata); got != tt.want {
+				t.Errorf("txnVisible(%+v) = %v, want %v", tt.fdata, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetOutcome(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		state structs.TxnState
+		at    time.Time // When the outcome is looked up
+		want  structs.TxnState
+		known bool
+	}{
+		{"committed is final", structs.TxnCommitted, now.Add(time.Hour), structs.TxnCommitted, true},
+		{"visible is final", structs.TxnVisible, now.Add(time.Hour), structs.TxnVisible, true},
+		{"aborted is final", structs.TxnAborted, now.Add(time.Hour), structs.TxnAborted, true},
+		{"unknown is aborted", structs.TxnUnknown, now, structs.TxnAborted, true},
+		{"unknown expires", structs.TxnUnknown, now.Add((TXN_UNKNOWN_TTL + 1) * time.Second), "", false},
+		{"open is not kept", structs.TxnOpen, now, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txnOutcomes = make(map[string]txnOutcome)
+			setOutcome("t", tt.state, now)
+
+			got, known := knownOutcome("t", tt.at)
+			if got != tt.want || known != tt.known {
+				t.Errorf("knownOutcome() = %q, %v, want %q, %v", got, known, tt.want, tt.known)
+			}
+		})
+	}
+}
+
+func TestRecordMarker(t *testing.T) {
+	markers = make(map[string]txnMarker)
+	txnOutcomes = map[string]txnOutcome{"t": {State: structs.TxnCommitted}}
+
+	recordMarker(FileData{Version: 5, TxnId: "t", Marker: structs.TxnCommitted})
+	if !HasTxnMarker("t", structs.TxnCommitted) || HasTxnMarker("t", structs.TxnVisible) {
+		t.Fatalf("after the commit marker, markers = %+v", markers["t"])
+	}
+	if _, known := txnOutcomes["t"]; !known {
+		t.Errorf("the server's outcome was dropped before the release")
+	}
+
+	recordMarker(FileData{Version: 9, TxnId: "t", Marker: structs.TxnVisible})
+	want := txnMarker{State: structs.TxnCommitted, Version: 5, Released: true}
+	if markers["t"] != want {
+		t.Errorf("after the release marker, markers = %+v, want %+v", markers["t"], want)
+	}
+	if _, known := txnOutcomes["t"]; known {
+		t.Errorf("the server's outcome is kept after the release")
+	}
+}
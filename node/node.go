@@ -2,27 +2,38 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"sync"
 	"time"
 
+	conf "../lib/config"
+	"../lib/logging"
+	"../lib/metrics"
+	"../lib/mtls"
+	"../lib/tracing"
 	"../structs"
 	"./clusterlib"
 )
 
-type ClusterRpc struct{}
+// Each client connection is served by its own ClusterRpc, which holds the
+// identity from the client's certificate
+type ClusterRpc struct {
+	caller mtls.Identity
+}
 
-type PeerRpc struct{}
+type PeerRpc struct {
+	caller mtls.Identity
+}
 
 // ANSII Colour Codes for debugging
-const ERR_COL = "\x1b[31;1m" // RED
-const ERR_END = "\x1b[0m"    // Neutral
 
-const WRITE_TIMEOUT_SEC = 10 // Time to wait for RPC call to peer nodes to confirm write
+// Time to wait for RPC call to peer nodes to confirm write, unless the
+// server's NodeSettings set a write-timeout
+const WRITE_TIMEOUT_SEC = 10
 
 // ClusterRpcAddr is the ip:port that the producer/consumer API's interface with
 // PeerRpcAddr is the ip:port connecting Leader -> Follower nodes
@@ -51,7 +62,7 @@ func InitializeDataStructs() {
 			select {
 			case wId := <-WriteIdCh:
 				// Set new WriteId
-				fmt.Println(ERR_COL+"New WriteId set %d"+ERR_END, wId)
+				node.Logger.Info("Set next WriteId", "version", wId)
 				WriteLock.Lock()
 				WriteId = wId
 				WriteLock.Unlock()
@@ -64,108 +75,343 @@ func InitializeDataStructs() {
 | Cluster RPC Calls
 ********************************/
 func ListenClusterRpc(ln net.Listener) {
-	cRpc := ClusterRpc{}
-	server := rpc.NewServer()
-	server.RegisterName("Cluster", cRpc)
 	ClusterRpcAddr = ln.Addr().String()
 	node.ClusterRpcAddr = ClusterRpcAddr
-	fmt.Println("ClusterRpc is listening on: ", ERR_COL+ClusterRpcAddr+ERR_END)
+	node.Logger.Info("ClusterRpc listening", "addr", ClusterRpcAddr)
+
+	mtls.Accept(ln, func(conn net.Conn, caller mtls.Identity) {
+		if !caller.Is(mtls.RoleClient, mtls.RoleAdmin) {
+			node.Logger.Warn("Dropping ClusterRpc connection from a caller that is not a client",
+				"remote", conn.RemoteAddr().String(), "caller", caller.String())
+			conn.Close()
+			return
+		}
+
+		server := rpc.NewServer()
+		server.RegisterName("Cluster", ClusterRpc{caller: caller})
+		server.ServeConn(conn)
+	})
+}
+
+func (c ClusterRpc) WriteToCluster(write structs.WriteMsg, _ignored *string) (err error) {
+	span := tracing.Start("node.WriteToCluster", write.Trace)
+	span.Set("topic", write.Topic)
+	span.Set("partition", write.Partition)
+	span.Set("client", write.Id)
+	defer func() { span.End(err) }()
+
+	if write.ProducerId != "" {
+		span.Set("producer", write.ProducerId)
+		span.Set("sequence", write.Sequence)
+	}
+
+	_, err = c.writeRecords(structs.WriteBatchMsg{
+		Topic:      write.Topic,
+		Partition:  write.Partition,
+		Id:         write.Id,
+		Records:    []string{write.Data},
+		Token:      write.Token,
+		ProducerId: write.ProducerId,
+		Sequence:   write.Sequence,
+		TxnId:      write.TxnId,
+	}, span)
+	return err
+}
+
+// Writes a batch of records with one round of replication and one write to
+// disk. versions is set to the version of each record, in order
+func (c ClusterRpc) WriteBatchToCluster(batch structs.WriteBatchMsg, versions *[]int) (err error) {
+	span := tracing.Start("node.WriteBatchToCluster", batch.Trace)
+	span.Set("topic", batch.Topic)
+	span.Set("partition", batch.Partition)
+	span.Set("client", batch.Id)
+	span.Set("records", len(batch.Records))
+	defer func() { span.End(err) }()
+
+	if len(batch.Records) > structs.MAX_BATCH_RECORDS {
+		return fmt.Errorf("Batch of %d records is over the limit of %d", len(batch.Records), structs.MAX_BATCH_RECORDS)
+	}
+
+	if batch.ProducerId != "" {
+		span.Set("producer", batch.ProducerId)
+		span.Set("sequence", batch.Sequence)
+	}
 
-	server.Accept(ln)
+	*versions, err = c.writeRecords(batch, span)
+	return err
 }
 
-func (c ClusterRpc) WriteToCluster(write structs.WriteMsg, _ignored *string) error {
+// Replicates the records of batch to the followers and stores them once a
+// majority has confirmed them. Either all of the records are written or none
+// are. Returns the version of each record. A retry of records the leader
+// already has returns their versions without writing them again
+func (c ClusterRpc) writeRecords(batch structs.WriteBatchMsg, span *tracing.Span) ([]int, error) {
+	topic, partition, clientId, records := batch.Topic, batch.Partition, batch.Id, batch.Records
+	if len(records) == 0 {
+		return []int{}, nil
+	}
+	n := float64(len(records))
+
+	// Before taking the lock, since it may wait for the server
+	if err := node.Authorize(topic, structs.PermProduce, batch.Token, c.caller); err != nil {
+		node.WritesRejected.With(node.RejectUnauthorized).Add(n)
+		return nil, err
+	}
+
+	size := 0
+	for _, record := range records {
+		size += len(record)
+	}
+
+	// Also before the lock, so a throttled client does not hold up the others
+	if err := node.ThrottleWrite(topic, clientId, len(records), size); err != nil {
+		node.WritesRejected.With(node.RejectThrottled).Add(n)
+		return nil, err
+	}
+
+	// Records of a transaction that was never begun would stay hidden for good
+	if batch.TxnId != "" {
+		if err := node.CheckTxnWrite(batch.TxnId, topic, partition, batch.Token, c.caller); err != nil {
+			if structs.IsUnauthorizedError(err) {
+				node.WritesRejected.With(node.RejectUnauthorized).Add(n)
+			} else {
+				node.WritesRejected.With(node.RejectTxnEnded).Add(n)
+			}
+			return nil, err
+		}
+	}
 
 	WriteLock.Lock()
 	defer WriteLock.Unlock()
 
 	if node.NodeMode == node.Leader {
-		node.PeerMap.MapLock.RLock()
-
-		writesCh := make(chan bool, 30)
+		if topic != node.TopicName || partition != node.Partition {
+			node.Logger.Warn("Received write for a partition this node does not lead",
+				"write-topic", topic, "write-partition", partition, "client", clientId)
+			node.WritesRejected.With(node.RejectNotLeader).Add(n)
+			return nil, structs.NotLeaderError(fmt.Sprintf("%s/%d", topic, partition))
+		}
 
-		numRequiredWrites := node.MinReplicas
-		// Subtract 1 because Leader is counted in ClusterSize and only Followers confirm Writes
-		maxFailures := node.ClusterSize - numRequiredWrites - 1
-		writeVerdictCh := node.CountConfirmedWrites(writesCh, numRequiredWrites, maxFailures)
+		// Under WriteLock, so a retry cannot race the write it repeats
+		if batch.ProducerId != "" {
+			versions, err := node.DuplicateWrites(batch.ProducerId, batch.Sequence, len(records))
+			if err != nil {
+				node.WritesRejected.With(node.RejectDuplicate).Add(n)
+				return nil, err
+			}
+			if versions != nil {
+				node.Logger.Info("Dropped a retried write", "client", clientId, "producer", batch.ProducerId,
+					"sequence", batch.Sequence, "version", versions[0])
+				node.WritesDeduplicated.Add(n)
+				span.Set("duplicate", true)
+				return versions, nil
+			}
+		}
 
-		go func(wId int) {
-			for ip, peer := range node.PeerMap.Map {
-				var writeConfirmed bool
+		if batch.TxnId != "" && node.TxnEnded(batch.TxnId) {
+			node.WritesRejected.With(node.RejectTxnEnded).Add(n)
+			return nil, structs.TxnNotOpenError(batch.TxnId)
+		}
 
-				resp := node.PropagateWriteReq{
-					Topic:      write.Topic,
-					VersionNum: wId,
-					LeaderId:   PublicIp,
-					Data:       write.Data,
-				}
+		// Every record gets its own version
+		timestamp := time.Now().UnixNano()
+		writes := make([]node.FileData, len(records))
+		versions := make([]int, len(records))
+		for i, record := range records {
+			versions[i] = WriteId + i
+			writes[i] = node.FileData{
+				Version:   WriteId + i,
+				Data:      record,
+				Timestamp: timestamp,
+				TxnId:     batch.TxnId,
+			}
+			if batch.ProducerId != "" {
+				writes[i].ProducerId = batch.ProducerId
+				writes[i].Sequence = batch.Sequence + uint64(i)
+			}
+		}
 
-				// fmt.Println(ERR_COL+"WRITE ID BEFORE CONFIRMWRITE: %d"+ERR_END, WriteId)
-				writeCall := peer.PeerConn.Go("Peer.ConfirmWrite", resp, &writeConfirmed, nil)
-
-				go func(wc *rpc.Call) {
-					select {
-					case w := <-wc.Done:
-						if w.Error != nil {
-							checkError(w.Error, "ConfirmWriteRPC")
-							fmt.Println("Peer [%s] REJECTED write", ERR_COL+ip+ERR_END)
-							writesCh <- false
-						}
-					case <-time.After(WRITE_TIMEOUT_SEC):
-						writesCh <- false
-					}
-				}(writeCall)
+		if err := replicate(topic, partition, writes, span); err != nil {
+			if _, ok := err.(node.InsufficientConfirmedWritesError); ok {
+				node.WritesRejected.With(node.RejectNotReplicated).Add(n)
+			} else {
+				node.WritesRejected.With(node.RejectDisk).Add(n)
 			}
-		}(WriteId)
+			return nil, err
+		}
 
-		// Block on writeVerdictCh
-		writeSucceed := <-writeVerdictCh
-		node.PeerMap.MapLock.RUnlock()
+		node.WritesAccepted.Add(n)
+		return versions, nil
+	}
+	node.Logger.Warn("Received write but not a leader", "write-topic", topic, "write-partition", partition, "client", clientId)
+	node.WritesRejected.With(node.RejectNotLeader).Add(n)
+	return nil, structs.NotLeaderError(fmt.Sprintf("%s/%d", topic, partition))
+}
 
-		if writeSucceed {
-			if err := node.WriteNode(write.Topic, write.Data, WriteId); err != nil {
-				fmt.Println(ERR_COL + "WRITING ERROR ON LEADER" + ERR_END)
-				return err
+// Sends writes, which are numbered from WriteId, to the followers and stores
+// them once enough have confirmed them. WriteId moves past them
+// Lock is manually set from caller
+func replicate(topic string, partition int, writes []node.FileData, span *tracing.Span) error {
+	node.PeerMap.MapLock.RLock()
+
+	// Every follower answers once, and so do the missing ones below
+	numFollowers := int(node.TopicSettings.ClusterSize) - 1
+	writesCh := make(chan bool, numFollowers+len(node.PeerMap.Map))
+
+	numRequiredWrites := node.TopicSettings.MinReplicas
+	// Subtract 1 because Leader is counted in ClusterSize and only Followers confirm Writes
+	maxFailures := node.TopicSettings.ClusterSize - numRequiredWrites - 1
+	confirmStart := time.Now()
+	writeVerdictCh := node.CountConfirmedWrites(writesCh, numRequiredWrites, maxFailures)
+	span.Set("version", WriteId)
+
+	// Followers that are not connected cannot confirm
+	for i := len(node.PeerMap.Map); i < numFollowers; i++ {
+		writesCh <- false
+	}
+
+	go func(wId int) {
+		for ip, peer := range node.PeerMap.Map {
+			var writeConfirmed bool
+
+			confirm := tracing.Start("node.ConfirmWrite", span.Context())
+			confirm.Set("peer", ip)
+			confirm.Set("version", wId)
+			confirm.Set("writes", len(writes))
+
+			resp := node.PropagateWriteReq{
+				Topic:     topic,
+				Partition: partition,
+				Writes:    writes,
+				LeaderId:  PublicIp,
+				Trace:     confirm.Context(),
 			}
-			WriteId++
-			return nil
+
+			writeCall := peer.PeerConn.Go("Peer.ConfirmWrite", resp, &writeConfirmed, nil)
+
+			go func(wc *rpc.Call, ip string, confirm *tracing.Span) {
+				select {
+				case w := <-wc.Done:
+					confirm.End(w.Error)
+					if w.Error != nil {
+						checkError(w.Error, "ConfirmWriteRPC")
+						node.Logger.Warn("Follower rejected write", "peer", ip, "version", wId)
+						node.ReplicationFailures.With(ip).Inc()
+						writesCh <- false
+						return
+					}
+					writesCh <- *w.Reply.(*bool)
+				case <-time.After(writeTimeout()):
+					confirm.End(errors.New("Timed out waiting for follower"))
+					node.ReplicationFailures.With(ip).Inc()
+					writesCh <- false
+				}
+			}(writeCall, ip, confirm)
 		}
+	}(WriteId)
 
+	// Block on writeVerdictCh
+	writeSucceed := <-writeVerdictCh
+	node.PeerMap.MapLock.RUnlock()
+	node.ConfirmWritesSeconds.ObserveSince(confirmStart)
+
+	if !writeSucceed {
 		return node.InsufficientConfirmedWritesError("")
 	}
-	log.Println("WriteToCluster:: Node is not a leader. Should not have received Write")
-	return errors.New("Node is not a leader. Cannot send Write")
+
+	if err := node.WriteNode(topic, partition, writes, span.Context()); err != nil {
+		node.Logger.Error("Could not store write on leader", "version", WriteId, "writes", len(writes), "err", err)
+		return err
+	}
+	WriteId += len(writes)
+	return nil
 }
 
-func (c ClusterRpc) ReadFromCluster(topic string, response *[]string) error {
-	topicData, err := node.ReadNode(topic)
+func (c ClusterRpc) ReadFromCluster(read structs.ReadMsg, response *[]string) error {
+	if err := node.Authorize(read.Topic, structs.PermConsume, read.Token, c.caller); err != nil {
+		return err
+	}
+
+	topicData, err := node.ReadNode(read.Topic)
 	*response = topicData
 	return err
 }
 
+// Same as ReadFromCluster, with the version of each record
+func (c ClusterRpc) ReadRecordsFromCluster(read structs.ReadMsg, response *[]structs.Record) error {
+	if err := node.Authorize(read.Topic, structs.PermConsume, read.Token, c.caller); err != nil {
+		return err
+	}
+
+	records, err := node.ReadNodeRecords(read.Topic)
+	*response = records
+	return err
+}
+
 /*******************************
 | Peer RPC Calls
 ********************************/
 func ListenPeerRpc(ln net.Listener) {
-	pRpc := new(PeerRpc)
-	server := rpc.NewServer()
-	server.RegisterName("Peer", pRpc)
 	PeerRpcAddr = ln.Addr().String()
-	fmt.Println("PeerRpc is listening on: ", PeerRpcAddr)
+	node.Logger.Info("PeerRpc listening", "addr", PeerRpcAddr)
+
+	// Clients only ever talk to the ClusterRpc
+	go mtls.Accept(ln, func(conn net.Conn, caller mtls.Identity) {
+		if !caller.Is(mtls.RoleNode, mtls.RoleServer, mtls.RoleAdmin) {
+			node.Logger.Warn("Dropping PeerRpc connection from a client",
+				"remote", conn.RemoteAddr().String(), "caller", caller.String())
+			conn.Close()
+			return
+		}
 
-	go server.Accept(ln)
+		server := rpc.NewServer()
+		server.RegisterName("Peer", PeerRpc{caller: caller})
+		server.ServeConn(conn)
+	})
+}
+
+// Checks that the caller has one of roles
+func (c PeerRpc) allow(method string, roles ...string) error {
+	if !c.caller.Is(roles...) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s may not call %s", c.caller, method))
+	}
+	return nil
 }
 
-// Server -> Node rpc that sets that node as a leader
+// Checks that the caller is the node at addr, its PeerRpc address
+func (c PeerRpc) allowNode(method string, addr string) error {
+	if !c.caller.Is(mtls.RoleNode) || !c.caller.Owns(addr) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s may not call %s for node %s", c.caller, method, addr))
+	}
+	return nil
+}
+
+// Checks that the caller is this node's leader
+func (c PeerRpc) allowLeader(method string) error {
+	return c.allowNode(method, node.LEADER_ID)
+}
+
+// Server -> Node rpc that sets that node as the leader of a topic's partition
 // When it returns the node will have been established as leader
-func (c PeerRpc) Lead(ips []string, clusterAddr *string) error {
-	_, err := node.BecomeLeader(ips, PeerRpcAddr)
+func (c PeerRpc) Lead(msg structs.LeadMsg, clusterAddr *string) error {
+	if err := c.allow("Lead", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	node.TopicName = msg.TopicName
+	node.Partition = msg.Partition
+	node.TopicSettings = msg.Spec
+	_, err := node.BecomeLeader(msg.FollowerIps, PeerRpcAddr)
 	*clusterAddr = ClusterRpcAddr
 	return err
 }
 
 // Leader -> Node rpc that sets the caller as this node's leader
 func (c PeerRpc) FollowMe(msg node.FollowMeMsg, latestData *int) error {
+	if err := c.allowNode("FollowMe", msg.LeaderIp); err != nil {
+		return err
+	}
+
 	err := node.FollowLeader(msg, PeerRpcAddr)
 	if err == nil {
 		version := node.GetLatestVersion()
@@ -176,20 +422,171 @@ func (c PeerRpc) FollowMe(msg node.FollowMeMsg, latestData *int) error {
 
 // Leader -> Node rpc that tells followers of new joining nodes
 func (c PeerRpc) AddFollower(msg node.ModFollowerListMsg, _ignored *string) error {
+	if err := c.allowLeader("AddFollower"); err != nil {
+		return err
+	}
+
 	err := node.ModifyFollowerList(msg, true)
 	return err
 }
 
 // Leader -> Node rpc that tells followers of nodes leaving
 func (c PeerRpc) RemoveFollower(msg node.ModFollowerListMsg, _ignored *string) error {
+	if err := c.allowLeader("RemoveFollower"); err != nil {
+		return err
+	}
+
 	err := node.ModifyFollowerList(msg, false)
 	return err
 }
 
+// Server -> Leader and Leader -> Follower rpc that drops this node's topic.
+// A leader first drops the topic on its followers. members is set to the
+// addresses of every node that dropped it, so the server can recycle them
+func (c PeerRpc) DropTopic(topic string, members *[]string) error {
+	if !c.caller.Is(mtls.RoleServer) {
+		if err := c.allowLeader("DropTopic"); err != nil {
+			return err
+		}
+	}
+
+	if topic != node.TopicName {
+		return structs.NotInTopicError(topic)
+	}
+
+	// No Writes while the cluster is torn down
+	WriteLock.Lock()
+	defer WriteLock.Unlock()
+
+	dropped := make([]string, 0)
+	if node.NodeMode == node.Leader {
+		dropped = node.DropFollowers(topic)
+	}
+
+	if err := node.ResetNode(); err != nil {
+		checkError(err, "DropTopic")
+		return err
+	}
+	WriteId = 1
+
+	node.Logger.Info("Dropped topic", "dropped", topic, "members", dropped)
+	*members = append(dropped, PeerRpcAddr)
+	return nil
+}
+
+// Server -> Leader rpc that moves leadership to an in-sync follower, when this
+// node is drained or leadership is rebalanced. partition is set to the
+// partition with its new leader
+func (c PeerRpc) HandOff(msg structs.HandOffMsg, partition *structs.Partition) error {
+	if err := c.allow("HandOff", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	// No Writes while leadership moves
+	WriteLock.Lock()
+	defer WriteLock.Unlock()
+
+	p, err := node.HandOffLeadership(msg)
+	if err != nil {
+		checkError(err, "HandOff")
+		return err
+	}
+	WriteId = 1
+
+	*partition = p
+	return nil
+}
+
+// Leader -> Follower rpc that makes this node the leader in place of the caller
+func (c PeerRpc) TakeLeadership(msg node.TakeLeadershipMsg, clusterAddr *string) error {
+	if err := c.allowLeader("TakeLeadership"); err != nil {
+		return err
+	}
+
+	WriteLock.Lock()
+	defer WriteLock.Unlock()
+
+	if err := node.TakeLeadership(msg); err != nil {
+		checkError(err, "TakeLeadership")
+		return err
+	}
+	WriteId = node.GetLatestVersion() + 1
+
+	*clusterAddr = ClusterRpcAddr
+	return nil
+}
+
+// Server -> Leader rpc that replaces a follower being drained with a new
+// follower holding a full copy of the data
+func (c PeerRpc) ReplaceFollower(msg structs.ReplaceFollowerMsg, _ignored *string) error {
+	if err := c.allow("ReplaceFollower", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	// No Writes until the new follower has every write
+	WriteLock.Lock()
+	defer WriteLock.Unlock()
+
+	return node.ReplaceFollower(msg.Old, msg.New)
+}
+
+// Server -> Node rpc sent once a drained node is out of its cluster. The node
+// deregisters and exits
+func (c PeerRpc) Leave(_ignored string, _reply *string) error {
+	if err := c.allow("Leave", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	go func() {
+		node.ServerDeregister(PeerRpcAddr)
+		node.Logger.Info("Drained. Leaving")
+		os.Exit(0)
+	}()
+	return nil
+}
+
+// Server -> Leader rpc that describes the state of every replica in the cluster
+func (c PeerRpc) DescribeCluster(_ignored string, desc *structs.PartitionDescription) error {
+	if err := c.allow("DescribeCluster", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	if node.NodeMode != node.Leader {
+		return errors.New("Node is not a leader. Cannot describe cluster")
+	}
+
+	*desc = node.DescribeCluster()
+	return nil
+}
+
+// Leader -> Follower rpc that describes this node's replica
+func (c PeerRpc) DescribeReplica(_ignored string, replica *structs.ReplicaDescription) error {
+	if err := c.allowLeader("DescribeReplica"); err != nil {
+		return err
+	}
+
+	*replica = node.DescribeReplica()
+	return nil
+}
+
+// Admin -> Node rpc that returns the node's topic and VersionList
+func (c PeerRpc) GetClusterData(_ignored string, clusterData *node.ClusterData) error {
+	if err := c.allow("GetClusterData", mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	*clusterData = node.GetClusterData()
+	return nil
+}
+
 // Follower -> Leader rpc that is used to join this leader's cluster
 // Used during the election process when attempting to connect to this leader
 func (c PeerRpc) Follow(msg node.FollowMsg, syncData *[]node.FileData) error {
-	fmt.Println("Peer.Follow from:", msg.Ip)
+	if err := c.allowNode("Follow", msg.Ip); err != nil {
+		return err
+	}
+
+	node.Logger.Info("Peer asked to follow", "peer", msg.Ip)
 	err := node.PeerAcceptThisNode(msg.Ip)
 
 	if err != nil {
@@ -204,15 +601,21 @@ func (c PeerRpc) Follow(msg node.FollowMsg, syncData *[]node.FileData) error {
 
 // Node -> Node RPC that is used to notify of liveliness
 func (c PeerRpc) Heartbeat(ip string, reply *string) error {
+	if err := c.allowNode("Heartbeat", ip); err != nil {
+		return err
+	}
+
 	id++
-	//fmt.Println("hb from:", ip, id)
 	return node.PeerHeartbeat(ip, reply, id)
 }
 
-// Leader -> Follower RPC to commit write
+// Leader -> Follower RPC to commit the writes of one client call
 func (c PeerRpc) ConfirmWrite(req node.PropagateWriteReq, writeOk *bool) error {
-	// fmt.Println(ERR_COL+"ConfirmWrite:: VersionNum %d"+ERR_END, req.VersionNum)
-	if err := node.WriteNode(req.Topic, req.Data, req.VersionNum); err != nil {
+	if err := c.allowLeader("ConfirmWrite"); err != nil {
+		return err
+	}
+
+	if err := node.WriteNode(req.Topic, req.Partition, req.Writes, req.Trace); err != nil {
 		checkError(err, "ConfirmWrite")
 		return err
 	}
@@ -221,14 +624,70 @@ func (c PeerRpc) ConfirmWrite(req node.PropagateWriteReq, writeOk *bool) error {
 	return nil
 }
 
+// Server -> Node rpc that gives the node the server's settings after the
+// server reloaded its config
+func (c PeerRpc) UpdateSettings(settings structs.NodeSettings, _ignored *bool) error {
+	if err := c.allow("UpdateSettings", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	node.UpdateServerSettings(settings)
+	node.Logger.Info("Took new settings from the server", "settings", settings)
+	return nil
+}
+
+// Server -> Leader rpc that writes the outcome of a transaction, or the
+// release of a committed one, to the leader's partition, replicated like any
+// write. Writing a marker the partition already has does nothing
+func (c PeerRpc) WriteTxnMarker(msg structs.TxnMarkerMsg, _ignored *bool) (err error) {
+	if err := c.allow("WriteTxnMarker", mtls.RoleServer); err != nil {
+		return err
+	}
+
+	span := tracing.Start("node.WriteTxnMarker", structs.TraceContext{})
+	span.Set("txn", msg.TxnId)
+	span.Set("state", string(msg.State))
+	defer func() { span.End(err) }()
+
+	if msg.State != structs.TxnCommitted && msg.State != structs.TxnAborted && msg.State != structs.TxnVisible {
+		return fmt.Errorf("Transaction marker must be committed, aborted or visible, not %s", msg.State)
+	}
+
+	WriteLock.Lock()
+	defer WriteLock.Unlock()
+
+	if node.NodeMode != node.Leader || msg.Topic != node.TopicName || msg.Partition != node.Partition {
+		return structs.NotLeaderError(fmt.Sprintf("%s/%d", msg.Topic, msg.Partition))
+	}
+
+	if node.HasTxnMarker(msg.TxnId, msg.State) {
+		return nil
+	}
+
+	marker := []node.FileData{{
+		Version:   WriteId,
+		Timestamp: time.Now().UnixNano(),
+		TxnId:     msg.TxnId,
+		Marker:    msg.State,
+	}}
+	if err := replicate(msg.Topic, msg.Partition, marker, span); err != nil {
+		return err
+	}
+
+	node.Logger.Info("Wrote transaction marker", "txn", msg.TxnId, "state", msg.State, "version", marker[0].Version)
+	return nil
+}
+
 func (c PeerRpc) GetWrites(requestedWrites map[int]bool, writeData *[]node.FileData) error {
+	if err := c.allow("GetWrites", mtls.RoleNode); err != nil {
+		return err
+	}
+
 	writes := make([]node.FileData, 0)
 	for id := range requestedWrites {
 		node.VersionListLock.Lock()
 
 		found := false
-		fmt.Println("\n\nVersionList in GETWRITES")
-		fmt.Println("%+v", node.VersionList)
 		for _, fdata := range node.VersionList {
 			if fdata.Version == id {
 				writes = append(writes, fdata)
@@ -239,46 +698,144 @@ func (c PeerRpc) GetWrites(requestedWrites map[int]bool, writeData *[]node.FileD
 		*writeData = writes
 
 		if !found {
-			log.Println(ERR_COL+"Received GetWrites for new Leader but does not have requested write[%d]"+ERR_END, id)
+			node.Logger.Warn("New leader asked for a write this node does not have", "version", id)
 		}
 		node.VersionListLock.Unlock()
 	}
 	return nil
 }
 
+// Time a leader waits for a follower to confirm a write
+func writeTimeout() time.Duration {
+	if ms := node.ServerSettings().WriteTimeout; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return WRITE_TIMEOUT_SEC * time.Second
+}
+
 /*******************************
 | Main
 ********************************/
 
 // Args:
-// serverIP
+// serverIPs - comma separated ip:port of every server replica
 // dataPath - a valid, existing directory path that ends with /
+// labels - optional failure domains of this node, e.g. zone=a,rack=r1,host=vm3
+//          host defaults to the machine's hostname
+//
+// The args may instead be given in -c JSON files, KTS_NODE_* environment
+// variables or -set flags, see node.Config. The args override them. SIGHUP
+// reloads the log level and format
+//
+// TLS is set up from KTS_TLS_CA, KTS_TLS_CERT and KTS_TLS_KEY. The
+// certificate's role must be node and it must be valid for the public IP
+//
+// Logs are JSON lines unless KTS_LOG_FORMAT=text. KTS_LOG_LEVEL sets the level
+//
+// Spans of the writes this node leads or follows are appended to KTS_TRACE_FILE, if set
 func main() {
-	serverIP := os.Args[1]
-	dataPath := os.Args[2]
+	var files, sets conf.List
+	flag.Var(&files, "c", "Path to a JSON config. May be given more than once, later files override earlier ones")
+	flag.Var(&sets, "set", "Setting that overrides the config files and environment, e.g. data-path=/data/")
+	flag.Parse()
+
+	if err := logging.ConfigureFromEnv(); err != nil {
+		node.Logger.Fatal("Logging setup", "err", err)
+	}
+
+	args, err := argSettings(flag.Args())
+	if err != nil {
+		node.Logger.Fatal("Invalid args", "err", err)
+	}
+
+	loader := conf.Loader{Files: files, EnvPrefix: node.ENV_CONFIG_PREFIX, Sets: append(sets, args...)}
+	config, err := node.LoadConfig(loader)
+	if err != nil {
+		node.Logger.Fatal("Config", "err", err)
+	}
+
+	if err := config.ApplyLogging(); err != nil {
+		node.Logger.Fatal("Logging setup", "err", err)
+	}
+
+	if err := tracing.ConfigureFromEnv(); err != nil {
+		node.Logger.Fatal("Tracing setup", "err", err)
+	}
+
+	serverIPs := config.Servers
+	dataPath := config.DataPath
+	node.Labels = config.Labels
+
+	if node.Labels.Host == "" {
+		node.Labels.Host, _ = os.Hostname()
+	}
+
+	if err := mtls.SetupFromEnv(); err != nil {
+		node.Logger.Fatal("TLS setup", "err", err)
+	}
+
+	if !mtls.Enabled() {
+		node.Logger.Warn("TLS is off. Any host can call this node")
+	}
 
 	PublicIp = node.GeneratePublicIP()
-	fmt.Println("The public IP is: [%s], DataPath is: %s", ERR_COL+PublicIp+ERR_END, ERR_COL+dataPath+ERR_END)
+	node.Logger.Info("Starting node", "ip", PublicIp, "data-path", dataPath, "labels", node.Labels)
 	// Listener for clients -> cluster
-	ln1, _ := net.Listen("tcp", PublicIp+"0")
+	ln1, _ := mtls.Listen(PublicIp + "0")
 
 	// Listener for server and other nodes
-	ln2, _ := net.Listen("tcp", PublicIp+"0")
+	ln2, _ := mtls.Listen(PublicIp + "0")
 
 	InitializeDataStructs()
 	// Open Filesystem on Disk
 	node.MountFiles(dataPath, WriteIdCh)
+	go node.CompactLoop()
+	// Serve Prometheus metrics
+	if addr := config.MetricsAddr; addr != "" {
+		go func() {
+			node.Logger.Error("Metrics stopped", "err", metrics.ListenAndServe(addr))
+		}()
+	}
 	// Open Peer to Peer RPC
 	ListenPeerRpc(ln2)
+	tracing.SetProcess("node " + PeerRpcAddr)
 	// Connect to the Server
-	node.InitiateServerConnection(serverIP, PeerRpcAddr)
+	node.InitiateServerConnection(serverIPs, PeerRpcAddr)
+	go node.ReloadOnHangup(loader, config)
 	// Open Cluster to App RPC
 	ListenClusterRpc(ln1)
 }
 
+// Turns the positional args into settings, which override the other layers
+func argSettings(args []string) ([]string, error) {
+	var settings []string
+	if len(args) > 0 {
+		settings = append(settings, "servers="+args[0])
+	}
+
+	if len(args) > 1 {
+		settings = append(settings, "data-path="+args[1])
+	}
+
+	if len(args) > 2 {
+		labels, err := structs.ParseNodeLabels(args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range map[string]string{"zone": labels.Zone, "rack": labels.Rack, "host": labels.Host} {
+			if value != "" {
+				settings = append(settings, "labels."+key+"="+value)
+			}
+		}
+	}
+
+	return settings, nil
+}
+
 func checkError(err error, parent string) bool {
 	if err != nil {
-		log.Println(parent, ":: found error! ", err)
+		node.Logger.Error("Found error", "in", parent, "err", err)
 		return true
 	}
 	return false
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Topic access control
+//
+// Clients are known by a principal: the name of the client whose token they send, or else the
+// CommonName of their TLS certificate. Tokens are listed in the config as SHA-256 hashes. Each
+// topic keeps an ACL of principal -> produce/consume/admin, which is journalled and replicated
+// with the topic. The principal that creates a topic is made its admin.
+//
+// The server checks CreateTopic, GetTopic and WatchTopic itself. Leaders check writes and reads
+// with Authorize, so that ACL changes apply without telling the nodes. Authorize also tells them
+// whether the topic is open, so that they need not ask again for every caller without a token.
+// Admin certificates may do anything.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// A client that may authenticate with a token
+type ClientCredential struct {
+	Name        string `json:"name"`
+	TokenSHA256 string `json:"token-sha256"` // Hex encoded SHA-256 of the token
+}
+
+// Returns the principal for token, or the certificate's name without a token.
+// Empty for anonymous callers
+func principalOf(token string, certName string, certRole string) (string, error) {
+	if token == "" {
+		if certRole == mtls.RoleClient || certRole == mtls.RoleAdmin {
+			return certName, nil
+		}
+		return "", nil
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	for _, client := range currentConfig().Clients {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(client.TokenSHA256)) == 1 {
+			return client.Name, nil
+		}
+	}
+
+	return "", structs.UnauthorizedError("unknown token")
+}
+
+// Checks that the caller may use one of perms on topic. Returns the caller's
+// principal
+func authorize(topic structs.Topic, token string, certName string, certRole string, perms ...structs.Permission) (string, error) {
+	principal, err := principalOf(token, certName, certRole)
+	if err != nil {
+		return "", err
+	}
+
+	if certRole == mtls.RoleAdmin {
+		return principal, nil
+	}
+
+	if principal == "" && currentConfig().RequireCredentials {
+		return "", structs.UnauthorizedError("credentials required")
+	}
+
+	for _, perm := range perms {
+		if topic.ACL.Allows(principal, perm) {
+			return principal, nil
+		}
+	}
+
+	name := principal
+	if name == "" {
+		name = "anonymous"
+	}
+	return "", structs.UnauthorizedError(fmt.Sprintf("%s may not %s topic %s", name, perms[0], topic.TopicName))
+}
+
+// Checks the caller of this connection with its token
+func (s *TServer) authorize(topic structs.Topic, token string, perms ...structs.Permission) (string, error) {
+	return authorize(topic, token, s.caller.Name, s.caller.Role, perms...)
+}
+
+// Leader -> Server rpc that checks whether a client may write to or read from
+// a topic. Returns the client's principal and whether the topic is open
+func (s *TServer) Authorize(msg structs.AuthorizeMsg, reply *structs.AuthorizeReply) error {
+	if err := s.allow("Authorize", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.Topic)
+	if !ok {
+		return TopicDoesNotExistError(msg.Topic)
+	}
+
+	name, err := authorize(topic, msg.Token, msg.CertName, msg.CertRole, msg.Permission)
+	if err != nil {
+		return err
+	}
+
+	*reply = structs.AuthorizeReply{
+		Principal: name,
+		Open:      len(topic.ACL) == 0 && !currentConfig().RequireCredentials}
+	return nil
+}
+
+// Admin -> Server rpc that sets a principal's permissions on a topic. Needs
+// admin on the topic, or an admin certificate for a topic without an ACL
+func (s *TServer) SetTopicACL(msg structs.SetACLMsg, topicReply *structs.Topic) (err error) {
+	if err := s.allow("SetTopicACL", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.TopicName)
+	if !ok {
+		return TopicDoesNotExistError(msg.TopicName)
+	}
+
+	// An open topic allows everyone everything, so it has no admin who could
+	// claim it. Otherwise any caller could lock out its producers and consumers
+	if len(topic.ACL) == 0 {
+		if err := s.allow("SetTopicACL on a topic without an ACL", mtls.RoleAdmin); err != nil {
+			return err
+		}
+	} else if _, err := s.authorize(topic, msg.Token, structs.PermAdmin); err != nil {
+		return err
+	}
+
+	if msg.Principal == "" {
+		return fmt.Errorf("Server: principal must not be empty")
+	}
+
+	// A topic without entries is open to everyone
+	if _, listed := topic.ACL[msg.Principal]; len(msg.Permissions) == 0 && listed && len(topic.ACL) == 1 {
+		return fmt.Errorf("Server: cannot remove %s, the last principal on %s. Grant %s first to open the topic",
+			msg.Principal, topic.TopicName, structs.AnyPrincipal)
+	}
+
+	// Copy so the stored topic is not modified outside of the map's lock
+	acl := make(structs.TopicACL)
+	for principal, perms := range topic.ACL {
+		acl[principal] = perms
+	}
+
+	if len(msg.Permissions) == 0 {
+		delete(acl, msg.Principal)
+	} else {
+		acl[msg.Principal] = msg.Permissions
+	}
+
+	topic.ACL = acl
+	defer commitOnReturn(&err)
+	if err := topics.Set(topic.TopicName, topic); err != nil {
+		return err
+	}
+
+	logger.Info("Set topic ACL", "topic", topic.TopicName, "principal", msg.Principal, "permissions", msg.Permissions)
+	*topicReply = topic
+	return nil
+}
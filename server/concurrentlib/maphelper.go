@@ -1,24 +1,16 @@
 package concurrentlib
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/rpc"
 	"sync"
 
 	"../../structs"
+	"../journal"
 )
 
 // This file is reserved for server's maps and arry helpers to ensure thread-safety
 
-type Orphanage struct {
-	sync.RWMutex
-	Orphans []structs.Node
-	Len     uint32
-}
-
 // Map Structures
 // To make it concurrent safe, we make a struct of each map, with a corresponding RWLock
 // Naming convention: XCMap, where X is the map type, C stands for Concurrent
@@ -35,6 +27,8 @@ type NodeCMap struct {
 type TopicCMap struct {
 	MapLock sync.RWMutex
 	Map     map[string]structs.Topic // Topicname -> Topic
+	Journal *journal.Journal         // Every change is journalled before it is applied
+	changed chan bool                // Closed on the next change. See Changed
 }
 
 func (nm *NodeCMap) Get(k string) (NodeInfo, bool) {
@@ -57,42 +51,144 @@ func (tm *TopicCMap) Get(k string) (structs.Topic, bool) {
 	return v, exists
 }
 
-// Set map AND commits to disk
-func (tm *TopicCMap) Set(k string, v structs.Topic, path string) error {
+// Set map AND commits to the journal
+func (tm *TopicCMap) Set(k string, v structs.Topic) error {
 	tm.MapLock.Lock()
 	defer tm.MapLock.Unlock()
+	if err := tm.Journal.PutTopic(v); err != nil {
+		return err
+	}
+
 	tm.Map[k] = v
+	tm.notify()
+	return nil
+}
+
+// Delete from map AND commits to the journal
+func (tm *TopicCMap) Delete(k string) error {
+	tm.MapLock.Lock()
+	defer tm.MapLock.Unlock()
+	if err := tm.Journal.DeleteTopic(k); err != nil {
+		return err
+	}
+
+	delete(tm.Map, k)
+	tm.notify()
+	return nil
+}
+
+// Replaces the whole map AND commits to the journal
+// Used by backup server replicas to apply the primary's state
+func (tm *TopicCMap) Replace(topics []structs.Topic) error {
+	tm.MapLock.Lock()
+	defer tm.MapLock.Unlock()
+	if err := tm.Journal.ReplaceTopics(topics); err != nil {
+		return err
+	}
+
+	tm.Map = make(map[string]structs.Topic)
+	for _, topic := range topics {
+		tm.Map[topic.TopicName] = topic
+	}
+	tm.notify()
+	return nil
+}
+
+// Returns a channel that is closed on the next change to the map. Take it
+// before reading the map so that no change is missed
+func (tm *TopicCMap) Changed() <-chan bool {
+	tm.MapLock.Lock()
+	defer tm.MapLock.Unlock()
+	if tm.changed == nil {
+		tm.changed = make(chan bool)
+	}
+	return tm.changed
+}
 
-	topicArray := make([]structs.Topic, 0)
+// Lock is manually set from caller
+func (tm *TopicCMap) notify() {
+	if tm.changed != nil {
+		close(tm.changed)
+		tm.changed = nil
+	}
+}
+
+// Returns a copy of every topic
+func (tm *TopicCMap) List() []structs.Topic {
+	tm.MapLock.RLock()
+	defer tm.MapLock.RUnlock()
+
+	topicArray := make([]structs.Topic, 0, len(tm.Map))
 	for _, topic := range tm.Map {
 		topicArray = append(topicArray, topic)
 	}
 
-	data, err := json.MarshalIndent(topicArray, "", "  ")
+	return topicArray
+}
+
+// Transactions coordinated by the server, keyed by id
+type TxnCMap struct {
+	MapLock sync.RWMutex
+	Map     map[string]structs.Transaction // Txn id -> Transaction
+	Journal *journal.Journal               // Every change is journalled before it is applied
+}
 
-	if err != nil {
+func (xm *TxnCMap) Get(k string) (structs.Transaction, bool) {
+	xm.MapLock.RLock()
+	defer xm.MapLock.RUnlock()
+	v, exists := xm.Map[k]
+	return v, exists
+}
+
+// Set map AND commits to the journal
+func (xm *TxnCMap) Set(v structs.Transaction) error {
+	xm.MapLock.Lock()
+	defer xm.MapLock.Unlock()
+	if err := xm.Journal.PutTxn(v); err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, data, 0644)
+	xm.Map[v.Id] = v
+	return nil
+}
+
+// Delete from map AND commits to the journal
+func (xm *TxnCMap) Delete(k string) error {
+	xm.MapLock.Lock()
+	defer xm.MapLock.Unlock()
+	if err := xm.Journal.DeleteTxn(k); err != nil {
+		return err
+	}
 
+	delete(xm.Map, k)
+	return nil
 }
 
-func (o *Orphanage) Append(orphan structs.Node) {
-	o.Lock()
-	defer o.Unlock()
-	o.Orphans = append(o.Orphans, orphan)
-	o.Len++
+// Replaces the whole map AND commits to the journal
+// Used by backup server replicas to apply the primary's state
+func (xm *TxnCMap) Replace(txns []structs.Transaction) error {
+	xm.MapLock.Lock()
+	defer xm.MapLock.Unlock()
+	if err := xm.Journal.ReplaceTxns(txns); err != nil {
+		return err
+	}
+
+	xm.Map = make(map[string]structs.Transaction)
+	for _, txn := range txns {
+		xm.Map[txn.Id] = txn
+	}
+	return nil
 }
 
-// Drop n items from the front of the Orphanage
-// Lock is manually set from caller
-func (o *Orphanage) DropN(n int) []structs.Node {
-	droppedNodes := o.Orphans[:n]
-	if n > len(o.Orphans) {
-		log.Println("\x1b[31;1m"+"INDEX OUT OF RANGE ERROR!!!! LEN %d, WANTS TO DROP : %d"+"\x1b[0m", len(o.Orphans), n)
+// Returns a copy of every transaction
+func (xm *TxnCMap) List() []structs.Transaction {
+	xm.MapLock.RLock()
+	defer xm.MapLock.RUnlock()
+
+	txnArray := make([]structs.Transaction, 0, len(xm.Map))
+	for _, txn := range xm.Map {
+		txnArray = append(txnArray, txn)
 	}
-	o.Orphans = o.Orphans[n:]
-	o.Len -= uint32(n)
-	return droppedNodes
+
+	return txnArray
 }
@@ -0,0 +1,246 @@
+package concurrentlib
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"../../lib/logging"
+	"../../structs"
+	"../journal"
+)
+
+// Number of transitions kept per node
+const MAX_TRANSITIONS = 32
+
+var logger = logging.New("server")
+
+// Every node the server knows of, keyed by address. Dead nodes are kept so that
+// their history stays visible
+type NodeRegistry struct {
+	sync.RWMutex
+	Nodes   map[string]*structs.Node // unique ip:port identifies a node
+	Journal *journal.Journal         // Every transition is journalled
+}
+
+// Returns the node if it is alive and the server has a connection to it
+// Lock is manually set from caller
+func (r *NodeRegistry) Connected(addr string) (*structs.Node, bool) {
+	node, exists := r.Nodes[addr]
+	if !exists || node.Client == nil || node.State == structs.NodeDead {
+		return nil, false
+	}
+	return node, true
+}
+
+// Adds the node in the given state, or replaces its connection and labels if
+// it is already known. Returns the stored node
+// Lock is manually set from caller
+func (r *NodeRegistry) Put(node structs.Node, state structs.NodeState) *structs.Node {
+	stored, exists := r.Nodes[node.Address]
+	if !exists {
+		stored = &structs.Node{Address: node.Address}
+		r.Nodes[node.Address] = stored
+	}
+
+	stored.Labels = node.Labels
+	stored.Client = node.Client
+	stored.RecentHeartbeat = node.RecentHeartbeat
+	transition(stored, state, node.Topic, node.Partition)
+	r.record(stored)
+	return stored
+}
+
+// Moves a node to state and records the transition. Topic and partition are
+// only kept for leaders and followers. Returns false for unknown nodes
+// Lock is manually set from caller
+func (r *NodeRegistry) Transition(addr string, state structs.NodeState, topic string, partition int) bool {
+	node, exists := r.Nodes[addr]
+	if !exists {
+		return false
+	}
+
+	if transition(node, state, topic, partition) {
+		r.record(node)
+	}
+	return true
+}
+
+// Forgets a node that has left the system. Its connection is closed
+// Lock is manually set from caller
+func (r *NodeRegistry) Remove(addr string) {
+	node, exists := r.Nodes[addr]
+	if !exists {
+		return
+	}
+
+	if node.Client != nil {
+		node.Client.Close()
+	}
+	delete(r.Nodes, addr)
+
+	if err := r.Journal.DeleteNode(addr); err != nil {
+		logger.Fatal("Could not journal removal of node", "node", addr, "err", err)
+	}
+}
+
+// Journals the node. The registry has already changed and can not be rolled
+// back, so the server stops rather than run on with state it did not persist
+// Lock is manually set from caller
+func (r *NodeRegistry) record(node *structs.Node) {
+	if err := r.Journal.PutNode(status(node)); err != nil {
+		logger.Fatal("Could not journal node", "node", node.Address, "err", err)
+	}
+}
+
+// Returns false if the node was already in that state
+func transition(node *structs.Node, state structs.NodeState, topic string, partition int) bool {
+	if state != structs.NodeLeader && state != structs.NodeFollower {
+		topic, partition = "", 0
+	}
+
+	if node.State == state && node.Topic == topic && node.Partition == partition && len(node.Transitions) > 0 {
+		return false
+	}
+
+	node.State = state
+	node.Topic = topic
+	node.Partition = partition
+	node.Transitions = append(node.Transitions, structs.NodeTransition{
+		State:     state,
+		Topic:     topic,
+		Partition: partition,
+		At:        time.Now().UnixNano()})
+
+	if len(node.Transitions) > MAX_TRANSITIONS {
+		node.Transitions = node.Transitions[len(node.Transitions)-MAX_TRANSITIONS:]
+	}
+	return true
+}
+
+// Returns the node leading partition of topic. Dead leaders are not returned
+// Lock is manually set from caller
+func (r *NodeRegistry) LeaderOf(topic string, partition int) (*structs.Node, bool) {
+	for _, node := range r.Nodes {
+		if node.State == structs.NodeLeader && node.Topic == topic && node.Partition == partition {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the addresses of the live leader and followers of partition of topic
+// Lock is manually set from caller
+func (r *NodeRegistry) Members(topic string, partition int) []string {
+	members := make([]string, 0)
+	for addr, node := range r.Nodes {
+		if (node.State == structs.NodeLeader || node.State == structs.NodeFollower) &&
+			node.Topic == topic && node.Partition == partition {
+			members = append(members, addr)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Returns the connected orphans in the order they became orphans, which is
+// the order they are handed out in when nodes are not labelled
+// Lock is manually set from caller
+func (r *NodeRegistry) Orphans() []*structs.Node {
+	orphans := make([]*structs.Node, 0)
+	for _, node := range r.Nodes {
+		if node.State == structs.NodeOrphan && node.Client != nil {
+			orphans = append(orphans, node)
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		a, b := since(orphans[i]), since(orphans[j])
+		if a != b {
+			return a < b
+		}
+		return orphans[i].Address < orphans[j].Address
+	})
+	return orphans
+}
+
+// Returns the status of every node, sorted by address
+func (r *NodeRegistry) List() []structs.NodeStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	nodes := make([]structs.NodeStatus, 0, len(r.Nodes))
+	for _, node := range r.Nodes {
+		nodes = append(nodes, status(node))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Address < nodes[j].Address
+	})
+	return nodes
+}
+
+// Returns the status of the connected orphans in the order they are handed out
+func (r *NodeRegistry) ListOrphans() []structs.NodeStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	orphans := r.Orphans()
+	nodes := make([]structs.NodeStatus, 0, len(orphans))
+	for _, node := range orphans {
+		nodes = append(nodes, status(node))
+	}
+	return nodes
+}
+
+// Replaces every node with the given statuses AND commits to the journal.
+// Nodes are left without a connection until they register or rejoin.
+// Used by backup server replicas to apply the primary's state, and on startup
+// to load the nodes recovered from the journal
+func (r *NodeRegistry) Replace(nodes []structs.NodeStatus) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.Journal.ReplaceNodes(nodes); err != nil {
+		return err
+	}
+
+	for _, node := range r.Nodes {
+		if node.Client != nil {
+			node.Client.Close()
+		}
+	}
+
+	r.Nodes = make(map[string]*structs.Node)
+	for _, n := range nodes {
+		r.Nodes[n.Address] = &structs.Node{
+			Address:         n.Address,
+			Labels:          n.Labels,
+			RecentHeartbeat: n.RecentHeartbeat,
+			State:           n.State,
+			Topic:           n.Topic,
+			Partition:       n.Partition,
+			Transitions:     append([]structs.NodeTransition{}, n.Transitions...)}
+	}
+	return nil
+}
+
+func status(node *structs.Node) structs.NodeStatus {
+	return structs.NodeStatus{
+		Address:         node.Address,
+		Labels:          node.Labels,
+		RecentHeartbeat: node.RecentHeartbeat,
+		Connected:       node.Client != nil && node.State != structs.NodeDead,
+		State:           node.State,
+		Topic:           node.Topic,
+		Partition:       node.Partition,
+		Transitions:     append([]structs.NodeTransition{}, node.Transitions...)}
+}
+
+// Time the node entered its current state
+func since(node *structs.Node) int64 {
+	if len(node.Transitions) == 0 {
+		return 0
+	}
+	return node.Transitions[len(node.Transitions)-1].At
+}
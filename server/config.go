@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	conf "../lib/config"
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Configuration
+//
+// The config is loaded in layers: built in defaults, then the -c JSON files, then KTS_SERVER_*
+// environment variables, then -set key=value flags. It is validated before the server starts.
+// On SIGHUP the layers are loaded again. Settings that can change under a running server are
+// applied, and new NodeSettings are pushed to every connected node. Listeners, TLS, the journal
+// and the replicas only change on a restart.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Environment variables of settings start with this, e.g. KTS_SERVER_NODE_SETTINGS_HEARTBEAT
+const ENV_CONFIG_PREFIX = "KTS_SERVER_"
+
+// Settings of the server, loaded by loadConfig. Keys are the json tags
+type Config struct {
+	NodeSettings structs.NodeSettings `json:"node-settings"`
+	RpcIpPort    string               `json:"rpc-ip-port"`
+
+	// CA, certificate and key for mutual TLS on every RPC connection. The
+	// certificate's role must be server. Empty runs plain TCP
+	TLS mtls.Config `json:"tls"`
+
+	// Directory of the journal that keeps topics and nodes across restarts
+	JournalDir    string `json:"journal-dir"`
+	SnapshotEvery int    `json:"snapshot-every"` // Journal records between snapshots
+
+	// Topics file written by older servers. Imported into an empty journal
+	DataPath string `json:"data-filepath"`
+
+	// Addresses of every server replica, including this one. Empty runs a
+	// single server that is always the primary
+	Replicas    []string `json:"replicas"`
+	ReplicaAddr string   `json:"replica-addr"` // This replica's address in Replicas
+
+	// Optional listener for the admin HTTP/JSON API
+	HttpIpPort string `json:"http-ip-port"`
+
+	// Optional listener for Prometheus metrics on /metrics, without the admin API
+	MetricsIpPort string `json:"metrics-ip-port"`
+
+	// Clients that authenticate with a token. Clients with a TLS certificate
+	// are known by its name and need no token
+	Clients []ClientCredential `json:"clients"`
+
+	// Refuse clients without a token or certificate, even on open topics
+	RequireCredentials bool `json:"require-credentials"`
+
+	// Write quotas of topics and clients that have none of their own
+	Quotas DefaultQuotas `json:"quotas"`
+
+	// Seconds between leadership rebalancing rounds. 0 disables rebalancing
+	RebalanceInterval  int     `json:"rebalance-interval"`
+	RebalanceThreshold float64 `json:"rebalance-threshold"` // Busiest host's load over the average
+}
+
+// Top level settings that a reload applies
+var reloadable = map[string]bool{
+	"node-settings":       true,
+	"clients":             true,
+	"require-credentials": true,
+	"quotas":              true,
+	"rebalance-interval":  true,
+	"rebalance-threshold": true,
+}
+
+// Guards the reloadable settings of config. The others never change after
+// startup and are read without it
+var configLock sync.RWMutex
+
+func defaultConfig() Config {
+	return Config{
+		NodeSettings: structs.NodeSettings{
+			HeartBeat:   10000,
+			MinReplicas: 2,
+			ClusterSize: 3},
+		JournalDir: journalDir}
+}
+
+// Loads and validates every layer of the config
+func loadConfig(loader conf.Loader) (Config, error) {
+	loaded := defaultConfig()
+	if err := loader.Load(&loaded); err != nil {
+		return loaded, err
+	}
+	return loaded, loaded.Validate()
+}
+
+// Returns a copy of the config, for reading the reloadable settings
+func currentConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+type InvalidConfigError string
+
+func (e InvalidConfigError) Error() string {
+	return fmt.Sprintf("Server: invalid config: %s", string(e))
+}
+
+// Checks the invariants of the README, and that the settings make sense together
+func (cfg Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.RpcIpPort != "", "rpc-ip-port must be set")
+
+	if err := cfg.NodeSettings.Validate(); err != nil {
+		problems = append(problems, "node-settings: "+err.Error())
+	}
+
+	check(cfg.SnapshotEvery >= 0, "snapshot-every must not be negative, got %d", cfg.SnapshotEvery)
+
+	if len(cfg.Replicas) > 0 {
+		seen := make(map[string]bool)
+		for _, addr := range cfg.Replicas {
+			check(!seen[addr], "replicas lists %s twice", addr)
+			seen[addr] = true
+		}
+		check(seen[cfg.ReplicaAddr], "replica-addr [%s] must be one of replicas", cfg.ReplicaAddr)
+	}
+
+	names := make(map[string]bool)
+	for _, client := range cfg.Clients {
+		check(client.Name != "", "clients must have a name")
+		check(!names[client.Name], "clients lists %s twice", client.Name)
+		check(len(client.TokenSHA256) == 64, "token-sha256 of client %s must be 64 hex digits", client.Name)
+		names[client.Name] = true
+	}
+
+	for _, quota := range []structs.Quota{cfg.Quotas.Client, cfg.Quotas.Topic} {
+		check(quota.MessagesPerSec >= 0 && quota.BytesPerSec >= 0, "quotas must not be negative, got %s", quota)
+	}
+
+	check(cfg.RebalanceInterval >= 0, "rebalance-interval must not be negative, got %d", cfg.RebalanceInterval)
+	check(cfg.RebalanceThreshold == 0 || cfg.RebalanceThreshold >= 1,
+		"rebalance-threshold must be at least 1, got %g", cfg.RebalanceThreshold)
+
+	if len(problems) > 0 {
+		return InvalidConfigError(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Loads the config again on every SIGHUP
+func reloadOnHangup(loader conf.Loader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		if err := reloadConfig(loader); err != nil {
+			logger.Error("Could not reload config, keeping the current one", "err", err)
+		}
+	}
+}
+
+// Applies the reloadable settings that changed. Changes to the others are
+// logged and wait for a restart
+func reloadConfig(loader conf.Loader) error {
+	loaded, err := loadConfig(loader)
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	old := config
+	config.NodeSettings = loaded.NodeSettings
+	config.Clients = loaded.Clients
+	config.RequireCredentials = loaded.RequireCredentials
+	config.Quotas = loaded.Quotas
+	config.RebalanceInterval = loaded.RebalanceInterval
+	config.RebalanceThreshold = loaded.RebalanceThreshold
+	configLock.Unlock()
+
+	var applied, needRestart []string
+	for _, key := range conf.Changed(&old, &loaded) {
+		if reloadable[strings.Split(key, ".")[0]] {
+			applied = append(applied, key)
+		} else {
+			needRestart = append(needRestart, key)
+		}
+	}
+
+	logger.Info("Reloaded config", "changed", applied)
+	if len(needRestart) > 0 {
+		logger.Warn("Changed settings only apply after a restart", "settings", needRestart)
+	}
+
+	if old.NodeSettings != loaded.NodeSettings && isPrimary() {
+		go pushNodeSettings(loaded.NodeSettings)
+	}
+	return nil
+}
+
+// Sends settings to every connected node. Nodes that miss them are given
+// them when they rejoin
+func pushNodeSettings(settings structs.NodeSettings) {
+	nodeRegistry.RLock()
+	nodes := make([]structs.Node, 0, len(nodeRegistry.Nodes))
+	for addr := range nodeRegistry.Nodes {
+		if node, ok := nodeRegistry.Connected(addr); ok {
+			nodes = append(nodes, *node)
+		}
+	}
+	nodeRegistry.RUnlock()
+
+	for _, node := range nodes {
+		var ignored bool
+		if err := node.Client.Call("Peer.UpdateSettings", settings, &ignored); err != nil {
+			logger.Warn("Could not push node settings", "node", node.Address, "err", err)
+		}
+	}
+
+	logger.Info("Pushed node settings", "nodes", len(nodes))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Node drain
+//
+// Takes a node out of service without an election or a TakeNode scramble:
+//
+//   orphan   - leaves right away
+//   follower - an orphan is added to its cluster with a full copy of the data, then the
+//              follower drops the topic
+//   leader   - hands leadership to an in-sync follower and tells the server of the new leader
+//              through UpdateTopicLeader, then is replaced like a follower
+//
+// The node is marked draining first so that it is never handed out again. Once it is out of its
+// cluster the server tells it to leave, and it deregisters instead of timing out in monitor.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Where a node was before it started draining
+type drainedFrom struct {
+	State     structs.NodeState
+	Topic     string
+	Partition int
+}
+
+// Admin -> Server rpc that drains the node at addr, its PeerRpc address
+func (s *TServer) DrainNode(addr *string, _ignored *bool) (err error) {
+	if err := s.allow("DrainNode", mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	defer commitOnReturn(&err)
+
+	node, from, replacement, err := startDrain(*addr)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Draining node", "node", node.Address, "role", from.State, "topic", from.Topic, "partition", from.Partition)
+
+	var replaceErr error
+	switch from.State {
+	case structs.NodeFollower:
+		if err := replaceFollower(from, node.Address, replacement); err != nil {
+			abortDrain(node.Address, from, replacement)
+			return err
+		}
+
+	case structs.NodeLeader:
+		var partition structs.Partition
+		if err := node.Client.Call("Peer.HandOff", structs.HandOffMsg{}, &partition); err != nil {
+			abortDrain(node.Address, from, replacement)
+			return err
+		}
+
+		// The node is out of its cluster now, so it leaves even if the
+		// cluster stays a follower short
+		from.State = structs.NodeFollower
+		if replaceErr = replaceFollower(from, node.Address, replacement); replaceErr != nil {
+			logger.Error("Could not replace drained node", "node", node.Address, "topic", from.Topic, "partition", from.Partition, "err", replaceErr)
+			abortDrain("", from, replacement)
+		}
+	}
+
+	var ignored string
+	if err := node.Client.Call("Peer.Leave", "", &ignored); err != nil {
+		checkError(err, "DrainNode Leave")
+	}
+
+	logger.Info("Node drained", "node", node.Address)
+	return replaceErr
+}
+
+// Node -> Server rpc sent by a drained node as it leaves. The node is
+// forgotten rather than marked dead
+func (s *TServer) Deregister(addr string, _ignored *bool) (err error) {
+	if err := s.allowNode("Deregister", addr); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	// Deferred first so that it runs after the registry is unlocked
+	defer commitOnReturn(&err)
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	node, connected := nodeRegistry.Connected(addr)
+	if !connected {
+		return UnknownNodeError(addr)
+	}
+
+	if node.State != structs.NodeDraining {
+		return NodeNotDrainingError(addr)
+	}
+
+	nodeRegistry.Remove(addr)
+	logger.Info("Node deregistered", "node", addr)
+	return nil
+}
+
+// Marks the node draining. Leaders and followers also get a replacement,
+// claimed now so that the partition keeps its spread across failure domains.
+// Returns a copy of the node, where it was and its replacement
+func startDrain(addr string) (structs.Node, drainedFrom, string, error) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	node, connected := nodeRegistry.Connected(addr)
+	if !connected {
+		return structs.Node{}, drainedFrom{}, "", UnknownNodeError(addr)
+	}
+
+	if node.State == structs.NodeDraining {
+		return structs.Node{}, drainedFrom{}, "", NodeDrainingError(addr)
+	}
+
+	from := drainedFrom{State: node.State, Topic: node.Topic, Partition: node.Partition}
+
+	replacement := ""
+	if from.State == structs.NodeLeader || from.State == structs.NodeFollower {
+		orphans := nodeRegistry.Orphans()
+		if len(orphans) == 0 {
+			return structs.Node{}, drainedFrom{}, "", InsufficientNodesForCluster("")
+		}
+
+		members := make([]string, 0)
+		for _, member := range nodeRegistry.Members(from.Topic, from.Partition) {
+			if member != addr {
+				members = append(members, member)
+			}
+		}
+
+		replacement = orphans[spreadOrphans(orphans, 1, memberLabels(members))[0]].Address
+		nodeRegistry.Transition(replacement, structs.NodeFollower, from.Topic, from.Partition)
+	}
+
+	nodeRegistry.Transition(addr, structs.NodeDraining, "", 0)
+	return *node, from, replacement, nil
+}
+
+// Asks the partition's leader to swap the draining follower for replacement
+func replaceFollower(from drainedFrom, addr string, replacement string) error {
+	nodeRegistry.RLock()
+	leader, ok := nodeRegistry.LeaderOf(from.Topic, from.Partition)
+	var leaderNode structs.Node
+	if ok {
+		leaderNode = *leader
+	}
+	nodeRegistry.RUnlock()
+
+	if !ok || leaderNode.Client == nil {
+		return fmt.Errorf("Partition %s/%d has no connected leader", from.Topic, from.Partition)
+	}
+
+	var ignored string
+	msg := structs.ReplaceFollowerMsg{Old: addr, New: replacement}
+	return leaderNode.Client.Call("Peer.ReplaceFollower", msg, &ignored)
+}
+
+// Puts the node back where it was and returns its replacement to the orphans.
+// An empty addr only releases the replacement
+func abortDrain(addr string, from drainedFrom, replacement string) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	if _, connected := nodeRegistry.Connected(addr); connected {
+		nodeRegistry.Transition(addr, from.State, from.Topic, from.Partition)
+	}
+
+	if _, connected := nodeRegistry.Connected(replacement); connected {
+		nodeRegistry.Transition(replacement, structs.NodeOrphan, "", 0)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"../structs"
+	c "./concurrentlib"
+)
+
+// Answers the peer rpcs the server makes to a node
+type fakeNode struct {
+	refuse    bool   // Fails ReplaceFollower, HandOff and WriteTxnMarker
+	onHandOff func() // Stands in for the new leader's UpdateTopicLeader
+
+	sync.Mutex
+	replaced []structs.ReplaceFollowerMsg
+	handOffs []structs.HandOffMsg
+	markers  []structs.TxnMarkerMsg
+	left     bool
+}
+
+func (n *fakeNode) ReplaceFollower(msg structs.ReplaceFollowerMsg, _ignored *string) error {
+	if n.refuse {
+		return errors.New("refused")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	n.replaced = append(n.replaced, msg)
+	return nil
+}
+
+func (n *fakeNode) HandOff(msg structs.HandOffMsg, partition *structs.Partition) error {
+	if n.refuse {
+		return errors.New("refused")
+	}
+
+	if n.onHandOff != nil {
+		n.onHandOff()
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	n.handOffs = append(n.handOffs, msg)
+	return nil
+}
+
+func (n *fakeNode) WriteTxnMarker(msg structs.TxnMarkerMsg, _ignored *bool) error {
+	if n.refuse {
+		return errors.New("refused")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	n.markers = append(n.markers, msg)
+	return nil
+}
+
+func (n *fakeNode) Leave(_ignored string, _reply *string) error {
+	n.Lock()
+	defer n.Unlock()
+	n.left = true
+	return nil
+}
+
+// Returns a client whose calls are served by n
+func dialFake(t *testing.T, n *fakeNode) *rpc.Client {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Peer", n); err != nil {
+		t.Fatal(err)
+	}
+
+	serverEnd, clientEnd := net.Pipe()
+	go server.ServeConn(serverEnd)
+
+	client := rpc.NewClient(clientEnd)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Replaces the registry with nodes in the given states, all in t/0 unless
+// orphans. Returns the fake behind each address
+func resetRegistry(t *testing.T, states map[string]structs.NodeState, refuse map[string]bool) map[string]*fakeNode {
+	nodeRegistry = c.NodeRegistry{Nodes: make(map[string]*structs.Node)}
+	config.Replicas = nil
+
+	fakes := make(map[string]*fakeNode)
+	for addr, state := range states {
+		fakes[addr] = &fakeNode{refuse: refuse[addr]}
+
+		node := structs.Node{Address: addr, Client: dialFake(t, fakes[addr])}
+		if state == structs.NodeLeader || state == structs.NodeFollower {
+			node.Topic = "t"
+		}
+		nodeRegistry.Put(node, state)
+	}
+	return fakes
+}
+
+func stateOf(addr string) structs.NodeState {
+	nodeRegistry.RLock()
+	defer nodeRegistry.RUnlock()
+	return nodeRegistry.Nodes[addr].State
+}
+
+func TestDrainFollower(t *testing.T) {
+	fakes := resetRegistry(t, map[string]structs.NodeState{
+		"leader:1":   structs.NodeLeader,
+		"follower:1": structs.NodeFollower,
+		"orphan:1":   structs.NodeOrphan}, nil)
+
+	addr := "follower:1"
+	if err := (&TServer{}).DrainNode(&addr, new(bool)); err != nil {
+		t.Fatalf("DrainNode: %s", err)
+	}
+
+	want := structs.ReplaceFollowerMsg{Old: "follower:1", New: "orphan:1"}
+	if got := fakes["leader:1"].replaced; len(got) != 1 || got[0] != want {
+		t.Errorf("leader was asked to replace %v, want %v", got, want)
+	}
+	if got := stateOf("orphan:1"); got != structs.NodeFollower {
+		t.Errorf("replacement is %s, want %s", got, structs.NodeFollower)
+	}
+	if got := stateOf(addr); got != structs.NodeDraining {
+		t.Errorf("drained node is %s, want %s", got, structs.NodeDraining)
+	}
+	if !fakes[addr].left {
+		t.Errorf("drained node was not told to leave")
+	}
+
+	// Draining nodes are never handed out again
+	var taken string
+	if err := (&TServer{}).TakeNode([]string{"leader:1"}, &taken); err == nil {
+		t.Errorf("TakeNode gave %s, want no orphan left", taken)
+	}
+
+	if err := (&TServer{}).Deregister(addr, new(bool)); err != nil {
+		t.Fatalf("Deregister: %s", err)
+	}
+	if _, ok := nodeRegistry.Nodes[addr]; ok {
+		t.Errorf("deregistered node is still known")
+	}
+}
+
+func TestDrainLeader(t *testing.T) {
+	fakes := resetRegistry(t, map[string]structs.NodeState{
+		"leader:1":   structs.NodeLeader,
+		"follower:1": structs.NodeFollower,
+		"orphan:1":   structs.NodeOrphan}, nil)
+
+	addr := "leader:1"
+	fakes[addr].onHandOff = func() {
+		nodeRegistry.Lock()
+		defer nodeRegistry.Unlock()
+		nodeRegistry.Transition("follower:1", structs.NodeLeader, "t", 0)
+	}
+
+	if err := (&TServer{}).DrainNode(&addr, new(bool)); err != nil {
+		t.Fatalf("DrainNode: %s", err)
+	}
+
+	if len(fakes[addr].handOffs) != 1 {
+		t.Errorf("leader handed off %d times, want 1", len(fakes[addr].handOffs))
+	}
+	if got := stateOf(addr); got != structs.NodeDraining {
+		t.Errorf("drained leader is %s, want %s", got, structs.NodeDraining)
+	}
+	if !fakes[addr].left {
+		t.Errorf("drained leader was not told to leave")
+	}
+
+	// The new leader swaps the old one for the replacement
+	want := structs.ReplaceFollowerMsg{Old: "leader:1", New: "orphan:1"}
+	if got := fakes["follower:1"].replaced; len(got) != 1 || got[0] != want {
+		t.Errorf("new leader was asked to replace %v, want %v", got, want)
+	}
+	if got := stateOf("orphan:1"); got != structs.NodeFollower {
+		t.Errorf("replacement is %s, want %s", got, structs.NodeFollower)
+	}
+}
+
+func TestDrainAbort(t *testing.T) {
+	resetRegistry(t, map[string]structs.NodeState{
+		"leader:1":   structs.NodeLeader,
+		"follower:1": structs.NodeFollower,
+		"orphan:1":   structs.NodeOrphan}, map[string]bool{"leader:1": true})
+
+	addr := "follower:1"
+	if err := (&TServer{}).DrainNode(&addr, new(bool)); err == nil {
+		t.Fatal("DrainNode succeeded although the leader refused the replacement")
+	}
+
+	if got := stateOf(addr); got != structs.NodeFollower {
+		t.Errorf("node is %s after the failed drain, want %s", got, structs.NodeFollower)
+	}
+	if got := stateOf("orphan:1"); got != structs.NodeOrphan {
+		t.Errorf("replacement is %s after the failed drain, want %s", got, structs.NodeOrphan)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Geo-routed topics
+//
+// A topic may cover a region, a bounding box or a polygon, which is journalled and replicated with
+// the topic. Together the regions form the geographic index that clients use to find the topic of a
+// location: LocateTopic resolves one location on the server, and GetGeoIndex returns every region
+// so that producers can route their points without a call per point.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Returns the regions of every geo-routed topic, sorted by topic
+func geoIndex() structs.GeoIndex {
+	index := make(structs.GeoIndex, 0)
+	for _, topic := range topics.List() {
+		if topic.Region != nil {
+			index = append(index, structs.TopicRegion{Topic: topic.TopicName, Region: *topic.Region})
+		}
+	}
+
+	index.Sort()
+	return index
+}
+
+// Client -> Server rpc that returns the geographic index. Like ListTopics, it
+// shows every topic's name
+func (s *TServer) GetGeoIndex(_ignored string, indexReply *structs.GeoIndex) error {
+	if err := s.allow("GetGeoIndex", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	*indexReply = geoIndex()
+	return nil
+}
+
+// Client -> Server rpc that returns the topic whose region holds a location.
+// Needs the same permissions as GetTopic
+func (s *TServer) LocateTopic(msg structs.LocateMsg, topicReply *structs.Topic) error {
+	if err := s.allow("LocateTopic", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topicName, ok := geoIndex().Lookup(msg.Location)
+	if !ok {
+		return structs.NoTopicAtLocationError(msg.Location.String())
+	}
+
+	topic, ok := topics.Get(topicName)
+	if !ok {
+		return TopicDoesNotExistError(topicName)
+	}
+
+	if _, err := s.authorize(topic, msg.Token, structs.PermProduce, structs.PermConsume); err != nil {
+		return err
+	}
+
+	*topicReply = topic
+	return nil
+}
+
+// Admin -> Server rpc that sets or removes the region of a topic. Needs admin
+// on the topic. Regions may overlap, the smallest holding a location wins
+func (s *TServer) SetTopicRegion(msg structs.SetRegionMsg, topicReply *structs.Topic) (err error) {
+	if err := s.allow("SetTopicRegion", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.TopicName)
+	if !ok {
+		return TopicDoesNotExistError(msg.TopicName)
+	}
+
+	if _, err := s.authorize(topic, msg.Token, structs.PermAdmin); err != nil {
+		return err
+	}
+
+	if msg.Region != nil {
+		if err := msg.Region.Validate(); err != nil {
+			return err
+		}
+	}
+
+	topic.Region = msg.Region
+	defer commitOnReturn(&err)
+	if err := topics.Set(topic.TopicName, topic); err != nil {
+		return err
+	}
+
+	if msg.Region == nil {
+		logger.Info("Removed topic region", "topic", topic.TopicName)
+	} else {
+		logger.Info("Set topic region", "topic", topic.TopicName, "region", msg.Region.String())
+	}
+
+	*topicReply = topic
+	return nil
+}
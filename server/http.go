@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"../lib/metrics"
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Admin HTTP/JSON API
+//
+// GET    /topics         - every topic
+// POST   /topics         - create a topic, body: {"name": "ubc", "spec": {"partitions": 2}}
+// GET    /topics/<name>  - live description of a topic from its leaders
+// DELETE /topics/<name>  - delete a topic and recycle its nodes
+// GET    /nodes          - every node with its state and transitions
+// POST   /nodes/<addr>/drain - drain a node, addr is its PeerRpc ip:port
+// GET    /orphans        - the orphan pool
+// GET    /metrics        - Prometheus metrics
+//
+// Handlers call the same TServer methods as the RPC API. With TLS on the API is served over mutual
+// TLS, and each request is checked against the role of the caller's certificate as over RPC.
+// Errors are returned as {"error": "..."}
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+type createTopicRequest struct {
+	Name string            `json:"name"`
+	Spec structs.TopicSpec `json:"spec"`
+}
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Primary string `json:"primary,omitempty"` // Set when this replica is not the primary
+}
+
+func serveHttp(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics", withCaller(handleTopics))
+	mux.HandleFunc("/topics/", withCaller(handleTopic))
+	mux.HandleFunc("/nodes", withCaller(func(w http.ResponseWriter, r *http.Request, tServer *TServer) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+
+		var nodes []structs.NodeStatus
+		writeJson(w, nodes, tServer.ListNodes("", &nodes))
+	}))
+	mux.HandleFunc("/nodes/", withCaller(handleNode))
+	mux.HandleFunc("/orphans", withCaller(func(w http.ResponseWriter, r *http.Request, tServer *TServer) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+
+		var orphans []structs.NodeStatus
+		writeJson(w, orphans, tServer.ListOrphans("", &orphans))
+	}))
+
+	mux.Handle("/metrics", metrics.Handler())
+
+	l, err := mtls.Listen(addr)
+	if checkError(err, "serveHttp") {
+		return
+	}
+
+	logger.Info("Admin HTTP API started", "addr", addr, "tls", mtls.Enabled())
+	err = http.Serve(l, mux)
+	checkError(err, "serveHttp")
+}
+
+// Calls handler with a TServer for the identity of the request's client
+// certificate, like the one each RPC connection gets
+func withCaller(handler func(http.ResponseWriter, *http.Request, *TServer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := mtls.RequestIdentity(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		handler(w, r, &TServer{caller: caller})
+	}
+}
+
+func handleTopics(w http.ResponseWriter, r *http.Request, tServer *TServer) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var topicList []structs.Topic
+		writeJson(w, topicList, tServer.ListTopics("", &topicList))
+		return
+	}
+
+	var req createTopicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Body must be {\"name\": <topic>, \"spec\": {...}}"))
+		return
+	}
+
+	var topic structs.Topic
+	msg := structs.CreateTopicMsg{TopicName: req.Name, Spec: req.Spec}
+	writeJson(w, topic, tServer.CreateTopic(&msg, &topic))
+}
+
+func handleTopic(w http.ResponseWriter, r *http.Request, tServer *TServer) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/topics/")
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, TopicDoesNotExistError(name))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var desc structs.TopicDescription
+		writeJson(w, desc, tServer.DescribeTopic(&name, &desc))
+		return
+	}
+
+	var ignored bool
+	writeJson(w, map[string]string{"deleted": name}, tServer.DeleteTopic(&name, &ignored))
+}
+
+func handleNode(w http.ResponseWriter, r *http.Request, tServer *TServer) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	addr := strings.TrimPrefix(r.URL.Path, "/nodes/")
+	if !strings.HasSuffix(addr, "/drain") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown node action %s", r.URL.Path))
+		return
+	}
+
+	addr = strings.TrimSuffix(addr, "/drain")
+	var ignored bool
+	writeJson(w, map[string]string{"drained": addr}, tServer.DrainNode(&addr, &ignored))
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+	return false
+}
+
+// Writes v, or the error returned by the TServer method with a matching status code
+func writeJson(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		writeError(w, statusForError(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		checkError(err, "writeJson")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	resp := errorResponse{Error: err.Error()}
+	if primary, ok := structs.PrimaryFromError(err); ok {
+		resp.Primary = primary
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func statusForError(err error) int {
+	switch err.(type) {
+	case TopicDoesNotExistError, PartitionDoesNotExistError, UnknownNodeError:
+		return http.StatusNotFound
+	case DuplicateTopicNameError, TopicRecyclingError, NodeDrainingError:
+		return http.StatusConflict
+	case structs.InvalidTopicSpecError:
+		return http.StatusBadRequest
+	case structs.UnauthorizedError:
+		return http.StatusForbidden
+	case structs.NotPrimaryError, NoMajorityError, InsufficientNodesForCluster:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
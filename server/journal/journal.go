@@ -0,0 +1,513 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"../../lib/logging"
+	"../../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Server metadata journal
+//
+// Topics, nodes, transactions and the replica's election term are kept in an append-only journal. Every change is appended as
+// one record and fsynced before the call returns. Each record is framed as
+//
+//	[4 byte length][4 byte CRC-32C of the payload][JSON payload]
+//
+// Every SnapshotEvery records the whole state is written to a snapshot file, which replaces the
+// old one with an atomic rename, and the journal is truncated. On startup the snapshot is loaded
+// and the journal replayed on top of it. A record cut short by a crash, or one that fails its
+// checksum, ends the journal: it and anything after it are dropped. A failed append is cut off
+// again right away so that later records are not written after it. If that fails too, the journal
+// refuses every later append. A failed snapshot only delays truncating the journal, since the
+// record that triggered it is already written.
+//
+// Records set state rather than change it, so replaying a record that is already part of the
+// snapshot is harmless. This covers a crash between writing a snapshot and truncating the journal.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	JOURNAL_FILE  = "journal.log"
+	SNAPSHOT_FILE = "snapshot.json"
+
+	// Default number of records between snapshots
+	SNAPSHOT_EVERY = 1000
+
+	// Larger records can only come from a corrupt length
+	MAX_RECORD_SIZE = 64 << 20
+
+	HEADER_SIZE = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var logger = logging.New("journal")
+
+type RecordType string
+
+const (
+	PutTopicRecord      RecordType = "put-topic"
+	DeleteTopicRecord   RecordType = "delete-topic"
+	ReplaceTopicsRecord RecordType = "replace-topics"
+	PutNodeRecord       RecordType = "put-node"
+	DeleteNodeRecord    RecordType = "delete-node"
+	ReplaceNodesRecord  RecordType = "replace-nodes"
+	PutTxnRecord        RecordType = "put-txn"
+	DeleteTxnRecord     RecordType = "delete-txn"
+	ReplaceTxnsRecord   RecordType = "replace-txns"
+	PutTermRecord       RecordType = "put-term"
+)
+
+type Record struct {
+	Type      RecordType            `json:"type"`
+	Topic     *structs.Topic        `json:"topic,omitempty"`
+	TopicName string                `json:"topic-name,omitempty"`
+	Topics    []structs.Topic       `json:"topics,omitempty"`
+	Node      *structs.NodeStatus   `json:"node,omitempty"`
+	Address   string                `json:"address,omitempty"`
+	Nodes     []structs.NodeStatus  `json:"nodes,omitempty"`
+	Txn       *structs.Transaction  `json:"txn,omitempty"`
+	TxnId     string                `json:"txn-id,omitempty"`
+	Txns      []structs.Transaction `json:"txns,omitempty"`
+	Term      *ReplicaTerm          `json:"term,omitempty"`
+}
+
+// Election state of a server replica. It is kept so that a restarted replica
+// neither votes twice in one term nor forgets how new its state is
+type ReplicaTerm struct {
+	Term         uint64 `json:"term"`                // Only ever increases
+	VotedFor     string `json:"voted-for,omitempty"` // Replica given this replica's vote in Term
+	StateTerm    uint64 `json:"state-term"`          // Term of the primary that wrote the state
+	StateVersion uint64 `json:"state-version"`
+}
+
+// Server metadata as recovered from disk. Nodes have no connections after a
+// restart, so Connected is always false
+type State struct {
+	Topics []structs.Topic       `json:"topics"`
+	Nodes  []structs.NodeStatus  `json:"nodes"`
+	Txns   []structs.Transaction `json:"txns"`
+	Term   ReplicaTerm           `json:"term"`
+}
+
+type snapshotFile struct {
+	Version int   `json:"version"`
+	State   State `json:"state"`
+}
+
+type UnusableJournalError string
+
+func (e UnusableJournalError) Error() string {
+	return fmt.Sprintf("Journal: a failed write could not be undone, no more records are accepted: %s", string(e))
+}
+
+type CorruptSnapshotError string
+
+func (e CorruptSnapshotError) Error() string {
+	return fmt.Sprintf("Journal: snapshot [%s] is corrupt", string(e))
+}
+
+// A nil Journal accepts every record and writes nothing
+type Journal struct {
+	sync.Mutex
+	dir           string
+	file          *os.File
+	size          int64 // bytes of intact records in file
+	records       int   // records since the last snapshot
+	snapshotEvery int
+	unusable      error // Set once the file may hold a torn record
+
+	// Mirror of the journalled state, used to write snapshots without
+	// reaching into the server's maps
+	topics map[string]structs.Topic
+	nodes  map[string]structs.NodeStatus
+	txns   map[string]structs.Transaction
+	term   ReplicaTerm
+}
+
+// Opens the journal in dir, creating it if needed, and recovers the state
+// it holds. snapshotEvery <= 0 uses SNAPSHOT_EVERY
+func Open(dir string, snapshotEvery int) (*Journal, State, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = SNAPSHOT_EVERY
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, State{}, err
+	}
+
+	j := &Journal{
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+		topics:        make(map[string]structs.Topic),
+		nodes:         make(map[string]structs.NodeStatus),
+		txns:          make(map[string]structs.Transaction)}
+
+	// Left behind by a crash while snapshotting. The old snapshot is intact
+	os.Remove(filepath.Join(dir, SNAPSHOT_FILE+".tmp"))
+
+	if err := j.loadSnapshot(); err != nil {
+		return nil, State{}, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, JOURNAL_FILE), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, State{}, err
+	}
+	j.file = file
+
+	if err := j.replay(); err != nil {
+		file.Close()
+		return nil, State{}, err
+	}
+
+	return j, j.state(), nil
+}
+
+func (j *Journal) PutTopic(topic structs.Topic) error {
+	return j.append(Record{Type: PutTopicRecord, Topic: &topic})
+}
+
+func (j *Journal) DeleteTopic(topicName string) error {
+	return j.append(Record{Type: DeleteTopicRecord, TopicName: topicName})
+}
+
+func (j *Journal) ReplaceTopics(topics []structs.Topic) error {
+	return j.append(Record{Type: ReplaceTopicsRecord, Topics: topics})
+}
+
+func (j *Journal) PutNode(node structs.NodeStatus) error {
+	return j.append(Record{Type: PutNodeRecord, Node: &node})
+}
+
+func (j *Journal) DeleteNode(addr string) error {
+	return j.append(Record{Type: DeleteNodeRecord, Address: addr})
+}
+
+func (j *Journal) ReplaceNodes(nodes []structs.NodeStatus) error {
+	return j.append(Record{Type: ReplaceNodesRecord, Nodes: nodes})
+}
+
+func (j *Journal) PutTxn(txn structs.Transaction) error {
+	return j.append(Record{Type: PutTxnRecord, Txn: &txn})
+}
+
+func (j *Journal) DeleteTxn(txnId string) error {
+	return j.append(Record{Type: DeleteTxnRecord, TxnId: txnId})
+}
+
+func (j *Journal) ReplaceTxns(txns []structs.Transaction) error {
+	return j.append(Record{Type: ReplaceTxnsRecord, Txns: txns})
+}
+
+func (j *Journal) PutTerm(term ReplicaTerm) error {
+	return j.append(Record{Type: PutTermRecord, Term: &term})
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	return j.file.Close()
+}
+
+// Writes the record and fsyncs it, then takes a snapshot if one is due. An
+// error means the record was not written
+func (j *Journal) append(rec Record) error {
+	if j == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[HEADER_SIZE:], payload)
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.unusable != nil {
+		return j.unusable
+	}
+
+	if _, err := j.file.Write(frame); err != nil {
+		return j.undoAppend(err)
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return j.undoAppend(err)
+	}
+
+	j.apply(rec)
+	j.size += int64(len(frame))
+	j.records++
+
+	// The record is already durable, so a failed snapshot does not fail the
+	// append. The journal keeps growing and the next snapshot is tried after
+	// another SnapshotEvery records
+	if j.records >= j.snapshotEvery {
+		if err := j.snapshot(); err != nil {
+			logger.Error("Failed to snapshot the journal", "file", SNAPSHOT_FILE, "err", err)
+			j.records = 0
+		}
+	}
+	return nil
+}
+
+// Cuts off what a failed append may have written, since replay stops at the
+// first bad record and would drop every record after it. Returns err, or an
+// UnusableJournalError if the file could not be cut
+// Lock is manually set from caller
+func (j *Journal) undoAppend(err error) error {
+	if truncErr := j.file.Truncate(j.size); truncErr != nil {
+		j.unusable = UnusableJournalError(truncErr.Error())
+	} else if syncErr := j.file.Sync(); syncErr != nil {
+		j.unusable = UnusableJournalError(syncErr.Error())
+	}
+
+	if j.unusable != nil {
+		logger.Error("Journal is unusable", "file", JOURNAL_FILE, "err", err, "undo-err", j.unusable)
+		return j.unusable
+	}
+	return err
+}
+
+// Writes the mirrored state to a new snapshot and empties the journal
+// Lock is manually set from caller
+func (j *Journal) snapshot() error {
+	data, err := json.MarshalIndent(snapshotFile{Version: 1, State: j.state()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.dir, SNAPSHOT_FILE)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	if err := syncDir(j.dir); err != nil {
+		return err
+	}
+
+	// The file is opened with O_APPEND, so later writes start from 0
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.records = 0
+	return nil
+}
+
+func (j *Journal) loadSnapshot() error {
+	path := filepath.Join(j.dir, SNAPSHOT_FILE)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Snapshots are only ever replaced by rename, so a bad one is not a torn write
+	var snap snapshotFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return CorruptSnapshotError(path)
+	}
+
+	j.apply(Record{Type: ReplaceTopicsRecord, Topics: snap.State.Topics})
+	j.apply(Record{Type: ReplaceNodesRecord, Nodes: snap.State.Nodes})
+	j.apply(Record{Type: ReplaceTxnsRecord, Txns: snap.State.Txns})
+	j.apply(Record{Type: PutTermRecord, Term: &snap.State.Term})
+	return nil
+}
+
+// Applies every intact record in the journal, then truncates whatever
+// follows the last one
+func (j *Journal) replay() error {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(j.file)
+	var offset int64
+
+	for {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			j.size = offset
+			return nil
+		} else if err != nil {
+			logger.Warn("Dropping the torn end of the journal", "file", JOURNAL_FILE, "offset", offset, "err", err)
+			if err := j.file.Truncate(offset); err != nil {
+				return err
+			}
+			j.size = offset
+			return j.file.Sync()
+		}
+
+		j.apply(rec)
+		j.records++
+		offset += size
+	}
+}
+
+// Returns the next record and its size on disk. io.EOF means the journal
+// ended cleanly between two records
+func readRecord(reader io.Reader) (Record, int64, error) {
+	var rec Record
+
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return rec, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > MAX_RECORD_SIZE {
+		return rec, 0, fmt.Errorf("record length %d is too large", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err == io.EOF {
+		return rec, 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return rec, 0, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return rec, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, err
+	}
+
+	return rec, int64(HEADER_SIZE + len(payload)), nil
+}
+
+// Lock is manually set from caller
+func (j *Journal) apply(rec Record) {
+	switch rec.Type {
+	case PutTopicRecord:
+		j.topics[rec.Topic.TopicName] = *rec.Topic
+	case DeleteTopicRecord:
+		delete(j.topics, rec.TopicName)
+	case ReplaceTopicsRecord:
+		j.topics = make(map[string]structs.Topic)
+		for _, topic := range rec.Topics {
+			j.topics[topic.TopicName] = topic
+		}
+	case PutNodeRecord:
+		rec.Node.Connected = false
+		j.nodes[rec.Node.Address] = *rec.Node
+	case DeleteNodeRecord:
+		delete(j.nodes, rec.Address)
+	case ReplaceNodesRecord:
+		j.nodes = make(map[string]structs.NodeStatus)
+		for _, node := range rec.Nodes {
+			node.Connected = false
+			j.nodes[node.Address] = node
+		}
+	case PutTxnRecord:
+		j.txns[rec.Txn.Id] = *rec.Txn
+	case DeleteTxnRecord:
+		delete(j.txns, rec.TxnId)
+	case ReplaceTxnsRecord:
+		j.txns = make(map[string]structs.Transaction)
+		for _, txn := range rec.Txns {
+			j.txns[txn.Id] = txn
+		}
+	case PutTermRecord:
+		j.term = *rec.Term
+	default:
+		logger.Warn("Skipping journal record of unknown type", "type", rec.Type)
+	}
+}
+
+// Lock is manually set from caller
+func (j *Journal) state() State {
+	state := State{
+		Topics: make([]structs.Topic, 0, len(j.topics)),
+		Nodes:  make([]structs.NodeStatus, 0, len(j.nodes)),
+		Txns:   make([]structs.Transaction, 0, len(j.txns)),
+		Term:   j.term}
+
+	for _, topic := range j.topics {
+		state.Topics = append(state.Topics, topic)
+	}
+
+	for _, node := range j.nodes {
+		state.Nodes = append(state.Nodes, node)
+	}
+
+	for _, txn := range j.txns {
+		state.Txns = append(state.Txns, txn)
+	}
+
+	sort.Slice(state.Topics, func(a, b int) bool {
+		return state.Topics[a].TopicName < state.Topics[b].TopicName
+	})
+	sort.Slice(state.Nodes, func(a, b int) bool {
+		return state.Nodes[a].Address < state.Nodes[b].Address
+	})
+	sort.Slice(state.Txns, func(a, b int) bool {
+		return state.Txns[a].Id < state.Txns[b].Id
+	})
+	return state
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
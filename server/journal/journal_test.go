@@ -0,0 +1,243 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"../../structs"
+)
+
+func topicNames(state State) []string {
+	names := make([]string, 0, len(state.Topics))
+	for _, topic := range state.Topics {
+		names = append(names, topic.TopicName)
+	}
+	return names
+}
+
+func putTopics(t *testing.T, j *Journal, names ...string) {
+	for _, name := range names {
+		if err := j.PutTopic(structs.Topic{TopicName: name}); err != nil {
+			t.Fatalf("PutTopic(%s): %s", name, err)
+		}
+	}
+}
+
+func openJournal(t *testing.T, dir string, snapshotEvery int) (*Journal, State) {
+	j, state, err := Open(dir, snapshotEvery)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	return j, state
+}
+
+func TestReplayDropsTornEnd(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte, last int) []byte // last is the offset of the last record
+		want   []string
+	}{
+		{"intact", func(data []byte, last int) []byte { return data }, []string{"a", "b", "c"}},
+		{"cut in header", func(data []byte, last int) []byte { return data[:last+3] }, []string{"a", "b"}},
+		{"cut in payload", func(data []byte, last int) []byte { return data[:len(data)-2] }, []string{"a", "b"}},
+		{"bad checksum", func(data []byte, last int) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}, []string{"a", "b"}},
+		{"bad length", func(data []byte, last int) []byte {
+			data[last] = 0xff
+			return data
+		}, []string{"a", "b"}},
+		{"garbage after the last record", func(data []byte, last int) []byte {
+			return append(data, 0, 0, 0)
+		}, []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "journal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			j, _ := openJournal(t, dir, 100)
+			putTopics(t, j, "a", "b")
+			info, err := os.Stat(filepath.Join(dir, JOURNAL_FILE))
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := int(info.Size())
+			putTopics(t, j, "c")
+			j.Close()
+
+			path := filepath.Join(dir, JOURNAL_FILE)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, tt.damage(data, last), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			j, state := openJournal(t, dir, 100)
+			if got := topicNames(state); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("topics after replay = %v, want %v", got, tt.want)
+			}
+
+			// The torn end must be gone, or it would hide records written after it
+			putTopics(t, j, "d")
+			j.Close()
+
+			j, state = openJournal(t, dir, 100)
+			defer j.Close()
+			if got, want := topicNames(state), append(tt.want, "d"); !reflect.DeepEqual(got, want) {
+				t.Errorf("topics after a later append = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	tests := []struct {
+		name          string
+		snapshotEvery int
+		ops           func(t *testing.T, j *Journal)
+		want          []string
+	}{
+		{"journal only", 100, func(t *testing.T, j *Journal) {
+			putTopics(t, j, "a", "b")
+		}, []string{"a", "b"}},
+		{"snapshot only", 2, func(t *testing.T, j *Journal) {
+			putTopics(t, j, "a", "b")
+		}, []string{"a", "b"}},
+		{"snapshot and journal", 2, func(t *testing.T, j *Journal) {
+			putTopics(t, j, "a", "b", "c")
+		}, []string{"a", "b", "c"}},
+		{"delete after snapshot", 2, func(t *testing.T, j *Journal) {
+			putTopics(t, j, "a", "b")
+			if err := j.DeleteTopic("a"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"b"}},
+		{"replace", 3, func(t *testing.T, j *Journal) {
+			putTopics(t, j, "a", "b")
+			if err := j.ReplaceTopics([]structs.Topic{{TopicName: "c"}}); err != nil {
+				t.Fatal(err)
+			}
+			putTopics(t, j, "d")
+		}, []string{"c", "d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "journal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			j, _ := openJournal(t, dir, tt.snapshotEvery)
+			tt.ops(t, j)
+			j.Close()
+
+			j, state := openJournal(t, dir, tt.snapshotEvery)
+			defer j.Close()
+			if got := topicNames(state); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topics = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, _ := openJournal(t, dir, 2)
+	putTopics(t, j, "a", "b", "c")
+	j.Close()
+
+	// A crash while writing the next snapshot leaves the old one in place
+	tmp := filepath.Join(dir, SNAPSHOT_FILE+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte("{\"version\": 1, \"sta"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, state := openJournal(t, dir, 2)
+	j.Close()
+	if got, want := topicNames(state), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topics = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("partial snapshot %s was not removed", tmp)
+	}
+
+	// A crash between the rename and the truncate replays records the
+	// snapshot already holds, which must not change the state
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, SNAPSHOT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, _ = openJournal(t, dir, 100)
+	putTopics(t, j, "b", "c")
+	j.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, SNAPSHOT_FILE), snapshot, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, state = openJournal(t, dir, 100)
+	j.Close()
+	if got, want := topicNames(state), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topics after replaying over the snapshot = %v, want %v", got, want)
+	}
+
+	// Snapshots are only replaced by rename, so a bad one is corruption
+	if err := ioutil.WriteFile(filepath.Join(dir, SNAPSHOT_FILE), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Open(dir, 100); err == nil {
+		t.Errorf("Open with a corrupt snapshot succeeded")
+	} else if _, ok := err.(CorruptSnapshotError); !ok {
+		t.Errorf("Open with a corrupt snapshot = %v, want a CorruptSnapshotError", err)
+	}
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, _ := openJournal(t, dir, 2)
+
+	// A directory in the way of the temporary file makes every snapshot fail
+	tmp := filepath.Join(dir, SNAPSHOT_FILE+".tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	putTopics(t, j, "a", "b", "c")
+	if got, want := topicNames(j.state()), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topics after failed snapshots = %v, want %v", got, want)
+	}
+	j.Close()
+
+	if err := os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	j, state := openJournal(t, dir, 2)
+	defer j.Close()
+	if got, want := topicNames(state), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topics after reopening = %v, want %v", got, want)
+	}
+}
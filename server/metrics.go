@@ -0,0 +1,52 @@
+package main
+
+import (
+	"../lib/metrics"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Prometheus metrics
+//
+// Served on /metrics of the admin HTTP API, and on metrics-ip-port so that they can be scraped
+// without exposing the API. Gauges are read from the registry and topic map on every scrape.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+var heartbeatMisses = metrics.NewCounter("kts_server_heartbeat_misses_total",
+	"Nodes marked dead because their heartbeats stopped")
+
+func init() {
+	metrics.NewGaugeVecFunc("kts_server_nodes", "Registered nodes by state", "state", func() map[string]float64 {
+		counts := map[string]float64{
+			string(structs.NodeOrphan):   0,
+			string(structs.NodeFollower): 0,
+			string(structs.NodeLeader):   0,
+			string(structs.NodeDraining): 0,
+			string(structs.NodeDead):     0}
+		for _, node := range nodeRegistry.List() {
+			counts[string(node.State)]++
+		}
+		return counts
+	})
+
+	metrics.NewGaugeFunc("kts_server_orphans", "Connected orphans waiting for a topic", func() float64 {
+		return float64(len(nodeRegistry.ListOrphans()))
+	})
+
+	metrics.NewGaugeFunc("kts_server_topics", "Topics", func() float64 {
+		return float64(len(topics.List()))
+	})
+
+	metrics.NewGaugeFunc("kts_server_primary", "1 if this replica is the primary", func() float64 {
+		if isPrimary() {
+			return 1
+		}
+		return 0
+	})
+}
+
+func serveMetrics(addr string) {
+	logger.Info("Metrics started", "addr", addr)
+	err := metrics.ListenAndServe(addr)
+	checkError(err, "serveMetrics")
+}
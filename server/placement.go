@@ -0,0 +1,91 @@
+package main
+
+import (
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Cluster placement across failure domains
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Number of nodes already picked for a cluster that share each failure
+// domain with a candidate node
+type domainOverlap struct {
+	zone int
+	rack int
+	host int
+}
+
+// Zones matter most, then racks, then hosts
+func (a domainOverlap) less(b domainOverlap) bool {
+	if a.zone != b.zone {
+		return a.zone < b.zone
+	}
+	if a.rack != b.rack {
+		return a.rack < b.rack
+	}
+	return a.host < b.host
+}
+
+func overlap(candidate structs.NodeLabels, picked []structs.NodeLabels) domainOverlap {
+	var o domainOverlap
+	for _, labels := range picked {
+		if labels.Zone == candidate.Zone {
+			o.zone++
+			if labels.Rack == candidate.Rack {
+				o.rack++
+			}
+		}
+		if labels.Host == candidate.Host {
+			o.host++
+		}
+	}
+	return o
+}
+
+// Picks up to n orphans, one at a time, each from the failure domains least
+// used by the cluster so far. existing are the labels of nodes already in the
+// cluster. Ties go to the orphan that arrived first, so without labels this
+// is arrival order. Returns indices into orphans in pick order
+func spreadOrphans(orphans []*structs.Node, n int, existing []structs.NodeLabels) []int {
+	picked := make([]int, 0, n)
+	pickedLabels := append([]structs.NodeLabels{}, existing...)
+	used := make(map[int]bool)
+
+	for len(picked) < n {
+		best := -1
+		var bestOverlap domainOverlap
+		for i, orphan := range orphans {
+			if used[i] {
+				continue
+			}
+
+			o := overlap(orphan.Labels, pickedLabels)
+			if best == -1 || o.less(bestOverlap) {
+				best, bestOverlap = i, o
+			}
+		}
+
+		if best == -1 {
+			break
+		}
+
+		used[best] = true
+		picked = append(picked, best)
+		pickedLabels = append(pickedLabels, orphans[best].Labels)
+	}
+
+	return picked
+}
+
+// Returns the labels of the known nodes among addrs
+// Registry lock is manually set from caller
+func memberLabels(addrs []string) []structs.NodeLabels {
+	labels := make([]structs.NodeLabels, 0, len(addrs))
+	for _, addr := range addrs {
+		if node, ok := nodeRegistry.Nodes[addr]; ok {
+			labels = append(labels, node.Labels)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"../structs"
+)
+
+func labelled(labels ...structs.NodeLabels) []*structs.Node {
+	nodes := make([]*structs.Node, len(labels))
+	for i, l := range labels {
+		nodes[i] = &structs.Node{Labels: l}
+	}
+	return nodes
+}
+
+func TestSpreadOrphans(t *testing.T) {
+	a1 := structs.NodeLabels{Zone: "a", Rack: "r1", Host: "vm1"}
+	a1b := structs.NodeLabels{Zone: "a", Rack: "r1", Host: "vm2"}
+	a2 := structs.NodeLabels{Zone: "a", Rack: "r2", Host: "vm3"}
+	b1 := structs.NodeLabels{Zone: "b", Rack: "r1", Host: "vm4"}
+	c1 := structs.NodeLabels{Zone: "c", Rack: "r1", Host: "vm5"}
+
+	tests := []struct {
+		name     string
+		orphans  []*structs.Node
+		n        int
+		existing []structs.NodeLabels
+		want     []int
+	}{
+		{"unlabelled in arrival order", labelled(structs.NodeLabels{}, structs.NodeLabels{}, structs.NodeLabels{}), 2, nil, []int{0, 1}},
+		{"one per zone first", labelled(a1, a1b, a2, b1, c1), 3, nil, []int{0, 3, 4}},
+		{"other rack before same rack", labelled(a1, a1b, a2), 2, nil, []int{0, 2}},
+		{"other host before same host", labelled(a1, a1, a1b), 2, nil, []int{0, 2}},
+		{"away from existing members", labelled(a1, b1, c1), 1, []structs.NodeLabels{a1b, b1}, []int{2}},
+		{"fewer orphans than asked", labelled(a1, b1), 3, nil, []int{0, 1}},
+		{"none asked", labelled(a1, b1), 0, nil, []int{}},
+		{"no orphans", labelled(), 2, nil, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := spreadOrphans(tt.orphans, tt.n, tt.existing)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spreadOrphans() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Write quotas
+//
+// Leaders limit how fast each client, and each topic as a whole, may write. The defaults come from
+// the config and a topic may replace them with its own Quotas, which are journalled and replicated
+// with the topic. Leaders fetch a client's quotas with GetQuota and keep them for a few seconds,
+// so changes made with SetTopicQuota reach them without telling the nodes.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Quotas used for topics and clients without their own
+type DefaultQuotas struct {
+	Client structs.Quota `json:"client"` // Each client id on each topic
+	Topic  structs.Quota `json:"topic"`  // All clients of a topic together
+}
+
+// Returns the quotas a leader of topic enforces for clientId
+func quotaLimits(topic structs.Topic, clientId string) structs.QuotaLimits {
+	defaults := currentConfig().Quotas
+	limits := structs.QuotaLimits{
+		Client: defaults.Client,
+		Topic:  defaults.Topic}
+
+	if topic.Quotas.Topic != nil {
+		limits.Topic = *topic.Quotas.Topic
+	}
+
+	if quota, ok := topic.Quotas.Clients[clientId]; ok {
+		limits.Client = quota
+	} else if quota, ok := topic.Quotas.Clients[structs.AnyPrincipal]; ok {
+		limits.Client = quota
+	}
+
+	// Every partition's leader enforces its share of the topic's quota
+	if n := float64(len(topic.Partitions)); n > 1 {
+		limits.Topic.MessagesPerSec /= n
+		limits.Topic.BytesPerSec /= n
+	}
+
+	return limits
+}
+
+// Leader -> Server rpc that returns the quotas of a client on a topic
+func (s *TServer) GetQuota(msg structs.QuotaMsg, limits *structs.QuotaLimits) error {
+	if err := s.allow("GetQuota", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.Topic)
+	if !ok {
+		return TopicDoesNotExistError(msg.Topic)
+	}
+
+	*limits = quotaLimits(topic, msg.ClientId)
+	return nil
+}
+
+// Admin -> Server rpc that sets or removes a quota on a topic. Needs admin on
+// the topic. Leaders apply it once their cached quotas expire
+func (s *TServer) SetTopicQuota(msg structs.SetQuotaMsg, topicReply *structs.Topic) (err error) {
+	if err := s.allow("SetTopicQuota", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.TopicName)
+	if !ok {
+		return TopicDoesNotExistError(msg.TopicName)
+	}
+
+	if _, err := s.authorize(topic, msg.Token, structs.PermAdmin); err != nil {
+		return err
+	}
+
+	if msg.Quota != nil && (msg.Quota.MessagesPerSec < 0 || msg.Quota.BytesPerSec < 0) {
+		return fmt.Errorf("Server: quota must not be negative, got %s", *msg.Quota)
+	}
+
+	// Copy so the stored topic is not modified outside of the map's lock
+	quotas := structs.TopicQuotas{
+		Topic:   topic.Quotas.Topic,
+		Clients: make(map[string]structs.Quota)}
+	for clientId, quota := range topic.Quotas.Clients {
+		quotas.Clients[clientId] = quota
+	}
+
+	switch {
+	case msg.ClientId == "":
+		quotas.Topic = msg.Quota
+	case msg.Quota == nil:
+		delete(quotas.Clients, msg.ClientId)
+	default:
+		quotas.Clients[msg.ClientId] = *msg.Quota
+	}
+
+	if len(quotas.Clients) == 0 {
+		quotas.Clients = nil
+	}
+
+	topic.Quotas = quotas
+	defer commitOnReturn(&err)
+	if err := topics.Set(topic.TopicName, topic); err != nil {
+		return err
+	}
+
+	name := msg.ClientId
+	if name == "" {
+		name = "the topic"
+	}
+	if msg.Quota == nil {
+		logger.Info("Removed topic quota", "topic", topic.TopicName, "client", name)
+	} else {
+		logger.Info("Set topic quota", "topic", topic.TopicName, "client", name, "quota", msg.Quota.String())
+	}
+
+	*topicReply = topic
+	return nil
+}
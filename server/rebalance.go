@@ -0,0 +1,333 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Leadership rebalancing
+//
+// Every RebalanceInterval seconds the primary asks each partition's leader for its latest version.
+// The difference to the last round is the partition's write rate. The load of a host is the write
+// rate of the partitions led by nodes on it. Idle partitions count as MIN_PARTITION_LOAD so that
+// the number of leaders per host is evened out as well.
+//
+// When the busiest host carries more than RebalanceThreshold times the average load, one of the
+// partitions it leads is moved per round, busiest partition first:
+//
+//   - leadership is handed to an in-sync follower on a host that stays below the busiest one,
+//     with the old leader staying on as a follower
+//   - if every follower is on a host too busy to take the partition, the follower on the
+//     busiest of them is replaced by a synced orphan on a quiet host, and leadership is handed
+//     to the orphan
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Default ratio of the busiest host's load to the average that triggers a move
+const REBALANCE_THRESHOLD = 1.25
+
+// Seconds between checks of whether a reload turned rebalancing on
+const REBALANCE_OFF_POLL = 10
+
+// Writes per second an idle partition counts as
+const MIN_PARTITION_LOAD = 1.0
+
+type partitionKey struct {
+	Topic     string
+	Partition int
+}
+
+type versionSample struct {
+	Version int
+	At      time.Time
+}
+
+type partitionLoad struct {
+	key       partitionKey
+	rate      float64 // Writes per second
+	leader    structs.Node
+	followers []structs.ReplicaDescription
+}
+
+// Latest version of each partition at the last round. Only used by rebalanceLoop
+var versionSamples = make(map[partitionKey]versionSample)
+
+// Runs for the life of the server, since a reload may turn rebalancing on
+func rebalanceLoop() {
+	for {
+		interval := currentConfig().RebalanceInterval
+		if interval <= 0 {
+			time.Sleep(REBALANCE_OFF_POLL * time.Second)
+			continue
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		// Rates from before a failover are stale
+		if !isPrimary() {
+			versionSamples = make(map[partitionKey]versionSample)
+			continue
+		}
+
+		rebalance()
+	}
+}
+
+func rebalance() {
+	loads := samplePartitions()
+	if len(loads) == 0 {
+		return
+	}
+
+	hostOf := make(map[string]string)
+	hostLoad := make(map[string]float64)
+	for _, node := range nodeRegistry.List() {
+		if !node.Connected || node.State == structs.NodeDraining {
+			continue
+		}
+
+		// Hosts without leaders count towards the average
+		host := hostKey(node)
+		hostOf[node.Address] = host
+		if _, ok := hostLoad[host]; !ok {
+			hostLoad[host] = 0
+		}
+	}
+
+	for _, p := range loads {
+		hostLoad[hostOf[p.leader.Address]] += p.rate
+	}
+
+	busiest, total := "", 0.0
+	for host, load := range hostLoad {
+		total += load
+		if busiest == "" || load > hostLoad[busiest] {
+			busiest = host
+		}
+	}
+
+	threshold := currentConfig().RebalanceThreshold
+	if threshold <= 0 {
+		threshold = REBALANCE_THRESHOLD
+	}
+
+	mean := total / float64(len(hostLoad))
+	if hostLoad[busiest] <= threshold*mean {
+		return
+	}
+
+	logger.Info("Rebalancing busiest host", "host", busiest, "load", hostLoad[busiest], "average", mean)
+
+	candidates := make([]partitionLoad, 0)
+	for _, p := range loads {
+		if hostOf[p.leader.Address] == busiest {
+			candidates = append(candidates, p)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+
+	for _, p := range candidates {
+		if moveLeadership(p, hostOf, hostLoad, hostLoad[busiest]) {
+			return
+		}
+	}
+
+	for _, p := range candidates {
+		if moveReplica(p, hostOf, hostLoad, hostLoad[busiest]) {
+			return
+		}
+	}
+
+	logger.Warn("No follower or orphan can take load from the busiest host", "host", busiest)
+}
+
+// Asks every partition's leader for its latest version and returns the
+// partitions that were also sampled in the last round
+func samplePartitions() []partitionLoad {
+	now := time.Now()
+	samples := make(map[partitionKey]versionSample)
+	loads := make([]partitionLoad, 0)
+
+	for _, topic := range topics.List() {
+		for _, partition := range topic.Partitions {
+			key := partitionKey{topic.TopicName, partition.Id}
+
+			leader, exists := connectedNode(partition.Leaders[1])
+			if !exists {
+				continue
+			}
+
+			desc, err := describeCluster(leader)
+			if err != nil {
+				checkError(err, "Rebalance DescribeCluster")
+				continue
+			}
+
+			samples[key] = versionSample{Version: desc.Leader.LatestVersion, At: now}
+
+			prev, sampled := versionSamples[key]
+			if !sampled {
+				continue
+			}
+
+			rate := float64(desc.Leader.LatestVersion-prev.Version) / now.Sub(prev.At).Seconds()
+			if rate < MIN_PARTITION_LOAD {
+				rate = MIN_PARTITION_LOAD
+			}
+
+			loads = append(loads, partitionLoad{
+				key:       key,
+				rate:      rate,
+				leader:    leader,
+				followers: desc.Followers})
+		}
+	}
+
+	versionSamples = samples
+	return loads
+}
+
+// Hands leadership of p to the in-sync follower on the least loaded host, as
+// long as that host stays below busiestLoad
+func moveLeadership(p partitionLoad, hostOf map[string]string, hostLoad map[string]float64, busiestLoad float64) bool {
+	target := leadershipTarget(p, hostOf, hostLoad, busiestLoad)
+	if target == "" {
+		return false
+	}
+
+	return handOff(p, target)
+}
+
+// Returns the in-sync follower of p on the least loaded host that stays below
+// busiestLoad with p, or "" if there is none
+func leadershipTarget(p partitionLoad, hostOf map[string]string, hostLoad map[string]float64, busiestLoad float64) string {
+	target := ""
+	for _, follower := range p.followers {
+		host, connected := hostOf[follower.Address]
+		if !follower.InSync || !connected || hostLoad[host]+p.rate >= busiestLoad {
+			continue
+		}
+
+		if target == "" || hostLoad[host] < hostLoad[hostOf[target]] {
+			target = follower.Address
+		}
+	}
+	return target
+}
+
+// Tells the leader of p to hand leadership to target and stay on as a follower
+func handOff(p partitionLoad, target string) bool {
+	logger.Info("Rebalance moving leadership", "topic", p.key.Topic, "partition", p.key.Partition,
+		"writes-per-sec", p.rate, "from", p.leader.Address, "to", target)
+
+	var partition structs.Partition
+	msg := structs.HandOffMsg{Target: target, Stay: true}
+	if err := p.leader.Client.Call("Peer.HandOff", msg, &partition); err != nil {
+		checkError(err, "Rebalance HandOff")
+		return false
+	}
+
+	return true
+}
+
+// For a partition whose followers are all on hosts too busy to take it:
+// replaces the follower on the busiest of them with an orphan on a host that
+// stays below busiestLoad, then hands leadership to the orphan. It has a full
+// copy of the data once it is added, so it is in sync
+func moveReplica(p partitionLoad, hostOf map[string]string, hostLoad map[string]float64, busiestLoad float64) bool {
+	nodeRegistry.Lock()
+	old, replacement := replicaMove(p, hostOf, hostLoad, busiestLoad, nodeRegistry.Orphans())
+	if replacement == "" {
+		nodeRegistry.Unlock()
+		return false
+	}
+
+	nodeRegistry.Transition(replacement, structs.NodeFollower, p.key.Topic, p.key.Partition)
+	nodeRegistry.Unlock()
+
+	logger.Info("Rebalance moving replica", "topic", p.key.Topic, "partition", p.key.Partition, "from", old, "to", replacement)
+
+	var ignored string
+	msg := structs.ReplaceFollowerMsg{Old: old, New: replacement}
+	err := p.leader.Client.Call("Peer.ReplaceFollower", msg, &ignored)
+
+	// The old follower dropped the topic and is an orphan again
+	released := old
+	if err != nil {
+		checkError(err, "Rebalance ReplaceFollower")
+		released = replacement
+	}
+
+	nodeRegistry.Lock()
+	if _, connected := nodeRegistry.Connected(released); connected {
+		nodeRegistry.Transition(released, structs.NodeOrphan, "", 0)
+	}
+	nodeRegistry.Unlock()
+
+	if err := commitState(); err != nil || released == replacement {
+		return false
+	}
+
+	return handOff(p, replacement)
+}
+
+// Returns the follower of p that moveLeadership skipped for its host's load,
+// on the busiest such host, and the orphan to replace it with. Both are "" if
+// there is no such follower or no orphan on a host below busiestLoad
+// Lock is manually set from caller
+func replicaMove(p partitionLoad, hostOf map[string]string, hostLoad map[string]float64, busiestLoad float64, orphans []*structs.Node) (string, string) {
+	old := ""
+	for _, follower := range p.followers {
+		host, connected := hostOf[follower.Address]
+		if !connected || hostLoad[host]+p.rate < busiestLoad {
+			continue
+		}
+
+		if old == "" || hostLoad[host] > hostLoad[hostOf[old]] {
+			old = follower.Address
+		}
+	}
+
+	if old == "" {
+		return "", ""
+	}
+
+	quiet := make([]*structs.Node, 0)
+	for _, orphan := range orphans {
+		if host, connected := hostOf[orphan.Address]; connected && hostLoad[host]+p.rate < busiestLoad {
+			quiet = append(quiet, orphan)
+		}
+	}
+
+	if len(quiet) == 0 {
+		return "", ""
+	}
+
+	members := make([]string, 0)
+	for _, member := range nodeRegistry.Members(p.key.Topic, p.key.Partition) {
+		if member != old {
+			members = append(members, member)
+		}
+	}
+
+	return old, quiet[spreadOrphans(quiet, 1, memberLabels(members))[0]].Address
+}
+
+// Nodes without a host label are told apart by their IP
+func hostKey(node structs.NodeStatus) string {
+	if node.Labels.Host != "" {
+		return node.Labels.Zone + "/" + node.Labels.Host
+	}
+
+	host, _, err := net.SplitHostPort(node.Address)
+	if err != nil {
+		return node.Address
+	}
+	return host
+}
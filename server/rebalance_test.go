@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"../structs"
+	c "./concurrentlib"
+)
+
+func TestRebalanceSelection(t *testing.T) {
+	tests := []struct {
+		name        string
+		followers   []structs.ReplicaDescription
+		orphans     []string
+		hostLoad    map[string]float64
+		leaderTo    string
+		replaced    string
+		replacement string
+	}{
+		{
+			name:      "follower on a quiet host takes leadership",
+			followers: []structs.ReplicaDescription{{Address: "b:1", InSync: true}},
+			orphans:   []string{"c:1"},
+			hostLoad:  map[string]float64{"a": 10, "b": 2},
+			leaderTo:  "b:1",
+		},
+		{
+			name:        "follower on a busy host is replaced by a quiet orphan",
+			followers:   []structs.ReplicaDescription{{Address: "b:1", InSync: true}},
+			orphans:     []string{"c:1", "d:1"},
+			hostLoad:    map[string]float64{"a": 10, "b": 9, "d": 8},
+			replaced:    "b:1",
+			replacement: "c:1",
+		},
+		{
+			name: "follower on the busiest blocking host is replaced first",
+			followers: []structs.ReplicaDescription{
+				{Address: "a:2", InSync: true},
+				{Address: "b:1", InSync: true}},
+			orphans:     []string{"c:1"},
+			hostLoad:    map[string]float64{"a": 10, "b": 9},
+			replaced:    "a:2",
+			replacement: "c:1",
+		},
+		{
+			name:      "out of sync follower on a quiet host is left to catch up",
+			followers: []structs.ReplicaDescription{{Address: "b:1"}},
+			orphans:   []string{"c:1"},
+			hostLoad:  map[string]float64{"a": 10},
+		},
+		{
+			name:      "no orphan on a quiet host",
+			followers: []structs.ReplicaDescription{{Address: "b:1", InSync: true}},
+			orphans:   []string{"d:1"},
+			hostLoad:  map[string]float64{"a": 10, "b": 9, "d": 8},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeRegistry = c.NodeRegistry{Nodes: make(map[string]*structs.Node)}
+
+			// Each address is on the host named by its first letter
+			hostOf := map[string]string{"a:1": "a"}
+			for _, f := range tt.followers {
+				hostOf[f.Address] = f.Address[:1]
+			}
+			orphans := make([]*structs.Node, 0)
+			for _, addr := range tt.orphans {
+				hostOf[addr] = addr[:1]
+				orphans = append(orphans, &structs.Node{Address: addr})
+			}
+
+			p := partitionLoad{
+				key:       partitionKey{Topic: "t"},
+				rate:      3,
+				leader:    structs.Node{Address: "a:1"},
+				followers: tt.followers}
+
+			if got := leadershipTarget(p, hostOf, tt.hostLoad, tt.hostLoad["a"]); got != tt.leaderTo {
+				t.Errorf("leadershipTarget = %q, want %q", got, tt.leaderTo)
+			}
+			if tt.leaderTo != "" {
+				return
+			}
+
+			replaced, replacement := replicaMove(p, hostOf, tt.hostLoad, tt.hostLoad["a"], orphans)
+			if replaced != tt.replaced || replacement != tt.replacement {
+				t.Errorf("replicaMove = %q, %q, want %q, %q", replaced, replacement, tt.replaced, tt.replacement)
+			}
+		})
+	}
+}
+
+func TestMoveReplica(t *testing.T) {
+	fakes := resetRegistry(t, map[string]structs.NodeState{
+		"leader:1":   structs.NodeLeader,
+		"follower:1": structs.NodeFollower,
+		"orphan:1":   structs.NodeOrphan}, nil)
+
+	// The follower shares the leader's host, so it cannot take leadership
+	hostOf := map[string]string{"leader:1": "busy", "follower:1": "busy", "orphan:1": "quiet"}
+	hostLoad := map[string]float64{"busy": 10}
+	p := partitionLoad{
+		key:       partitionKey{Topic: "t"},
+		rate:      5,
+		leader:    *nodeRegistry.Nodes["leader:1"],
+		followers: []structs.ReplicaDescription{{Address: "follower:1", InSync: true}}}
+
+	if moveLeadership(p, hostOf, hostLoad, hostLoad["busy"]) {
+		t.Fatal("leadership moved to a follower on the busiest host")
+	}
+	if !moveReplica(p, hostOf, hostLoad, hostLoad["busy"]) {
+		t.Fatal("moveReplica did not move the partition")
+	}
+
+	want := structs.ReplaceFollowerMsg{Old: "follower:1", New: "orphan:1"}
+	if got := fakes["leader:1"].replaced; len(got) != 1 || got[0] != want {
+		t.Errorf("leader was asked to replace %v, want %v", got, want)
+	}
+	if got := fakes["leader:1"].handOffs; len(got) != 1 || got[0].Target != "orphan:1" || !got[0].Stay {
+		t.Errorf("leader was asked to hand off %+v, want to orphan:1 staying on", got)
+	}
+	if got := stateOf("follower:1"); got != structs.NodeOrphan {
+		t.Errorf("replaced follower is %s, want %s", got, structs.NodeOrphan)
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"../lib/mtls"
+	"../structs"
+	"./journal"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Server replication
+//
+// The topic registry, node registry and transactions are replicated between the server replicas
+// listed in config.Replicas. One replica is the primary: it serves every TServer RPC and pushes its
+// state to the backups after each change and on every replica heartbeat. A change succeeds once a
+// majority of replicas has it; otherwise the call fails with a NoMajorityError. Backups reject calls
+// with a NotPrimaryError so that clients move on to the primary.
+//
+// Nodes only heartbeat to the primary, so backups hold the node registry without connections.
+// After a failover nodes re-register or rejoin with the new primary, which connects to them.
+//
+// Elections are numbered by a term that only increases and is journalled with the vote each
+// replica gave in it. A replica that has not heard from a primary for PRIMARY_TIMEOUT, sees a
+// majority of replicas, none of which hears from a primary either, and has the newest state among
+// them asks the others for their votes in the next term. Each replica votes once per term, and
+// only for state at least as new as its own. With a majority of votes it is primary for that term.
+// Backups refuse state and votes from older terms, so a deposed primary learns that it was replaced
+// on its next push and steps down.
+//
+// The primary only serves calls while it holds a lease, which it renews whenever a majority of
+// replicas accepts a push of its state. The lease is shorter than PRIMARY_TIMEOUT, so an old
+// primary cut off from the majority stops serving before the others elect a new one.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Number of seconds between heartbeats to the other replicas
+const REPLICA_HB_INTERVAL = 2
+
+// Number of seconds to wait for a replica to answer before considering it dead
+const REPLICA_TIMEOUT = 2
+
+// Seconds the primary may serve calls after a majority of replicas accepted
+// its state, and seconds a backup waits without hearing from the primary
+// before it may elect a new one. A push may take two REPLICA_TIMEOUTs to
+// dial and answer, so the lease outlasts a slow round
+const (
+	PRIMARY_LEASE   = 4 * REPLICA_HB_INTERVAL
+	PRIMARY_TIMEOUT = 6 * REPLICA_HB_INTERVAL
+)
+
+// Replica -> Replica heartbeat
+type ReplicaHeartBeatMsg struct {
+	From string
+	Term uint64
+}
+
+// Replica -> Replica heartbeat reply
+type ReplicaStatus struct {
+	Addr         string
+	Term         uint64
+	Primary      string // Primary the replica heard from within PRIMARY_TIMEOUT, or itself while it holds the lease
+	StateTerm    uint64
+	StateVersion uint64
+}
+
+// Primary -> Backup state
+type ReplicaState struct {
+	From         string
+	Term         uint64 // Term the sender is primary in
+	StateVersion uint64
+	Topics       []structs.Topic
+	Nodes        []structs.NodeStatus
+	Txns         []structs.Transaction
+}
+
+// Candidate -> Replica request for a vote
+type VoteRequest struct {
+	From         string
+	Term         uint64
+	StateTerm    uint64
+	StateVersion uint64
+}
+
+type VoteReply struct {
+	Term    uint64 // The voter's term, so that a candidate behind it catches up
+	Granted bool
+}
+
+// Returned for pushes and votes from a term older than the replica's. The
+// value is the replica's term
+type StaleTermError uint64
+
+const staleTermPrefix = "Server: replica is in a newer term "
+
+func (e StaleTermError) Error() string {
+	return fmt.Sprintf("%s[%d]", staleTermPrefix, uint64(e))
+}
+
+// Returns the newer term and whether err was a StaleTermError
+func termFromError(err error) (uint64, bool) {
+	if !structs.HasErrorPrefix(err, staleTermPrefix) {
+		return 0, false
+	}
+
+	var term uint64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(err.Error(), staleTermPrefix), "[%d]", &term); err != nil {
+		return 0, false
+	}
+	return term, true
+}
+
+var (
+	replicaLock    sync.RWMutex
+	primaryAddr    string
+	term           journal.ReplicaTerm            // Its StateVersion is incremented by the primary on every state change
+	leaseUntil     time.Time                      // Primary only. Calls are refused after it
+	primaryContact time.Time                      // Backup only. Last push from primaryAddr
+	replicaClients = make(map[string]*rpc.Client) // replica address -> connection
+	termJournal    *journal.Journal
+)
+
+// Returns a NotPrimaryError if this replica should not serve RPCs
+func checkPrimary() error {
+	if len(config.Replicas) == 0 {
+		return nil
+	}
+
+	replicaLock.RLock()
+	defer replicaLock.RUnlock()
+
+	if primaryAddr != config.ReplicaAddr {
+		return structs.NotPrimaryError(primaryAddr)
+	}
+
+	// Cut off from the majority, which may have elected another primary
+	if time.Now().After(leaseUntil) {
+		return structs.NotPrimaryError("")
+	}
+	return nil
+}
+
+func isPrimary() bool {
+	return checkPrimary() == nil
+}
+
+// Replica -> Replica rpc to check liveliness and learn who the other replica
+// thinks is primary
+func (s *TServer) ReplicaHeartBeat(msg ReplicaHeartBeatMsg, status *ReplicaStatus) error {
+	if err := s.allowReplica("ReplicaHeartBeat", msg.From); err != nil {
+		return err
+	}
+
+	replicaLock.RLock()
+	defer replicaLock.RUnlock()
+
+	*status = localStatus()
+	return nil
+}
+
+// Primary -> Backup rpc that replaces the backup's topics, nodes and transactions
+func (s *TServer) ReplicateState(state ReplicaState, _ignored *bool) error {
+	if err := s.allowReplica("ReplicateState", state.From); err != nil {
+		return err
+	}
+
+	replicaLock.Lock()
+	defer replicaLock.Unlock()
+
+	if state.Term < term.Term {
+		logger.Warn("Refusing state from an old primary", "from", state.From, "term", state.Term, "have", term.Term)
+		return StaleTermError(term.Term)
+	}
+
+	if state.Term > term.Term {
+		if err := setTerm(state.Term, ""); err != nil {
+			return err
+		}
+	}
+
+	if primaryAddr != state.From {
+		logger.Info("Server primary changed", "primary", state.From, "term", state.Term)
+	}
+	primaryAddr = state.From
+	primaryContact = time.Now()
+
+	if state.Term == term.StateTerm && state.StateVersion < term.StateVersion {
+		logger.Warn("Ignoring stale replica state", "from", state.From, "version", state.StateVersion, "have", term.StateVersion)
+		return nil
+	}
+
+	// Every heartbeat carries the state. Only journal it when it changed
+	if state.Term == term.StateTerm && state.StateVersion == term.StateVersion {
+		return nil
+	}
+
+	if err := topics.Replace(state.Topics); err != nil {
+		return err
+	}
+
+	if err := nodeRegistry.Replace(state.Nodes); err != nil {
+		return err
+	}
+
+	if err := transactions.Replace(state.Txns); err != nil {
+		return err
+	}
+
+	updated := term
+	updated.StateTerm = state.Term
+	updated.StateVersion = state.StateVersion
+	return saveTerm(updated)
+}
+
+// Candidate -> Replica rpc for this replica's vote in req.Term
+func (s *TServer) RequestVote(req VoteRequest, reply *VoteReply) error {
+	if err := s.allowReplica("RequestVote", req.From); err != nil {
+		return err
+	}
+
+	replicaLock.Lock()
+	defer replicaLock.Unlock()
+
+	reply.Term = term.Term
+	if req.Term < term.Term {
+		return StaleTermError(term.Term)
+	}
+
+	// A live primary is not replaced, e.g. by a replica only cut off from it
+	if current := localStatus().Primary; current != "" && current != req.From {
+		return nil
+	}
+
+	if req.Term > term.Term {
+		if err := setTerm(req.Term, ""); err != nil {
+			return err
+		}
+		reply.Term = term.Term
+	}
+
+	if term.VotedFor != "" && term.VotedFor != req.From {
+		return nil
+	}
+
+	if req.StateTerm < term.StateTerm || (req.StateTerm == term.StateTerm && req.StateVersion < term.StateVersion) {
+		return nil
+	}
+
+	if err := setTerm(req.Term, req.From); err != nil {
+		return err
+	}
+
+	logger.Info("Voted for server replica", "candidate", req.From, "term", req.Term)
+	reply.Granted = true
+	return nil
+}
+
+// Returned by the primary when a change could not be pushed to a majority of
+// replicas. The change is kept and pushed again with the next one, so it may
+// still take effect. The value is the number of replicas that have it
+type NoMajorityError int
+
+func (e NoMajorityError) Error() string {
+	return fmt.Sprintf("Server: change reached %d of %d replicas, a majority is needed", int(e), len(config.Replicas))
+}
+
+// Called by the primary after it changes topics, nodes or transactions. Pushes the new
+// state to the backups before returning. Returns a NoMajorityError if a majority of
+// replicas does not have it, or a NotPrimaryError if this replica lost the primary role
+func commitState() error {
+	if len(config.Replicas) == 0 {
+		return nil
+	}
+
+	replicaLock.Lock()
+	if primaryAddr == config.ReplicaAddr {
+		updated := term
+		updated.StateVersion++
+		if err := saveTerm(updated); err != nil {
+			checkError(err, "commitState")
+		}
+	}
+	replicaLock.Unlock()
+
+	return pushState()
+}
+
+// Deferred by RPCs that change the state, with their error named. Commits the
+// state and fails the RPC if that fails, unless it already failed
+func commitOnReturn(err *error) {
+	if commitErr := commitState(); commitErr != nil && *err == nil {
+		*err = commitErr
+	}
+}
+
+// Pushes the state to the backups. Renews the lease if a majority of replicas,
+// this one included, accepted it, and steps down if one is in a newer term
+func pushState() error {
+	if len(config.Replicas) == 0 {
+		return nil
+	}
+
+	nodeList := nodeRegistry.List()
+
+	replicaLock.RLock()
+	if primaryAddr != config.ReplicaAddr {
+		replicaLock.RUnlock()
+		return structs.NotPrimaryError(primaryAddr)
+	}
+	state := ReplicaState{
+		From:         config.ReplicaAddr,
+		Term:         term.Term,
+		StateVersion: term.StateVersion,
+		Topics:       topics.List(),
+		Nodes:        nodeList,
+		Txns:         transactions.List()}
+	replicaLock.RUnlock()
+
+	sent := time.Now()
+
+	var (
+		wg        sync.WaitGroup
+		ackLock   sync.Mutex
+		acks      = 1
+		newerTerm uint64
+	)
+	for _, addr := range config.Replicas {
+		if addr == config.ReplicaAddr {
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			var ignored bool
+			err := callReplica(addr, "TServer.ReplicateState", state, &ignored)
+
+			ackLock.Lock()
+			defer ackLock.Unlock()
+			if err == nil {
+				acks++
+			} else if t, ok := termFromError(err); ok && t > newerTerm {
+				newerTerm = t
+			} else {
+				checkError(err, "pushState "+addr)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	replicaLock.Lock()
+	defer replicaLock.Unlock()
+
+	// Lost the primary role while pushing
+	if primaryAddr != config.ReplicaAddr || term.Term != state.Term {
+		return structs.NotPrimaryError(primaryAddr)
+	}
+
+	if newerTerm > term.Term {
+		logger.Warn("A newer primary was elected. Stepping down", "term", term.Term, "newer-term", newerTerm)
+		primaryAddr = ""
+		if err := setTerm(newerTerm, ""); err != nil {
+			checkError(err, "pushState")
+		}
+		return structs.NotPrimaryError("")
+	}
+
+	if acks < majority() {
+		if time.Now().After(leaseUntil) {
+			logger.Error("Lost majority of server replicas. Not serving calls", "acks", acks)
+		}
+		return NoMajorityError(acks)
+	}
+
+	leaseUntil = sent.Add(PRIMARY_LEASE * time.Second)
+	return nil
+}
+
+// Heartbeats the other replicas and elects a primary when there is none. The
+// primary pushes its state instead, which also renews its lease. Runs forever
+func monitorReplicas() {
+	for {
+		replicaLock.RLock()
+		primary := primaryAddr == config.ReplicaAddr
+		replicaLock.RUnlock()
+
+		if primary {
+			// Also lets restarted backups catch up
+			pushState()
+		} else {
+			electPrimary(heartbeatReplicas())
+		}
+
+		time.Sleep(REPLICA_HB_INTERVAL * time.Second)
+	}
+}
+
+// Returns the status of every replica that answered, this one included
+func heartbeatReplicas() []ReplicaStatus {
+	replicaLock.RLock()
+	alive := []ReplicaStatus{localStatus()}
+	msg := ReplicaHeartBeatMsg{From: config.ReplicaAddr, Term: term.Term}
+	replicaLock.RUnlock()
+
+	for _, addr := range config.Replicas {
+		if addr == config.ReplicaAddr {
+			continue
+		}
+
+		var status ReplicaStatus
+		if err := callReplica(addr, "TServer.ReplicaHeartBeat", msg, &status); err == nil {
+			alive = append(alive, status)
+		}
+	}
+	return alive
+}
+
+// Starts an election if no live replica hears from a primary. Every replica
+// sees roughly the same statuses, so they agree on the candidate:
+//  1. Without a majority alive there is no primary
+//  2. While any live replica still hears from a primary there is no election,
+//     so a replica only cut off from the primary does not depose it
+//  3. Otherwise the replica with the newest state stands, ties go to the one
+//     listed first in config.Replicas. The others vote for it
+func electPrimary(alive []ReplicaStatus) {
+	replicaLock.Lock()
+
+	if len(alive) < majority() {
+		if primaryAddr != "" {
+			logger.Error("Lost majority of server replicas. No primary")
+		}
+		primaryAddr = ""
+		replicaLock.Unlock()
+		return
+	}
+
+	maxTerm := term.Term
+	for _, status := range alive {
+		if status.Primary != "" {
+			replicaLock.Unlock()
+			return
+		}
+		if status.Term > maxTerm {
+			maxTerm = status.Term
+		}
+	}
+
+	best := alive[0]
+	for _, status := range alive[1:] {
+		if newerState(status, best) ||
+			(!newerState(best, status) && replicaIndex(status.Addr) < replicaIndex(best.Addr)) {
+			best = status
+		}
+	}
+
+	if primaryAddr != "" {
+		logger.Warn("Server primary timed out", "primary", primaryAddr)
+		primaryAddr = ""
+	}
+
+	if best.Addr != config.ReplicaAddr {
+		replicaLock.Unlock()
+		return
+	}
+
+	// Stand in the next term, voting for ourselves
+	if err := setTerm(maxTerm+1, config.ReplicaAddr); err != nil {
+		checkError(err, "electPrimary")
+		replicaLock.Unlock()
+		return
+	}
+	req := VoteRequest{
+		From:         config.ReplicaAddr,
+		Term:         term.Term,
+		StateTerm:    term.StateTerm,
+		StateVersion: term.StateVersion}
+	replicaLock.Unlock()
+
+	votes := 1
+	for _, addr := range config.Replicas {
+		if addr == config.ReplicaAddr {
+			continue
+		}
+
+		var reply VoteReply
+		err := callReplica(addr, "TServer.RequestVote", req, &reply)
+		if t, ok := termFromError(err); ok {
+			reply.Term = t
+		} else if err != nil {
+			continue
+		}
+
+		if reply.Term > req.Term {
+			replicaLock.Lock()
+			if reply.Term > term.Term {
+				checkError(setTerm(reply.Term, ""), "electPrimary")
+			}
+			replicaLock.Unlock()
+			return
+		}
+
+		if reply.Granted {
+			votes++
+		}
+	}
+
+	if votes < majority() {
+		logger.Info("Lost server election", "term", req.Term, "votes", votes)
+		return
+	}
+
+	replicaLock.Lock()
+	if term.Term != req.Term {
+		replicaLock.Unlock()
+		return
+	}
+
+	// The state is now this term's, so backups take it over whatever they had
+	updated := term
+	updated.StateTerm = term.Term
+	updated.StateVersion++
+	if err := saveTerm(updated); err != nil {
+		checkError(err, "electPrimary")
+		replicaLock.Unlock()
+		return
+	}
+	primaryAddr = config.ReplicaAddr
+	replicaLock.Unlock()
+
+	logger.Info("Elected server primary", "primary", config.ReplicaAddr, "term", req.Term, "votes", votes)
+
+	// The lease starts once a majority has the state
+	pushState()
+}
+
+// Lock is manually set from caller
+func localStatus() ReplicaStatus {
+	status := ReplicaStatus{
+		Addr:         config.ReplicaAddr,
+		Term:         term.Term,
+		StateTerm:    term.StateTerm,
+		StateVersion: term.StateVersion}
+
+	switch {
+	case primaryAddr == config.ReplicaAddr && time.Now().Before(leaseUntil):
+		status.Primary = primaryAddr
+	case primaryAddr != config.ReplicaAddr && primaryAddr != "" && time.Since(primaryContact) < PRIMARY_TIMEOUT*time.Second:
+		status.Primary = primaryAddr
+	}
+	return status
+}
+
+// Moves to a newer term, or records the vote in this one. A primary of an
+// older term steps down
+// Lock is manually set from caller
+func setTerm(newTerm uint64, votedFor string) error {
+	if newTerm > term.Term && primaryAddr == config.ReplicaAddr {
+		primaryAddr = ""
+	}
+
+	updated := term
+	updated.Term = newTerm
+	updated.VotedFor = votedFor
+	return saveTerm(updated)
+}
+
+// Journals the term before it is used, so that a restart does not vote again
+// Lock is manually set from caller
+func saveTerm(updated journal.ReplicaTerm) error {
+	if err := termJournal.PutTerm(updated); err != nil {
+		return err
+	}
+	term = updated
+	return nil
+}
+
+func newerState(a ReplicaStatus, b ReplicaStatus) bool {
+	return a.StateTerm > b.StateTerm || (a.StateTerm == b.StateTerm && a.StateVersion > b.StateVersion)
+}
+
+func majority() int {
+	return len(config.Replicas)/2 + 1
+}
+
+func replicaIndex(addr string) int {
+	for i, replica := range config.Replicas {
+		if replica == addr {
+			return i
+		}
+	}
+	return len(config.Replicas)
+}
+
+// Calls a method on another replica, dialing it if needed. Dead connections
+// are dropped so that the next call redials
+func callReplica(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	replicaLock.Lock()
+	client, ok := replicaClients[addr]
+	replicaLock.Unlock()
+
+	if !ok {
+		conn, err := mtls.DialTimeout(addr, REPLICA_TIMEOUT*time.Second)
+		if err != nil {
+			return err
+		}
+
+		client = rpc.NewClient(conn)
+		replicaLock.Lock()
+		replicaClients[addr] = client
+		replicaLock.Unlock()
+	}
+
+	var err error
+	call := client.Go(serviceMethod, args, reply, nil)
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return nil
+		}
+
+		if _, ok := call.Error.(rpc.ServerError); ok {
+			return call.Error
+		}
+		err = call.Error
+	case <-time.After(REPLICA_TIMEOUT * time.Second):
+		err = ReplicaTimeoutError(addr)
+	}
+
+	replicaLock.Lock()
+	delete(replicaClients, addr)
+	replicaLock.Unlock()
+	client.Close()
+
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"../structs"
+)
+
+func TestCommitStateWithoutMajority(t *testing.T) {
+	saved, savedPrimary := config, primaryAddr
+	defer func() { config, primaryAddr = saved, savedPrimary }()
+
+	// Nothing listens on the backups' ports, so only this replica has the state
+	config.ReplicaAddr = "127.0.0.1:1"
+	config.Replicas = []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	primaryAddr = config.ReplicaAddr
+	leaseUntil = time.Now().Add(time.Minute)
+
+	if err := commitState(); err != NoMajorityError(1) {
+		t.Errorf("commitState() = %v, want %v", err, NoMajorityError(1))
+	}
+
+	change := func(failed error) (err error) {
+		defer commitOnReturn(&err)
+		return failed
+	}
+	if err := change(nil); err != NoMajorityError(1) {
+		t.Errorf("change without a majority = %v, want %v", err, NoMajorityError(1))
+	}
+
+	failed := errors.New("failed")
+	if err := change(failed); err != failed {
+		t.Errorf("failed change = %v, want its own error", err)
+	}
+
+	primaryAddr = "127.0.0.1:2"
+	if err := commitState(); err != structs.NotPrimaryError("127.0.0.1:2") {
+		t.Errorf("commitState() on a backup = %v, want a NotPrimaryError", err)
+	}
+
+	config.Replicas = nil
+	if err := commitState(); err != nil {
+		t.Errorf("commitState() without replicas = %v, want nil", err)
+	}
+}
@@ -5,27 +5,26 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
+	conf "../lib/config"
+	"../lib/logging"
+	"../lib/mtls"
 	"../structs"
 	c "./concurrentlib"
+	"./journal"
 )
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 // ERRORS
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-// Just for debugging
-const GREEN_COL = "\x1b[32;1m"
-const ERR_COL = "\x1b[31;1m"
-const ERR_END = "\x1b[0m"
-
 type AddressAlreadyRegisteredError string
 
 func (e AddressAlreadyRegisteredError) Error() string {
@@ -50,12 +49,48 @@ func (e TopicDoesNotExistError) Error() string {
 	return fmt.Sprintf("Server: Topic: [%s] does not exist", string(e))
 }
 
+type PartitionDoesNotExistError string
+
+func (e PartitionDoesNotExistError) Error() string {
+	return fmt.Sprintf("Server: Partition: [%s] does not exist", string(e))
+}
+
+type ReplicaTimeoutError string
+
+func (e ReplicaTimeoutError) Error() string {
+	return fmt.Sprintf("Server: replica [%s] timed out", string(e))
+}
+
+type NodeTimeoutError string
+
+func (e NodeTimeoutError) Error() string {
+	return fmt.Sprintf("Server: node [%s] timed out", string(e))
+}
+
 type InsufficientNodesForCluster string
 
 func (e InsufficientNodesForCluster) Error() string {
 	return fmt.Sprintf("Server: There are not enough available nodes to form a topic's cluster")
 }
 
+type NodeDrainingError string
+
+func (e NodeDrainingError) Error() string {
+	return fmt.Sprintf("Server: node [%s] is already draining", string(e))
+}
+
+type NodeNotDrainingError string
+
+func (e NodeNotDrainingError) Error() string {
+	return fmt.Sprintf("Server: node [%s] must be drained before it deregisters", string(e))
+}
+
+type TopicRecyclingError string
+
+func (e TopicRecyclingError) Error() string {
+	return fmt.Sprintf("Server: nodes of an old topic [%s] are still being recycled", string(e))
+}
+
 // END OF ERRORS
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -63,178 +98,367 @@ func (e InsufficientNodesForCluster) Error() string {
 // DATA STRUCTURES
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-type TServer struct{}
-
-type Config struct {
-	NodeSettings structs.NodeSettings `json:"node-settings"`
-	RpcIpPort    string               `json:"rpc-ip-port"`
-	DataPath     string               `json:"data-filepath"`
+// Each RPC connection is served by its own TServer, which holds the identity
+// from the caller's certificate. Calls from within the server, and all calls
+// when TLS is off, have an empty identity and are always allowed
+type TServer struct {
+	caller mtls.Identity
 }
 
 const (
-	topicFile string = "./topics.json"
+	journalDir string = "./journal"
 )
 
-type AllNodes struct {
-	sync.RWMutex
-	all map[string]*structs.Node // unique ip:port idenitifies a node
-}
+// Seconds a WatchTopic call waits for a leader change before returning the
+// unchanged topic. Clients call again right away
+const WATCH_TIMEOUT = 30
 
-var (
-	config Config
+// Seconds a leader has to describe its cluster
+const DESCRIBE_TIMEOUT = 5
 
-	allNodes    = AllNodes{all: make(map[string]*structs.Node)}
-	orphanNodes = c.Orphanage{Orphans: make([]structs.Node, 0)}
-	topics      = c.TopicCMap{Map: make(map[string]structs.Topic)}
+// Seconds between attempts to recycle nodes that are still in a topic the
+// server no longer has
+const RECYCLE_INTERVAL = 10
 
-	errLog = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
-	outLog = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
-)
+var (
+	config Config
 
-func readConfigOrDie(path string) {
-	file, err := os.Open(path)
-	handleErrorFatal("config file", err)
+	nodeRegistry = c.NodeRegistry{Nodes: make(map[string]*structs.Node)}
+	topics       = c.TopicCMap{Map: make(map[string]structs.Topic)}
+	transactions = c.TxnCMap{Map: make(map[string]structs.Transaction)}
 
-	buffer, err := ioutil.ReadAll(file)
-	handleErrorFatal("read config", err)
+	logger = logging.New("server")
 
-	err = json.Unmarshal(buffer, &config)
-	handleErrorFatal("parse config", err)
-}
+	creatingLock sync.Mutex
+	creating     = make(map[string]bool) // Topics whose clusters are being started
+)
 
 // Register Nodes
-func (s *TServer) Register(n string, nodeSettings *structs.NodeSettings) error {
-	allNodes.Lock()
-	defer allNodes.Unlock()
-
-	for _, node := range allNodes.all {
-		if node.Address == n {
-			return AddressAlreadyRegisteredError(n)
-		}
+func (s *TServer) Register(msg structs.RegisterMsg, nodeSettings *structs.NodeSettings) (err error) {
+	if err := s.allowNode("Register", msg.Address); err != nil {
+		return err
 	}
 
-	outLog.Println("Register::Connecting to address: ", n)
-	localAddr, err := net.ResolveTCPAddr("tcp", ":0")
-	checkError(err, "GetPeers:ResolvePeerAddr")
+	if err := checkPrimary(); err != nil {
+		return err
+	}
 
-	nodeAddr, err := net.ResolveTCPAddr("tcp", n)
-	checkError(err, "GetPeers:ResolveLocalAddr")
+	n := msg.Address
 
-	conn, err := net.DialTCP("tcp", localAddr, nodeAddr)
-	checkError(err, "GetPeers:DialTCP")
+	// Dialed before the registry is locked, so that a slow node does not hold
+	// up every other call
+	logger.Debug("Connecting to node", "node", n)
+	conn, err := mtls.Dial(n)
+	if checkError(err, "Register:Dial") {
+		return err
+	}
 
 	client := rpc.NewClient(conn)
 
-	// Add to orphan nodes
-	orphanNodes.Append(structs.Node{
-		Address: n,
-		Client:  client})
+	// Deferred first so that it runs after the registry is unlocked
+	defer commitOnReturn(&err)
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	// Dead nodes and nodes replicated from an old primary have no connection
+	// and may register again
+	if _, connected := nodeRegistry.Connected(n); connected {
+		client.Close()
+		return AddressAlreadyRegisteredError(n)
+	}
 
-	allNodes.all[n] = &structs.Node{
+	// Nodes only register when they are not in a cluster
+	nodeRegistry.Put(structs.Node{
 		Address:         n,
+		Labels:          msg.Labels,
 		Client:          client,
-		RecentHeartbeat: time.Now().UnixNano()}
+		RecentHeartbeat: time.Now().UnixNano()}, structs.NodeOrphan)
 
-	go monitor(n, time.Millisecond*time.Duration(config.NodeSettings.HeartBeat))
+	go monitor(n, client)
 
-	*nodeSettings = config.NodeSettings
+	*nodeSettings = currentConfig().NodeSettings
 
-	outLog.Printf("Got Register from %s\n", GREEN_COL+n+ERR_END)
+	logger.Info("Node registered", "node", n)
 
 	return nil
 }
 
 // Rejoin Nodes to a cluster
-func (s *TServer) Rejoin(n string, nodeSettings *structs.NodeSettings) error {
-	allNodes.Lock()
-	defer allNodes.Unlock()
+// Rejoining is idempotent since nodes rejoin whenever they lose the server,
+// which may only have been a dropped connection. The node's role is checked
+// against the topic: a node the topic does not name as leader rejoins as a
+// follower. A node in a topic the server does not have is recycled
+func (s *TServer) Rejoin(msg structs.RegisterMsg, nodeSettings *structs.NodeSettings) (err error) {
+	if err := s.allowNode("Rejoin", msg.Address); err != nil {
+		return err
+	}
 
-	for _, node := range allNodes.all {
-		if node.Address == n {
-			return AddressAlreadyRegisteredError(n)
-		}
+	if err := checkPrimary(); err != nil {
+		return err
 	}
 
-	outLog.Println("Register::Connecting to address: ", n)
-	localAddr, err := net.ResolveTCPAddr("tcp", ":0")
-	checkError(err, "GetPeers:ResolvePeerAddr")
+	n := msg.Address
+	state, err := rejoinState(msg)
+	if err != nil {
+		return err
+	}
 
-	nodeAddr, err := net.ResolveTCPAddr("tcp", n)
-	checkError(err, "GetPeers:ResolveLocalAddr")
+	// The node only lost its connection to the server
+	if _, connected := connectedNode(n); connected {
+		return heartbeatRejoin(n, nodeSettings)
+	}
 
-	conn, err := net.DialTCP("tcp", localAddr, nodeAddr)
-	checkError(err, "GetPeers:DialTCP")
+	// Dialed before the registry is locked, so that a slow node does not hold
+	// up every other call
+	logger.Debug("Connecting to node", "node", n)
+	conn, err := mtls.Dial(n)
+	if checkError(err, "Rejoin:Dial") {
+		return err
+	}
 
 	client := rpc.NewClient(conn)
 
-	allNodes.all[n] = &structs.Node{
+	// Deferred first so that it runs after the registry is unlocked
+	defer commitOnReturn(&err)
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	// Connected by a concurrent call
+	if node, connected := nodeRegistry.Connected(n); connected {
+		client.Close()
+		node.RecentHeartbeat = time.Now().UnixNano()
+		*nodeSettings = currentConfig().NodeSettings
+		return nil
+	}
+
+	// The node knows which cluster it is in, even if it died in between
+	nodeRegistry.Put(structs.Node{
 		Address:         n,
+		Labels:          msg.Labels,
 		Client:          client,
-		RecentHeartbeat: time.Now().UnixNano()}
+		RecentHeartbeat: time.Now().UnixNano(),
+		Topic:           msg.Topic,
+		Partition:       msg.Partition}, state)
 
-	go monitor(n, time.Millisecond*time.Duration(config.NodeSettings.HeartBeat))
+	go monitor(n, client)
 
-	*nodeSettings = config.NodeSettings
+	*nodeSettings = currentConfig().NodeSettings
 
-	outLog.Printf("Got Rejoin from %s\n", GREEN_COL+n+ERR_END)
+	logger.Info("Node rejoined", "node", n, "role", state, "topic", msg.Topic, "partition", msg.Partition)
 
 	return nil
 }
 
-// Writes to disk any connections that have been made to the server along
-// with their corresponding topics (if any)
-func updateNodeMap(addr string, topicName string, server *TServer) error {
-	_, err := os.OpenFile(topicFile, os.O_WRONLY, 0644)
+// Refreshes the heartbeat of a node that is still connected
+func heartbeatRejoin(addr string, nodeSettings *structs.NodeSettings) error {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
 
-	if err == nil {
-		// f.Write
-		return nil
+	// Lost since it was looked up. The node rejoins again
+	node, connected := nodeRegistry.Connected(addr)
+	if !connected {
+		return UnknownNodeError(addr)
 	}
 
-	return err
+	node.RecentHeartbeat = time.Now().UnixNano()
+	*nodeSettings = currentConfig().NodeSettings
+	return nil
 }
 
-func monitor(k string, heartBeatInterval time.Duration) {
+// Returns the state a node rejoins in. Only the node the topic names as the
+// leader of the partition rejoins as its leader
+func rejoinState(msg structs.RegisterMsg) (structs.NodeState, error) {
+	switch msg.State {
+	case "":
+		return structs.NodeOrphan, nil
+	case structs.NodeLeader, structs.NodeFollower:
+	default:
+		return "", fmt.Errorf("Server: node %s cannot rejoin as %s", msg.Address, msg.State)
+	}
+
+	topic, ok := topics.Get(msg.Topic)
+	if !ok {
+		// Recycled by recycleLoop
+		return msg.State, nil
+	}
+
+	if msg.Partition < 0 || msg.Partition >= len(topic.Partitions) {
+		return "", PartitionDoesNotExistError(fmt.Sprintf("%s/%d", msg.Topic, msg.Partition))
+	}
+
+	leader := topic.Partitions[msg.Partition].Leaders[1]
+	if msg.State == structs.NodeLeader && leader != msg.Address {
+		logger.Warn("Node claims to lead a partition with another leader", "node", msg.Address,
+			"topic", msg.Topic, "partition", msg.Partition, "leader", leader)
+		return structs.NodeFollower, nil
+	}
+	return msg.State, nil
+}
+
+// Marks the node dead once its heartbeats stop. Stops early if the node
+// registers again, since that starts a new monitor for the new connection.
+// The interval is read on every check, so a reload applies to running monitors
+func monitor(k string, client *rpc.Client) {
 	time.Sleep(time.Second * 10)
 	for {
-		allNodes.Lock()
-		if time.Now().UnixNano()-allNodes.all[k].RecentHeartbeat > int64(heartBeatInterval) {
-			outLog.Printf("%s timed out\n", ERR_COL+allNodes.all[k].Address+ERR_END)
-			delete(allNodes.all, k)
-			allNodes.Unlock()
+		heartBeatInterval := time.Millisecond * time.Duration(currentConfig().NodeSettings.HeartBeat)
+
+		nodeRegistry.Lock()
+		node, ok := nodeRegistry.Connected(k)
+		if !ok || node.Client != client {
+			nodeRegistry.Unlock()
+			return
+		}
+
+		if time.Now().UnixNano()-node.RecentHeartbeat > int64(heartBeatInterval) {
+			logger.Warn("Node heartbeat timed out", "node", node.Address, "role", node.State, "topic", node.Topic, "partition", node.Partition)
+			heartbeatMisses.Inc()
+			nodeRegistry.Transition(k, structs.NodeDead, "", 0)
+			node.Client.Close()
+			node.Client = nil
+			nodeRegistry.Unlock()
+			commitState()
 			return
 		}
-		outLog.Printf("%s is alive\n", allNodes.all[k].Address)
-		allNodes.Unlock()
+		logger.Debug("Node is alive", "node", node.Address)
+		nodeRegistry.Unlock()
 		time.Sleep(heartBeatInterval)
 	}
 }
 
 func (s *TServer) HeartBeat(addr string, _ignored *bool) error {
-	allNodes.Lock()
-	defer allNodes.Unlock()
-	if _, ok := allNodes.all[addr]; !ok {
+	if err := s.allowNode("HeartBeat", addr); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+	node, ok := nodeRegistry.Connected(addr)
+	if !ok {
 		return UnknownNodeError(addr)
 	}
 
-	allNodes.all[addr].RecentHeartbeat = time.Now().UnixNano()
+	node.RecentHeartbeat = time.Now().UnixNano()
 
 	return nil
 }
 
-func (s *TServer) TakeNode(ignored string, nodeAddr *string) error {
-	orphanNodes.Lock()
-	defer orphanNodes.Unlock()
+// Leader -> Server rpc for a replacement follower. members are the addresses
+// of the nodes already in the leader's cluster, so that the replacement keeps
+// the cluster spread across failure domains. The replacement is held as a
+// follower of the leader's partition; the leader returns it with ReturnNode
+// if it cannot add it
+func (s *TServer) TakeNode(members []string, nodeAddr *string) (err error) {
+	if err := s.allow("TakeNode", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	// Deferred first so that it runs after the registry is unlocked
+	defer commitOnReturn(&err)
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	// The replacement follows the partition led by one of the members, which
+	// must be the caller
+	var leader *structs.Node
+	for _, addr := range members {
+		if member, ok := nodeRegistry.Nodes[addr]; ok && member.State == structs.NodeLeader {
+			leader = member
+			break
+		}
+	}
+
+	if leader == nil || !s.caller.Owns(leader.Address) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s does not lead a partition of %v", s.caller, members))
+	}
 
-	if orphanNodes.Len <= 0 {
-		outLog.Println("TakeNode: No nodes available")
+	orphans := nodeRegistry.Orphans()
+	if len(orphans) == 0 {
+		logger.Warn("No orphan available for a replacement follower")
 		return fmt.Errorf("No nodes available for taking")
 	}
 
-	node := orphanNodes.DropN(1)
-	*nodeAddr = node[0].Address
-	outLog.Printf("TakeNode: gave %s\n", *nodeAddr)
+	node := orphans[spreadOrphans(orphans, 1, memberLabels(members))[0]]
+	nodeRegistry.Transition(node.Address, structs.NodeFollower, leader.Topic, leader.Partition)
+
+	*nodeAddr = node.Address
+	logger.Info("Gave replacement follower", "node", *nodeAddr, "topic", leader.Topic, "partition", leader.Partition)
+
+	return nil
+}
+
+// Leader -> Server rpc that returns a node given by TakeNode that the leader
+// could not add to its cluster. The node is an orphan again
+func (s *TServer) ReturnNode(addr string, _ignored *bool) (err error) {
+	if err := s.allow("ReturnNode", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	// Deferred first so that it runs after the registry is unlocked
+	defer commitOnReturn(&err)
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	node, ok := nodeRegistry.Nodes[addr]
+	if !ok {
+		return UnknownNodeError(addr)
+	}
+
+	if node.State != structs.NodeFollower {
+		return fmt.Errorf("Server: node %s is %s, not a follower", addr, node.State)
+	}
+
+	leader, ok := nodeRegistry.LeaderOf(node.Topic, node.Partition)
+	if !ok || !s.caller.Owns(leader.Address) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s does not lead %s/%d", s.caller, node.Topic, node.Partition))
+	}
+
+	nodeRegistry.Transition(addr, structs.NodeOrphan, "", 0)
+	logger.Info("Replacement follower was returned", "node", addr, "topic", node.Topic, "partition", node.Partition)
+	return nil
+}
+
+// Returns every node the server knows of, sorted by address
+func (s *TServer) ListNodes(_ignored string, nodesReply *[]structs.NodeStatus) error {
+	if err := s.allow("ListNodes", mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	*nodesReply = nodeRegistry.List()
+	return nil
+}
+
+// Returns the orphan pool in the order the orphans will be handed out
+func (s *TServer) ListOrphans(_ignored string, orphansReply *[]structs.NodeStatus) error {
+	if err := s.allow("ListOrphans", mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
 
+	*orphansReply = nodeRegistry.ListOrphans()
 	return nil
 }
 
@@ -242,181 +466,752 @@ func (s *TServer) TakeNode(ignored string, nodeAddr *string) error {
 // Producer API RPC
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-func (s *TServer) CreateTopic(topicName *string, topicReply *structs.Topic) error {
+func (s *TServer) CreateTopic(msg *structs.CreateTopicMsg, topicReply *structs.Topic) (err error) {
+	if err := s.allow("CreateTopic", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	// Nobody has permissions on a topic that does not exist yet
+	creator, err := s.authorize(structs.Topic{TopicName: msg.TopicName}, msg.Token, structs.PermAdmin)
+	if err != nil {
+		return err
+	}
+
 	// Check if there is already a Topic with the same name
-	if _, ok := topics.Get(*topicName); !ok {
-		orphanNodes.Lock()
-		defer orphanNodes.Unlock()
-
-		for {
-			if orphanNodes.Len >= uint32(config.NodeSettings.ClusterSize) {
-				lNode := orphanNodes.Orphans[0]
-
-				allNodes.Lock()
-				node, exists := allNodes.all[lNode.Address]
-				allNodes.Unlock()
-
-				// Node may have disconnected and was removed from allNodes map. We do not
-				// remove stale nodes from orphanNodes
-				if !exists {
-					log.Printf("Discrepancy in orphan nodes vs. Node Map. [%s] does not exist in NodeMap\n", lNode.Address)
-					log.Printf("All nodes: %+v\n", allNodes.all)
-					log.Printf("Orphan Nodes: %+v\n", orphanNodes.Orphans)
-					orphanNodes.DropN(1)
-					continue
-				}
-
-				orphanIps := make([]string, 0)
-
-				for i, orphan := range orphanNodes.Orphans {
-					if i >= int(config.NodeSettings.ClusterSize) {
-						break
-					}
-
-					orphanIps = append(orphanIps, orphan.Address)
-				}
-
-				var leaderClusterRpc string
-				if err := node.Client.Call("Peer.Lead", orphanIps, &leaderClusterRpc); err != nil {
-					errLog.Printf("Node [%s] could not accept Leader position.\n", lNode.Address)
-					return err
-				}
-
-				orphanNodes.DropN(int(config.NodeSettings.ClusterSize))
-
-				topic := structs.Topic{
-					TopicName:   *topicName,
-					MinReplicas: config.NodeSettings.MinReplicas,
-					Leaders:     []string{leaderClusterRpc, lNode.Address}}
-
-				topics.Set(*topicName, topic, config.DataPath)
-				*topicReply = topic
-				return nil
-			} else {
-				break
+	if _, ok := topics.Get(msg.TopicName); ok {
+		return DuplicateTopicNameError(msg.TopicName)
+	}
+
+	spec := msg.Spec.WithDefaults(currentConfig().NodeSettings)
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	defer commitOnReturn(&err)
+
+	clusters, err := claimClusters(msg.TopicName, spec)
+	if err != nil {
+		return err
+	}
+
+	topic := structs.Topic{
+		TopicName:  msg.TopicName,
+		Spec:       spec,
+		Partitions: make([]structs.Partition, 0, spec.NumPartitions)}
+
+	// Topics created without credentials stay open to everyone
+	if creator != "" {
+		topic.ACL = structs.TopicACL{creator: {structs.PermAdmin}}
+	}
+
+	for id, cluster := range clusters {
+		partition, err := leadPartition(msg.TopicName, id, spec, cluster)
+		if err != nil {
+			// The partitions already led would belong to a topic that is never stored
+			releaseClusters(clusters[id:])
+			doneCreating(msg.TopicName)
+			recycleTopic(msg.TopicName)
+			return err
+		}
+
+		topic.Partitions = append(topic.Partitions, partition)
+	}
+
+	err = topics.Set(msg.TopicName, topic)
+	doneCreating(msg.TopicName)
+	if err != nil {
+		recycleTopic(msg.TopicName)
+		return err
+	}
+
+	*topicReply = topic
+	return nil
+}
+
+// Picks ClusterSize orphans spread across failure domains for every partition.
+// The first node of each cluster becomes the partition's leader and the others
+// its followers. Nodes are claimed before any of them is told to lead so that
+// concurrent calls do not pick the same orphans
+func claimClusters(topicName string, spec structs.TopicSpec) ([][]structs.Node, error) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	// Nodes of a deleted topic of the same name would be taken for members
+	for _, node := range nodeRegistry.Nodes {
+		if node.Topic == topicName {
+			return nil, TopicRecyclingError(topicName)
+		}
+	}
+
+	// Every partition is led by its own cluster
+	if len(nodeRegistry.Orphans()) < int(spec.ClusterSize)*spec.NumPartitions {
+		return nil, InsufficientNodesForCluster("")
+	}
+
+	creatingLock.Lock()
+	creating[topicName] = true
+	creatingLock.Unlock()
+
+	clusters := make([][]structs.Node, 0, spec.NumPartitions)
+	for id := 0; id < spec.NumPartitions; id++ {
+		orphans := nodeRegistry.Orphans()
+		cluster := make([]structs.Node, 0, spec.ClusterSize)
+
+		for i, picked := range spreadOrphans(orphans, int(spec.ClusterSize), nil) {
+			state := structs.NodeFollower
+			if i == 0 {
+				state = structs.NodeLeader
 			}
+
+			nodeRegistry.Transition(orphans[picked].Address, state, topicName, id)
+			cluster = append(cluster, *orphans[picked])
 		}
 
-		return InsufficientNodesForCluster("")
+		clusters = append(clusters, cluster)
 	}
 
-	return DuplicateTopicNameError(*topicName)
+	return clusters, nil
 }
 
-func (s *TServer) GetTopic(topicName *string, topicReply *structs.Topic) error {
-	if topic, ok := topics.Get(*topicName); ok {
-		*topicReply = topic
-		return nil
+// Lets recycleLoop drop the topic's nodes if the topic was not stored
+func doneCreating(topicName string) {
+	creatingLock.Lock()
+	defer creatingLock.Unlock()
+	delete(creating, topicName)
+}
+
+// Returns the nodes of clusters that were never told to lead to the orphans
+func releaseClusters(clusters [][]structs.Node) {
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	for _, cluster := range clusters {
+		for _, node := range cluster {
+			if _, connected := nodeRegistry.Connected(node.Address); connected {
+				nodeRegistry.Transition(node.Address, structs.NodeOrphan, "", 0)
+			}
+		}
 	}
+}
 
-	return TopicDoesNotExistError(*topicName)
+// Tells the first node of cluster to lead partition id of the topic with the
+// others as its followers
+func leadPartition(topicName string, id int, spec structs.TopicSpec, cluster []structs.Node) (structs.Partition, error) {
+	lNode := cluster[0]
+
+	orphanIps := make([]string, 0)
+
+	for _, node := range cluster {
+		orphanIps = append(orphanIps, node.Address)
+	}
+
+	msg := structs.LeadMsg{
+		TopicName:   topicName,
+		Partition:   id,
+		Spec:        spec,
+		FollowerIps: orphanIps}
+
+	var leaderClusterRpc string
+	if err := lNode.Client.Call("Peer.Lead", msg, &leaderClusterRpc); err != nil {
+		logger.Error("Node could not accept leader position", "node", lNode.Address, "topic", topicName, "partition", id, "err", err)
+		return structs.Partition{}, err
+	}
+
+	return structs.Partition{
+		Id:      id,
+		Leaders: []string{leaderClusterRpc, lNode.Address}}, nil
+}
+
+// Needs produce or consume on the topic
+func (s *TServer) GetTopic(msg structs.GetTopicMsg, topicReply *structs.Topic) error {
+	if err := s.allow("GetTopic", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.TopicName)
+	if !ok {
+		return TopicDoesNotExistError(msg.TopicName)
+	}
+
+	if _, err := s.authorize(topic, msg.Token, structs.PermProduce, structs.PermConsume); err != nil {
+		return err
+	}
+
+	*topicReply = topic
+	return nil
+}
+
+// Node -> Server rpc that returns one partition of a topic, e.g. to find the
+// leader to rejoin
+func (s *TServer) GetPartition(msg structs.GetPartitionMsg, partitionReply *structs.Partition) error {
+	if err := s.allow("GetPartition", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(msg.TopicName)
+	if !ok {
+		return TopicDoesNotExistError(msg.TopicName)
+	}
+
+	if msg.Partition < 0 || msg.Partition >= len(topic.Partitions) {
+		return PartitionDoesNotExistError(fmt.Sprintf("%s/%d", msg.TopicName, msg.Partition))
+	}
+
+	*partitionReply = topic.Partitions[msg.Partition]
+	return nil
+}
+
+// Long-poll for a leader change. Returns the topic as soon as its Epoch is
+// past msg.KnownEpoch, or the unchanged topic after WATCH_TIMEOUT seconds
+func (s *TServer) WatchTopic(msg structs.WatchTopicMsg, topicReply *structs.Topic) error {
+	if err := s.allow("WatchTopic", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	timeout := time.After(WATCH_TIMEOUT * time.Second)
+	for {
+		// Taken before the checks so that a change in between wakes us up
+		changed := topics.Changed()
+
+		// This replica may have lost the primary role while waiting
+		if err := checkPrimary(); err != nil {
+			return err
+		}
+
+		topic, ok := topics.Get(msg.TopicName)
+		if !ok {
+			return TopicDoesNotExistError(msg.TopicName)
+		}
+
+		// Checked on every change so that a revoked client stops watching
+		if _, err := s.authorize(topic, msg.Token, structs.PermProduce, structs.PermConsume); err != nil {
+			return err
+		}
+
+		if topic.Epoch > msg.KnownEpoch {
+			*topicReply = topic
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			*topicReply = topic
+			return nil
+		}
+	}
+}
+
+// Returns every topic, sorted by name
+func (s *TServer) ListTopics(_ignored string, topicsReply *[]structs.Topic) error {
+	if err := s.allow("ListTopics", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topicList := topics.List()
+	sort.Slice(topicList, func(i, j int) bool {
+		return topicList[i].TopicName < topicList[j].TopicName
+	})
+
+	*topicsReply = topicList
+	return nil
+}
+
+// Asks a leader to describe its cluster. A leader that is stuck, e.g. in an
+// election, does not hold up the caller for longer than DESCRIBE_TIMEOUT
+func describeCluster(leader structs.Node) (structs.PartitionDescription, error) {
+	var desc structs.PartitionDescription
+	call := leader.Client.Go("Peer.DescribeCluster", "", &desc, nil)
+	select {
+	case <-call.Done:
+		return desc, call.Error
+	case <-time.After(DESCRIBE_TIMEOUT * time.Second):
+		return structs.PartitionDescription{}, NodeTimeoutError(leader.Address)
+	}
+}
+
+// Describes the live state of every partition of a topic, as reported by the
+// partition's leader. Partitions whose leader cannot be reached have Error set
+func (s *TServer) DescribeTopic(topicName *string, descReply *structs.TopicDescription) error {
+	if err := s.allow("DescribeTopic", mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(*topicName)
+	if !ok {
+		return TopicDoesNotExistError(*topicName)
+	}
+
+	desc := structs.TopicDescription{
+		TopicName:  topic.TopicName,
+		Spec:       topic.Spec,
+		Partitions: make([]structs.PartitionDescription, 0, len(topic.Partitions))}
+
+	for _, partition := range topic.Partitions {
+		var partitionDesc structs.PartitionDescription
+
+		leader, exists := connectedNode(partition.Leaders[1])
+		if !exists {
+			partitionDesc.Error = UnknownNodeError(partition.Leaders[1]).Error()
+		} else if live, err := describeCluster(leader); err != nil {
+			partitionDesc.Error = err.Error()
+		} else {
+			partitionDesc = live
+		}
+
+		partitionDesc.Id = partition.Id
+		partitionDesc.Leaders = partition.Leaders
+		if partitionDesc.Error != "" {
+			partitionDesc.UnderReplicated = true
+		}
+
+		desc.Partitions = append(desc.Partitions, partitionDesc)
+	}
+
+	*descReply = desc
+	return nil
+}
+
+// Tears down every partition's cluster of the topic and returns its nodes to
+// the orphan pool. Nodes that cannot be reached now are recycled by
+// recycleLoop once they can
+func (s *TServer) DeleteTopic(topicName *string, _ignored *bool) (err error) {
+	if err := s.allow("DeleteTopic", mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(*topicName)
+	if !ok {
+		return TopicDoesNotExistError(*topicName)
+	}
+
+	defer commitOnReturn(&err)
+	if err := topics.Delete(topic.TopicName); err != nil {
+		return err
+	}
+
+	recycled, remaining := recycleTopic(topic.TopicName)
+	logger.Info("Deleted topic", "topic", topic.TopicName, "recycled", recycled, "remaining", remaining)
+	return nil
+}
+
+// Tells the nodes the registry still has in topicName, a topic the server
+// does not have, to drop it, leaders first since they drop their followers
+// too. The nodes that dropped it become orphans. Returns their addresses and
+// the addresses of the nodes that are still in the topic. The caller commits
+// the state
+func recycleTopic(topicName string) ([]string, []string) {
+	nodeRegistry.RLock()
+	members := make([]*structs.Node, 0)
+	for _, node := range nodeRegistry.Nodes {
+		if node.Topic == topicName {
+			members = append(members, node)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].State == structs.NodeLeader && members[j].State != structs.NodeLeader
+	})
+	addrs := make([]string, len(members))
+	for i, node := range members {
+		addrs[i] = node.Address
+	}
+	nodeRegistry.RUnlock()
+
+	dropped := make(map[string]bool)
+	for _, addr := range addrs {
+		if dropped[addr] {
+			continue
+		}
+
+		node, connected := connectedNode(addr)
+		if !connected {
+			continue
+		}
+
+		var members []string
+		err := node.Client.Call("Peer.DropTopic", topicName, &members)
+		switch {
+		case err == nil:
+			for _, member := range members {
+				dropped[member] = true
+			}
+		case structs.IsNotInTopicError(err):
+			// Dropped before, but the reply was lost
+			dropped[addr] = true
+		default:
+			logger.Warn("Node could not drop the topic, will retry",
+				"node", addr, "topic", topicName, "partition", node.Partition, "err", err)
+		}
+	}
+
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+
+	recycled := make([]string, 0)
+	for addr := range dropped {
+		// Replacement followers are given without a topic if their leader was unknown
+		node, connected := nodeRegistry.Connected(addr)
+		if connected && (node.Topic == topicName || node.Topic == "" && node.State == structs.NodeFollower) {
+			nodeRegistry.Transition(addr, structs.NodeOrphan, "", 0)
+			recycled = append(recycled, addr)
+		}
+	}
+
+	remaining := make([]string, 0)
+	for _, addr := range addrs {
+		if !dropped[addr] {
+			remaining = append(remaining, addr)
+		}
+	}
+	sort.Strings(recycled)
+	return recycled, remaining
+}
+
+// Recycles the nodes of topics that were deleted, or never stored because
+// CreateTopic failed, while some of their nodes could not be reached. Runs
+// forever, only acting on the primary
+func recycleLoop() {
+	for {
+		time.Sleep(RECYCLE_INTERVAL * time.Second)
+		if !isPrimary() {
+			continue
+		}
+
+		stale := make(map[string]bool)
+		nodeRegistry.RLock()
+		creatingLock.Lock()
+		for _, node := range nodeRegistry.Nodes {
+			if node.Topic == "" || creating[node.Topic] {
+				continue
+			}
+			if _, exists := topics.Get(node.Topic); !exists {
+				stale[node.Topic] = true
+			}
+		}
+		creatingLock.Unlock()
+		nodeRegistry.RUnlock()
+
+		for topicName := range stale {
+			recycled, remaining := recycleTopic(topicName)
+			if len(recycled) > 0 {
+				logger.Info("Recycled nodes of deleted topic", "topic", topicName, "recycled", recycled, "remaining", remaining)
+				commitState()
+			}
+		}
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 // Helpers for Leader promotion/demotion
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-func (s *TServer) UpdateTopicLeader(topic *structs.Topic, ignore *string) (err error) {
-	fmt.Println(ERR_COL + "TOPIC LEADER IS BEING UPDATED" + ERR_END)
-	return topics.Set(topic.TopicName, *topic, config.DataPath)
+func isMember(members []string, addr string) bool {
+	for _, member := range members {
+		if member == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Called by a newly elected leader. update only holds the partitions whose
+// leader has changed
+func (s *TServer) UpdateTopicLeader(update *structs.Topic, ignore *string) (err error) {
+	if err := s.allow("UpdateTopicLeader", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	topic, ok := topics.Get(update.TopicName)
+	if !ok {
+		return TopicDoesNotExistError(update.TopicName)
+	}
+
+	// Copy so the stored topic is not modified outside of the map's lock
+	partitions := make([]structs.Partition, len(topic.Partitions))
+	copy(partitions, topic.Partitions)
+
+	for _, p := range update.Partitions {
+		if p.Id < 0 || p.Id >= len(partitions) {
+			return PartitionDoesNotExistError(fmt.Sprintf("%s/%d", update.TopicName, p.Id))
+		}
+
+		if len(p.Leaders) < 2 {
+			return fmt.Errorf("Server: no leader given for %s/%d", update.TopicName, p.Id)
+		}
+
+		// Sent by the new leader after an election, or by the old one when it
+		// hands off. Both must be registered in the partition, so a node cannot
+		// make itself or another node leader of a partition it is not in
+		nodeRegistry.Lock()
+		members := nodeRegistry.Members(update.TopicName, p.Id)
+		nodeRegistry.Unlock()
+
+		newLeader, oldLeader := p.Leaders[1], partitions[p.Id].Leaders[1]
+		if !isMember(members, newLeader) {
+			return structs.UnauthorizedError(fmt.Sprintf("%s is not a member of %s/%d", newLeader, update.TopicName, p.Id))
+		}
+
+		if !s.caller.Owns(newLeader) && !(isMember(members, oldLeader) && s.caller.Owns(oldLeader)) {
+			return structs.UnauthorizedError(fmt.Sprintf("%s does not lead %s/%d", s.caller, update.TopicName, p.Id))
+		}
+
+		partitions[p.Id] = p
+	}
+
+	topic.Partitions = partitions
+	topic.Epoch++
+	defer commitOnReturn(&err)
+	if err := topics.Set(topic.TopicName, topic); err != nil {
+		return err
+	}
+
+	// A leader that is still alive has stepped down to follow the new one
+	nodeRegistry.Lock()
+	defer nodeRegistry.Unlock()
+	for _, p := range update.Partitions {
+		if old, ok := nodeRegistry.LeaderOf(update.TopicName, p.Id); ok && old.Address != p.Leaders[1] {
+			nodeRegistry.Transition(old.Address, structs.NodeFollower, update.TopicName, p.Id)
+		}
+		nodeRegistry.Transition(p.Leaders[1], structs.NodeLeader, update.TopicName, p.Id)
+	}
+	return nil
+}
+
+// Returns a copy of the node if the server has a live connection to it
+func connectedNode(addr string) (structs.Node, bool) {
+	nodeRegistry.RLock()
+	defer nodeRegistry.RUnlock()
+
+	node, connected := nodeRegistry.Connected(addr)
+	if !connected {
+		return structs.Node{}, false
+	}
+	return *node, true
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Caller checks
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Checks that the caller's certificate has one of roles
+func (s *TServer) allow(method string, roles ...string) error {
+	if !s.caller.Is(roles...) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s may not call %s", s.caller, method))
+	}
+	return nil
+}
+
+// Checks that the caller is the node at addr, its PeerRpc address
+func (s *TServer) allowNode(method string, addr string) error {
+	if !s.caller.Is(mtls.RoleNode) || !s.caller.Owns(addr) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s may not call %s for node %s", s.caller, method, addr))
+	}
+	return nil
+}
+
+// Checks that the caller is the server replica at addr
+func (s *TServer) allowReplica(method string, addr string) error {
+	if !s.caller.Is(mtls.RoleServer) || !s.caller.Owns(addr) {
+		return structs.UnauthorizedError(fmt.Sprintf("%s may not call %s for replica %s", s.caller, method, addr))
+	}
+	return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 // Disk operations to survive server failure
 ///////////////////////////////////////////////////////////////////////////////////////////////////
 
-func readDiskData() error {
-	data, err := ioutil.ReadFile(config.DataPath)
+// Recovers topics and nodes from the journal and journals every later change
+func openJournal() error {
+	if config.JournalDir == "" {
+		config.JournalDir = journalDir
+	}
+
+	j, state, err := journal.Open(config.JournalDir, config.SnapshotEvery)
 	if err != nil {
-		fmt.Println("ReadFile failed")
 		return err
 	}
 
-	if len(data) == 0 {
+	// Not concurrent so it's fine to not lock
+	for _, topic := range state.Topics {
+		topics.Map[topic.TopicName] = topic
+	}
+
+	// Recovered nodes have no connection until they register or rejoin
+	if err := nodeRegistry.Replace(state.Nodes); err != nil {
+		return err
+	}
+
+	for _, txn := range state.Txns {
+		transactions.Map[txn.Id] = txn
+	}
+
+	topics.Journal = j
+	nodeRegistry.Journal = j
+	transactions.Journal = j
+	termJournal = j
+	term = state.Term
+
+	logger.Info("Recovered journal", "topics", len(state.Topics), "nodes", len(state.Nodes),
+		"transactions", len(state.Txns), "term", state.Term.Term, "dir", config.JournalDir)
+
+	if len(state.Topics) == 0 && config.DataPath != "" {
+		return importTopicsFile(config.DataPath)
+	}
+	return nil
+}
+
+// A topic in the file older servers kept. Servers from before partitions
+// wrote the leader of the topic's one cluster and its MinReplicas instead of
+// Spec and Partitions
+type legacyTopic struct {
+	structs.Topic
+	MinReplicas uint8
+	Leaders     []string // [0] = ClusterRpcAddr, [1] = PeerRpcAddr
+}
+
+// Moves topics from the file older servers rewrote on every change into the
+// journal. The file is renamed so that it is only imported once. A file that
+// was torn by a crash is skipped rather than stop the server
+func importTopicsFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || len(data) == 0 {
 		return nil
+	} else if err != nil {
+		return err
 	}
 
-	var topicsJson []structs.Topic
+	var topicsJson []legacyTopic
 	if err = json.Unmarshal(data, &topicsJson); err != nil {
-		fmt.Println("Unmarshal failed")
-		return err
+		logger.Error("Could not parse old topics file, skipping it", "path", path, "err", err)
+		return nil
 	}
 
-	fmt.Println("Looking for old topics")
+	imported := 0
+	for _, legacy := range topicsJson {
+		topic := legacy.Topic
 
-	// Not concurrent so it's fine to not lock
-	for _, topic := range topicsJson {
-		topics.Map[topic.TopicName] = topic
-		fmt.Println("TOPIC:", topic)
+		// Written before topics had partitions. The topic was one cluster
+		if len(topic.Partitions) == 0 {
+			if len(legacy.Leaders) < 2 {
+				logger.Warn("Skipping old topic without a leader", "topic", topic.TopicName, "path", path)
+				continue
+			}
+
+			topic.Spec = structs.TopicSpec{NumPartitions: 1, MinReplicas: legacy.MinReplicas}.WithDefaults(currentConfig().NodeSettings)
+			topic.Partitions = []structs.Partition{{Id: 0, Leaders: legacy.Leaders}}
+		}
+
+		if err := topics.Set(topic.TopicName, topic); err != nil {
+			return err
+		}
+		imported++
 	}
 
-	return nil
+	logger.Info("Imported old topics file", "topics", imported, "path", path)
+	return os.Rename(path, path+".imported")
 }
 
 func main() {
 	//gob.Register(&net.TCPAddr{})
 
-	// Pass in IP as command line argument
-	path := flag.String("c", "", "Path to the JSON config")
+	var files, sets conf.List
+	flag.Var(&files, "c", "Path to a JSON config. May be given more than once, later files override earlier ones")
+	flag.Var(&sets, "set", "Setting that overrides the config files and environment, e.g. node-settings.heartbeat=5000")
 	flag.Parse()
 
-	if *path == "" {
+	if len(files) == 0 && len(sets) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	readConfigOrDie(*path)
+	handleErrorFatal("Logging setup", logging.ConfigureFromEnv())
 
-	// Check if there was previous data on this server
-
-	if _, err := os.Stat(config.DataPath); os.IsNotExist(err) {
-		fmt.Println(GREEN_COL + "No Previous Data" + ERR_END)
-		f, err := os.Create(config.DataPath)
-		if err != nil {
-			handleErrorFatal("Couldn't create file "+config.DataPath, err)
-		}
+	loader := conf.Loader{Files: files, EnvPrefix: ENV_CONFIG_PREFIX, Sets: sets}
+	loaded, err := loadConfig(loader)
+	handleErrorFatal("config", err)
+	config = loaded
+	logger = logger.With("server", config.RpcIpPort)
 
-		f.Sync()
-		f.Close()
-	} else {
-		fmt.Println(ERR_COL + "PREVIOUS DATA ON SERVER" + ERR_END)
-		if err = readDiskData(); err != nil {
-			handleErrorFatal("Could not read topics data from disk", err)
-		}
-	}
+	// Recover any previous data on this server
+	handleErrorFatal("Could not recover server state from the journal", openJournal())
 
 	rand.Seed(time.Now().UnixNano())
 
-	// Set up Server RPC
-	tServer := new(TServer)
-	server := rpc.NewServer()
-	server.Register(tServer)
-
-	l, err := net.Listen("tcp", config.RpcIpPort)
+	// Elect a primary between the server replicas
+	if len(config.Replicas) > 0 {
+		logger.Info("Server replica", "replica", config.ReplicaAddr, "replicas", config.Replicas)
+		go monitorReplicas()
+	}
 
-	handleErrorFatal("listen error", err)
-	outLog.Printf("Server started. Receiving on %s\n", config.RpcIpPort)
+	handleErrorFatal("TLS setup", mtls.Setup(config.TLS))
+	if !mtls.Enabled() {
+		logger.Warn("TLS is off. Any host can call the server")
+	}
 
-	if err != nil {
-		fmt.Sprintln("Server: Error initializing RPC Listener")
-		return
+	if config.HttpIpPort != "" {
+		go serveHttp(config.HttpIpPort)
 	}
 
-	for {
-		conn, _ := l.Accept()
-		go server.ServeConn(conn)
+	if config.MetricsIpPort != "" {
+		go serveMetrics(config.MetricsIpPort)
 	}
+
+	go rebalanceLoop()
+	go recycleLoop()
+	go txnLoop()
+	go reloadOnHangup(loader)
+
+	l, err := mtls.Listen(config.RpcIpPort)
+
+	handleErrorFatal("listen error", err)
+	logger.Info("Server started", "addr", config.RpcIpPort)
+
+	// Set up Server RPC, one TServer per connection for the caller's identity
+	mtls.Accept(l, func(conn net.Conn, caller mtls.Identity) {
+		server := rpc.NewServer()
+		server.Register(&TServer{caller: caller})
+		server.ServeConn(conn)
+	})
 }
 
 func handleErrorFatal(msg string, e error) {
 	if e != nil {
-		errLog.Fatalf("%s, err = %s\n", msg, e.Error())
+		logger.Fatal(msg, "err", e)
 	}
 }
 
 func checkError(err error, parent string) bool {
 	if err != nil {
-		errLog.Println(parent, ":: found error! ", err)
+		logger.Error("Found error", "in", parent, "err", err)
 		return true
 	}
 	return false
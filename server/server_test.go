@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"../structs"
+	c "./concurrentlib"
+)
+
+func TestTakeNode(t *testing.T) {
+	tests := []struct {
+		name      string
+		members   []string
+		wantErr   bool
+		wantState structs.NodeState // Of the orphan afterwards
+	}{
+		{"from a leader", []string{"follower:1", "leader:1"}, false, structs.NodeFollower},
+		{"without a leader", []string{"follower:1"}, true, structs.NodeOrphan},
+		{"from unknown nodes", []string{"other:1"}, true, structs.NodeOrphan},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRegistry(t, map[string]structs.NodeState{
+				"leader:1":   structs.NodeLeader,
+				"follower:1": structs.NodeFollower,
+				"orphan:1":   structs.NodeOrphan}, nil)
+
+			var taken string
+			err := (&TServer{}).TakeNode(tt.members, &taken)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TakeNode(%v) = %q, %v, want error %v", tt.members, taken, err, tt.wantErr)
+			}
+			if err == nil && taken != "orphan:1" {
+				t.Errorf("TakeNode(%v) = %q, want orphan:1", tt.members, taken)
+			}
+			if got := stateOf("orphan:1"); got != tt.wantState {
+				t.Errorf("orphan is %s, want %s", got, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestReturnNode(t *testing.T) {
+	resetRegistry(t, map[string]structs.NodeState{
+		"leader:1": structs.NodeLeader,
+		"orphan:1": structs.NodeOrphan}, nil)
+
+	if err := (&TServer{}).ReturnNode("orphan:1", new(bool)); err == nil {
+		t.Errorf("ReturnNode of an orphan succeeded")
+	}
+
+	var taken string
+	if err := (&TServer{}).TakeNode([]string{"leader:1"}, &taken); err != nil {
+		t.Fatalf("TakeNode: %s", err)
+	}
+
+	// The leader could not add it
+	if err := (&TServer{}).ReturnNode(taken, new(bool)); err != nil {
+		t.Fatalf("ReturnNode: %s", err)
+	}
+	if got := stateOf(taken); got != structs.NodeOrphan {
+		t.Errorf("returned node is %s, want %s", got, structs.NodeOrphan)
+	}
+
+	if err := (&TServer{}).TakeNode([]string{"leader:1"}, &taken); err != nil {
+		t.Errorf("returned node was not handed out again: %s", err)
+	}
+}
+
+func TestRejoinState(t *testing.T) {
+	topics = c.TopicCMap{Map: make(map[string]structs.Topic)}
+	topics.Set("t", structs.Topic{
+		TopicName:  "t",
+		Partitions: []structs.Partition{{Id: 0, Leaders: []string{"leader:2", "leader:1"}}}})
+
+	tests := []struct {
+		name    string
+		msg     structs.RegisterMsg
+		want    structs.NodeState
+		wantErr bool
+	}{
+		{"not in a cluster", structs.RegisterMsg{Address: "n:1"}, structs.NodeOrphan, false},
+		{"leader named by the topic", structs.RegisterMsg{Address: "leader:1", State: structs.NodeLeader, Topic: "t"}, structs.NodeLeader, false},
+		{"replaced leader", structs.RegisterMsg{Address: "n:1", State: structs.NodeLeader, Topic: "t"}, structs.NodeFollower, false},
+		{"follower", structs.RegisterMsg{Address: "n:1", State: structs.NodeFollower, Topic: "t"}, structs.NodeFollower, false},
+		{"deleted topic", structs.RegisterMsg{Address: "n:1", State: structs.NodeLeader, Topic: "gone"}, structs.NodeLeader, false},
+		{"missing partition", structs.RegisterMsg{Address: "n:1", State: structs.NodeFollower, Topic: "t", Partition: 1}, "", true},
+		{"draining", structs.RegisterMsg{Address: "n:1", State: structs.NodeDraining}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rejoinState(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rejoinState(%+v) error = %v, want error %v", tt.msg, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("rejoinState(%+v) = %s, want %s", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
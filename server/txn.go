@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"../lib/mtls"
+	"../structs"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////////////////
+// Transactions
+//
+// The server coordinates transactions that write to several topics. A producer begins one, names
+// each partition before its first write there, writes its records with the transaction's id, then
+// commits or aborts. The outcome is journalled and replicated like a topic before the producer is
+// answered, which is the point where the transaction commits. The server then writes a marker
+// with the outcome to each partition.
+//
+// Leaders hide the records of a committed transaction until the server decides that consumers may
+// see them, which it does once every partition has the commit marker. The decision is journalled
+// and replicated, then written to each partition as a release marker. A leader without its release
+// marker asks the server instead of trusting its commit marker, so no partition shows a
+// transaction before all of them hold it, and no partition ever shows records of an aborted one.
+//
+// Markers are written again every TXN_CHECK_INTERVAL until every leader has them, also by a new
+// primary. Transactions still open at their deadline are aborted.
+///////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Seconds between checks for expired transactions and unwritten markers
+const TXN_CHECK_INTERVAL = 5
+
+// Seconds an ended transaction is kept after its last marker is written
+const TXN_RETENTION = 600
+
+var (
+	txnLock    sync.Mutex // Serialises changes to transactions
+	markerLock sync.Mutex // One delivery of markers at a time
+)
+
+// Client -> Server rpc that begins a transaction. Only the caller's
+// principal may write in it and end it
+func (s *TServer) BeginTransaction(msg structs.BeginTxnMsg, txnReply *structs.Transaction) (err error) {
+	if err := s.allow("BeginTransaction", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	principal, err := principalOf(msg.Token, s.caller.Name, s.caller.Role)
+	if err != nil {
+		return err
+	}
+	if principal == "" && currentConfig().RequireCredentials {
+		return structs.UnauthorizedError("credentials required")
+	}
+
+	timeout := msg.Timeout
+	if timeout == 0 {
+		timeout = structs.DEFAULT_TXN_TIMEOUT
+	}
+	if timeout > structs.MAX_TXN_TIMEOUT {
+		return fmt.Errorf("Server: transaction timeout %dms is over the limit of %dms", timeout, structs.MAX_TXN_TIMEOUT)
+	}
+
+	id, err := newTxnId()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	txn := structs.Transaction{
+		Id:         id,
+		Principal:  principal,
+		State:      structs.TxnOpen,
+		Partitions: make([]structs.TopicPartition, 0),
+		Started:    now.UnixNano(),
+		Deadline:   now.Add(time.Duration(timeout) * time.Millisecond).UnixNano()}
+
+	defer commitOnReturn(&err)
+	if err := transactions.Set(txn); err != nil {
+		return err
+	}
+
+	logger.Info("Began transaction", "txn", id, "principal", principal, "timeout-ms", timeout)
+	*txnReply = txn
+	return nil
+}
+
+// Client -> Server rpc that adds partitions to an open transaction. Needs
+// produce on their topics
+func (s *TServer) AddTxnPartitions(msg structs.AddTxnPartitionsMsg, txnReply *structs.Transaction) (err error) {
+	if err := s.allow("AddTxnPartitions", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	// Deferred first so that it runs after txnLock is unlocked
+	defer commitOnReturn(&err)
+
+	txnLock.Lock()
+	defer txnLock.Unlock()
+
+	txn, err := s.ownTxn(msg.TxnId, msg.Token)
+	if err != nil {
+		return err
+	}
+	if txn.State != structs.TxnOpen || time.Now().UnixNano() > txn.Deadline {
+		return structs.TxnNotOpenError(txn.Id)
+	}
+
+	for _, tp := range msg.Partitions {
+		topic, ok := topics.Get(tp.Topic)
+		if !ok {
+			return TopicDoesNotExistError(tp.Topic)
+		}
+
+		if tp.Partition < 0 || tp.Partition >= len(topic.Partitions) {
+			return PartitionDoesNotExistError(tp.String())
+		}
+
+		if _, err := s.authorize(topic, msg.Token, structs.PermProduce); err != nil {
+			return err
+		}
+
+		if !hasPartition(txn.Partitions, tp) {
+			txn.Partitions = append(txn.Partitions, tp)
+		}
+	}
+
+	if err := transactions.Set(txn); err != nil {
+		return err
+	}
+
+	*txnReply = txn
+	return nil
+}
+
+// Client -> Server rpc that commits or aborts a transaction. Ending it again
+// the same way returns it as it is, so a producer whose reply was lost can
+// retry. Committing a transaction past its deadline aborts it
+func (s *TServer) EndTransaction(msg structs.EndTxnMsg, txnReply *structs.Transaction) (err error) {
+	if err := s.allow("EndTransaction", mtls.RoleClient, mtls.RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	// Markers are only written once a majority of replicas has the outcome,
+	// so a new primary never aborts a transaction that a leader has as
+	// committed. Otherwise the call fails and txnLoop writes them once the
+	// outcome reaches a majority
+	ended := false
+	defer func() {
+		commitOnReturn(&err)
+		if ended && err == nil {
+			go deliverMarkers(msg.TxnId)
+		}
+	}()
+
+	txnLock.Lock()
+	defer txnLock.Unlock()
+
+	txn, err := s.ownTxn(msg.TxnId, msg.Token)
+	if err != nil {
+		return err
+	}
+
+	outcome := structs.TxnAborted
+	if msg.Commit {
+		outcome = structs.TxnCommitted
+	}
+
+	if txn.State == outcome {
+		*txnReply = txn
+		return nil
+	}
+	if txn.State != structs.TxnOpen {
+		return structs.TxnNotOpenError(txn.Id)
+	}
+
+	expired := time.Now().UnixNano() > txn.Deadline
+	if expired {
+		outcome = structs.TxnAborted
+	}
+
+	if err := endTxn(&txn, outcome); err != nil {
+		return err
+	}
+	ended = true
+
+	if expired && msg.Commit {
+		return structs.TxnNotOpenError(txn.Id)
+	}
+	*txnReply = txn
+	return nil
+}
+
+// Leader -> Server rpc that returns the state of transactions whose records
+// the leader holds without a marker, or without a release marker. Committed
+// transactions are reported as visible once every partition has the marker
+func (s *TServer) TransactionStatus(txnIds []string, states *map[string]structs.TxnState) error {
+	if err := s.allow("TransactionStatus", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	result := make(map[string]structs.TxnState, len(txnIds))
+	for _, id := range txnIds {
+		if txn, ok := transactions.Get(id); ok {
+			result[id] = txn.Status()
+		} else {
+			result[id] = structs.TxnUnknown
+		}
+	}
+
+	*states = result
+	return nil
+}
+
+// Leader -> Server rpc that checks a client's first write in a transaction:
+// that the client began it and added the partition to it. Returns the state
+// of the transaction, TxnUnknown if there is no such transaction
+func (s *TServer) CheckTxnWrite(msg structs.TxnWriteMsg, state *structs.TxnState) error {
+	if err := s.allow("CheckTxnWrite", mtls.RoleNode); err != nil {
+		return err
+	}
+
+	if err := checkPrimary(); err != nil {
+		return err
+	}
+
+	txn, ok := transactions.Get(msg.TxnId)
+	if !ok {
+		*state = structs.TxnUnknown
+		return nil
+	}
+
+	principal, err := principalOf(msg.Token, msg.CertName, msg.CertRole)
+	if err != nil {
+		return err
+	}
+
+	if principal != txn.Principal && msg.CertRole != mtls.RoleAdmin {
+		return structs.UnauthorizedError(fmt.Sprintf("transaction %s was not begun by %s", msg.TxnId, principal))
+	}
+
+	tp := structs.TopicPartition{Topic: msg.Topic, Partition: msg.Partition}
+	if !hasPartition(txn.Partitions, tp) {
+		return fmt.Errorf("Server: partition %s was not added to transaction %s", tp.String(), msg.TxnId)
+	}
+
+	*state = txn.State
+	return nil
+}
+
+// Returns the transaction if the caller began it
+func (s *TServer) ownTxn(txnId string, token string) (structs.Transaction, error) {
+	txn, ok := transactions.Get(txnId)
+	if !ok {
+		return txn, structs.TxnNotOpenError(txnId)
+	}
+
+	principal, err := principalOf(token, s.caller.Name, s.caller.Role)
+	if err != nil {
+		return txn, err
+	}
+
+	if principal != txn.Principal && s.caller.Role != mtls.RoleAdmin {
+		return txn, structs.UnauthorizedError(fmt.Sprintf("transaction %s was not begun by %s", txnId, principal))
+	}
+	return txn, nil
+}
+
+// Journals the outcome of a transaction. The caller commits the state once
+// txnLock is unlocked, then delivers the markers
+// Lock is manually set from caller
+func endTxn(txn *structs.Transaction, outcome structs.TxnState) error {
+	txn.State = outcome
+	txn.Ended = time.Now().UnixNano()
+	txn.Unmarked = append([]structs.TopicPartition{}, txn.Partitions...)
+
+	if err := transactions.Set(*txn); err != nil {
+		return err
+	}
+
+	logger.Info("Ended transaction", "txn", txn.Id, "state", outcome, "partitions", len(txn.Partitions))
+	return nil
+}
+
+// Writes the outcome of an ended transaction to every partition that does
+// not have it yet. Once every partition of a committed transaction has it,
+// makes the transaction visible and writes the release markers. Nothing is
+// written until a majority of replicas has the outcome, or the decision to
+// release it
+func deliverMarkers(txnId string) {
+	markerLock.Lock()
+	defer markerLock.Unlock()
+
+	txn, ok := transactions.Get(txnId)
+	if !ok || !markersPending(txn) {
+		return
+	}
+
+	if err := pushState(); err != nil {
+		logger.Warn("Transaction outcome is not on a majority of replicas, will retry", "txn", txn.Id, "err", err)
+		return
+	}
+
+	if len(txn.Unmarked) > 0 || (txn.State == structs.TxnCommitted && !txn.Visible) {
+		marked := writeTxnMarkers(txn, txn.Unmarked, txn.State)
+		if len(marked) == 0 && len(txn.Unmarked) > 0 {
+			return
+		}
+
+		if txn, ok = markTxn(txnId, marked); !ok || !txn.Visible || len(txn.Unreleased) == 0 {
+			return
+		}
+
+		if err := pushState(); err != nil {
+			logger.Warn("Transaction release is not on a majority of replicas, will retry", "txn", txn.Id, "err", err)
+			return
+		}
+	}
+
+	released := writeTxnMarkers(txn, txn.Unreleased, structs.TxnVisible)
+	releaseTxn(txnId, released)
+}
+
+// Returns whether a transaction has markers left to write
+func markersPending(txn structs.Transaction) bool {
+	if txn.State == structs.TxnOpen {
+		return false
+	}
+	return len(txn.Unmarked) > 0 || len(txn.Unreleased) > 0 || (txn.State == structs.TxnCommitted && !txn.Visible)
+}
+
+// Writes a marker of state to each of partitions. Returns the ones written
+func writeTxnMarkers(txn structs.Transaction, partitions []structs.TopicPartition, state structs.TxnState) []structs.TopicPartition {
+	written := make([]structs.TopicPartition, 0, len(partitions))
+	for _, tp := range partitions {
+		if err := writeTxnMarker(txn.Id, tp, state); err != nil {
+			logger.Warn("Could not write transaction marker, will retry", "txn", txn.Id, "partition", tp.String(),
+				"state", state, "err", err)
+			continue
+		}
+		written = append(written, tp)
+	}
+	return written
+}
+
+// Takes marked partitions off the transaction's unmarked ones. A committed
+// transaction without unmarked partitions becomes visible, with every
+// partition still to be released. Returns the transaction as journalled
+func markTxn(txnId string, marked []structs.TopicPartition) (structs.Transaction, bool) {
+	defer commitState()
+
+	txnLock.Lock()
+	defer txnLock.Unlock()
+
+	txn, ok := transactions.Get(txnId)
+	if !ok {
+		return txn, false
+	}
+
+	txn.Unmarked = withoutPartitions(txn.Unmarked, marked)
+	if txn.State == structs.TxnCommitted && !txn.Visible && len(txn.Unmarked) == 0 {
+		txn.Visible = true
+		txn.Unreleased = append([]structs.TopicPartition{}, txn.Partitions...)
+		logger.Info("Every partition has the commit marker, releasing transaction", "txn", txn.Id)
+	}
+
+	if err := transactions.Set(txn); err != nil {
+		checkError(err, "markTxn")
+		return txn, false
+	}
+	return txn, true
+}
+
+// Takes released partitions off the transaction's unreleased ones
+func releaseTxn(txnId string, released []structs.TopicPartition) {
+	if len(released) == 0 {
+		return
+	}
+
+	defer commitState()
+
+	txnLock.Lock()
+	defer txnLock.Unlock()
+
+	txn, ok := transactions.Get(txnId)
+	if !ok {
+		return
+	}
+
+	txn.Unreleased = withoutPartitions(txn.Unreleased, released)
+	if err := transactions.Set(txn); err != nil {
+		checkError(err, "releaseTxn")
+	}
+}
+
+// Partitions of deleted topics need no marker
+func writeTxnMarker(txnId string, tp structs.TopicPartition, state structs.TxnState) error {
+	topic, ok := topics.Get(tp.Topic)
+	if !ok || tp.Partition >= len(topic.Partitions) {
+		return nil
+	}
+
+	leaderAddr := topic.Partitions[tp.Partition].Leaders[1]
+	leader, connected := connectedNode(leaderAddr)
+	if !connected {
+		return fmt.Errorf("Server: leader [%s] of %s is not connected", leaderAddr, tp.String())
+	}
+
+	msg := structs.TxnMarkerMsg{
+		TxnId:     txnId,
+		Topic:     tp.Topic,
+		Partition: tp.Partition,
+		State:     state}
+
+	var ignored bool
+	return leader.Client.Call("Peer.WriteTxnMarker", msg, &ignored)
+}
+
+// Aborts expired transactions, retries markers and forgets old transactions.
+// Runs forever, only acting on the primary
+func txnLoop() {
+	for {
+		time.Sleep(TXN_CHECK_INTERVAL * time.Second)
+		if !isPrimary() {
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		for _, txn := range transactions.List() {
+			switch {
+			case txn.State == structs.TxnOpen && now > txn.Deadline:
+				txnLock.Lock()
+				// It may have ended since the list was taken
+				if current, ok := transactions.Get(txn.Id); ok && current.State == structs.TxnOpen {
+					logger.Warn("Aborting transaction past its deadline", "txn", txn.Id, "principal", txn.Principal)
+					if err := endTxn(&current, structs.TxnAborted); err != nil {
+						checkError(err, "txnLoop abort")
+					}
+				}
+				txnLock.Unlock()
+				commitState()
+				deliverMarkers(txn.Id)
+
+			case markersPending(txn):
+				deliverMarkers(txn.Id)
+
+			case txn.State != structs.TxnOpen && now-txn.Ended > int64(TXN_RETENTION*time.Second):
+				if err := transactions.Delete(txn.Id); err != nil {
+					checkError(err, "txnLoop delete")
+				}
+				commitState()
+			}
+		}
+	}
+}
+
+func withoutPartitions(partitions []structs.TopicPartition, drop []structs.TopicPartition) []structs.TopicPartition {
+	kept := make([]structs.TopicPartition, 0)
+	for _, tp := range partitions {
+		if !hasPartition(drop, tp) {
+			kept = append(kept, tp)
+		}
+	}
+	return kept
+}
+
+func hasPartition(partitions []structs.TopicPartition, tp structs.TopicPartition) bool {
+	for _, p := range partitions {
+		if p == tp {
+			return true
+		}
+	}
+	return false
+}
+
+func newTxnId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
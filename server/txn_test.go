@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"../structs"
+	c "./concurrentlib"
+)
+
+// States of the markers each fake was asked to write for the transaction
+func markerStates(n *fakeNode) []structs.TxnState {
+	n.Lock()
+	defer n.Unlock()
+
+	states := make([]structs.TxnState, 0)
+	for _, msg := range n.markers {
+		states = append(states, msg.State)
+	}
+	return states
+}
+
+func txnStatus(t *testing.T, txnId string) structs.TxnState {
+	var states map[string]structs.TxnState
+	if err := (&TServer{}).TransactionStatus([]string{txnId}, &states); err != nil {
+		t.Fatalf("TransactionStatus: %s", err)
+	}
+	return states[txnId]
+}
+
+func TestDeliverMarkers(t *testing.T) {
+	fakes := resetRegistry(t, map[string]structs.NodeState{
+		"a:1": structs.NodeLeader,
+		"b:1": structs.NodeLeader}, map[string]bool{"b:1": true})
+
+	topics = c.TopicCMap{Map: make(map[string]structs.Topic)}
+	for _, name := range []string{"a", "b"} {
+		topics.Set(name, structs.Topic{
+			TopicName:  name,
+			Partitions: []structs.Partition{{Id: 0, Leaders: []string{name + ":0", name + ":1"}}}})
+	}
+
+	partitions := []structs.TopicPartition{{Topic: "a"}, {Topic: "b"}}
+	transactions = c.TxnCMap{Map: make(map[string]structs.Transaction)}
+	txn := structs.Transaction{Id: "txn", State: structs.TxnOpen, Partitions: partitions}
+	if err := endTxn(&txn, structs.TxnCommitted); err != nil {
+		t.Fatal(err)
+	}
+
+	// b cannot take its marker, so a keeps the records hidden
+	deliverMarkers("txn")
+	if got := markerStates(fakes["a:1"]); len(got) != 1 || got[0] != structs.TxnCommitted {
+		t.Fatalf("a was sent markers %v, want only the commit marker", got)
+	}
+	if got := txnStatus(t, "txn"); got != structs.TxnCommitted {
+		t.Errorf("status with b unmarked = %s, want %s", got, structs.TxnCommitted)
+	}
+
+	fakes["b:1"].refuse = false
+	deliverMarkers("txn")
+
+	want := []structs.TxnState{structs.TxnCommitted, structs.TxnVisible}
+	for _, addr := range []string{"a:1", "b:1"} {
+		got := markerStates(fakes[addr])
+		if len(got) != len(want) || got[len(got)-2] != want[0] || got[len(got)-1] != want[1] {
+			t.Errorf("%s was sent markers %v, want %v", addr, got, want)
+		}
+	}
+	if got := txnStatus(t, "txn"); got != structs.TxnVisible {
+		t.Errorf("status once every partition is marked = %s, want %s", got, structs.TxnVisible)
+	}
+
+	txn, _ = transactions.Get("txn")
+	if markersPending(txn) {
+		t.Errorf("markers are still pending: %+v", txn)
+	}
+}
+
+func TestDeliverAbortMarkers(t *testing.T) {
+	fakes := resetRegistry(t, map[string]structs.NodeState{"a:1": structs.NodeLeader}, nil)
+
+	topics = c.TopicCMap{Map: make(map[string]structs.Topic)}
+	topics.Set("a", structs.Topic{
+		TopicName:  "a",
+		Partitions: []structs.Partition{{Id: 0, Leaders: []string{"a:0", "a:1"}}}})
+
+	transactions = c.TxnCMap{Map: make(map[string]structs.Transaction)}
+	txn := structs.Transaction{Id: "txn", State: structs.TxnOpen, Partitions: []structs.TopicPartition{{Topic: "a"}}}
+	if err := endTxn(&txn, structs.TxnAborted); err != nil {
+		t.Fatal(err)
+	}
+
+	deliverMarkers("txn")
+	if got := markerStates(fakes["a:1"]); len(got) != 1 || got[0] != structs.TxnAborted {
+		t.Errorf("a was sent markers %v, want only the abort marker", got)
+	}
+
+	txn, _ = transactions.Get("txn")
+	if txn.Visible || markersPending(txn) {
+		t.Errorf("aborted transaction is %+v, want it done and not visible", txn)
+	}
+}
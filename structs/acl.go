@@ -0,0 +1,85 @@
+package structs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Permission string
+
+const (
+	PermProduce Permission = "produce"
+	PermConsume Permission = "consume"
+	PermAdmin   Permission = "admin" // Implies produce and consume, and allows changing the topic's ACL
+)
+
+// Matches every caller, including ones without credentials
+const AnyPrincipal = "*"
+
+// Principal -> permissions on a topic. A principal is the name of a client
+// token or the CommonName of a client certificate. A topic without entries
+// is open to every caller
+type TopicACL map[string][]Permission
+
+// Reports whether principal may use perm. Empty principals are anonymous
+// callers and only match AnyPrincipal
+func (acl TopicACL) Allows(principal string, perm Permission) bool {
+	if len(acl) == 0 {
+		return true
+	}
+
+	for _, name := range []string{principal, AnyPrincipal} {
+		if name == "" {
+			continue
+		}
+
+		for _, p := range acl[name] {
+			if p == perm || p == PermAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether principal has any permission on the topic
+func (acl TopicACL) AllowsAny(principal string) bool {
+	return acl.Allows(principal, PermProduce) || acl.Allows(principal, PermConsume)
+}
+
+// Parses a comma separated list such as produce,consume
+func ParsePermissions(s string) ([]Permission, error) {
+	perms := make([]Permission, 0)
+	if len(s) == 0 {
+		return perms, nil
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		perm := Permission(strings.TrimSpace(name))
+		switch perm {
+		case PermProduce, PermConsume, PermAdmin:
+			perms = append(perms, perm)
+		default:
+			return nil, fmt.Errorf("Unknown permission [%s], must be produce, consume or admin", name)
+		}
+	}
+
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	return perms, nil
+}
+
+// Returned by the server and by nodes when the caller's credentials do not
+// allow the call
+type UnauthorizedError string
+
+const unauthorizedPrefix = "Unauthorized: "
+
+func (e UnauthorizedError) Error() string {
+	return unauthorizedPrefix + string(e)
+}
+
+// Reports whether err is an UnauthorizedError
+func IsUnauthorizedError(err error) bool {
+	return HasErrorPrefix(err, unauthorizedPrefix)
+}
@@ -1,13 +1,140 @@
 package structs
 
+import (
+	"fmt"
+	"hash/fnv"
+)
+
 /*
 Standard message that the lib sends to the cluster leader
 Topic = topic name so we know this is the correct topic to store information under
+Partition = the partition of the topic this cluster leads
 Id = let's use the IP address or something unique like that
 Data= the GPS coordinates data
 */
 type WriteMsg struct {
-	Topic string
-	Id string
-	Data string
-}
\ No newline at end of file
+	Topic     string
+	Partition int
+	Id        string
+	Data      string
+	Token     string       // Client credentials. Empty uses the TLS certificate's name
+	Trace     TraceContext // Span of the client's call, empty if it is not traced
+
+	// Set by idempotent producers so that leaders drop writes they already
+	// have. Sequence counts up from 1 for each producer and partition
+	ProducerId string // Empty turns off deduplication
+	Sequence   uint64
+
+	TxnId string // Set for writes in a transaction, which are hidden until it commits
+}
+
+// Largest number of records in one WriteBatchMsg. Producers split larger batches
+const MAX_BATCH_RECORDS = 1000
+
+// Message that the lib sends to a cluster leader to write many records of
+// one partition. They are replicated and stored as one unit, so either all
+// are written or none are, and each gets its own version
+type WriteBatchMsg struct {
+	Topic     string
+	Partition int
+	Id        string
+	Records   []string
+	Token     string
+	Trace     TraceContext
+
+	ProducerId string
+	Sequence   uint64 // Of the first record, the others follow on from it
+
+	TxnId string
+}
+
+// Identifies a span so that the process a write is sent to can continue its
+// trace. Both ids are hex, and empty when the write is not traced
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+}
+
+// Message that the lib sends to a cluster leader to read its partition
+type ReadMsg struct {
+	Topic     string
+	Partition int
+	Id        string
+	Token     string
+}
+
+// A readable write of a partition with its version. Versions grow in the
+// order the leader accepted the writes, but a transaction's writes only
+// become readable once it commits, after later versions may have been read
+type Record struct {
+	Version int
+	Data    string
+}
+
+// Hashes a write's key (e.g. a vehicle id) to one of numPartitions partitions.
+// The same key always maps to the same partition so its writes stay in order
+func PartitionForKey(key string, numPartitions int) int {
+	if numPartitions <= 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(numPartitions))
+}
+
+// Returned by a node that does not lead the partition a write was sent to,
+// e.g. after it handed off leadership. Nothing was written, so the write can
+// be sent to the new leader. The value is the topic/partition
+type NotLeaderError string
+
+const notLeaderPrefix = "Node does not lead "
+
+func (e NotLeaderError) Error() string {
+	return fmt.Sprintf("%s[%s]", notLeaderPrefix, string(e))
+}
+
+// Reports whether err is a NotLeaderError
+func IsNotLeaderError(err error) bool {
+	return HasErrorPrefix(err, notLeaderPrefix)
+}
+
+// Returned by a node asked to drop a topic it is not in, e.g. because it
+// dropped it before and the reply was lost. The value is the topic
+type NotInTopicError string
+
+const notInTopicPrefix = "Node is not part of topic "
+
+func (e NotInTopicError) Error() string {
+	return fmt.Sprintf("%s[%s]", notInTopicPrefix, string(e))
+}
+
+// Reports whether err is a NotInTopicError
+func IsNotInTopicError(err error) bool {
+	return HasErrorPrefix(err, notInTopicPrefix)
+}
+
+// Returned for a write whose sequence is older than the leader's dedupe
+// window, so the leader cannot tell whether it already has the write. The
+// value is the producer id
+type StaleSequenceError string
+
+const staleSequencePrefix = "Sequence is older than the dedupe window of producer "
+
+func (e StaleSequenceError) Error() string {
+	return fmt.Sprintf("%s[%s]", staleSequencePrefix, string(e))
+}
+
+// Reports whether err is a StaleSequenceError
+func IsStaleSequenceError(err error) bool {
+	return HasErrorPrefix(err, staleSequencePrefix)
+}
+
+// Start of the message of a leader that could not replicate a write to enough
+// followers. Some of them may have stored it
+const NotReplicatedPrefix = "Could not replicate write enough times."
+
+// Reports whether err is a failed replication
+func IsNotReplicatedError(err error) bool {
+	return HasErrorPrefix(err, NotReplicatedPrefix)
+}
@@ -0,0 +1,10 @@
+package structs
+
+import "strings"
+
+// net/rpc hands the caller every error as an rpc.ServerError holding only
+// the message, whatever type the handler returned. So each error that callers
+// tell apart starts with a prefix of its own, and is recognised by it here
+func HasErrorPrefix(err error, prefix string) bool {
+	return err != nil && strings.HasPrefix(err.Error(), prefix)
+}
@@ -0,0 +1,174 @@
+package structs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A position as the producers write it. X is the longitude and Y the
+// latitude, as in movement.Point
+type GPSCoordinates struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func (p GPSCoordinates) String() string {
+	return fmt.Sprintf("%s,%s", strconv.FormatFloat(p.X, 'f', -1, 64), strconv.FormatFloat(p.Y, 'f', -1, 64))
+}
+
+// Parses a position in the format x,y
+func ParseGPSCoordinates(s string) (GPSCoordinates, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return GPSCoordinates{}, fmt.Errorf("Invalid coordinates [%s], must be x,y", s)
+	}
+
+	x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errX != nil || errY != nil {
+		return GPSCoordinates{}, fmt.Errorf("Invalid coordinates [%s], must be x,y", s)
+	}
+	return GPSCoordinates{X: x, Y: y}, nil
+}
+
+// Box between its lowest and highest corner
+type BoundingBox struct {
+	Min GPSCoordinates `json:"min"`
+	Max GPSCoordinates `json:"max"`
+}
+
+func (b BoundingBox) Contains(p GPSCoordinates) bool {
+	return p.X >= b.Min.X && p.X <= b.Max.X && p.Y >= b.Min.Y && p.Y <= b.Max.Y
+}
+
+// Area covered by a geo-routed topic: either a bounding box or a polygon
+type GeoRegion struct {
+	Box     *BoundingBox     `json:"box,omitempty"`
+	Polygon []GPSCoordinates `json:"polygon,omitempty"` // Vertices in order, the last joins the first
+}
+
+func (r GeoRegion) Validate() error {
+	switch {
+	case r.Box != nil && len(r.Polygon) > 0:
+		return fmt.Errorf("Region must be a box or a polygon, not both")
+	case r.Box != nil:
+		if r.Box.Min.X >= r.Box.Max.X || r.Box.Min.Y >= r.Box.Max.Y {
+			return fmt.Errorf("Box min %s must be below and left of max %s", r.Box.Min, r.Box.Max)
+		}
+	case len(r.Polygon) > 0:
+		if len(r.Polygon) < 3 {
+			return fmt.Errorf("Polygon needs at least 3 points, got %d", len(r.Polygon))
+		}
+		if r.Area() == 0 {
+			return fmt.Errorf("Polygon has no area")
+		}
+	default:
+		return fmt.Errorf("Region must have a box or a polygon")
+	}
+
+	for _, p := range r.points() {
+		if math.IsNaN(p.X) || math.IsNaN(p.Y) || math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) {
+			return fmt.Errorf("Region has an invalid point %s", p)
+		}
+	}
+	return nil
+}
+
+// Returns whether p is inside the region. Points on the edge of a box are
+// inside, on the edge of a polygon they may fall either way
+func (r GeoRegion) Contains(p GPSCoordinates) bool {
+	if r.Box != nil {
+		return r.Box.Contains(p)
+	}
+
+	// Even-odd rule: count the edges a ray from p to the right crosses
+	inside := false
+	for i, j := 0, len(r.Polygon)-1; i < len(r.Polygon); j, i = i, i+1 {
+		a, b := r.Polygon[i], r.Polygon[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (r GeoRegion) Area() float64 {
+	if r.Box != nil {
+		return (r.Box.Max.X - r.Box.Min.X) * (r.Box.Max.Y - r.Box.Min.Y)
+	}
+
+	// Shoelace formula
+	sum := 0.0
+	for i, j := 0, len(r.Polygon)-1; i < len(r.Polygon); j, i = i, i+1 {
+		sum += r.Polygon[j].X*r.Polygon[i].Y - r.Polygon[i].X*r.Polygon[j].Y
+	}
+	return math.Abs(sum) / 2
+}
+
+func (r GeoRegion) String() string {
+	if r.Box != nil {
+		return fmt.Sprintf("box %s to %s", r.Box.Min, r.Box.Max)
+	}
+
+	points := make([]string, len(r.Polygon))
+	for i, p := range r.Polygon {
+		points[i] = p.String()
+	}
+	return "polygon " + strings.Join(points, " ")
+}
+
+func (r GeoRegion) points() []GPSCoordinates {
+	if r.Box != nil {
+		return []GPSCoordinates{r.Box.Min, r.Box.Max}
+	}
+	return r.Polygon
+}
+
+// The region of one geo-routed topic
+type TopicRegion struct {
+	Topic  string    `json:"topic"`
+	Region GeoRegion `json:"region"`
+}
+
+// Regions of every geo-routed topic, as returned by GetGeoIndex
+type GeoIndex []TopicRegion
+
+// Returns the topic whose region holds p. Where regions overlap the smallest
+// wins, so a region can be carved out of a larger one. Ties go to the first
+// topic by name
+func (index GeoIndex) Lookup(p GPSCoordinates) (string, bool) {
+	best, bestArea := "", math.Inf(1)
+	for _, tr := range index {
+		if !tr.Region.Contains(p) {
+			continue
+		}
+
+		area := tr.Region.Area()
+		if area < bestArea || (area == bestArea && tr.Topic < best) {
+			best, bestArea = tr.Topic, area
+		}
+	}
+	return best, best != ""
+}
+
+// Sorts the index by topic name
+func (index GeoIndex) Sort() {
+	sort.Slice(index, func(i, j int) bool { return index[i].Topic < index[j].Topic })
+}
+
+// Returned when no topic's region holds a location. The value is the location
+type NoTopicAtLocationError string
+
+const noTopicAtLocationPrefix = "No topic covers location "
+
+func (e NoTopicAtLocationError) Error() string {
+	return fmt.Sprintf("%s[%s]", noTopicAtLocationPrefix, string(e))
+}
+
+// Reports whether err is a NoTopicAtLocationError
+func IsNoTopicAtLocationError(err error) bool {
+	return HasErrorPrefix(err, noTopicAtLocationPrefix)
+}
@@ -0,0 +1,85 @@
+package structs
+
+import "testing"
+
+func box(minX, minY, maxX, maxY float64) GeoRegion {
+	return GeoRegion{Box: &BoundingBox{Min: GPSCoordinates{minX, minY}, Max: GPSCoordinates{maxX, maxY}}}
+}
+
+func polygon(points ...float64) GeoRegion {
+	var region GeoRegion
+	for i := 0; i+1 < len(points); i += 2 {
+		region.Polygon = append(region.Polygon, GPSCoordinates{points[i], points[i+1]})
+	}
+	return region
+}
+
+func TestGeoRegionContains(t *testing.T) {
+	// L shape: the square 0..2 without its top right quarter
+	ell := polygon(0, 0, 2, 0, 2, 1, 1, 1, 1, 2, 0, 2)
+	triangle := polygon(0, 0, 4, 0, 0, 4)
+
+	tests := []struct {
+		name   string
+		region GeoRegion
+		point  GPSCoordinates
+		want   bool
+	}{
+		{"box inside", box(0, 0, 2, 2), GPSCoordinates{1, 1}, true},
+		{"box outside", box(0, 0, 2, 2), GPSCoordinates{3, 1}, false},
+		{"box corner", box(0, 0, 2, 2), GPSCoordinates{2, 2}, true},
+		{"box edge", box(0, 0, 2, 2), GPSCoordinates{0, 1}, true},
+		{"box negative", box(-123.3, 49.2, -123.0, 49.3), GPSCoordinates{-123.1, 49.25}, true},
+		{"triangle inside", triangle, GPSCoordinates{1, 1}, true},
+		{"triangle past hypotenuse", triangle, GPSCoordinates{3, 3}, false},
+		{"triangle below", triangle, GPSCoordinates{1, -1}, false},
+		{"concave inside", ell, GPSCoordinates{0.5, 1.5}, true},
+		{"concave notch", ell, GPSCoordinates{1.5, 1.5}, false},
+		{"concave lower arm", ell, GPSCoordinates{1.5, 0.5}, true},
+		{"concave far left", ell, GPSCoordinates{-1, 0.5}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.region.Contains(tt.point); got != tt.want {
+				t.Errorf("%s.Contains(%s) = %v, want %v", tt.region, tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoIndexLookup(t *testing.T) {
+	index := GeoIndex{
+		{Topic: "vancouver", Region: box(0, 0, 10, 10)},
+		{Topic: "downtown", Region: box(2, 2, 4, 4)},
+		{Topic: "westend", Region: polygon(2, 2, 3, 2, 3, 3, 2, 3)},
+		{Topic: "b-twin", Region: box(20, 0, 22, 2)},
+		{Topic: "a-twin", Region: box(20, 0, 22, 2)},
+	}
+
+	tests := []struct {
+		name  string
+		point GPSCoordinates
+		want  string
+		found bool
+	}{
+		{"only the large region", GPSCoordinates{8, 8}, "vancouver", true},
+		{"smaller region carved out", GPSCoordinates{3.5, 3.5}, "downtown", true},
+		{"smallest of three", GPSCoordinates{2.5, 2.5}, "westend", true},
+		{"same area ties to the first name", GPSCoordinates{21, 1}, "a-twin", true},
+		{"outside every region", GPSCoordinates{15, 15}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := index.Lookup(tt.point)
+			if got != tt.want || found != tt.found {
+				t.Errorf("Lookup(%s) = %q, %v, want %q, %v", tt.point, got, found, tt.want, tt.found)
+			}
+		})
+	}
+
+	if got, found := (GeoIndex{}).Lookup(GPSCoordinates{0, 0}); found {
+		t.Errorf("empty index Lookup = %q, want none", got)
+	}
+}
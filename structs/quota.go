@@ -0,0 +1,79 @@
+package structs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Write rate allowed by a quota. 0 leaves that dimension unlimited
+type Quota struct {
+	MessagesPerSec float64 `json:"messages-per-sec"`
+	BytesPerSec    float64 `json:"bytes-per-sec"`
+}
+
+func (q Quota) Unlimited() bool {
+	return q.MessagesPerSec <= 0 && q.BytesPerSec <= 0
+}
+
+func (q Quota) String() string {
+	if q.Unlimited() {
+		return "unlimited"
+	}
+
+	parts := make([]string, 0, 2)
+	if q.MessagesPerSec > 0 {
+		parts = append(parts, fmt.Sprintf("%g msg/s", q.MessagesPerSec))
+	}
+	if q.BytesPerSec > 0 {
+		parts = append(parts, fmt.Sprintf("%g B/s", q.BytesPerSec))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Quotas set on a topic. They replace the server's defaults for that topic.
+// Clients is keyed by the client id of WriteMsg.Id, and AnyPrincipal applies
+// to every client without its own entry
+type TopicQuotas struct {
+	Topic   *Quota           `json:"topic,omitempty"` // nil uses the server's default
+	Clients map[string]Quota `json:"clients,omitempty"`
+}
+
+// Server -> Leader reply with the quotas a leader enforces for one client.
+// Topic is already divided by the topic's number of partitions, since each
+// leader only sees the writes to its own partition
+type QuotaLimits struct {
+	Client Quota
+	Topic  Quota
+}
+
+// Returned by a leader when a write would go over a quota. Nothing was
+// written; the write may be sent again after RetryAfter
+type ThrottledError struct {
+	RetryAfter time.Duration
+	Reason     string
+}
+
+const throttledPrefix = "Throttled, retry after "
+
+func (e ThrottledError) Error() string {
+	return fmt.Sprintf("%s%v: %s", throttledPrefix, e.RetryAfter, e.Reason)
+}
+
+// Returns the time to wait and whether err was a ThrottledError
+func RetryAfterFromError(err error) (time.Duration, bool) {
+	if !HasErrorPrefix(err, throttledPrefix) {
+		return 0, false
+	}
+
+	hint := strings.TrimPrefix(err.Error(), throttledPrefix)
+	if i := strings.Index(hint, ":"); i >= 0 {
+		hint = hint[:i]
+	}
+
+	retryAfter, err := time.ParseDuration(hint)
+	if err != nil {
+		return 0, true
+	}
+	return retryAfter, true
+}
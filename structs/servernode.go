@@ -1,29 +1,298 @@
 package structs
 
 import (
+	"fmt"
 	"net/rpc"
+	"strings"
 )
 
+// Settings the server gives every node on Register and Rejoin, and pushes
+// to them again when its config is reloaded. The timings are in
+// milliseconds, and 0 leaves the node's built in default
 type NodeSettings struct {
 	MinReplicas uint8  `json:"min-replicas"`
 	HeartBeat   uint32 `json:"heartbeat"`
 	ClusterSize uint8  `json:"cluster-size"`
+
+	MissedHeartbeats uint32 `json:"missed-heartbeats"` // Peer heartbeats missed until a peer is considered dead
+	ElectionWait     uint32 `json:"election-wait"`     // Time an election waits for enough followers
+	WriteTimeout     uint32 `json:"write-timeout"`     // Time a leader waits for a follower to confirm a write
+}
+
+// Checks the settings against the rules in the README, the same as a
+// topic's settings
+func (s NodeSettings) Validate() error {
+	if err := checkHeartbeat(s.HeartBeat); err != nil {
+		return err
+	}
+
+	return checkReplication(s.ClusterSize, s.MinReplicas)
 }
 
 type Node struct {
 	Address         string
+	Labels          NodeLabels
 	Client          *rpc.Client
 	RecentHeartbeat int64
-	IsLeader        bool
+	State           NodeState
+	Topic           string // Set when the node is a leader or follower
+	Partition       int
+	Transitions     []NodeTransition // Oldest first
+}
+
+// Lifecycle of a node as tracked by the server:
+//
+//	orphan -> leader/follower -> orphan  when its topic is deleted
+//	any state -> dead                    when its heartbeats stop
+//	dead -> its previous state           when it rejoins
+//	dead -> orphan                       when it registers again
+//	any live state -> draining           when an operator drains it
+//	draining -> removed                  when it deregisters
+//
+// Draining nodes are leaving the system and are never handed out
+type NodeState string
+
+const (
+	NodeOrphan   NodeState = "orphan"
+	NodeFollower NodeState = "follower"
+	NodeLeader   NodeState = "leader"
+	NodeDraining NodeState = "draining"
+	NodeDead     NodeState = "dead"
+)
+
+type NodeTransition struct {
+	State     NodeState `json:"state"`
+	Topic     string    `json:"topic,omitempty"`
+	Partition int       `json:"partition"`
+	At        int64     `json:"at"` // Unix nanoseconds
+}
+
+// Failure domains a node runs in. A cluster is spread across as many zones,
+// then racks, then hosts as possible. Unset labels are one shared domain
+type NodeLabels struct {
+	Zone string `json:"zone"`
+	Rack string `json:"rack"` // Racks are only unique within their zone
+	Host string `json:"host"`
+}
+
+// Parses labels in the format zone=a,rack=r1,host=vm3. Any label may be left out
+func ParseNodeLabels(s string) (NodeLabels, error) {
+	var labels NodeLabels
+	if len(s) == 0 {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return labels, fmt.Errorf("Invalid node label [%s], must be key=value", pair)
+		}
+
+		switch strings.TrimSpace(kv[0]) {
+		case "zone":
+			labels.Zone = strings.TrimSpace(kv[1])
+		case "rack":
+			labels.Rack = strings.TrimSpace(kv[1])
+		case "host":
+			labels.Host = strings.TrimSpace(kv[1])
+		default:
+			return labels, fmt.Errorf("Unknown node label [%s], must be zone, rack or host", kv[0])
+		}
+	}
+
+	return labels, nil
+}
+
+// A Partition is led by its own cluster of ClusterSize nodes
+type Partition struct {
+	Id      int
+	Leaders []string // [0] = ClusterRpcAddr, [1] = PeerRpcAddr
 }
 
 type Topic struct {
-	TopicName   string
-	MinReplicas uint8
-	Leaders     []string // [0] = ClusterRpcAddr
-					 	 // [1] = PeerRpcAddr
+	TopicName  string
+	Spec       TopicSpec
+	Partitions []Partition // index = partition Id
+	Epoch      uint64      // Incremented by the server whenever a partition's leader changes
+	ACL        TopicACL    // Who may produce to, consume from and administer the topic
+	Quotas     TopicQuotas // Write rates enforced by the partition leaders
+	Region     *GeoRegion  // Area the topic covers, nil if it is not geo-routed
+}
+
+// Returned by a server replica that is not the primary. The value is the
+// address of the current primary, or empty if no primary is elected
+type NotPrimaryError string
+
+const notPrimaryPrefix = "Server: not the primary. Primary is "
+
+func (e NotPrimaryError) Error() string {
+	return fmt.Sprintf("%s[%s]", notPrimaryPrefix, string(e))
+}
+
+// Returns the primary's address and whether err was a NotPrimaryError
+func PrimaryFromError(err error) (string, bool) {
+	if !HasErrorPrefix(err, notPrimaryPrefix) {
+		return "", false
+	}
+
+	primary := strings.TrimPrefix(err.Error(), notPrimaryPrefix)
+	return strings.Trim(primary, "[]"), true
 }
 
 ////////////////////// RPC STRUCTS //////////////////////
 
+// Node -> Server message on Register and Rejoin
+type RegisterMsg struct {
+	Address string // PeerRpcAddr
+	Labels  NodeLabels
+
+	// Only set on Rejoin, by nodes that are in a cluster
+	State     NodeState
+	Topic     string
+	Partition int
+}
+
+// Server -> Leader message to move leadership of its partition to a follower
+type HandOffMsg struct {
+	Target string // PeerRpcAddr of an in-sync follower. Empty picks one
+	Stay   bool   // Follow the new leader instead of dropping the topic
+}
+
+// Server -> Leader message to swap a follower that is being drained for a
+// new one. Old may already have left the cluster
+type ReplaceFollowerMsg struct {
+	Old string // PeerRpcAddr
+	New string // PeerRpcAddr
+}
+
+// Client -> Server message to wait for a leader change of a topic
+type WatchTopicMsg struct {
+	TopicName  string
+	KnownEpoch uint64 // Epoch of the topic the client is connected to
+	Token      string // Client credentials. Empty uses the TLS certificate's name
+}
+
+// Client -> Server message to look up a topic
+type GetTopicMsg struct {
+	TopicName string
+	Token     string
+}
+
+// Producer -> Server message to create a topic
+// Unset fields of Spec take the server's NodeSettings. The creator is given
+// admin on the topic
+type CreateTopicMsg struct {
+	TopicName string
+	Spec      TopicSpec
+	Token     string
+}
+
+// Admin -> Server message that sets a principal's permissions on a topic.
+// Empty Permissions removes the principal from the ACL
+type SetACLMsg struct {
+	TopicName   string
+	Principal   string
+	Permissions []Permission
+	Token       string
+}
+
+// Leader -> Server message asking whether a client may use Permission on Topic.
+// CertName and CertRole are from the client's TLS certificate, if any
+type AuthorizeMsg struct {
+	Topic      string
+	Permission Permission
+	Token      string
+	CertName   string
+	CertRole   string
+}
+
+type AuthorizeReply struct {
+	Principal string
+	Open      bool // The topic has no ACL and needs no credentials, so every caller without a token may use it
+}
+
+// Admin -> Server message that sets a quota on a topic. An empty ClientId
+// sets the quota of the whole topic, AnyPrincipal the default of its clients.
+// A nil Quota removes the setting so the server's default applies again
+type SetQuotaMsg struct {
+	TopicName string
+	ClientId  string
+	Quota     *Quota
+	Token     string
+}
+
+// Admin -> Server message that sets the area a topic covers. A nil Region
+// takes the topic out of geo-routing
+type SetRegionMsg struct {
+	TopicName string
+	Region    *GeoRegion
+	Token     string
+}
+
+// Client -> Server message to find the topic that covers a location
+type LocateMsg struct {
+	Location GPSCoordinates
+	Token    string
+}
+
+// Leader -> Server message asking for the quotas of a client on a topic
+type QuotaMsg struct {
+	Topic    string
+	ClientId string
+}
+
+// Node -> Server message to look up the leader of the node's partition
+type GetPartitionMsg struct {
+	TopicName string
+	Partition int
+}
+
+// Server -> Node message telling a node to lead one partition of a topic
+type LeadMsg struct {
+	TopicName   string
+	Partition   int
+	Spec        TopicSpec
+	FollowerIps []string
+}
+
+// State of one replica of a partition. Collected by the partition's leader
+type ReplicaDescription struct {
+	Address       string // PeerRpcAddr
+	FollowerId    int    // Unset for the leader
+	LatestVersion int
+	NumWrites     int
+	FirstMismatch int
+	HasAllData    bool // No gaps in the replica's versions
+	Reachable     bool
+	InSync        bool // Reachable, has all data and is caught up to the leader
+}
+
+type PartitionDescription struct {
+	Id              int
+	Leaders         []string // [0] = ClusterRpcAddr, [1] = PeerRpcAddr
+	Leader          ReplicaDescription
+	Followers       []ReplicaDescription
+	UnderReplicated bool   // Fewer than ClusterSize - 1 followers are in sync
+	Error           string // Set if the leader could not be described
+}
+
+// Server -> Client view of a registered node
+type NodeStatus struct {
+	Address         string           `json:"address"`
+	Labels          NodeLabels       `json:"labels"`
+	RecentHeartbeat int64            `json:"recent-heartbeat"` // Unix nanoseconds
+	Connected       bool             `json:"connected"`        // The server has an open connection to the node
+	State           NodeState        `json:"state"`
+	Topic           string           `json:"topic,omitempty"`
+	Partition       int              `json:"partition"`
+	Transitions     []NodeTransition `json:"transitions"`
+}
+
+// Server -> Client reply with live data from each partition's leader
+type TopicDescription struct {
+	TopicName  string
+	Spec       TopicSpec
+	Partitions []PartitionDescription
+}
+
 /////////////////// RPC STRUCTS END ////////////////////
@@ -0,0 +1,93 @@
+package structs
+
+import (
+	"fmt"
+)
+
+// Per-topic settings given by a producer on CreateTopic. Zero values are
+// filled in from the server's NodeSettings by WithDefaults
+type TopicSpec struct {
+	NumPartitions int    `json:"partitions"`
+	ClusterSize   uint8  `json:"cluster-size"`
+	MinReplicas   uint8  `json:"min-replicas"`
+	Retention     int64  `json:"retention"` // Milliseconds a write is readable for. 0 keeps writes forever
+	HeartBeat     uint32 `json:"heartbeat"` // Milliseconds between heartbeats of the cluster's nodes. 0 uses the node's default
+}
+
+// Bounds of a heartbeat interval in milliseconds. Shorter ones flood the
+// cluster, and with longer ones a dead leader goes unnoticed for minutes
+const (
+	MIN_HEARTBEAT = 100
+	MAX_HEARTBEAT = 60000
+)
+
+type InvalidTopicSpecError string
+
+func (e InvalidTopicSpecError) Error() string {
+	return fmt.Sprintf("Invalid topic settings: %s", string(e))
+}
+
+// Returns a copy of the spec where unset fields take the server's settings
+func (spec TopicSpec) WithDefaults(settings NodeSettings) TopicSpec {
+	if spec.NumPartitions <= 0 {
+		spec.NumPartitions = 1
+	}
+
+	if spec.ClusterSize == 0 {
+		spec.ClusterSize = settings.ClusterSize
+	}
+
+	if spec.MinReplicas == 0 {
+		spec.MinReplicas = settings.MinReplicas
+	}
+
+	return spec
+}
+
+// Checks the spec against the rules in the README
+func (spec TopicSpec) Validate() error {
+	if spec.NumPartitions <= 0 {
+		return InvalidTopicSpecError(fmt.Sprintf("partitions must be positive, got %d", spec.NumPartitions))
+	}
+
+	if err := checkReplication(spec.ClusterSize, spec.MinReplicas); err != nil {
+		return InvalidTopicSpecError(err.Error())
+	}
+
+	if spec.Retention < 0 {
+		return InvalidTopicSpecError(fmt.Sprintf("retention must not be negative, got %d", spec.Retention))
+	}
+
+	// 0 uses the node's default
+	if spec.HeartBeat != 0 {
+		if err := checkHeartbeat(spec.HeartBeat); err != nil {
+			return InvalidTopicSpecError(err.Error())
+		}
+	}
+
+	return nil
+}
+
+func checkHeartbeat(heartBeat uint32) error {
+	if heartBeat < MIN_HEARTBEAT || heartBeat > MAX_HEARTBEAT {
+		return fmt.Errorf("heartbeat must be between %d and %d milliseconds, got %d", MIN_HEARTBEAT, MAX_HEARTBEAT, heartBeat)
+	}
+	return nil
+}
+
+// cluster-size includes the leader, and min-replicas must be at least a
+// majority of the Follower nodes and no more than the number of Follower nodes
+func checkReplication(clusterSize uint8, minReplicas uint8) error {
+	if clusterSize < 2 {
+		return fmt.Errorf("cluster-size must be at least 2, got %d", clusterSize)
+	}
+
+	numFollowers := int(clusterSize) - 1
+	majority := numFollowers/2 + 1
+	if int(minReplicas) < majority || int(minReplicas) > numFollowers {
+		return fmt.Errorf("min-replicas must be between %d and %d for cluster-size %d, got %d",
+			majority, numFollowers, clusterSize, minReplicas)
+	}
+
+	return nil
+}
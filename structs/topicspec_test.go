@@ -0,0 +1,40 @@
+package structs
+
+import "testing"
+
+func TestTopicSpecValidate(t *testing.T) {
+	valid := TopicSpec{NumPartitions: 1, ClusterSize: 3, MinReplicas: 2}
+
+	tests := []struct {
+		name    string
+		change  func(spec *TopicSpec)
+		wantErr bool
+	}{
+		{"valid", func(spec *TopicSpec) {}, false},
+		{"no partitions", func(spec *TopicSpec) { spec.NumPartitions = 0 }, true},
+		{"cluster of one", func(spec *TopicSpec) { spec.ClusterSize = 1 }, true},
+		{"min-replicas below a majority", func(spec *TopicSpec) { spec.ClusterSize, spec.MinReplicas = 5, 2 }, true},
+		{"min-replicas above the followers", func(spec *TopicSpec) { spec.MinReplicas = 3 }, true},
+		{"negative retention", func(spec *TopicSpec) { spec.Retention = -1 }, true},
+		{"default heartbeat", func(spec *TopicSpec) { spec.HeartBeat = 0 }, false},
+		{"shortest heartbeat", func(spec *TopicSpec) { spec.HeartBeat = MIN_HEARTBEAT }, false},
+		{"longest heartbeat", func(spec *TopicSpec) { spec.HeartBeat = MAX_HEARTBEAT }, false},
+		{"heartbeat too short", func(spec *TopicSpec) { spec.HeartBeat = MIN_HEARTBEAT - 1 }, true},
+		{"heartbeat too long", func(spec *TopicSpec) { spec.HeartBeat = MAX_HEARTBEAT + 1 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := valid
+			tt.change(&spec)
+
+			err := spec.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate(%+v) = %v, want error %v", spec, err, tt.wantErr)
+			}
+			if _, ok := err.(InvalidTopicSpecError); err != nil && !ok {
+				t.Errorf("Validate(%+v) = %T, want an InvalidTopicSpecError", spec, err)
+			}
+		})
+	}
+}
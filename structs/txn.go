@@ -0,0 +1,129 @@
+package structs
+
+import "fmt"
+
+// Lifecycle of a transaction as kept by the server, its coordinator:
+//
+//	open -> committed  when the producer commits
+//	open -> aborted    when the producer aborts, or its timeout passes
+//
+// The move out of open is journalled before the producer is answered, and
+// is final. Consumers see a committed transaction's records once every one
+// of its partitions has the commit marker, which the server reports to
+// leaders as visible
+type TxnState string
+
+const (
+	TxnOpen      TxnState = "open"
+	TxnCommitted TxnState = "committed"
+	TxnAborted   TxnState = "aborted"
+	TxnUnknown   TxnState = "unknown" // Never begun, or forgotten long after it ended
+
+	// Committed, and every partition has the commit marker. Only reported to
+	// leaders and written as their release marker, never a transaction's State
+	TxnVisible TxnState = "visible"
+)
+
+// Default and largest time a transaction may stay open, in milliseconds
+const (
+	DEFAULT_TXN_TIMEOUT = 60000
+	MAX_TXN_TIMEOUT     = 900000
+)
+
+type TopicPartition struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+}
+
+func (tp TopicPartition) String() string {
+	return fmt.Sprintf("%s/%d", tp.Topic, tp.Partition)
+}
+
+type Transaction struct {
+	Id         string           `json:"id"`
+	Principal  string           `json:"principal"` // Who began it. Only they may write in it and end it
+	State      TxnState         `json:"state"`
+	Partitions []TopicPartition `json:"partitions"` // Every partition written in the transaction
+	Started    int64            `json:"started"`    // Unix nanoseconds
+	Deadline   int64            `json:"deadline"`   // Unix nanoseconds. Aborted if still open then
+	Ended      int64            `json:"ended,omitempty"`
+
+	// Partitions whose leader has not yet written the transaction's marker
+	Unmarked []TopicPartition `json:"unmarked,omitempty"`
+
+	// Set once every partition of a committed transaction has its marker.
+	// Consumers see the transaction's records from then on
+	Visible bool `json:"visible,omitempty"`
+
+	// Partitions of a visible transaction whose leader has not yet written
+	// the release marker
+	Unreleased []TopicPartition `json:"unreleased,omitempty"`
+}
+
+// Returns the state reported to leaders: visible for a committed
+// transaction that consumers may see, otherwise its State
+func (txn Transaction) Status() TxnState {
+	if txn.State == TxnCommitted && txn.Visible {
+		return TxnVisible
+	}
+	return txn.State
+}
+
+// Returned when a transaction is not open, e.g. because it timed out. The
+// value is the transaction id
+type TxnNotOpenError string
+
+const txnNotOpenPrefix = "Transaction is not open "
+
+func (e TxnNotOpenError) Error() string {
+	return fmt.Sprintf("%s[%s]", txnNotOpenPrefix, string(e))
+}
+
+// Reports whether err is a TxnNotOpenError
+func IsTxnNotOpenError(err error) bool {
+	return HasErrorPrefix(err, txnNotOpenPrefix)
+}
+
+////////////////////// RPC STRUCTS //////////////////////
+
+// Producer -> Server message to begin a transaction
+type BeginTxnMsg struct {
+	Timeout uint32 // Milliseconds. 0 uses DEFAULT_TXN_TIMEOUT
+	Token   string
+}
+
+// Producer -> Server message sent before the first write of a transaction to
+// each partition, so that the server knows where to write its marker
+type AddTxnPartitionsMsg struct {
+	TxnId      string
+	Partitions []TopicPartition
+	Token      string
+}
+
+// Producer -> Server message to commit or abort a transaction
+type EndTxnMsg struct {
+	TxnId  string
+	Commit bool
+	Token  string
+}
+
+// Leader -> Server message to check a client's first write in a transaction
+type TxnWriteMsg struct {
+	TxnId     string
+	Topic     string
+	Partition int
+	Token     string
+	CertName  string
+	CertRole  string
+}
+
+// Server -> Leader message to write the outcome of a transaction to the
+// leader's partition, or to release the records of a committed one
+type TxnMarkerMsg struct {
+	TxnId     string
+	Topic     string
+	Partition int
+	State     TxnState // Committed or aborted, or visible to release
+}
+
+/////////////////// RPC STRUCTS END ////////////////////